@@ -4,6 +4,7 @@ package agent
 
 import (
 	"github.com/buildkite/agent/v3/api"
+	"io"
 )
 
 // APIClient is an interface generated for "github.com/buildkite/agent/v3/api.Client".
@@ -16,15 +17,18 @@ type APIClient interface {
 	Connect() (*api.Response, error)
 	CreateArtifacts(string, *api.ArtifactBatch) (*api.ArtifactBatchCreateResponse, *api.Response, error)
 	Disconnect() (*api.Response, error)
+	DownloadArtifact(*api.Artifact, io.Writer) (*api.Response, error)
 	ExistsMetaData(string, string) (*api.MetaDataExists, *api.Response, error)
 	FinishJob(*api.Job) (*api.Response, error)
 	FromAgentRegisterResponse(*api.AgentRegisterResponse) *api.Client
 	FromPing(*api.Ping) *api.Client
 	GetJobState(string) (*api.JobState, *api.Response, error)
 	GetMetaData(string, string) (*api.MetaData, *api.Response, error)
+	GetPipeline(string) (*api.Pipeline, *api.Response, error)
 	Heartbeat() (*api.Heartbeat, *api.Response, error)
 	MetaDataKeys(string) ([]string, *api.Response, error)
 	Ping() (*api.Ping, *api.Response, error)
+	PipelineUploadStatus(string, string) (*api.PipelineUploadStatus, *api.Response, error)
 	Register(*api.AgentRegisterRequest) (*api.AgentRegisterResponse, *api.Response, error)
 	SaveHeaderTimes(string, *api.HeaderTimes) (*api.Response, error)
 	SearchArtifacts(string, *api.ArtifactSearchOptions) ([]*api.Artifact, *api.Response, error)
@@ -35,4 +39,5 @@ type APIClient interface {
 	UpdateArtifacts(string, map[string]string) (*api.Response, error)
 	UploadChunk(string, *api.Chunk) (*api.Response, error)
 	UploadPipeline(string, *api.Pipeline) (*api.Response, error)
+	ValidatePipeline(string, *api.Pipeline) (*api.PipelineValidation, *api.Response, error)
 }
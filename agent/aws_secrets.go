@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/buildkite/agent/v3/env"
+)
+
+// AWSSecretPrefix marks an environment variable value as a reference to a
+// secret in AWS Secrets Manager, in the form awssm:<arn-or-name>[#json-key]
+const AWSSecretPrefix = "awssm:"
+
+// secretValueGetter is the part of the Secrets Manager API used to resolve
+// secrets, so that it can be replaced in tests
+type secretValueGetter interface {
+	GetSecretValue(*secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// ResolveAWSSecrets replaces the value of each variable in environ that refers
+// to an AWS Secrets Manager secret with the secret itself, using the default
+// AWS credential chain. It returns the names of the variables it resolved.
+func ResolveAWSSecrets(environ *env.Environment) ([]string, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+
+	return resolveAWSSecrets(environ, secretsmanager.New(sess))
+}
+
+func resolveAWSSecrets(environ *env.Environment, client secretValueGetter) ([]string, error) {
+	var names []string
+	for name, value := range environ.ToMap() {
+		if strings.HasPrefix(value, AWSSecretPrefix) {
+			names = append(names, name)
+		}
+	}
+
+	// Resolve in a consistent order so that errors are predictable
+	sort.Strings(names)
+
+	// Secrets are often referenced more than once with different keys
+	secrets := map[string]string{}
+
+	for _, name := range names {
+		value, _ := environ.Get(name)
+		ref := strings.TrimPrefix(value, AWSSecretPrefix)
+
+		id, key := ref, ""
+		if i := strings.LastIndex(ref, "#"); i != -1 {
+			id, key = ref[:i], ref[i+1:]
+		}
+
+		secret, ok := secrets[id]
+		if !ok {
+			out, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+				SecretId: aws.String(id),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("Failed to fetch AWS secret %q for $%s: %v", id, name, err)
+			}
+			if out.SecretString == nil {
+				return nil, fmt.Errorf("AWS secret %q for $%s is binary, only string secrets are supported", id, name)
+			}
+			secret = *out.SecretString
+			secrets[id] = secret
+		}
+
+		if key != "" {
+			var fields map[string]interface{}
+			if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+				return nil, fmt.Errorf("AWS secret %q for $%s isn't a JSON object, so key %q can't be read from it", id, name, key)
+			}
+
+			field, ok := fields[key]
+			if !ok {
+				return nil, fmt.Errorf("AWS secret %q for $%s doesn't have a key %q", id, name, key)
+			}
+
+			if s, ok := field.(string); ok {
+				secret = s
+			} else {
+				b, err := json.Marshal(field)
+				if err != nil {
+					return nil, err
+				}
+				secret = string(b)
+			}
+		}
+
+		environ.Set(name, secret)
+	}
+
+	return names, nil
+}
@@ -0,0 +1,70 @@
+package agent
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSecretsManager struct {
+	secrets map[string]string
+	calls   int
+}
+
+func (f *fakeSecretsManager) GetSecretValue(in *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	f.calls++
+	secret, ok := f.secrets[*in.SecretId]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(secret)}, nil
+}
+
+func TestResolveAWSSecrets(t *testing.T) {
+	sm := &fakeSecretsManager{secrets: map[string]string{
+		"plain":   "llamas",
+		"prod/db": `{"username":"admin","password":"hunter2","port":5432}`,
+	}}
+
+	environ := env.FromSlice([]string{
+		"PLAIN=awssm:plain",
+		"DB_USER=awssm:prod/db#username",
+		"DB_PASS=awssm:prod/db#password",
+		"DB_PORT=awssm:prod/db#port",
+		"OTHER=unrelated",
+	})
+
+	names, err := resolveAWSSecrets(environ, sm)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DB_PASS", "DB_PORT", "DB_USER", "PLAIN"}, names)
+	assert.Equal(t, 2, sm.calls)
+
+	for name, expected := range map[string]string{
+		"PLAIN":   "llamas",
+		"DB_USER": "admin",
+		"DB_PASS": "hunter2",
+		"DB_PORT": "5432",
+		"OTHER":   "unrelated",
+	} {
+		v, _ := environ.Get(name)
+		assert.Equal(t, expected, v, name)
+	}
+}
+
+func TestResolveAWSSecretsErrors(t *testing.T) {
+	sm := &fakeSecretsManager{secrets: map[string]string{
+		"plain": "llamas",
+	}}
+
+	for _, value := range []string{
+		"awssm:missing",
+		"awssm:plain#key",
+	} {
+		_, err := resolveAWSSecrets(env.FromSlice([]string{"SECRET=" + value}), sm)
+		assert.Error(t, err, value)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -460,7 +461,15 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	// We present only the clean environment - i.e only variables configured
 	// on the job upstream - and expose the path in another environment variable.
 	if r.envFile != nil {
-		for key, value := range env {
+		keys := make([]string, 0, len(env))
+		for key := range env {
+			keys = append(keys, key)
+		}
+		// Sort the file so it's the same for the same environment
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value := env[key]
 			if _, err := r.envFile.WriteString(fmt.Sprintf("%s=%q\n", key, value)); err != nil {
 				return nil, err
 			}
@@ -477,6 +486,9 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	var protectedEnv = []string{
 		`BUILDKITE_AGENT_ENDPOINT`,
 		`BUILDKITE_AGENT_ACCESS_TOKEN`,
+		`BUILDKITE_AGENT_CACERT`,
+		`BUILDKITE_AGENT_HTTPS_PROXY`,
+		`BUILDKITE_AGENT_NO_PROXY`,
 		`BUILDKITE_AGENT_DEBUG`,
 		`BUILDKITE_AGENT_PID`,
 		`BUILDKITE_BIN_PATH`,
@@ -517,6 +529,18 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_AGENT_ENDPOINT"] = apiConfig.Endpoint
 	env["BUILDKITE_AGENT_ACCESS_TOKEN"] = apiConfig.Token
 
+	// Commands run by the job talk to the same endpoint, so need the same CA
+	// and proxy settings
+	if apiConfig.CACert != "" {
+		env["BUILDKITE_AGENT_CACERT"] = apiConfig.CACert
+	}
+	if apiConfig.HTTPSProxy != "" {
+		env["BUILDKITE_AGENT_HTTPS_PROXY"] = apiConfig.HTTPSProxy
+	}
+	if apiConfig.NoProxy != "" {
+		env["BUILDKITE_AGENT_NO_PROXY"] = apiConfig.NoProxy
+	}
+
 	// Add agent environment variables
 	env["BUILDKITE_AGENT_DEBUG"] = fmt.Sprintf("%t", r.conf.Debug)
 	env["BUILDKITE_AGENT_DEBUG_HTTP"] = fmt.Sprintf("%t", r.conf.DebugHTTP)
@@ -0,0 +1,248 @@
+package agent
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// dependencyStep is a step in the graph built by ValidateDependencies
+type dependencyStep struct {
+	name      string
+	key       string
+	dependsOn []string
+}
+
+// ValidateDependencies checks the depends_on of every step in the pipeline
+// (including those nested in groups) against the keys of the other steps, and
+// returns a description of each reference to a key that doesn't exist, each
+// key used more than once, and each cycle of steps that depend on each other
+func (p *PipelineParserResult) ValidateDependencies() []string {
+	var steps []dependencyStep
+
+	p.mapSteps(func(step yaml.MapSlice) yaml.MapSlice {
+		steps = append(steps, dependencyStep{
+			name:      stepName(step),
+			key:       stepKey(step),
+			dependsOn: stepDependsOn(step),
+		})
+		return step
+	})
+
+	var problems []string
+
+	byKey := map[string]dependencyStep{}
+	for _, step := range steps {
+		if step.key == "" {
+			continue
+		}
+		if _, ok := byKey[step.key]; ok {
+			problems = append(problems, fmt.Sprintf("Key %q is used by more than one step", step.key))
+			continue
+		}
+		byKey[step.key] = step
+	}
+
+	for _, step := range steps {
+		for _, dep := range step.dependsOn {
+			if _, ok := byKey[dep]; !ok {
+				problems = append(problems, fmt.Sprintf("Step %s depends on %q, which isn't the key of any step", step.name, dep))
+			}
+		}
+	}
+
+	// Only keyed steps can be depended on, so only they can be in a cycle.
+	// Walk the graph depth first from each, in pipeline order, and report a
+	// cycle whenever a step on the current path is reached again.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var path []string
+
+	var visit func(key string)
+	visit = func(key string) {
+		state[key] = visiting
+		path = append(path, key)
+
+		for _, dep := range byKey[key].dependsOn {
+			if _, ok := byKey[dep]; !ok {
+				continue
+			}
+			switch state[dep] {
+			case unvisited:
+				visit(dep)
+			case visiting:
+				var cycle []string
+				for i := len(path) - 1; i >= 0; i-- {
+					cycle = append([]string{fmt.Sprintf("%q", path[i])}, cycle...)
+					if path[i] == dep {
+						break
+					}
+				}
+				cycle = append(cycle, fmt.Sprintf("%q", dep))
+				problems = append(problems, fmt.Sprintf("Steps depend on each other in a cycle: %s", strings.Join(cycle, " -> ")))
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[key] = visited
+	}
+
+	for _, step := range steps {
+		if step.key != "" && state[step.key] == unvisited {
+			visit(step.key)
+		}
+	}
+
+	return problems
+}
+
+// stepKey returns the key of a step, which can also be given as its
+// identifier or id
+func stepKey(step yaml.MapSlice) string {
+	for _, k := range []string{"key", "identifier", "id"} {
+		if item, ok := mapSliceItem(k, step); ok {
+			if key, ok := item.Value.(string); ok {
+				return key
+			}
+		}
+	}
+	return ""
+}
+
+// stepName returns a description of a step for use in messages
+func stepName(step yaml.MapSlice) string {
+	if key := stepKey(step); key != "" {
+		return fmt.Sprintf("%q", key)
+	}
+
+	for _, k := range []string{"label", "name", "group", "block", "input", "trigger"} {
+		if item, ok := mapSliceItem(k, step); ok {
+			if name, ok := item.Value.(string); ok && name != "" {
+				return fmt.Sprintf("%q", name)
+			}
+		}
+	}
+
+	if item, ok := mapSliceItem("command", step); ok {
+		if command, ok := item.Value.(string); ok {
+			return fmt.Sprintf("with command %q", command)
+		}
+	}
+
+	return fmt.Sprintf("(unnamed %s step)", stepType(step))
+}
+
+// stepDependsOn returns the keys of the steps a step depends on, which can be
+// given as a single key, or a list of keys or {step: key} maps
+func stepDependsOn(step yaml.MapSlice) []string {
+	item, ok := mapSliceItem("depends_on", step)
+	if !ok {
+		return nil
+	}
+
+	switch v := item.Value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var deps []string
+		for _, d := range v {
+			switch dep := d.(type) {
+			case string:
+				deps = append(deps, dep)
+			case yaml.MapSlice:
+				if item, ok := mapSliceItem("step", dep); ok {
+					if key, ok := item.Value.(string); ok {
+						deps = append(deps, key)
+					}
+				}
+			}
+		}
+		return deps
+	}
+
+	return nil
+}
+
+// uuidPattern matches keys that look like UUIDs, which Buildkite doesn't allow
+// so that they can't be confused with step IDs
+var uuidPattern = regexp.MustCompile(`(?i)^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// PrefixStepKeys adds prefix to the key of every step in the pipeline
+// (including those nested in groups), and to the references to those keys in
+// depends_on, so that the same pipeline can be uploaded more than once to a
+// build. References to steps outside the pipeline are left alone.
+func (p *PipelineParserResult) PrefixStepKeys(prefix string) error {
+	if strings.ContainsAny(prefix, " \t\r\n") {
+		return fmt.Errorf("Step key prefix %q can't contain whitespace", prefix)
+	}
+
+	keys := map[string]bool{}
+	p.mapSteps(func(step yaml.MapSlice) yaml.MapSlice {
+		if key := stepKey(step); key != "" {
+			keys[key] = true
+		}
+		return step
+	})
+
+	for key := range keys {
+		if uuidPattern.MatchString(prefix + key) {
+			return fmt.Errorf("Prefixed step key %q looks like a UUID, which isn't allowed", prefix+key)
+		}
+	}
+
+	p.mapSteps(func(step yaml.MapSlice) yaml.MapSlice {
+		for _, attr := range []string{"key", "identifier", "id"} {
+			if item, ok := mapSliceItem(attr, step); ok {
+				if key, ok := item.Value.(string); ok && key != "" {
+					step = upsertSliceItem(attr, step, prefix+key)
+				}
+			}
+		}
+
+		if item, ok := mapSliceItem("depends_on", step); ok {
+			step = upsertSliceItem("depends_on", step, prefixDependsOn(item.Value, prefix, keys))
+		}
+
+		return step
+	})
+
+	return nil
+}
+
+// prefixDependsOn adds prefix to each of the keys in a depends_on value that
+// are one of keys
+func prefixDependsOn(dependsOn interface{}, prefix string, keys map[string]bool) interface{} {
+	prefixed := func(key string) string {
+		if keys[key] {
+			return prefix + key
+		}
+		return key
+	}
+
+	switch v := dependsOn.(type) {
+	case string:
+		return prefixed(v)
+	case []interface{}:
+		for i, d := range v {
+			switch dep := d.(type) {
+			case string:
+				v[i] = prefixed(dep)
+			case yaml.MapSlice:
+				if item, ok := mapSliceItem("step", dep); ok {
+					if key, ok := item.Value.(string); ok {
+						v[i] = upsertSliceItem("step", dep, prefixed(key))
+					}
+				}
+			}
+		}
+		return v
+	}
+
+	return dependsOn
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDependencies(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - command: make build
+    key: build
+  - wait
+  - command: make test
+    key: test
+    depends_on: build
+  - group: deploy
+    key: deploy
+    depends_on:
+      - step: test
+      - tset
+    steps:
+      - command: make deploy
+        depends_on: [build, deploy-prep]
+`)
+
+	assert.Equal(t, []string{
+		`Step with command "make deploy" depends on "deploy-prep", which isn't the key of any step`,
+		`Step "deploy" depends on "tset", which isn't the key of any step`,
+	}, result.ValidateDependencies())
+}
+
+func TestValidateDependenciesFindsCyclesAndDuplicateKeys(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - label: a
+    command: a
+    key: a
+    depends_on: c
+  - command: b
+    identifier: b
+    depends_on: a
+  - command: c
+    key: c
+    depends_on: [b]
+  - command: c again
+    key: c
+  - command: self
+    key: self
+    depends_on: self
+`)
+
+	assert.Equal(t, []string{
+		`Key "c" is used by more than one step`,
+		`Steps depend on each other in a cycle: "a" -> "c" -> "b" -> "a"`,
+		`Steps depend on each other in a cycle: "self" -> "self"`,
+	}, result.ValidateDependencies())
+}
+
+func TestValidateDependenciesWithValidPipeline(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - command: make build
+    key: build
+  - command: make test
+    depends_on:
+      - build
+`)
+
+	assert.Empty(t, result.ValidateDependencies())
+}
+
+func TestPrefixStepKeys(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - command: make build
+    key: build
+  - command: make test
+    identifier: test
+    depends_on: build
+  - group: deploy
+    steps:
+      - command: make deploy
+        depends_on:
+          - step: test
+          - elsewhere
+          - build
+`)
+
+	if err := result.PrefixStepKeys("linux-"); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"steps": [
+		{"command": "make build", "key": "linux-build"},
+		{"command": "make test", "identifier": "linux-test", "depends_on": "linux-build"},
+		{"group": "deploy", "steps": [
+			{"command": "make deploy", "depends_on": [{"step": "linux-test"}, "elsewhere", "linux-build"]}
+		]}
+	]}`, string(j))
+
+	assert.Equal(t, []string{
+		`Step with command "make deploy" depends on "elsewhere", which isn't the key of any step`,
+	}, result.ValidateDependencies())
+}
+
+func TestPrefixStepKeysWithInvalidPrefix(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - command: make build
+    key: 9876-1234-1234-1234-123456789abc
+`)
+
+	assert.EqualError(t, result.PrefixStepKeys("my prefix"), `Step key prefix "my prefix" can't contain whitespace`)
+	assert.EqualError(t, result.PrefixStepKeys("abcd"), `Prefixed step key "abcd9876-1234-1234-1234-123456789abc" looks like a UUID, which isn't allowed`)
+}
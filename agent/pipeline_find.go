@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// FindString returns the path to every key and value in the pipeline that
+// contains s, like steps[2].env.TOKEN
+func (p *PipelineParserResult) FindString(s string) []string {
+	return findString(p.pipeline, "", s)
+}
+
+// Strings returns every key and value in the pipeline as a string, and the
+// text of each value before it was interpolated
+func (p *PipelineParserResult) Strings() []string {
+	ss := collectStrings(p.pipeline, nil)
+	for _, source := range p.sources {
+		ss = append(ss, source.Source)
+	}
+	return ss
+}
+
+func collectStrings(v interface{}, ss []string) []string {
+	switch value := v.(type) {
+	case yaml.MapSlice:
+		for _, item := range value {
+			ss = append(ss, fmt.Sprint(item.Key))
+			ss = collectStrings(item.Value, ss)
+		}
+	case []interface{}:
+		for _, item := range value {
+			ss = collectStrings(item, ss)
+		}
+	case nil:
+	default:
+		ss = append(ss, fmt.Sprint(value))
+	}
+	return ss
+}
+
+func findString(v interface{}, path string, s string) []string {
+	var paths []string
+
+	switch value := v.(type) {
+	case yaml.MapSlice:
+		for _, item := range value {
+			key := fmt.Sprint(item.Key)
+
+			itemPath := key
+			if path != "" {
+				itemPath = path + "." + key
+			}
+
+			if strings.Contains(key, s) {
+				paths = append(paths, itemPath)
+			}
+			paths = append(paths, findString(item.Value, itemPath, s)...)
+		}
+	case []interface{}:
+		for i, item := range value {
+			paths = append(paths, findString(item, fmt.Sprintf("%s[%d]", path, i), s)...)
+		}
+	case nil:
+	default:
+		if strings.Contains(fmt.Sprint(value), s) {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// Redacted returns a copy of the result with each of values replaced by
+// [REDACTED] wherever it appears in the pipeline's keys and values. Values
+// that aren't strings become strings if they contain one.
+func (p *PipelineParserResult) Redacted(values []string) *PipelineParserResult {
+	var needles []string
+	for _, value := range values {
+		if value != "" {
+			needles = append(needles, value)
+		}
+	}
+
+	// Longer values go first, so values containing others are still replaced
+	// whole
+	sort.Slice(needles, func(i, j int) bool {
+		return len(needles[i]) > len(needles[j])
+	})
+
+	redacted := *p
+	if pipeline, ok := redactStrings(p.pipeline, needles).(yaml.MapSlice); ok {
+		redacted.pipeline = pipeline
+	}
+	return &redacted
+}
+
+func redactStrings(v interface{}, needles []string) interface{} {
+	replace := func(s string) string {
+		for _, needle := range needles {
+			s = strings.Replace(s, needle, "[REDACTED]", -1)
+		}
+		return s
+	}
+
+	switch value := v.(type) {
+	case yaml.MapSlice:
+		redacted := make(yaml.MapSlice, 0, len(value))
+		for _, item := range value {
+			key := item.Key
+			if s := fmt.Sprint(key); replace(s) != s {
+				key = replace(s)
+			}
+			redacted = append(redacted, yaml.MapItem{Key: key, Value: redactStrings(item.Value, needles)})
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			redacted = append(redacted, redactStrings(item, needles))
+		}
+		return redacted
+	case nil:
+		return nil
+	case string:
+		return replace(value)
+	default:
+		if s := fmt.Sprint(value); replace(s) != s {
+			return replace(s)
+		}
+		return value
+	}
+}
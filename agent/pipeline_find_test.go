@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindString(t *testing.T) {
+	result := parsePipelineForTest(t, `env:
+  TOKEN: hunter2
+steps:
+  - command: echo hunter2
+  - wait
+  - group: nested
+    steps:
+      - command: make
+        env:
+          hunter2: 42
+          OTHER: llamas
+`)
+
+	assert.Equal(t, []string{
+		"env.TOKEN",
+		"steps[0].command",
+		"steps[2].steps[0].env.hunter2",
+	}, result.FindString("hunter2"))
+	assert.Equal(t, []string{"steps[2].steps[0].env.hunter2"}, result.FindString("42"))
+	assert.Empty(t, result.FindString("alpacas"))
+}
+
+func TestRedacted(t *testing.T) {
+	result := parsePipelineForTest(t, `env:
+  TOKEN: hunter2
+steps:
+  - command: echo hunter2 && echo correcthorse
+  - wait
+  - group: nested
+    steps:
+      - command: make
+        parallelism: 42
+        env:
+          hunter2: true
+`)
+
+	redacted := result.Redacted([]string{"hunter2", "correcthorse", "42", ""})
+	assert.Empty(t, redacted.FindString("hunter2"))
+	assert.Empty(t, redacted.FindString("correcthorse"))
+	assert.Equal(t, []string{
+		"env.TOKEN",
+		"steps[0].command",
+		"steps[2].steps[0].parallelism",
+		"steps[2].steps[0].env.[REDACTED]",
+	}, redacted.FindString("[REDACTED]"))
+
+	// The original is left alone
+	assert.Equal(t, []string{"env.TOKEN", "steps[0].command", "steps[2].steps[0].env.hunter2"}, result.FindString("hunter2"))
+}
+
+func TestStrings(t *testing.T) {
+	result, _, err := PipelineParser{
+		Env:           env.FromSlice([]string{"DB_URL=postgres://db?password=hunter2"}),
+		Pipeline:      []byte("steps:\n  - command: psql $DB_URL\n    parallelism: 2\n  - wait\n"),
+		RecordSources: true,
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{
+		"steps",
+		"command", "psql postgres://db?password=hunter2",
+		"parallelism", "2",
+		"wait",
+		"psql $DB_URL",
+	}, result.Strings())
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// GroupUntaggedSteps moves the top-level steps of the pipeline that aren't
+// group steps into a new group step with the given label, where the first of
+// them was, and returns how many steps were moved. Group steps are left where
+// they are.
+//
+// Steps keep their keys, so depends_on works across the group's boundary as it
+// did before. But wait, block and input steps in a group only affect the
+// steps in the group, so it's an error to move them when there are other
+// groups whose steps they'd no longer wait for.
+func (p *PipelineParserResult) GroupUntaggedSteps(label string) (int, error) {
+	item, ok := mapSliceItem("steps", p.pipeline)
+	if !ok {
+		return 0, nil
+	}
+	steps, ok := item.Value.([]interface{})
+	if !ok {
+		return 0, nil
+	}
+
+	var untagged []interface{}
+	var waits []string
+	first := -1
+	groups := 0
+	for i, s := range steps {
+		step, isMap := s.(yaml.MapSlice)
+		if isMap && stepType(step) == "group" {
+			groups++
+			continue
+		}
+
+		if first == -1 {
+			first = i
+		}
+		untagged = append(untagged, s)
+
+		switch {
+		case !isMap:
+			// Steps that are plain strings are waits and the like
+			waits = append(waits, fmt.Sprintf("%q", s))
+		case stepType(step) == "wait" || stepType(step) == "block" || stepType(step) == "input":
+			waits = append(waits, stepName(step))
+		}
+	}
+
+	if len(untagged) == 0 {
+		return 0, nil
+	}
+
+	if groups > 0 && len(waits) > 0 {
+		return 0, fmt.Errorf("Steps can't be grouped along with other groups, as grouping wait, block and input steps (%s) would change which steps they wait for",
+			strings.Join(waits, ", "))
+	}
+
+	grouped := make([]interface{}, 0, len(steps)-len(untagged)+1)
+	for i, s := range steps {
+		if i == first {
+			grouped = append(grouped, yaml.MapSlice{
+				{Key: "group", Value: label},
+				{Key: "steps", Value: untagged},
+			})
+		}
+		if step, ok := s.(yaml.MapSlice); ok && stepType(step) == "group" {
+			grouped = append(grouped, s)
+		}
+	}
+
+	p.pipeline = upsertSliceItem("steps", p.pipeline, grouped)
+	return len(untagged), nil
+}
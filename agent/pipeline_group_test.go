@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupUntaggedSteps(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - group: Lint
+    steps:
+      - command: make lint
+        key: lint
+  - command: make
+    key: build
+  - group: Tests
+    steps:
+      - command: make test
+        depends_on: build
+  - command: make docs
+    depends_on: lint
+`)
+
+	n, err := result.GroupUntaggedSteps("Other")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[`+
+		`{"group":"Lint","steps":[{"command":"make lint","key":"lint"}]},`+
+		`{"group":"Other","steps":[{"command":"make","key":"build"},{"command":"make docs","depends_on":"lint"}]},`+
+		`{"group":"Tests","steps":[{"command":"make test","depends_on":"build"}]}`+
+		`]}`, string(j))
+	assert.Empty(t, result.ValidateDependencies())
+}
+
+func TestGroupUntaggedStepsWithWaits(t *testing.T) {
+	// Without other groups, the waits still wait for the same steps
+	result := parsePipelineForTest(t, "steps:\n  - command: make\n  - wait\n  - command: deploy\n")
+
+	n, err := result.GroupUntaggedSteps("All")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"group":"All","steps":[{"command":"make"},"wait",{"command":"deploy"}]}]}`, string(j))
+
+	result = parsePipelineForTest(t, `steps:
+  - group: Tests
+    steps:
+      - command: make test
+  - wait
+  - block: Deploy?
+  - command: deploy
+`)
+
+	_, err = result.GroupUntaggedSteps("Deploy")
+	assert.EqualError(t, err, `Steps can't be grouped along with other groups, as grouping wait, block and input steps ("wait", "Deploy?") would change which steps they wait for`)
+
+	j, err = json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"group":"Tests","steps":[{"command":"make test"}]},"wait",{"block":"Deploy?"},{"command":"deploy"}]}`, string(j))
+}
+
+func TestGroupUntaggedStepsWithOnlyGroups(t *testing.T) {
+	result := parsePipelineForTest(t, "steps:\n  - group: Tests\n    steps:\n      - command: make test\n")
+
+	n, err := result.GroupUntaggedSteps("Other")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/buildkite/yaml"
+)
+
+// MaxGeneratedLabelLength is the longest label, in characters, that a
+// LabelTemplate generates. Longer labels are truncated.
+const MaxGeneratedLabelLength = 100
+
+// labelTemplateFuncs are the functions available to label templates
+var labelTemplateFuncs = template.FuncMap{
+	"firstLine": func(s string) string {
+		return strings.SplitN(s, "\n", 2)[0]
+	},
+}
+
+// LabelTemplate generates labels for command steps that don't have one, from
+// a text/template over the step's attributes
+type LabelTemplate struct {
+	tmpl *template.Template
+}
+
+// labelTemplateData is what a label template is executed with
+type labelTemplateData struct {
+	// The step's command, or its commands joined with newlines
+	Command string
+	Key     string
+	Env     map[string]string
+	Agents  map[string]string
+}
+
+// NewLabelTemplate parses a label template, like {{ .Command | firstLine }},
+// and checks that it only refers to attributes that steps have
+func NewLabelTemplate(text string) (*LabelTemplate, error) {
+	tmpl, err := template.New("label").Funcs(labelTemplateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid step label template: %v", err)
+	}
+
+	// Template errors like unknown fields are only found when it's executed
+	if err := tmpl.Execute(&bytes.Buffer{}, labelTemplateData{}); err != nil {
+		return nil, fmt.Errorf("Invalid step label template: %v", err)
+	}
+
+	return &LabelTemplate{tmpl: tmpl}, nil
+}
+
+// GenerateLabels adds a label from t to every command step in the pipeline
+// (including those nested in groups) that doesn't have a label or name, and
+// returns how many steps were labelled. Steps that the template generates an
+// empty label for are left alone.
+func (p *PipelineParserResult) GenerateLabels(t *LabelTemplate) (int, error) {
+	labelled := 0
+
+	err := p.flatMapSteps(func(step yaml.MapSlice) ([]interface{}, error) {
+		if stepType(step) != "command" {
+			return []interface{}{step}, nil
+		}
+		for _, attr := range []string{"label", "name"} {
+			if _, ok := mapSliceItem(attr, step); ok {
+				return []interface{}{step}, nil
+			}
+		}
+
+		var label bytes.Buffer
+		if err := t.tmpl.Execute(&label, newLabelTemplateData(step)); err != nil {
+			return nil, fmt.Errorf("Failed to generate a label for step %s: %v", stepName(step), err)
+		}
+
+		generated := strings.TrimSpace(label.String())
+		if generated == "" {
+			return []interface{}{step}, nil
+		}
+		if utf8.RuneCountInString(generated) > MaxGeneratedLabelLength {
+			generated = string([]rune(generated)[:MaxGeneratedLabelLength-1]) + "…"
+		}
+
+		labelled++
+		return []interface{}{upsertSliceItem("label", step, generated)}, nil
+	})
+
+	return labelled, err
+}
+
+func newLabelTemplateData(step yaml.MapSlice) labelTemplateData {
+	data := labelTemplateData{
+		Key:    stepKey(step),
+		Env:    stringMap(step, "env"),
+		Agents: stringMap(step, "agents"),
+	}
+
+	for _, attr := range []string{"command", "commands"} {
+		item, ok := mapSliceItem(attr, step)
+		if !ok {
+			continue
+		}
+		if lines, ok := item.Value.([]interface{}); ok {
+			commands := make([]string, 0, len(lines))
+			for _, line := range lines {
+				commands = append(commands, fmt.Sprint(line))
+			}
+			data.Command = strings.Join(commands, "\n")
+		} else {
+			data.Command = fmt.Sprint(item.Value)
+		}
+		break
+	}
+
+	return data
+}
+
+// stringMap returns the map attribute of a step with its values as strings
+func stringMap(step yaml.MapSlice, attr string) map[string]string {
+	m := map[string]string{}
+	if item, ok := mapSliceItem(attr, step); ok {
+		if values, ok := item.Value.(yaml.MapSlice); ok {
+			for _, v := range values {
+				m[fmt.Sprint(v.Key)] = fmt.Sprint(v.Value)
+			}
+		}
+	}
+	return m
+}
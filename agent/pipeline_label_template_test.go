@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateLabels(t *testing.T) {
+	result, _, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - command: "make test\nmake lint"
+  - commands:
+      - "echo one"
+      - "echo two"
+    key: echo
+  - command: "labelled"
+    label: ":pipeline:"
+  - command: "named"
+    name: "Named"
+  - wait
+  - block: "Deploy?"
+  - group: "Group"
+    steps:
+      - command: "nested"
+  - plugins:
+      - docker#v3.0.0: ~
+`),
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := NewLabelTemplate(`{{ .Command | firstLine }}{{ with .Key }} ({{ . }}){{ end }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := result.GenerateLabels(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 3, n)
+	assert.Equal(t, `{"steps":[{"command":"make test\nmake lint","label":"make test"},{"commands":["echo one","echo two"],"key":"echo","label":"echo one (echo)"},{"command":"labelled","label":":pipeline:"},{"command":"named","name":"Named"},"wait",{"block":"Deploy?"},{"group":"Group","steps":[{"command":"nested","label":"nested"}]},{"plugins":[{"docker#v3.0.0":null}]}]}`, string(j))
+}
+
+func TestGenerateLabelsTruncatesLongLabels(t *testing.T) {
+	result, _, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - command: "echo ` + strings.Repeat("é", 200) + `"
+`),
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl, err := NewLabelTemplate(`{{ .Command }}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := result.GenerateLabels(tmpl); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	label := "echo " + strings.Repeat("é", MaxGeneratedLabelLength-6) + "…"
+	assert.Equal(t, `{"steps":[{"command":"echo `+strings.Repeat("é", 200)+`","label":"`+label+`"}]}`, string(j))
+}
+
+func TestNewLabelTemplateRejectsInvalidTemplates(t *testing.T) {
+	for _, text := range []string{
+		`{{ .Command`,
+		`{{ .Nope }}`,
+		`{{ .Command | nope }}`,
+	} {
+		_, err := NewLabelTemplate(text)
+		assert.Error(t, err, text)
+	}
+}
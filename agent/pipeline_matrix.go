@@ -0,0 +1,303 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// matrixPlaceholder matches {{matrix}} and {{matrix.dimension}}
+var matrixPlaceholder = regexp.MustCompile(`\{\{\s*matrix(?:\.(\w+))?\s*\}\}`)
+
+// matrixCombination is one set of values from a step's matrix, keyed by
+// dimension, or by an empty string for a matrix with a single dimension
+type matrixCombination struct {
+	values   yaml.MapSlice
+	skip     interface{}
+	softFail interface{}
+}
+
+// ExpandMatrix replaces every command step with a matrix (including those
+// nested in groups) with a step for each combination of the matrix's values,
+// like Buildkite does when the build runs, so that the combinations can be
+// checked. Combinations skipped by an adjustment are kept, with their skip.
+func (p *PipelineParserResult) ExpandMatrix() error {
+	return p.flatMapSteps(func(step yaml.MapSlice) ([]interface{}, error) {
+		item, ok := mapSliceItem("matrix", step)
+		if !ok || stepType(step) != "command" {
+			return []interface{}{step}, nil
+		}
+
+		combinations, err := matrixCombinations(item.Value)
+		if err != nil {
+			return nil, fmt.Errorf("Step %s has an invalid matrix: %v", stepName(step), err)
+		}
+
+		steps := make([]interface{}, 0, len(combinations))
+		for _, combination := range combinations {
+			expanded, err := expandMatrixStep(step, combination)
+			if err != nil {
+				return nil, fmt.Errorf("Step %s can't be expanded: %v", stepName(step), err)
+			}
+			steps = append(steps, expanded)
+		}
+
+		return steps, nil
+	})
+}
+
+// matrixCombinations returns every combination of the values in a matrix,
+// with its adjustments applied
+func matrixCombinations(matrix interface{}) ([]*matrixCombination, error) {
+	var setup interface{} = matrix
+	var adjustments []interface{}
+
+	if m, ok := matrix.(yaml.MapSlice); ok {
+		for _, item := range m {
+			switch item.Key {
+			case "setup":
+				setup = item.Value
+			case "adjustments":
+				if adjustments, ok = item.Value.([]interface{}); !ok {
+					return nil, errors.New("adjustments must be a list")
+				}
+			default:
+				return nil, fmt.Errorf("unknown matrix attribute %q", item.Key)
+			}
+		}
+		if _, ok := mapSliceItem("setup", m); !ok {
+			return nil, errors.New("a matrix map must have a setup")
+		}
+	}
+
+	var dimensions []string
+	var combinations []*matrixCombination
+
+	switch s := setup.(type) {
+	case []interface{}:
+		// A single dimension of values
+		dimensions = []string{""}
+		values, err := matrixValues("", s)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			combinations = append(combinations, &matrixCombination{values: yaml.MapSlice{{Key: "", Value: v}}})
+		}
+
+	case yaml.MapSlice:
+		// The cross product of multiple dimensions
+		if len(s) == 0 {
+			return nil, errors.New("setup must have at least one dimension")
+		}
+		combinations = []*matrixCombination{{}}
+		for _, item := range s {
+			dimension := fmt.Sprint(item.Key)
+			list, ok := item.Value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("dimension %q must be a list of values", dimension)
+			}
+			values, err := matrixValues(dimension, list)
+			if err != nil {
+				return nil, err
+			}
+
+			dimensions = append(dimensions, dimension)
+
+			var product []*matrixCombination
+			for _, c := range combinations {
+				for _, v := range values {
+					combined := append(append(yaml.MapSlice{}, c.values...), yaml.MapItem{Key: dimension, Value: v})
+					product = append(product, &matrixCombination{values: combined})
+				}
+			}
+			combinations = product
+		}
+
+	default:
+		return nil, errors.New("setup must be a list of values, or a map of dimensions to lists of values")
+	}
+
+	for i, a := range adjustments {
+		adjustment, ok := a.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("adjustment %d must be a map", i+1)
+		}
+
+		with, ok := mapSliceItem("with", adjustment)
+		if !ok {
+			return nil, fmt.Errorf("adjustment %d must have a with", i+1)
+		}
+
+		values, err := adjustmentValues(dimensions, with.Value)
+		if err != nil {
+			return nil, fmt.Errorf("adjustment %d %v", i+1, err)
+		}
+
+		// Adjustments either change an existing combination, or add a new one
+		var combination *matrixCombination
+		for _, c := range combinations {
+			if fmt.Sprint(c.values) == fmt.Sprint(values) {
+				combination = c
+				break
+			}
+		}
+		if combination == nil {
+			combination = &matrixCombination{values: values}
+			combinations = append(combinations, combination)
+		}
+
+		for _, item := range adjustment {
+			switch item.Key {
+			case "with":
+			case "skip":
+				combination.skip = item.Value
+			case "soft_fail":
+				combination.softFail = item.Value
+			default:
+				return nil, fmt.Errorf("adjustment %d has unknown attribute %q", i+1, item.Key)
+			}
+		}
+	}
+
+	return combinations, nil
+}
+
+// matrixValues checks that the values of a dimension are all scalars
+func matrixValues(dimension string, values []interface{}) ([]interface{}, error) {
+	if len(values) == 0 {
+		if dimension == "" {
+			return nil, errors.New("setup must have at least one value")
+		}
+		return nil, fmt.Errorf("dimension %q must have at least one value", dimension)
+	}
+
+	for _, v := range values {
+		if !isMatrixScalar(v) {
+			if dimension == "" {
+				return nil, fmt.Errorf("value %v must be a string, number or boolean", v)
+			}
+			return nil, fmt.Errorf("value %v of dimension %q must be a string, number or boolean", v, dimension)
+		}
+	}
+
+	return values, nil
+}
+
+// adjustmentValues returns the combination that the with of an adjustment
+// refers to, which must have a value for each of the dimensions
+func adjustmentValues(dimensions []string, with interface{}) (yaml.MapSlice, error) {
+	if len(dimensions) == 1 && dimensions[0] == "" {
+		if !isMatrixScalar(with) {
+			return nil, errors.New("with must be a single value")
+		}
+		return yaml.MapSlice{{Key: "", Value: with}}, nil
+	}
+
+	m, ok := with.(yaml.MapSlice)
+	if !ok {
+		return nil, errors.New("with must be a map of dimensions to values")
+	}
+
+	var values yaml.MapSlice
+	for _, dimension := range dimensions {
+		item, ok := mapSliceItem(dimension, m)
+		if !ok {
+			return nil, fmt.Errorf("with is missing dimension %q", dimension)
+		}
+		if !isMatrixScalar(item.Value) {
+			return nil, fmt.Errorf("with value for dimension %q must be a string, number or boolean", dimension)
+		}
+		values = append(values, yaml.MapItem{Key: dimension, Value: item.Value})
+	}
+
+	if len(m) != len(dimensions) {
+		return nil, fmt.Errorf("with has dimensions that aren't in the setup (setup has %s)", strings.Join(dimensions, ", "))
+	}
+
+	return values, nil
+}
+
+func isMatrixScalar(v interface{}) bool {
+	switch v.(type) {
+	case string, int, float64, bool:
+		return true
+	}
+	return false
+}
+
+// expandMatrixStep returns a copy of step without its matrix, with the
+// matrix placeholders replaced with the values of the combination
+func expandMatrixStep(step yaml.MapSlice, combination *matrixCombination) (yaml.MapSlice, error) {
+	expanded := yaml.MapSlice{}
+	for _, item := range step {
+		if item.Key == "matrix" {
+			continue
+		}
+
+		value, err := substituteMatrix(item.Value, combination.values)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, yaml.MapItem{Key: item.Key, Value: value})
+	}
+
+	if combination.skip != nil {
+		expanded = upsertSliceItem("skip", expanded, combination.skip)
+	}
+	if combination.softFail != nil {
+		expanded = upsertSliceItem("soft_fail", expanded, combination.softFail)
+	}
+
+	return expanded, nil
+}
+
+// substituteMatrix returns a copy of v with the matrix placeholders in its
+// strings replaced with values
+func substituteMatrix(v interface{}, values yaml.MapSlice) (interface{}, error) {
+	switch value := v.(type) {
+	case string:
+		var err error
+		substituted := matrixPlaceholder.ReplaceAllStringFunc(value, func(placeholder string) string {
+			dimension := matrixPlaceholder.FindStringSubmatch(placeholder)[1]
+			item, ok := mapSliceItem(dimension, values)
+			if !ok {
+				if dimension == "" {
+					err = errors.New("{{matrix}} can only be used with a single dimension matrix")
+				} else {
+					err = fmt.Errorf("%s refers to a dimension that isn't in the matrix", placeholder)
+				}
+				return placeholder
+			}
+			return fmt.Sprint(item.Value)
+		})
+		return substituted, err
+
+	case yaml.MapSlice:
+		substituted := yaml.MapSlice{}
+		for _, item := range value {
+			v, err := substituteMatrix(item.Value, values)
+			if err != nil {
+				return nil, err
+			}
+			substituted = append(substituted, yaml.MapItem{Key: item.Key, Value: v})
+		}
+		return substituted, nil
+
+	case []interface{}:
+		substituted := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			v, err := substituteMatrix(item, values)
+			if err != nil {
+				return nil, err
+			}
+			substituted = append(substituted, v)
+		}
+		return substituted, nil
+	}
+
+	return v, nil
+}
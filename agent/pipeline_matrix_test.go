@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandMatrixWithSingleDimension(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - command: "make test-{{matrix}}"
+    label: "{{ matrix }} tests"
+    matrix:
+      - unit
+      - integration
+  - wait
+`)
+
+	if err := result.ExpandMatrix(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"steps": [
+		{"command": "make test-unit", "label": "unit tests"},
+		{"command": "make test-integration", "label": "integration tests"},
+		"wait"
+	]}`, string(j))
+}
+
+func TestExpandMatrixToml(t *testing.T) {
+	result := parseTOMLPipelineForTest(t, `[[steps]]
+command = "make test-{{matrix}}"
+matrix = [1, 2]
+`)
+
+	if err := result.ExpandMatrix(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"steps": [
+		{"command": "make test-1"},
+		{"command": "make test-2"}
+	]}`, string(j))
+}
+
+func TestExpandMatrixWithDimensionsAndAdjustments(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - group: builds
+    steps:
+      - command: "make build"
+        env:
+          GOOS: "{{matrix.os}}"
+          GOARCH: "{{matrix.arch}}"
+        matrix:
+          setup:
+            os: [linux, darwin]
+            arch: [amd64, arm64]
+          adjustments:
+            - with: {os: darwin, arch: amd64}
+              skip: "no longer supported"
+            - with: {os: windows, arch: amd64}
+              soft_fail: true
+`)
+
+	if err := result.ExpandMatrix(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"steps": [
+		{"group": "builds", "steps": [
+			{"command": "make build", "env": {"GOOS": "linux", "GOARCH": "amd64"}},
+			{"command": "make build", "env": {"GOOS": "linux", "GOARCH": "arm64"}},
+			{"command": "make build", "env": {"GOOS": "darwin", "GOARCH": "amd64"}, "skip": "no longer supported"},
+			{"command": "make build", "env": {"GOOS": "darwin", "GOARCH": "arm64"}},
+			{"command": "make build", "env": {"GOOS": "windows", "GOARCH": "amd64"}, "soft_fail": true}
+		]}
+	]}`, string(j))
+}
+
+func TestExpandMatrixWithInvalidMatrices(t *testing.T) {
+	for pipeline, expected := range map[string]string{
+		`steps: [{command: "{{matrix.os}}", matrix: [a, b]}]`:                                        `Step with command "{{matrix.os}}" can't be expanded: {{matrix.os}} refers to a dimension that isn't in the matrix`,
+		`steps: [{command: "{{matrix}}", matrix: {setup: {os: [a]}}}]`:                               `Step with command "{{matrix}}" can't be expanded: {{matrix}} can only be used with a single dimension matrix`,
+		`steps: [{command: x, matrix: {setup: {os: []}}}]`:                                           `Step with command "x" has an invalid matrix: dimension "os" must have at least one value`,
+		`steps: [{command: x, matrix: {setup: {os: [a]}, adjustments: [{with: {arch: b}}]}}]`:        `Step with command "x" has an invalid matrix: adjustment 1 with is missing dimension "os"`,
+		`steps: [{command: x, matrix: {setup: {os: [a]}, adjustments: [{with: {os: a, arch: b}}]}}]`: `Step with command "x" has an invalid matrix: adjustment 1 with has dimensions that aren't in the setup (setup has os)`,
+		`steps: [{command: x, matrix: {setup: [a], adjustments: [{with: a, retry: 1}]}}]`:            `Step with command "x" has an invalid matrix: adjustment 1 has unknown attribute "retry"`,
+		`steps: [{command: x, matrix: [[a]]}]`:                                                       `Step with command "x" has an invalid matrix: value [a] must be a string, number or boolean`,
+	} {
+		result := parsePipelineForTest(t, pipeline)
+		assert.EqualError(t, result.ExpandMatrix(), expected, pipeline)
+	}
+}
@@ -0,0 +1,118 @@
+package agent
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// Merge adds the steps of other to the end of the pipeline's steps, and the
+// variables in its top-level env block to the pipeline's. Other top-level
+// attributes are added if the pipeline doesn't have them. It's an error for
+// both pipelines to set a variable or attribute to different values.
+//
+// What other recorded while it was interpolated is added to the pipeline's
+// too, with the paths of its steps moved to where they end up.
+func (p *PipelineParserResult) Merge(other *PipelineParserResult) error {
+	merged := append(yaml.MapSlice{}, p.pipeline...)
+
+	// The other pipeline's steps go after this many
+	offset := 0
+	if item, ok := mapSliceItem("steps", p.pipeline); ok {
+		if steps, ok := item.Value.([]interface{}); ok {
+			offset = len(steps)
+		}
+	}
+
+	for _, item := range other.pipeline {
+		key := fmt.Sprint(item.Key)
+		existing, ok := mapSliceItem(key, merged)
+		if !ok {
+			merged = append(merged, item)
+			continue
+		}
+
+		switch key {
+		case "steps":
+			steps, ok := existing.Value.([]interface{})
+			otherSteps, otherOk := item.Value.([]interface{})
+			if !ok || !otherOk {
+				return fmt.Errorf("Expected steps to be a list of steps, got %T and %T", existing.Value, item.Value)
+			}
+			merged = upsertSliceItem(key, merged, append(append([]interface{}{}, steps...), otherSteps...))
+
+		case "env":
+			env, ok := existing.Value.(yaml.MapSlice)
+			otherEnv, otherOk := item.Value.(yaml.MapSlice)
+			if !ok || !otherOk {
+				return fmt.Errorf("Expected pipeline top-level env block to be a map, got %T and %T", existing.Value, item.Value)
+			}
+			mergedEnv := append(yaml.MapSlice{}, env...)
+			for _, envItem := range otherEnv {
+				name := fmt.Sprint(envItem.Key)
+				if existingEnv, ok := mapSliceItem(name, mergedEnv); ok {
+					if !reflect.DeepEqual(existingEnv.Value, envItem.Value) {
+						return fmt.Errorf("Pipelines set env variable %s to different values", name)
+					}
+					continue
+				}
+				mergedEnv = append(mergedEnv, envItem)
+			}
+			merged = upsertSliceItem(key, merged, mergedEnv)
+
+		default:
+			if !reflect.DeepEqual(existing.Value, item.Value) {
+				return fmt.Errorf("Pipelines set %s to different values", key)
+			}
+		}
+	}
+
+	p.pipeline = merged
+
+	referenced := map[string]bool{}
+	for name, empty := range p.referenced {
+		referenced[name] = empty
+	}
+	for name, empty := range other.referenced {
+		if _, ok := referenced[name]; !ok {
+			referenced[name] = empty
+		}
+	}
+	p.referenced = referenced
+
+	for _, si := range other.secretInterpolations {
+		si.Path = offsetStepPath(si.Path, offset)
+		p.secretInterpolations = append(p.secretInterpolations, si)
+	}
+	for _, source := range other.sources {
+		source.Path = offsetStepPath(source.Path, offset)
+		p.sources = append(p.sources, source)
+	}
+
+	return nil
+}
+
+// offsetStepPath adds offset to the index of the top-level step in a path
+// like steps[2].env, which interpolation records values by. Other paths are
+// returned as they are.
+func offsetStepPath(path string, offset int) string {
+	const prefix = "steps["
+	if !strings.HasPrefix(path, prefix) {
+		return path
+	}
+
+	end := strings.Index(path, "]")
+	if end < 0 {
+		return path
+	}
+
+	i, err := strconv.Atoi(path[len(prefix):end])
+	if err != nil {
+		return path
+	}
+
+	return fmt.Sprintf("%s%d%s", prefix, i+offset, path[end:])
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge(t *testing.T) {
+	result := parsePipelineForTest(t, `env:
+  REGION: us-east-1
+agents:
+  queue: build
+steps:
+  - command: make
+`)
+
+	err := result.Merge(parsePipelineForTest(t, `env:
+  REGION: us-east-1
+  RELEASE: "1"
+agents:
+  queue: build
+notify:
+  - email: team@example.com
+steps:
+  - wait
+  - command: deploy
+`))
+	assert.NoError(t, err)
+
+	err = result.Merge(parsePipelineForTest(t, `- command: lint
+`))
+	assert.NoError(t, err)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"REGION":"us-east-1","RELEASE":"1"},"agents":{"queue":"build"},`+
+		`"steps":[{"command":"make"},"wait",{"command":"deploy"},{"command":"lint"}],`+
+		`"notify":[{"email":"team@example.com"}]}`, string(j))
+}
+
+func TestMergeConflicts(t *testing.T) {
+	result := parsePipelineForTest(t, `env:
+  REGION: us-east-1
+agents:
+  queue: build
+steps:
+  - command: make
+`)
+
+	err := result.Merge(parsePipelineForTest(t, "env:\n  REGION: eu-west-1\nsteps: []\n"))
+	assert.EqualError(t, err, "Pipelines set env variable REGION to different values")
+
+	err = result.Merge(parsePipelineForTest(t, "agents:\n  queue: deploy\nsteps: []\n"))
+	assert.EqualError(t, err, "Pipelines set agents to different values")
+
+	// Failed merges leave the pipeline as it was
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":{"REGION":"us-east-1"},"agents":{"queue":"build"},"steps":[{"command":"make"}]}`, string(j))
+}
+
+func TestMergeInterpolationRecords(t *testing.T) {
+	parse := func(pipeline string) *PipelineParserResult {
+		result, _, err := PipelineParser{
+			Pipeline:      []byte(pipeline),
+			Env:           env.FromSlice([]string{"NAME=world", "TOKEN=secret", "EMPTY="}),
+			SecretVars:    []string{"TOKEN"},
+			RecordSources: true,
+		}.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	result := parse(`steps:
+  - command: echo $NAME $EMPTY
+  - wait
+`)
+	err := result.Merge(parse(`steps:
+  - command: echo $NAME $MISSING
+  - command: deploy $TOKEN
+`))
+	assert.NoError(t, err)
+
+	// $NAME is only counted once
+	assert.Equal(t, InterpolationStats{Referenced: 4, Resolved: 2, Empty: 2}, result.InterpolationStats())
+
+	assert.Equal(t, []InterpolationSource{
+		{Path: "steps[0].command", Source: "echo $NAME $EMPTY"},
+		{Path: "steps[2].command", Source: "echo $NAME $MISSING"},
+		{Path: "steps[3].command", Source: "deploy $TOKEN"},
+	}, result.Sources())
+
+	assert.Equal(t, []SecretInterpolation{
+		{Name: "TOKEN", Path: "steps[3].command"},
+	}, result.SecretInterpolations())
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/tracetools"
@@ -20,45 +22,93 @@ type PipelineParser struct {
 	Filename        string
 	Pipeline        []byte
 	NoInterpolation bool
+
+	// Providers are asked in order for the values of variables that aren't
+	// in Env, which is always asked first
+	Providers []VariableProvider
+
+	// Positional arguments that $1 or ${1}, $2 or ${2} and so on are
+	// interpolated as, like in a shell. Positional arguments are only
+	// interpolated if Args isn't nil.
+	Args []string
+
+	// Names of variables with sensitive values. Where their values are
+	// interpolated into the pipeline is available from the result's
+	// SecretInterpolations.
+	SecretVars []string
+
+	// The longest value, in bytes, that a variable is interpolated as. Longer
+	// values fail parsing, unless TruncateLongVars is set, in which case they
+	// are truncated with a warning. Zero allows values of any length.
+	MaxVarLength     int
+	TruncateLongVars bool
+
+	// Whether referencing a variable that isn't set, without a default, is an
+	// error rather than a warning. It has no effect without interpolation.
+	Strict bool
+
+	// Whether to record the text before interpolation of the values that
+	// interpolation changes, which is available from the result's Sources
+	RecordSources bool
+
+	// Records the variables referenced during interpolation. It's a pointer
+	// so that it's shared between the copies of the parser made by its
+	// value receivers.
+	tracker *interpolationTracker
 }
 
-func (p PipelineParser) Parse() (*PipelineParserResult, error) {
-	if p.Env == nil {
-		p.Env = env.New()
-	}
+// VariableProvider resolves the values of variables during interpolation.
+// *env.Environment is a VariableProvider.
+type VariableProvider interface {
+	Get(name string) (string, bool)
+}
 
-	var errPrefix string
-	if p.Filename == "" {
-		errPrefix = "Failed to parse pipeline"
-	} else {
-		errPrefix = fmt.Sprintf("Failed to parse %s", p.Filename)
-	}
+// VariableProviderFunc adapts a function to a VariableProvider
+type VariableProviderFunc func(name string) (string, bool)
 
-	var pipelineAsSlice []topLevelStep
-	var pipeline yaml.MapSlice
+func (f VariableProviderFunc) Get(name string) (string, bool) {
+	return f(name)
+}
 
-	// We support top-level arrays of steps, so try that first
-	if err := yaml.Unmarshal(p.Pipeline, &pipelineAsSlice); err == nil {
-		var steps []interface{}
+// variableChain is a VariableProvider that asks each of its providers in
+// turn, and returns the first value found
+type variableChain []VariableProvider
 
-		// Unwrap our custom topLevelStep types for marshaling later
-		for _, step := range pipelineAsSlice {
-			if step.MapSlice != nil {
-				steps = append(steps, step.MapSlice)
-			} else {
-				steps = append(steps, step.Body)
-			}
+func (c variableChain) Get(name string) (string, bool) {
+	for _, provider := range c {
+		if v, ok := provider.Get(name); ok {
+			return v, true
 		}
+	}
+	return "", false
+}
 
-		pipeline = yaml.MapSlice{
-			{Key: "steps", Value: steps},
-		}
-	} else if err := yaml.Unmarshal(p.Pipeline, &pipeline); err != nil {
-		return nil, fmt.Errorf("%s: %v", errPrefix, formatYAMLError(err))
+// Warning is a problem found while parsing a pipeline that doesn't stop it
+// from being parsed, but is probably a mistake
+type Warning struct {
+	Message string
+}
+
+func (w Warning) String() string {
+	return w.Message
+}
+
+func (p PipelineParser) Parse() (*PipelineParserResult, []Warning, error) {
+	if p.Env == nil {
+		p.Env = env.New()
+	}
+
+	p.tracker = newInterpolationTracker(p.SecretVars)
+
+	errPrefix := p.errPrefix()
+
+	pipeline, err := p.unmarshal()
+	if err != nil {
+		return nil, nil, err
 	}
 
 	if p.NoInterpolation {
-		return &PipelineParserResult{pipeline: pipeline}, nil
+		return &PipelineParserResult{pipeline: pipeline}, nil, nil
 	}
 
 	// Propagate distributed tracing context to the new pipelines if available
@@ -84,21 +134,105 @@ func (p PipelineParser) Parse() (*PipelineParserResult, error) {
 	if item, ok := mapSliceItem("env", pipeline); ok {
 		if envMap, ok := item.Value.(yaml.MapSlice); ok {
 			if err := p.interpolateEnvBlock(envMap); err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 		} else {
-			return nil, fmt.Errorf("Expected pipeline top-level env block to be a map, got %T", item)
+			return nil, nil, fmt.Errorf("Expected pipeline top-level env block to be a map, got %T", item)
 		}
 	}
 
 	// Recursively go through the entire pipeline and perform environment
 	// variable interpolation on strings
-	interpolated, err := p.interpolate(pipeline)
+	interpolated, err := p.interpolate(pipeline, "")
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if p.Strict && len(p.tracker.unset) > 0 {
+		names := make([]string, 0, len(p.tracker.unset))
+		for _, name := range p.tracker.unset {
+			names = append(names, "$"+name)
+		}
+		verb := "isn't"
+		if len(names) > 1 {
+			verb = "aren't"
+		}
+		return nil, nil, fmt.Errorf("%s: %s %s set", errPrefix, strings.Join(names, ", "), verb)
 	}
 
-	return &PipelineParserResult{pipeline: interpolated.(yaml.MapSlice)}, nil
+	var warnings []Warning
+	for _, name := range p.tracker.unset {
+		warnings = append(warnings, Warning{
+			Message: fmt.Sprintf("$%s is not set, so it was interpolated as an empty string", name),
+		})
+	}
+
+	if len(p.tracker.long) > 0 {
+		var problems []string
+		for _, long := range p.tracker.long {
+			if p.TruncateLongVars {
+				warnings = append(warnings, Warning{
+					Message: fmt.Sprintf("$%s is %d bytes long, so it was truncated to the maximum of %d", long.name, long.length, p.MaxVarLength),
+				})
+			} else {
+				problems = append(problems, fmt.Sprintf("$%s is %d bytes long", long.name, long.length))
+			}
+		}
+		if len(problems) > 0 {
+			return nil, nil, fmt.Errorf("%s: %s, which is more than the maximum of %d", errPrefix, strings.Join(problems, ", "), p.MaxVarLength)
+		}
+	}
+
+	return &PipelineParserResult{
+		pipeline:             interpolated.(yaml.MapSlice),
+		referenced:           p.tracker.seen,
+		secretInterpolations: p.tracker.secretInterpolations,
+		sources:              p.tracker.sources,
+	}, warnings, nil
+}
+
+func (p PipelineParser) errPrefix() string {
+	if p.Filename == "" {
+		return "Failed to parse pipeline"
+	}
+	return fmt.Sprintf("Failed to parse %s", p.Filename)
+}
+
+// unmarshal parses the pipeline's YAML, or TOML if its filename ends in .toml,
+// without interpolating it
+func (p PipelineParser) unmarshal() (yaml.MapSlice, error) {
+	if isTOMLFile(p.Filename) {
+		pipeline, err := unmarshalTOML(p.Pipeline)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", p.errPrefix(), err)
+		}
+		return pipeline, nil
+	}
+
+	var pipelineAsSlice []topLevelStep
+	var pipeline yaml.MapSlice
+
+	// We support top-level arrays of steps, so try that first
+	if err := yaml.Unmarshal(p.Pipeline, &pipelineAsSlice); err == nil {
+		var steps []interface{}
+
+		// Unwrap our custom topLevelStep types for marshaling later
+		for _, step := range pipelineAsSlice {
+			if step.MapSlice != nil {
+				steps = append(steps, step.MapSlice)
+			} else {
+				steps = append(steps, step.Body)
+			}
+		}
+
+		pipeline = yaml.MapSlice{
+			{Key: "steps", Value: steps},
+		}
+	} else if err := yaml.Unmarshal(p.Pipeline, &pipeline); err != nil {
+		return nil, fmt.Errorf("%s: %v", p.errPrefix(), formatYAMLError(err))
+	}
+
+	return pipeline, nil
 }
 
 // upsertSliceItem will replace a key's value in the given MapSlice with the given
@@ -139,7 +273,7 @@ func (p PipelineParser) interpolateEnvBlock(envMap yaml.MapSlice) error {
 		}
 		switch tv := item.Value.(type) {
 		case string:
-			interpolated, err := interpolate.Interpolate(p.Env, tv)
+			interpolated, err := p.interpolateString(tv, "env."+k)
 			if err != nil {
 				return err
 			}
@@ -153,9 +287,247 @@ func formatYAMLError(err error) error {
 	return errors.New(strings.TrimPrefix(err.Error(), "yaml: "))
 }
 
+// interpolateString performs variable interpolation on a single string,
+// recording the variables it references at path
+func (p PipelineParser) interpolateString(s string, path string) (string, error) {
+	if p.Args != nil {
+		s = expandPositionalArgs(s, p.Args)
+	}
+
+	variables := p.variables()
+
+	s, err := env.ExpandAlternates(s, variables, func(name string) {
+		if p.tracker != nil {
+			p.tracker.reference(variables, name, path, false)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	expr, err := interpolate.NewParser(s).Parse()
+	if err != nil {
+		return "", err
+	}
+
+	if p.tracker != nil {
+		p.tracker.track(variables, expr, path)
+	}
+
+	return expr.Expand(variables)
+}
+
+// variables returns the provider of values for interpolation
+func (p PipelineParser) variables() VariableProvider {
+	var variables VariableProvider = p.Env
+	if len(p.Providers) > 0 {
+		variables = append(variableChain{p.Env}, p.Providers...)
+	}
+
+	if p.MaxVarLength > 0 {
+		variables = lengthLimitedVariables{variables: variables, max: p.MaxVarLength, tracker: p.tracker}
+	}
+
+	return variables
+}
+
+// lengthLimitedVariables truncates values longer than max bytes, and records
+// the variables that were
+type lengthLimitedVariables struct {
+	variables VariableProvider
+	max       int
+	tracker   *interpolationTracker
+}
+
+func (l lengthLimitedVariables) Get(name string) (string, bool) {
+	v, ok := l.variables.Get(name)
+	if len(v) <= l.max {
+		return v, ok
+	}
+
+	if l.tracker != nil {
+		l.tracker.tooLong(name, len(v))
+	}
+
+	// Don't cut a multibyte character in half
+	truncated := v[:l.max]
+	for len(truncated) > 0 && !utf8.ValidString(truncated) {
+		truncated = truncated[:len(truncated)-1]
+	}
+	return truncated, ok
+}
+
+// expandPositionalArgs replaces $1 and ${1} style references in s with the
+// positional argument, escaped so that it isn't interpolated any further.
+// Escaped dollar signs ($$ and \$) are left alone.
+func expandPositionalArgs(s string, args []string) string {
+	if !strings.Contains(s, "$") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		// Leave escaped dollar signs and backslashes for the interpolator
+		if rest := s[i:]; strings.HasPrefix(rest, "$$") || strings.HasPrefix(rest, `\$`) || strings.HasPrefix(rest, `\\`) {
+			b.WriteString(s[i : i+2])
+			i++
+			continue
+		}
+
+		if c != '$' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+
+		// Find the digits of $1 or ${1}
+		start, end := i+1, i+1
+		braced := s[start] == '{'
+		if braced {
+			start++
+			end++
+		}
+		for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+			end++
+			if !braced {
+				// Like shells, $12 is $1 followed by a 2
+				break
+			}
+		}
+		if end == start || (braced && (end == len(s) || s[end] != '}')) {
+			b.WriteByte(c)
+			continue
+		}
+
+		n, _ := strconv.Atoi(s[start:end])
+		if n >= 1 && n <= len(args) {
+			b.WriteString(strings.Replace(args[n-1], "$", "$$", -1))
+		}
+
+		if braced {
+			end++
+		}
+		i = end - 1
+	}
+
+	return b.String()
+}
+
+// interpolationTracker records which variables were referenced while
+// interpolating a pipeline
+type interpolationTracker struct {
+	// Variables that were referenced without a default value but weren't
+	// set, in the order they were first referenced
+	unset []string
+
+	// Where the values of sensitive variables were interpolated, in the
+	// order they were found
+	secretInterpolations []SecretInterpolation
+
+	// The text before interpolation of the values it changed, if the parser
+	// records them
+	sources []InterpolationSource
+
+	// Variables with values longer than the parser allows, in the order they
+	// were first referenced
+	long []longVariable
+
+	// Every variable referenced, and whether it was empty or unset when
+	// first referenced
+	seen map[string]bool
+
+	warned  map[string]bool
+	secrets map[string]bool
+}
+
+func newInterpolationTracker(secretVars []string) *interpolationTracker {
+	t := &interpolationTracker{
+		seen:    map[string]bool{},
+		warned:  map[string]bool{},
+		secrets: map[string]bool{},
+	}
+	for _, name := range secretVars {
+		t.secrets[name] = true
+	}
+	return t
+}
+
+func (t *interpolationTracker) track(environ interpolate.Env, expr interpolate.Expression, path string) {
+	for _, item := range expr {
+		switch e := item.Expansion.(type) {
+		case interpolate.VariableExpansion:
+			t.reference(environ, e.Identifier, path, true)
+		case interpolate.SubstringExpansion:
+			t.reference(environ, e.Identifier, path, true)
+		case interpolate.RequiredExpansion:
+			t.reference(environ, e.Identifier, path, false)
+		case interpolate.EmptyValueExpansion:
+			t.reference(environ, e.Identifier, path, false)
+
+			// The default is only expanded when the variable is empty
+			if v, _ := environ.Get(e.Identifier); v == "" {
+				t.track(environ, e.Content, path)
+			}
+		case interpolate.UnsetValueExpansion:
+			t.reference(environ, e.Identifier, path, false)
+
+			// The default is only expanded when the variable is unset
+			if _, ok := environ.Get(e.Identifier); !ok {
+				t.track(environ, e.Content, path)
+			}
+		}
+	}
+}
+
+// reference records that a variable was referenced at path, and whether it
+// needs a warning because it isn't set and has no default
+func (t *interpolationTracker) reference(environ interpolate.Env, name string, path string, warnIfUnset bool) {
+	v, ok := environ.Get(name)
+
+	if v != "" && t.secrets[name] {
+		t.secretInterpolated(name, path)
+	}
+
+	if _, ok := t.seen[name]; !ok {
+		t.seen[name] = v == ""
+	}
+
+	if warnIfUnset && !ok && !t.warned[name] {
+		t.warned[name] = true
+		t.unset = append(t.unset, name)
+	}
+}
+
+type longVariable struct {
+	name   string
+	length int
+}
+
+// tooLong records that a variable's value is longer than the parser allows
+func (t *interpolationTracker) tooLong(name string, length int) {
+	for _, long := range t.long {
+		if long.name == name {
+			return
+		}
+	}
+	t.long = append(t.long, longVariable{name: name, length: length})
+}
+
+// secretInterpolated records that the value of a sensitive variable was
+// interpolated at path, once for each place
+func (t *interpolationTracker) secretInterpolated(name string, path string) {
+	for _, si := range t.secretInterpolations {
+		if si.Name == name && si.Path == path {
+			return
+		}
+	}
+	t.secretInterpolations = append(t.secretInterpolations, SecretInterpolation{Name: name, Path: path})
+}
+
 // interpolate function inspired from: https://gist.github.com/hvoecking/10772475
 
-func (p PipelineParser) interpolate(obj interface{}) (interface{}, error) {
+func (p PipelineParser) interpolate(obj interface{}, path string) (interface{}, error) {
 	// Make sure there's something actually to interpolate
 	if obj == nil {
 		return nil, nil
@@ -167,7 +539,7 @@ func (p PipelineParser) interpolate(obj interface{}) (interface{}, error) {
 	// Make a copy that we'll add the new values to
 	copy := reflect.New(original.Type()).Elem()
 
-	err := p.interpolateRecursive(copy, original)
+	err := p.interpolateRecursive(copy, original, path)
 	if err != nil {
 		return nil, err
 	}
@@ -176,7 +548,9 @@ func (p PipelineParser) interpolate(obj interface{}) (interface{}, error) {
 	return copy.Interface(), nil
 }
 
-func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error {
+// interpolateRecursive interpolates original into copy. path is where original
+// is in the pipeline, like steps[2].env.TOKEN
+func (p PipelineParser) interpolateRecursive(copy, original reflect.Value, path string) error {
 	switch original.Kind() {
 	// If it is a pointer we need to unwrap and call once again
 	case reflect.Ptr:
@@ -194,7 +568,7 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 		copy.Set(reflect.New(originalValue.Type()))
 
 		// Unwrap the newly created pointer
-		err := p.interpolateRecursive(copy.Elem(), originalValue)
+		err := p.interpolateRecursive(copy.Elem(), originalValue, path)
 		if err != nil {
 			return err
 		}
@@ -216,7 +590,7 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 		// points to, so we have to call Elem() to unwrap it
 		copyValue := reflect.New(originalValue.Type()).Elem()
 
-		err := p.interpolateRecursive(copyValue, originalValue)
+		err := p.interpolateRecursive(copyValue, originalValue, path)
 		if err != nil {
 			return err
 		}
@@ -225,8 +599,13 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 
 	// If it is a struct we interpolate each field
 	case reflect.Struct:
+		// The key and value of a map item are both at the path of the item
+		if original.Type() == reflect.TypeOf(yaml.MapItem{}) {
+			path = joinPath(path, fmt.Sprint(original.FieldByName("Key").Interface()))
+		}
+
 		for i := 0; i < original.NumField(); i += 1 {
-			err := p.interpolateRecursive(copy.Field(i), original.Field(i))
+			err := p.interpolateRecursive(copy.Field(i), original.Field(i), path)
 			if err != nil {
 				return err
 			}
@@ -236,8 +615,16 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 	case reflect.Slice:
 		copy.Set(reflect.MakeSlice(original.Type(), original.Len(), original.Cap()))
 
+		// The items of a MapSlice are named by their keys, not their index
+		isMapSlice := original.Type() == reflect.TypeOf(yaml.MapSlice{})
+
 		for i := 0; i < original.Len(); i += 1 {
-			err := p.interpolateRecursive(copy.Index(i), original.Index(i))
+			itemPath := path
+			if !isMapSlice {
+				itemPath = fmt.Sprintf("%s[%d]", path, i)
+			}
+
+			err := p.interpolateRecursive(copy.Index(i), original.Index(i), itemPath)
 			if err != nil {
 				return err
 			}
@@ -249,17 +636,18 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 
 		for _, key := range original.MapKeys() {
 			originalValue := original.MapIndex(key)
+			valuePath := joinPath(path, fmt.Sprint(key.Interface()))
 
 			// New gives us a pointer, but again we want the value
 			copyValue := reflect.New(originalValue.Type()).Elem()
-			err := p.interpolateRecursive(copyValue, originalValue)
+			err := p.interpolateRecursive(copyValue, originalValue, valuePath)
 			if err != nil {
 				return err
 			}
 
 			// Also interpolate the key if it's a string
 			if key.Kind() == reflect.String {
-				interpolatedKey, err := interpolate.Interpolate(p.Env, key.Interface().(string))
+				interpolatedKey, err := p.interpolateString(key.Interface().(string), valuePath)
 				if err != nil {
 					return err
 				}
@@ -271,10 +659,14 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 
 	// If it is a string interpolate it (yay finally we're doing what we came for)
 	case reflect.String:
-		interpolated, err := interpolate.Interpolate(p.Env, original.Interface().(string))
+		source := original.Interface().(string)
+		interpolated, err := p.interpolateString(source, path)
 		if err != nil {
 			return err
 		}
+		if p.RecordSources && p.tracker != nil && interpolated != source {
+			p.tracker.sources = append(p.tracker.sources, InterpolationSource{Path: path, Source: source})
+		}
 		copy.SetString(interpolated)
 
 	// And everything else will simply be taken from the original
@@ -285,15 +677,79 @@ func (p PipelineParser) interpolateRecursive(copy, original reflect.Value) error
 	return nil
 }
 
+// joinPath adds key to a path like steps[2].env
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
 // PipelineParserResult is the ordered parse tree of a Pipeline document
 type PipelineParserResult struct {
-	pipeline yaml.MapSlice
+	pipeline             yaml.MapSlice
+	referenced           map[string]bool
+	secretInterpolations []SecretInterpolation
+	sources              []InterpolationSource
+}
+
+// InterpolationSource is the text of a value in the pipeline before it was
+// interpolated
+type InterpolationSource struct {
+	Path   string `json:"path" yaml:"path"`
+	Source string `json:"source" yaml:"source"`
+}
+
+// SecretInterpolation is a place in the pipeline that the value of a
+// sensitive variable was interpolated into
+type SecretInterpolation struct {
+	Name string
+	Path string
+}
+
+// InterpolationStats counts the distinct variables referenced while
+// interpolating a pipeline, without recording their names or values
+type InterpolationStats struct {
+	Referenced int
+	Resolved   int
+	Empty      int
+}
+
+// InterpolationStats returns counts of the variables that were referenced
+// while interpolating the pipeline
+func (p *PipelineParserResult) InterpolationStats() InterpolationStats {
+	stats := InterpolationStats{Referenced: len(p.referenced)}
+	for _, empty := range p.referenced {
+		if empty {
+			stats.Empty++
+		}
+	}
+	stats.Resolved = stats.Referenced - stats.Empty
+	return stats
+}
+
+// SecretInterpolations returns where the values of the parser's SecretVars
+// were interpolated into the pipeline
+func (p *PipelineParserResult) SecretInterpolations() []SecretInterpolation {
+	return p.secretInterpolations
+}
+
+// Sources returns the text before interpolation of each value in the pipeline
+// that interpolation changed, if the parser recorded them. The paths are of
+// the pipeline as it was parsed.
+func (p *PipelineParserResult) Sources() []InterpolationSource {
+	return p.sources
 }
 
 func (p *PipelineParserResult) MarshalJSON() ([]byte, error) {
 	return yamltojson.MarshalMapSliceJSON(p.pipeline)
 }
 
+// MarshalYAML marshals the pipeline with its keys in their original order
+func (p *PipelineParserResult) MarshalYAML() (interface{}, error) {
+	return p.pipeline, nil
+}
+
 // topLevelStep is a custom type to support "step or string" which works around
 // an issue where ordered parsing of yaml doesn't work with a top-level slice
 type topLevelStep struct {
@@ -13,7 +13,7 @@ import (
 )
 
 func TestPipelineParserParsesYaml(t *testing.T) {
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Env:      env.FromSlice([]string{`ENV_VAR_FRIEND="friend"`}),
 		Filename: "awesome.yml",
 		Pipeline: []byte("steps:\n  - label: \"hello ${ENV_VAR_FRIEND}\""),
@@ -25,7 +25,7 @@ func TestPipelineParserParsesYaml(t *testing.T) {
 }
 
 func TestPipelineParserParsesYamlWithNoInterpolation(t *testing.T) {
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Filename:        "awesome.yml",
 		Pipeline:        []byte("steps:\n  - label: \"hello ${ENV_VAR_FRIEND}\""),
 		NoInterpolation: true,
@@ -50,7 +50,7 @@ steps:
     agents:
       queue: default`
 
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Filename: "awesome.yml",
 		Pipeline: []byte(complexYAML),
 	}.Parse()
@@ -61,7 +61,7 @@ steps:
 }
 
 func TestPipelineParserReturnsYamlParsingErrors(t *testing.T) {
-	_, err := PipelineParser{
+	_, _, err := PipelineParser{
 		Filename: "awesome.yml",
 		Pipeline: []byte("steps: %blah%"),
 	}.Parse()
@@ -70,7 +70,7 @@ func TestPipelineParserReturnsYamlParsingErrors(t *testing.T) {
 }
 
 func TestPipelineParserReturnsJsonParsingErrors(t *testing.T) {
-	_, err := PipelineParser{
+	_, _, err := PipelineParser{
 		Filename: "awesome.json",
 		Pipeline: []byte("{"),
 	}.Parse()
@@ -79,7 +79,7 @@ func TestPipelineParserReturnsJsonParsingErrors(t *testing.T) {
 }
 
 func TestPipelineParserParsesJson(t *testing.T) {
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Env:      env.FromSlice([]string{`ENV_VAR_FRIEND="friend"`}),
 		Filename: "thing.json",
 		Pipeline: []byte("\n\n     \n  { \"foo\": \"bye ${ENV_VAR_FRIEND}\" }\n"),
@@ -91,7 +91,7 @@ func TestPipelineParserParsesJson(t *testing.T) {
 }
 
 func TestPipelineParserParsesJsonObjects(t *testing.T) {
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Env:      env.FromSlice([]string{`ENV_VAR_FRIEND="friend"`}),
 		Pipeline: []byte("\n\n     \n  { \"foo\": \"bye ${ENV_VAR_FRIEND}\" }\n"),
 	}.Parse()
@@ -102,7 +102,7 @@ func TestPipelineParserParsesJsonObjects(t *testing.T) {
 }
 
 func TestPipelineParserParsesJsonArrays(t *testing.T) {
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Env:      env.FromSlice([]string{`ENV_VAR_FRIEND="friend"`}),
 		Pipeline: []byte("\n\n     \n  [ { \"foo\": \"bye ${ENV_VAR_FRIEND}\" } ]\n"),
 	}.Parse()
@@ -113,7 +113,7 @@ func TestPipelineParserParsesJsonArrays(t *testing.T) {
 }
 
 func TestPipelineParserParsesTopLevelSteps(t *testing.T) {
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Pipeline: []byte("---\n- name: Build\n  command: echo hello world\n- wait\n"),
 	}.Parse()
 
@@ -123,7 +123,7 @@ func TestPipelineParserParsesTopLevelSteps(t *testing.T) {
 }
 
 func TestPipelineParserPreservesBools(t *testing.T) {
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Pipeline: []byte("steps:\n  - trigger: hello\n    async: true"),
 	}.Parse()
 
@@ -133,7 +133,7 @@ func TestPipelineParserPreservesBools(t *testing.T) {
 }
 
 func TestPipelineParserPreservesInts(t *testing.T) {
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Pipeline: []byte("steps:\n  - label: hello\n    parallelism: 10"),
 	}.Parse()
 
@@ -143,7 +143,7 @@ func TestPipelineParserPreservesInts(t *testing.T) {
 }
 
 func TestPipelineParserPreservesNull(t *testing.T) {
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Pipeline: []byte("steps:\n  - wait: ~"),
 	}.Parse()
 
@@ -153,7 +153,7 @@ func TestPipelineParserPreservesNull(t *testing.T) {
 }
 
 func TestPipelineParserPreservesFloats(t *testing.T) {
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Pipeline: []byte("steps:\n  - trigger: hello\n    llamas: 3.142"),
 	}.Parse()
 
@@ -163,7 +163,7 @@ func TestPipelineParserPreservesFloats(t *testing.T) {
 }
 
 func TestPipelineParserHandlesDates(t *testing.T) {
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Pipeline: []byte("steps:\n  - trigger: hello\n    llamas: 2002-08-15T17:18:23.18-06:00"),
 	}.Parse()
 
@@ -184,7 +184,7 @@ func TestPipelineParserInterpolatesKeysAsWellAsValues(t *testing.T) {
 		Env map[string]string `json:"env"`
 	}
 
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Env:      env.FromSlice([]string{`FROM_ENV=llamas`}),
 		Pipeline: []byte(pipeline),
 	}.Parse()
@@ -219,7 +219,7 @@ func TestPipelineParserLoadsGlobalEnvBlockFirst(t *testing.T) {
 		} `json:"steps"`
 	}
 
-	result, err := PipelineParser{
+	result, _, err := PipelineParser{
 		Pipeline: []byte(pipeline),
 		Env:      env.FromSlice([]string{`YEAR_FROM_SHELL=1912`}),
 	}.Parse()
@@ -266,7 +266,7 @@ steps:
     agents:
       queue: xxx`
 
-	result, err := PipelineParser{Pipeline: []byte(pipeline), Env: nil}.Parse()
+	result, _, err := PipelineParser{Pipeline: []byte(pipeline), Env: nil}.Parse()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -290,7 +290,7 @@ func TestPipelineParserParsesConditionalWithEndOfLineAnchorDollarSign(t *testing
 		{false, "steps:\n  - if: build.env(\"ACCOUNT\") =~ /^(foo|bar)\\$/"},
 		{true, "steps:\n  - if: build.env(\"ACCOUNT\") =~ /^(foo|bar)$/"},
 	} {
-		result, err := PipelineParser{
+		result, _, err := PipelineParser{
 			Pipeline:        []byte(row.pipeline),
 			NoInterpolation: row.noInterpolation,
 		}.Parse()
@@ -314,7 +314,7 @@ func TestPipelinePropagatesTracingDataIfAvailable(t *testing.T) {
 		if row.hasExistingEnv {
 			pipelineYaml += "env:\n  ASD: 1"
 		}
-		result, err := PipelineParser{
+		result, _, err := PipelineParser{
 			Pipeline: []byte(pipelineYaml),
 			Env:      e,
 		}.Parse()
@@ -337,3 +337,321 @@ func TestUpsertSliceItem(t *testing.T) {
 	assert.Len(t, y, 2)
 	assert.Equal(t, y[1], yaml.MapItem{Key: "b", Value: 1})
 }
+
+func TestPipelineParserReturnsWarningsForUnsetVariables(t *testing.T) {
+	_, warnings, err := PipelineParser{
+		Env:      env.FromSlice([]string{`FRIEND=llama`}),
+		Pipeline: []byte("steps:\n  - label: \"${FRIEND} ${ENEMY} ${ENEMY} ${OTHER:-default} ${BRANCH:0:3}\""),
+	}.Parse()
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Warning{
+		{Message: "$ENEMY is not set, so it was interpolated as an empty string"},
+		{Message: "$BRANCH is not set, so it was interpolated as an empty string"},
+	}, warnings)
+}
+
+func TestPipelineParserStrict(t *testing.T) {
+	for _, tc := range []struct {
+		pipeline string
+		err      string
+	}{
+		{"steps:\n  - command: echo ${BUILDKITE_BRANCHH}\n", "Failed to parse pipeline.yml: $BUILDKITE_BRANCHH isn't set"},
+		{"steps:\n  - command: echo $FOO $BAR $FOO\n    label: $BAZ\n", "Failed to parse pipeline.yml: $FOO, $BAR, $BAZ aren't set"},
+		{"env:\n  FOO: foo\nsteps:\n  - command: echo $FOO ${BAR:-bar} ${BAZ:+baz} $BUILDKITE_BRANCH\n", ""},
+	} {
+		_, _, err := PipelineParser{
+			Filename: "pipeline.yml",
+			Pipeline: []byte(tc.pipeline),
+			Env:      env.FromSlice([]string{"BUILDKITE_BRANCH=main"}),
+			Strict:   true,
+		}.Parse()
+		if tc.err == "" {
+			assert.NoError(t, err, tc.pipeline)
+		} else {
+			assert.EqualError(t, err, tc.err, tc.pipeline)
+		}
+
+		// Strictness is irrelevant without interpolation
+		_, _, err = PipelineParser{
+			Filename:        "pipeline.yml",
+			Pipeline:        []byte(tc.pipeline),
+			Strict:          true,
+			NoInterpolation: true,
+		}.Parse()
+		assert.NoError(t, err, tc.pipeline)
+	}
+}
+
+func TestPipelineParserInterpolationStats(t *testing.T) {
+	result, _, err := PipelineParser{
+		Env:      env.FromSlice([]string{`FRIEND=llama`, `EMPTY=`}),
+		Pipeline: []byte("steps:\n  - label: \"${FRIEND} ${FRIEND} ${EMPTY} ${ENEMY} ${OTHER:-$FRIEND}\""),
+	}.Parse()
+
+	assert.NoError(t, err)
+	assert.Equal(t, InterpolationStats{Referenced: 4, Resolved: 1, Empty: 3}, result.InterpolationStats())
+}
+
+func TestPipelineParserInterpolatesPositionalArgs(t *testing.T) {
+	result, _, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - command: "deploy $1 ${2} to ${3}nowhere $$1 \\$2 $12"
+    label: "${1}-$USER"
+`),
+		Env:  env.FromSlice([]string{"USER=llama"}),
+		Args: []string{"app", "$HOME"},
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `{"steps":[{"command":"deploy app $HOME to nowhere $1 $2 app2","label":"app-llama"}]}`, string(j))
+}
+
+func TestPipelineParserExpandPositionalArgs(t *testing.T) {
+	args := []string{"one", "two"}
+
+	for s, expected := range map[string]string{
+		"$1 $2 $3":      "one two ",
+		"${1}${2}":      "onetwo",
+		"$$1 \\$1":      "$$1 \\$1",
+		"\\\\$1":        "\\\\one",
+		"${1":           "${1",
+		"${10}":         "",
+		"$0 ${FOO} $":   " ${FOO} $",
+		"cost: $1.50":   "cost: one.50",
+		"$1x ${2}x $2$": "onex twox two$",
+	} {
+		assert.Equal(t, expected, expandPositionalArgs(s, args), s)
+	}
+}
+
+func TestPipelineParserInterpolatesDefaultAndAlternateValues(t *testing.T) {
+	result, _, err := PipelineParser{
+		Pipeline: []byte(`steps:
+  - command: "deploy ${TARGET:-staging} ${DEBUG:+--verbose} ${QUIET:+--quiet}"
+    label: "${DEBUG:+debug ${TARGET:-${FALLBACK:-somewhere}} ${EMPTY:+never}}"
+    env:
+      ESCAPED: "$${DEBUG:+not expanded} \\${DEBUG:+\\$DEBUG}"
+`),
+		Env: env.FromSlice([]string{"DEBUG=1", "EMPTY="}),
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `{"steps":[{"command":"deploy staging --verbose ","label":"debug somewhere ","env":{"ESCAPED":"${DEBUG:+not expanded} ${DEBUG:+$DEBUG}"}}]}`, string(j))
+}
+
+func TestPipelineParserWithVariableProviders(t *testing.T) {
+	result, warnings, err := PipelineParser{
+		Pipeline: []byte(`env:
+  FROM_PIPELINE: pipeline
+steps:
+  - command: "echo $FROM_ENV $FROM_PIPELINE $FROM_FIRST $FROM_SECOND $MISSING"
+`),
+		Env: env.FromSlice([]string{"FROM_ENV=env", "FROM_FIRST=env wins"}),
+		Providers: []VariableProvider{
+			VariableProviderFunc(func(name string) (string, bool) {
+				if strings.HasPrefix(name, "FROM_") {
+					return "first", true
+				}
+				return "", false
+			}),
+			env.FromSlice([]string{"FROM_SECOND=second", "FROM_PIPELINE=second"}),
+		},
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `{"env":{"FROM_PIPELINE":"pipeline"},"steps":[{"command":"echo env pipeline env wins first "}]}`, string(j))
+	assert.Equal(t, []Warning{{Message: "$MISSING is not set, so it was interpolated as an empty string"}}, warnings)
+}
+
+func TestPipelineParserRecordsSecretInterpolations(t *testing.T) {
+	result, _, err := PipelineParser{
+		Pipeline: []byte(`env:
+  DEPLOY_TOKEN: "$API_TOKEN"
+steps:
+  - command: "echo $API_TOKEN"
+    label: "${LABEL:-$API_TOKEN}"
+  - group: deploy
+    steps:
+      - command: "deploy"
+        env:
+          "$API_TOKEN": "${API_TOKEN}"
+  - command: "echo $PUBLIC $EMPTY_SECRET"
+`),
+		Env:        env.FromSlice([]string{"API_TOKEN=hunter2", "PUBLIC=public", "EMPTY_SECRET="}),
+		SecretVars: []string{"API_TOKEN", "EMPTY_SECRET"},
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []SecretInterpolation{
+		{Name: "API_TOKEN", Path: "env.DEPLOY_TOKEN"},
+		{Name: "API_TOKEN", Path: "steps[0].command"},
+		{Name: "API_TOKEN", Path: "steps[0].label"},
+		{Name: "API_TOKEN", Path: "steps[1].steps[0].env.$API_TOKEN"},
+	}, result.SecretInterpolations())
+}
+
+func TestPipelineParserRecordsSources(t *testing.T) {
+	result, _, err := PipelineParser{
+		Pipeline: []byte(`env:
+  GREETING: "hello $NAME"
+steps:
+  - command: "echo $GREETING"
+    label: "unchanged"
+    commands:
+      - "echo $$NAME"
+      - "echo ${NAME}"
+`),
+		Env:           env.FromSlice([]string{"NAME=world"}),
+		RecordSources: true,
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []InterpolationSource{
+		{Path: "env.GREETING", Source: "hello $NAME"},
+		{Path: "steps[0].command", Source: "echo $GREETING"},
+		{Path: "steps[0].commands[0]", Source: "echo $$NAME"},
+		{Path: "steps[0].commands[1]", Source: "echo ${NAME}"},
+	}, result.Sources())
+}
+
+func TestPipelineParserMaxVarLength(t *testing.T) {
+	pipeline := []byte(`steps:
+  - command: "echo $SHORT $LONG $LONG"
+    label: "${UNICODE}"
+`)
+	environ := []string{"SHORT=short", "LONG=0123456789", "UNICODE=ééééé"}
+
+	_, _, err := PipelineParser{
+		Pipeline:     pipeline,
+		Env:          env.FromSlice(environ),
+		MaxVarLength: 8,
+	}.Parse()
+	assert.EqualError(t, err, "Failed to parse pipeline: $LONG is 10 bytes long, $UNICODE is 10 bytes long, which is more than the maximum of 8")
+
+	result, warnings, err := PipelineParser{
+		Pipeline:         pipeline,
+		Env:              env.FromSlice(environ),
+		MaxVarLength:     5,
+		TruncateLongVars: true,
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `{"steps":[{"command":"echo short 01234 01234","label":"éé"}]}`, string(j))
+	assert.Equal(t, []Warning{
+		{Message: "$LONG is 10 bytes long, so it was truncated to the maximum of 5"},
+		{Message: "$UNICODE is 10 bytes long, so it was truncated to the maximum of 5"},
+	}, warnings)
+}
+
+func TestPipelineParserParsesToml(t *testing.T) {
+	yamlPipeline := `env:
+  GREETING: hello ${ENV_VAR_FRIEND}
+steps:
+  - label: ":wave: $GREETING"
+    command: echo $$GREETING
+    parallelism: 2
+    soft_fail: true
+    plugins:
+      docker#v3.7.0:
+        image: golang
+        environment: [FOO, BAR]
+    agents:
+      queue: default
+  - label: deploy
+    command: script/deploy.sh
+`
+
+	tomlPipeline := `[env]
+GREETING = "hello ${ENV_VAR_FRIEND}"
+
+[[steps]]
+label = ":wave: $GREETING"
+command = "echo $$GREETING"
+parallelism = 2
+soft_fail = true
+plugins = { "docker#v3.7.0" = { image = "golang", environment = ["FOO", "BAR"] } }
+
+[steps.agents]
+queue = "default"
+
+[[steps]]
+label = "deploy"
+command = "script/deploy.sh"
+`
+
+	environ := env.FromSlice([]string{"ENV_VAR_FRIEND=friend"})
+
+	yamlResult, _, err := PipelineParser{
+		Env:      environ.Copy(),
+		Filename: "pipeline.yml",
+		Pipeline: []byte(yamlPipeline),
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tomlResult, _, err := PipelineParser{
+		Env:      environ.Copy(),
+		Filename: "pipeline.toml",
+		Pipeline: []byte(tomlPipeline),
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yamlJSON, err := json.Marshal(yamlResult)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tomlJSON, err := json.Marshal(tomlResult)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `{"env":{"GREETING":"hello friend"},"steps":[{"label":":wave: hello friend","command":"echo $GREETING","parallelism":2,"soft_fail":true,"plugins":{"docker#v3.7.0":{"image":"golang","environment":["FOO","BAR"]}},"agents":{"queue":"default"}},{"label":"deploy","command":"script/deploy.sh"}]}`, string(yamlJSON))
+	assert.Equal(t, string(yamlJSON), string(tomlJSON))
+}
+
+func TestPipelineParserReturnsTomlParsingErrors(t *testing.T) {
+	_, _, err := PipelineParser{
+		Filename: "awesome.toml",
+		Pipeline: []byte("steps = [ "),
+	}.Parse()
+
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(err.Error(), "Failed to parse awesome.toml: "), err.Error())
+	}
+}
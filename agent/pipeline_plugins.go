@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// PluginPin is a plugin reference that PinPlugins changed to a pinned version
+type PluginPin struct {
+	Plugin string
+	From   string
+	To     string
+}
+
+// PinPlugins rewrites every reference to a plugin in pins, like docker#v3.0.0,
+// to use the version it's pinned to, and returns the references it changed.
+// It also returns the names of the plugins that aren't pinned, once each.
+func (p *PipelineParserResult) PinPlugins(pins map[string]string) ([]PluginPin, []string) {
+	var changed []PluginPin
+	var unpinned []string
+	seen := map[string]bool{}
+
+	pin := func(ref string) string {
+		name, version := splitPluginReference(ref)
+
+		pinned, ok := pins[name]
+		if !ok {
+			if !seen[name] {
+				seen[name] = true
+				unpinned = append(unpinned, name)
+			}
+			return ref
+		}
+
+		if version == pinned {
+			return ref
+		}
+
+		pinnedRef := name + "#" + pinned
+		changed = append(changed, PluginPin{Plugin: name, From: ref, To: pinnedRef})
+		return pinnedRef
+	}
+
+	p.mapSteps(func(step yaml.MapSlice) yaml.MapSlice {
+		item, ok := mapSliceItem("plugins", step)
+		if !ok {
+			return step
+		}
+		return upsertSliceItem("plugins", step, pinPlugins(item.Value, pin))
+	})
+
+	return changed, unpinned
+}
+
+// pinPlugins replaces the references in a step's plugins, which are either a
+// list of references or single item maps of references to their config, or a
+// map of references to their config
+func pinPlugins(plugins interface{}, pin func(string) string) interface{} {
+	switch value := plugins.(type) {
+	case []interface{}:
+		for i, plugin := range value {
+			value[i] = pinPlugins(plugin, pin)
+		}
+		return value
+
+	case yaml.MapSlice:
+		for i, item := range value {
+			value[i].Key = pin(fmt.Sprint(item.Key))
+		}
+		return value
+
+	case string:
+		return pin(value)
+	}
+
+	return plugins
+}
+
+// splitPluginReference splits a plugin reference into its name and version,
+// which is empty if the reference doesn't have one
+func splitPluginReference(ref string) (string, string) {
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinPlugins(t *testing.T) {
+	result, _, err := PipelineParser{Pipeline: []byte(`steps:
+  - command: make
+    plugins:
+      - docker#v3.0.0:
+          image: golang
+      - my-org/cache
+      - docker-compose#v2.5.1
+  - command: deploy
+    plugins:
+      docker#v5.3.0: {image: alpine}
+      ecr#v1.1.4: {login: true}
+  - group: Tests
+    steps:
+      - command: test
+        plugins:
+          - my-org/cache#v1.0.0
+          - ecr
+`)}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed, unpinned := result.PinPlugins(map[string]string{
+		"docker":       "v5.3.0",
+		"my-org/cache": "v2.0.0",
+	})
+
+	assert.Equal(t, []PluginPin{
+		{Plugin: "docker", From: "docker#v3.0.0", To: "docker#v5.3.0"},
+		{Plugin: "my-org/cache", From: "my-org/cache", To: "my-org/cache#v2.0.0"},
+		{Plugin: "my-org/cache", From: "my-org/cache#v1.0.0", To: "my-org/cache#v2.0.0"},
+	}, changed)
+	assert.Equal(t, []string{"docker-compose", "ecr"}, unpinned)
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `{"steps":[{"command":"make","plugins":[{"docker#v5.3.0":{"image":"golang"}},"my-org/cache#v2.0.0","docker-compose#v2.5.1"]},{"command":"deploy","plugins":{"docker#v5.3.0":{"image":"alpine"},"ecr#v1.1.4":{"login":true}}},{"group":"Tests","steps":[{"command":"test","plugins":["my-org/cache#v2.0.0","ecr"]}]}]}`, string(j))
+}
@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// RedactedValue replaces values masked by RedactPointer
+const RedactedValue = "[REDACTED]"
+
+// RedactPointer masks every value in the pipeline at pointer, or removes it if
+// remove is true, and returns the JSON pointers of the values it found.
+// pointer is a JSON pointer, like /steps/0/env/TOKEN, except that a * segment
+// matches every key of a map or item of a list.
+func (p *PipelineParserResult) RedactPointer(pointer string, remove bool) ([]string, error) {
+	segments, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []string
+	redacted, _ := redactPointer(p.pipeline, segments, "", remove, &matched)
+	p.pipeline = redacted.(yaml.MapSlice)
+
+	return matched, nil
+}
+
+// parsePointer splits a JSON pointer into its unescaped segments
+func parsePointer(pointer string) ([]string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("Invalid pointer %q, pointers must start with /", pointer)
+	}
+	if pointer == "/" {
+		return nil, errors.New("Invalid pointer \"/\", the whole pipeline can't be redacted")
+	}
+
+	segments := strings.Split(pointer[1:], "/")
+	for i, segment := range segments {
+		segments[i] = strings.Replace(strings.Replace(segment, "~1", "/", -1), "~0", "~", -1)
+	}
+	return segments, nil
+}
+
+func escapePointerSegment(segment string) string {
+	return strings.Replace(strings.Replace(segment, "~", "~0", -1), "/", "~1", -1)
+}
+
+// redactPointer returns v with the values at segments below it masked or
+// removed, and whether v itself should be removed
+func redactPointer(v interface{}, segments []string, path string, remove bool, matched *[]string) (interface{}, bool) {
+	if len(segments) == 0 {
+		*matched = append(*matched, path)
+		if remove {
+			return nil, true
+		}
+		return RedactedValue, false
+	}
+
+	segment, rest := segments[0], segments[1:]
+
+	switch value := v.(type) {
+	case yaml.MapSlice:
+		redacted := yaml.MapSlice{}
+		for _, item := range value {
+			key := fmt.Sprint(item.Key)
+			if segment == "*" || segment == key {
+				newValue, removed := redactPointer(item.Value, rest, path+"/"+escapePointerSegment(key), remove, matched)
+				if removed {
+					continue
+				}
+				item = yaml.MapItem{Key: item.Key, Value: newValue}
+			}
+			redacted = append(redacted, item)
+		}
+		return redacted, false
+
+	case []interface{}:
+		redacted := make([]interface{}, 0, len(value))
+		for i, item := range value {
+			if segment == "*" || segment == strconv.Itoa(i) {
+				newValue, removed := redactPointer(item, rest, fmt.Sprintf("%s/%d", path, i), remove, matched)
+				if removed {
+					continue
+				}
+				item = newValue
+			}
+			redacted = append(redacted, item)
+		}
+		return redacted, false
+	}
+
+	// Scalars have nothing below them to match
+	return v, false
+}
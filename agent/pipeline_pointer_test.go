@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const redactPointerPipeline = `env:
+  AWS_SECRET_ACCESS_KEY: top
+steps:
+  - command: one
+    env:
+      AWS_SECRET_ACCESS_KEY: first
+      REGION: us-east-1
+  - wait
+  - command: two
+    env:
+      a/b: slashed
+      AWS_SECRET_ACCESS_KEY: second
+`
+
+func TestRedactPointerMasks(t *testing.T) {
+	result, _, err := PipelineParser{Pipeline: []byte(redactPointerPipeline)}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matched, err := result.RedactPointer("/steps/*/env/AWS_SECRET_ACCESS_KEY", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"/steps/0/env/AWS_SECRET_ACCESS_KEY", "/steps/2/env/AWS_SECRET_ACCESS_KEY"}, matched)
+
+	matched, err = result.RedactPointer("/steps/2/env/a~1b", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"/steps/2/env/a~1b"}, matched)
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `{"env":{"AWS_SECRET_ACCESS_KEY":"top"},"steps":[{"command":"one","env":{"AWS_SECRET_ACCESS_KEY":"[REDACTED]","REGION":"us-east-1"}},"wait",{"command":"two","env":{"a/b":"[REDACTED]","AWS_SECRET_ACCESS_KEY":"[REDACTED]"}}]}`, string(j))
+}
+
+func TestRedactPointerRemoves(t *testing.T) {
+	result, _, err := PipelineParser{Pipeline: []byte(redactPointerPipeline)}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matched, err := result.RedactPointer("/*/AWS_SECRET_ACCESS_KEY", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"/env/AWS_SECRET_ACCESS_KEY"}, matched)
+
+	matched, err = result.RedactPointer("/steps/1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"/steps/1"}, matched)
+
+	matched, err = result.RedactPointer("/steps/*/env/NOPE", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, matched)
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `{"env":{},"steps":[{"command":"one","env":{"AWS_SECRET_ACCESS_KEY":"first","REGION":"us-east-1"}},{"command":"two","env":{"a/b":"slashed","AWS_SECRET_ACCESS_KEY":"second"}}]}`, string(j))
+}
+
+func TestRedactPointerRejectsInvalidPointers(t *testing.T) {
+	result, _, err := PipelineParser{Pipeline: []byte(redactPointerPipeline)}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pointer := range []string{"", "steps/0", "/"} {
+		_, err := result.RedactPointer(pointer, false)
+		assert.Error(t, err, pointer)
+	}
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"fmt"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/interpolate"
+	"github.com/buildkite/yaml"
+)
+
+// MissingReferences scans the pipeline before it's interpolated and returns
+// the variables it references without a default that aren't set, in the order
+// they're first referenced. Variables defined in the pipeline's top-level env
+// block count as set.
+func (p PipelineParser) MissingReferences() ([]string, error) {
+	if p.Env == nil {
+		p.Env = env.New()
+	}
+
+	pipeline, err := p.unmarshal()
+	if err != nil {
+		return nil, err
+	}
+
+	defined := map[string]bool{}
+	if item, ok := mapSliceItem("env", pipeline); ok {
+		if envMap, ok := item.Value.(yaml.MapSlice); ok {
+			for _, envItem := range envMap {
+				defined[fmt.Sprint(envItem.Key)] = true
+			}
+		}
+	}
+
+	s := referenceScanner{
+		variables: p.variables(),
+		defined:   defined,
+		seen:      map[string]bool{},
+	}
+
+	var scan func(v interface{}) error
+	scan = func(v interface{}) error {
+		switch value := v.(type) {
+		case string:
+			if p.Args != nil {
+				value = expandPositionalArgs(value, p.Args)
+			}
+			value, err := env.ExpandAlternates(value, s.variables, nil)
+			if err != nil {
+				return fmt.Errorf("%s: %v", p.errPrefix(), err)
+			}
+			expr, err := interpolate.NewParser(value).Parse()
+			if err != nil {
+				return fmt.Errorf("%s: %v", p.errPrefix(), err)
+			}
+			s.scan(expr)
+		case yaml.MapSlice:
+			for _, item := range value {
+				if err := scan(item.Key); err != nil {
+					return err
+				}
+				if err := scan(item.Value); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for _, item := range value {
+				if err := scan(item); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := scan(pipeline); err != nil {
+		return nil, err
+	}
+
+	return s.missing, nil
+}
+
+// referenceScanner collects the variables an expression needs that aren't set
+type referenceScanner struct {
+	variables VariableProvider
+	defined   map[string]bool
+	seen      map[string]bool
+	missing   []string
+}
+
+func (s *referenceScanner) isSet(name string) bool {
+	if s.defined[name] {
+		return true
+	}
+	_, ok := s.variables.Get(name)
+	return ok
+}
+
+func (s *referenceScanner) scan(expr interpolate.Expression) {
+	for _, item := range expr {
+		switch e := item.Expansion.(type) {
+		case interpolate.VariableExpansion:
+			s.require(e.Identifier)
+		case interpolate.SubstringExpansion:
+			s.require(e.Identifier)
+		case interpolate.RequiredExpansion:
+			s.require(e.Identifier)
+		case interpolate.EmptyValueExpansion:
+			// The default is only needed when the variable is unset or empty,
+			// and we can't know the value of variables from the env block yet
+			if v, _ := s.variables.Get(e.Identifier); v == "" && !s.defined[e.Identifier] {
+				s.scan(e.Content)
+			}
+		case interpolate.UnsetValueExpansion:
+			if !s.isSet(e.Identifier) {
+				s.scan(e.Content)
+			}
+		}
+	}
+}
+
+func (s *referenceScanner) require(name string) {
+	if s.seen[name] || s.isSet(name) {
+		return
+	}
+	s.seen[name] = true
+	s.missing = append(s.missing, name)
+}
@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMissingReferences(t *testing.T) {
+	pipeline := []byte(`env:
+  REGION: ${AWS_REGION:-us-east-1}
+steps:
+  - command: deploy --region $REGION --to ${TARGET} --tag ${TAG:0:7}
+    label: ${MISSING_LABEL?}
+  - command: echo ${OPTIONAL:-$FALLBACK} ${PRESENT:-$NOT_NEEDED} $$ESCAPED
+  - command: echo $TARGET ${EMPTY}
+`)
+
+	missing, err := PipelineParser{
+		Env:      env.FromSlice([]string{"PRESENT=yes", "EMPTY="}),
+		Pipeline: pipeline,
+	}.MissingReferences()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"TARGET", "TAG", "MISSING_LABEL", "FALLBACK"}, missing)
+}
+
+func TestMissingReferencesUsesProviders(t *testing.T) {
+	missing, err := PipelineParser{
+		Env:      env.New(),
+		Pipeline: []byte("steps:\n  - command: echo $FROM_PROVIDER $NOPE\n"),
+		Providers: []VariableProvider{
+			VariableProviderFunc(func(name string) (string, bool) {
+				return "value", name == "FROM_PROVIDER"
+			}),
+		},
+	}.MissingReferences()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"NOPE"}, missing)
+}
+
+func TestMissingReferencesReturnsInterpolationErrors(t *testing.T) {
+	_, err := PipelineParser{
+		Pipeline: []byte("steps:\n  - command: echo ${BROKEN\n"),
+	}.MissingReferences()
+	assert.Error(t, err)
+}
@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/qri-io/jsonschema"
+)
+
+// PipelineSchemaVersion is bumped whenever the rules in PipelineSchema change
+// in a way that could affect which pipelines validate against it
+const PipelineSchemaVersion = 1
+
+// PipelineSchema is the JSON Schema that parsed pipelines are checked against
+// when validating locally. It's deliberately a little more permissive than the
+// Buildkite API, which remains the source of truth for what is accepted.
+const PipelineSchema = `{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "description": "buildkite-agent pipeline schema version 1",
+  "title": "Buildkite pipeline",
+  "type": "object",
+  "required": ["steps"],
+  "properties": {
+    "env": { "$ref": "#/definitions/env" },
+    "agents": { "$ref": "#/definitions/agents" },
+    "notify": { "type": "array" },
+    "steps": { "$ref": "#/definitions/steps" }
+  },
+  "definitions": {
+    "env": {
+      "type": "object",
+      "additionalProperties": { "type": ["string", "number", "boolean"] }
+    },
+    "agents": {
+      "oneOf": [
+        { "type": "object" },
+        { "type": "array", "items": { "type": "string" } }
+      ]
+    },
+    "dependsOn": {
+      "oneOf": [
+        { "type": "null" },
+        { "type": "string" },
+        {
+          "type": "array",
+          "items": {
+            "oneOf": [
+              { "type": "string" },
+              {
+                "type": "object",
+                "required": ["step"],
+                "properties": {
+                  "step": { "type": "string" },
+                  "allow_failure": { "type": "boolean" }
+                }
+              }
+            ]
+          }
+        }
+      ]
+    },
+    "steps": {
+      "type": "array",
+      "items": { "$ref": "#/definitions/step" }
+    },
+    "step": {
+      "oneOf": [
+        { "type": "string", "enum": ["wait", "waiter", "block", "input"] },
+        { "$ref": "#/definitions/commandStep" },
+        { "$ref": "#/definitions/waitStep" },
+        { "$ref": "#/definitions/blockStep" },
+        { "$ref": "#/definitions/inputStep" },
+        { "$ref": "#/definitions/triggerStep" },
+        { "$ref": "#/definitions/groupStep" }
+      ]
+    },
+    "commandStep": {
+      "type": "object",
+      "anyOf": [
+        { "required": ["command"] },
+        { "required": ["commands"] },
+        { "required": ["plugins"] },
+        { "properties": { "type": { "enum": ["script", "command", "commands"] } }, "required": ["type"] }
+      ],
+      "properties": {
+        "type": { "type": "string" },
+        "label": { "type": "string" },
+        "name": { "type": "string" },
+        "key": { "type": "string" },
+        "identifier": { "type": "string" },
+        "id": { "type": "string" },
+        "command": { "type": ["string", "array"] },
+        "commands": { "type": ["string", "array"] },
+        "env": { "$ref": "#/definitions/env" },
+        "agents": { "$ref": "#/definitions/agents" },
+        "plugins": { "type": ["array", "object"] },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "artifact_paths": { "type": ["string", "array"] },
+        "branches": { "type": ["string", "array"] },
+        "if": { "type": "string" },
+        "concurrency": { "type": "integer" },
+        "concurrency_group": { "type": "string" },
+        "parallelism": { "type": "integer" },
+        "matrix": { "type": ["array", "object"] },
+        "retry": { "type": "object" },
+        "skip": { "type": ["string", "boolean"] },
+        "soft_fail": { "type": ["boolean", "array"] },
+        "timeout_in_minutes": { "type": "integer", "minimum": 1 },
+        "priority": { "type": "integer" },
+        "cancel_on_build_failing": { "type": "boolean" },
+        "notify": { "type": "array" }
+      },
+      "additionalProperties": false
+    },
+    "waitStep": {
+      "type": "object",
+      "required": ["wait"],
+      "properties": {
+        "wait": { "type": ["string", "null"] },
+        "key": { "type": "string" },
+        "if": { "type": "string" },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "continue_on_failure": { "type": "boolean" },
+        "type": { "type": "string" }
+      },
+      "additionalProperties": false
+    },
+    "blockStep": {
+      "type": "object",
+      "required": ["block"],
+      "properties": {
+        "block": { "type": "string" },
+        "key": { "type": "string" },
+        "prompt": { "type": "string" },
+        "fields": { "type": "array" },
+        "branches": { "type": ["string", "array"] },
+        "if": { "type": "string" },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "blocked_state": { "type": "string", "enum": ["passed", "failed", "running"] },
+        "type": { "type": "string" }
+      },
+      "additionalProperties": false
+    },
+    "inputStep": {
+      "type": "object",
+      "required": ["input"],
+      "properties": {
+        "input": { "type": "string" },
+        "key": { "type": "string" },
+        "prompt": { "type": "string" },
+        "fields": { "type": "array" },
+        "branches": { "type": ["string", "array"] },
+        "if": { "type": "string" },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "type": { "type": "string" }
+      },
+      "additionalProperties": false
+    },
+    "triggerStep": {
+      "type": "object",
+      "required": ["trigger"],
+      "properties": {
+        "trigger": { "type": "string" },
+        "label": { "type": "string" },
+        "key": { "type": "string" },
+        "async": { "type": "boolean" },
+        "build": { "type": "object" },
+        "branches": { "type": ["string", "array"] },
+        "if": { "type": "string" },
+        "skip": { "type": ["string", "boolean"] },
+        "soft_fail": { "type": ["boolean", "array"] },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "type": { "type": "string" }
+      },
+      "additionalProperties": false
+    },
+    "groupStep": {
+      "type": "object",
+      "required": ["group", "steps"],
+      "properties": {
+        "group": { "type": ["string", "null"] },
+        "label": { "type": "string" },
+        "key": { "type": "string" },
+        "if": { "type": "string" },
+        "depends_on": { "$ref": "#/definitions/dependsOn" },
+        "allow_dependency_failure": { "type": "boolean" },
+        "notify": { "type": "array" },
+        "steps": { "$ref": "#/definitions/steps" }
+      },
+      "additionalProperties": false
+    }
+  }
+}
+`
+
+// ValidateSchema checks the pipeline against PipelineSchema and returns a
+// description of each place it doesn't conform
+func (p *PipelineParserResult) ValidateSchema() ([]string, error) {
+	schema := &jsonschema.RootSchema{}
+	if err := json.Unmarshal([]byte(PipelineSchema), schema); err != nil {
+		return nil, fmt.Errorf("Failed to load pipeline schema: %v", err)
+	}
+
+	j, err := p.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	errs, err := schema.ValidateBytes(j)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations []string
+	for _, e := range errs {
+		violations = append(violations, e.Error())
+	}
+
+	return violations, nil
+}
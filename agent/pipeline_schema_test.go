@@ -0,0 +1,33 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/qri-io/jsonschema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineSchemaIsValidJSONSchema(t *testing.T) {
+	rs := &jsonschema.RootSchema{}
+	if err := json.Unmarshal([]byte(PipelineSchema), rs); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, err := rs.ValidateBytes([]byte(`{"steps":["wait",{"command":"make test"},{"group":"tests","steps":[{"commands":["make"]}]}]}`))
+	assert.NoError(t, err)
+	assert.Empty(t, errs)
+
+	errs, err = rs.ValidateBytes([]byte(`{"steps":[{"comand":"make test"}]}`))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, errs)
+}
+
+func TestPipelineParserResultValidateSchema(t *testing.T) {
+	result := parsePipelineForTest(t, "steps:\n  - command: make\n  - comand: make test\n")
+
+	violations, err := result.ValidateSchema()
+	assert.NoError(t, err)
+	assert.Len(t, violations, 1)
+	assert.Contains(t, violations[0], "/steps/1")
+}
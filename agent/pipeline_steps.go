@@ -0,0 +1,441 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/buildkite/yaml"
+)
+
+// StepDefaults are values that are added to command steps that don't already
+// specify them. Zero values are ignored.
+type StepDefaults struct {
+	// The default timeout_in_minutes for command steps
+	TimeoutInMinutes int
+
+	// The default number of automatic retries for command steps
+	RetryLimit int
+}
+
+// Validate checks that the defaults are values the Buildkite API will accept
+func (d StepDefaults) Validate() error {
+	if d.TimeoutInMinutes < 0 {
+		return fmt.Errorf("Default step timeout must be a positive number of minutes, got %d", d.TimeoutInMinutes)
+	}
+	if d.RetryLimit < 0 || d.RetryLimit > 10 {
+		return fmt.Errorf("Default step retry limit must be between 0 and 10, got %d", d.RetryLimit)
+	}
+	return nil
+}
+
+// ApplyStepDefaults adds the defaults to every command step in the pipeline
+// (including those nested in groups) that doesn't set its own value, and
+// returns how many steps were changed
+func (p *PipelineParserResult) ApplyStepDefaults(d StepDefaults) int {
+	changed := 0
+
+	p.mapSteps(func(step yaml.MapSlice) yaml.MapSlice {
+		if stepType(step) != "command" {
+			return step
+		}
+
+		before := len(step)
+
+		if _, ok := mapSliceItem("timeout_in_minutes", step); !ok && d.TimeoutInMinutes > 0 {
+			step = append(step, yaml.MapItem{Key: "timeout_in_minutes", Value: d.TimeoutInMinutes})
+		}
+
+		if _, ok := mapSliceItem("retry", step); !ok && d.RetryLimit > 0 {
+			step = append(step, yaml.MapItem{Key: "retry", Value: yaml.MapSlice{
+				{Key: "automatic", Value: yaml.MapSlice{
+					{Key: "limit", Value: d.RetryLimit},
+				}},
+			}})
+		}
+
+		if len(step) != before {
+			changed++
+		}
+
+		return step
+	})
+
+	return changed
+}
+
+// CapStepTimeouts lowers the timeout_in_minutes of every command step in the
+// pipeline (including those nested in groups) that's more than max to max, and
+// returns a description of each step it lowered. If setUnset is true, steps
+// without a timeout are given a timeout of max too.
+func (p *PipelineParserResult) CapStepTimeouts(max int, setUnset bool) []string {
+	var lowered []string
+
+	p.mapSteps(func(step yaml.MapSlice) yaml.MapSlice {
+		if stepType(step) != "command" {
+			return step
+		}
+
+		item, ok := mapSliceItem("timeout_in_minutes", step)
+		if !ok {
+			if setUnset {
+				step = append(step, yaml.MapItem{Key: "timeout_in_minutes", Value: max})
+			}
+			return step
+		}
+
+		timeout, ok := stepTimeout(item.Value)
+		if !ok || timeout <= float64(max) {
+			return step
+		}
+
+		lowered = append(lowered, fmt.Sprintf("The timeout of step %s was lowered from %v to the maximum of %d minutes",
+			stepName(step), item.Value, max))
+		return upsertSliceItem("timeout_in_minutes", step, max)
+	})
+
+	return lowered
+}
+
+// stepTimeout returns a timeout_in_minutes as a number, which can be a string
+// if it was interpolated
+func stepTimeout(v interface{}) (float64, bool) {
+	switch timeout := v.(type) {
+	case int:
+		return float64(timeout), true
+	case uint64:
+		return float64(timeout), true
+	case float64:
+		return timeout, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(timeout), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// PropagateEnv adds each variable in names to the env of every command step
+// in the pipeline (including those nested in groups) with its value from
+// values, as a literal that isn't interpolated again. Steps keep their own
+// value of a variable, and variables without a value are skipped. It returns
+// how many steps were changed.
+func (p *PipelineParserResult) PropagateEnv(names []string, values map[string]string) int {
+	changed := 0
+
+	p.mapSteps(func(step yaml.MapSlice) yaml.MapSlice {
+		if stepType(step) != "command" {
+			return step
+		}
+
+		stepEnv := yaml.MapSlice{}
+		if item, ok := mapSliceItem("env", step); ok {
+			if stepEnv, ok = item.Value.(yaml.MapSlice); !ok {
+				return step
+			}
+		}
+
+		before := len(stepEnv)
+		for _, name := range names {
+			value, ok := values[name]
+			if !ok {
+				continue
+			}
+			if _, ok := mapSliceItem(name, stepEnv); !ok {
+				stepEnv = append(stepEnv, yaml.MapItem{Key: name, Value: value})
+			}
+		}
+
+		if len(stepEnv) == before {
+			return step
+		}
+
+		changed++
+		return upsertSliceItem("env", step, stepEnv)
+	})
+
+	return changed
+}
+
+// SortSteps sorts the top-level steps of the pipeline by the value of field.
+// Wait and block steps stay where they are and steps are only sorted between
+// them, so that they still wait for the same steps. Numbers sort before
+// strings, and steps without the field keep their relative order after those
+// with it.
+func (p *PipelineParserResult) SortSteps(field string) {
+	item, ok := mapSliceItem("steps", p.pipeline)
+	if !ok {
+		return
+	}
+
+	steps, ok := item.Value.([]interface{})
+	if !ok {
+		return
+	}
+
+	start := 0
+	for i := 0; i <= len(steps); i++ {
+		if i < len(steps) && !isBarrierStep(steps[i]) {
+			continue
+		}
+
+		segment := steps[start:i]
+		sort.SliceStable(segment, func(a, b int) bool {
+			return stepSortsBefore(segment[a], segment[b], field)
+		})
+		start = i + 1
+	}
+}
+
+// isBarrierStep returns whether a step stops later steps from running until
+// the steps before it have finished
+func isBarrierStep(s interface{}) bool {
+	switch step := s.(type) {
+	case string:
+		return step == "wait" || step == "waiter" || step == "block"
+	case yaml.MapSlice:
+		t := stepType(step)
+		return t == "wait" || t == "block"
+	}
+	return false
+}
+
+func stepSortsBefore(a, b interface{}, field string) bool {
+	av, aok := stepSortValue(a, field)
+	bv, bok := stepSortValue(b, field)
+	if !aok || !bok {
+		return aok && !bok
+	}
+
+	an, aNumber := av.(float64)
+	bn, bNumber := bv.(float64)
+	switch {
+	case aNumber && bNumber:
+		return an < bn
+	case aNumber != bNumber:
+		return aNumber
+	}
+
+	return fmt.Sprint(av) < fmt.Sprint(bv)
+}
+
+// stepSortValue returns the value of field in a step, with all numbers as
+// float64 so that they compare with each other
+func stepSortValue(s interface{}, field string) (interface{}, bool) {
+	step, ok := s.(yaml.MapSlice)
+	if !ok {
+		return nil, false
+	}
+
+	item, ok := mapSliceItem(field, step)
+	if !ok || item.Value == nil {
+		return nil, false
+	}
+
+	switch v := item.Value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+
+	return item.Value, true
+}
+
+// RemoveSteps removes the top-level steps at the given indexes from the
+// pipeline. Indexes past the last step are ignored.
+func (p *PipelineParserResult) RemoveSteps(indexes []int) {
+	item, ok := mapSliceItem("steps", p.pipeline)
+	if !ok {
+		return
+	}
+
+	steps, ok := item.Value.([]interface{})
+	if !ok {
+		return
+	}
+
+	remove := map[int]bool{}
+	for _, i := range indexes {
+		remove[i] = true
+	}
+
+	kept := make([]interface{}, 0, len(steps))
+	for i, step := range steps {
+		if !remove[i] {
+			kept = append(kept, step)
+		}
+	}
+
+	p.pipeline = upsertSliceItem("steps", p.pipeline, kept)
+}
+
+// DefaultMaxLabelLength is the default longest label, in characters, that
+// steps are allowed before they're reported by CheckLabelLengths
+const DefaultMaxLabelLength = 1024
+
+// labelAttributes are the step attributes that are shown as its label
+var labelAttributes = []string{"label", "name", "group"}
+
+// CheckLabelLengths returns a description of each step in the pipeline
+// (including those nested in groups) with a label longer than max characters.
+// If truncate is true, those labels are shortened to max characters.
+func (p *PipelineParserResult) CheckLabelLengths(max int, truncate bool) []string {
+	var problems []string
+
+	p.mapSteps(func(step yaml.MapSlice) yaml.MapSlice {
+		for _, attr := range labelAttributes {
+			item, ok := mapSliceItem(attr, step)
+			if !ok {
+				continue
+			}
+
+			label, ok := item.Value.(string)
+			if !ok || utf8.RuneCountInString(label) <= max {
+				continue
+			}
+
+			problems = append(problems, fmt.Sprintf("The %s of step %s is %d characters long, which is more than the maximum of %d",
+				attr, stepName(step), utf8.RuneCountInString(label), max))
+
+			if truncate {
+				step = upsertSliceItem(attr, step, string([]rune(label)[:max]))
+			}
+		}
+		return step
+	})
+
+	return problems
+}
+
+// SelfTriggerSteps returns a description of each trigger step in the pipeline
+// (including those nested in groups) that triggers the pipeline with the
+// given slug, which would start a new build of the pipeline every time
+func (p *PipelineParserResult) SelfTriggerSteps(slug string) []string {
+	var names []string
+
+	p.mapSteps(func(step yaml.MapSlice) yaml.MapSlice {
+		if stepType(step) == "trigger" {
+			if item, ok := mapSliceItem("trigger", step); ok && item.Value == slug {
+				names = append(names, stepName(step))
+			}
+		}
+		return step
+	})
+
+	return names
+}
+
+// mapSteps calls fn with every step in the pipeline that is a map, descending
+// into the steps of group steps, and replaces the step with what fn returns
+func (p *PipelineParserResult) mapSteps(fn func(yaml.MapSlice) yaml.MapSlice) {
+	item, ok := mapSliceItem("steps", p.pipeline)
+	if !ok {
+		return
+	}
+
+	if steps, ok := item.Value.([]interface{}); ok {
+		p.pipeline = upsertSliceItem("steps", p.pipeline, mapSteps(steps, fn))
+	}
+}
+
+func mapSteps(steps []interface{}, fn func(yaml.MapSlice) yaml.MapSlice) []interface{} {
+	for i, s := range steps {
+		step, ok := s.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+
+		// Group steps have their own steps, which get mapped before the
+		// group itself
+		if stepType(step) == "group" {
+			if item, ok := mapSliceItem("steps", step); ok {
+				if groupSteps, ok := item.Value.([]interface{}); ok {
+					step = upsertSliceItem("steps", step, mapSteps(groupSteps, fn))
+				}
+			}
+		}
+
+		steps[i] = fn(step)
+	}
+
+	return steps
+}
+
+// flatMapSteps is like mapSteps, but replaces each step with all of the steps
+// that fn returns, and stops at the first error
+func (p *PipelineParserResult) flatMapSteps(fn func(yaml.MapSlice) ([]interface{}, error)) error {
+	item, ok := mapSliceItem("steps", p.pipeline)
+	if !ok {
+		return nil
+	}
+
+	steps, ok := item.Value.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	mapped, err := flatMapSteps(steps, fn)
+	if err != nil {
+		return err
+	}
+
+	p.pipeline = upsertSliceItem("steps", p.pipeline, mapped)
+	return nil
+}
+
+func flatMapSteps(steps []interface{}, fn func(yaml.MapSlice) ([]interface{}, error)) ([]interface{}, error) {
+	mapped := make([]interface{}, 0, len(steps))
+
+	for _, s := range steps {
+		step, ok := s.(yaml.MapSlice)
+		if !ok {
+			mapped = append(mapped, s)
+			continue
+		}
+
+		if stepType(step) == "group" {
+			if item, ok := mapSliceItem("steps", step); ok {
+				if groupSteps, ok := item.Value.([]interface{}); ok {
+					groupMapped, err := flatMapSteps(groupSteps, fn)
+					if err != nil {
+						return nil, err
+					}
+					step = upsertSliceItem("steps", step, groupMapped)
+				}
+			}
+		}
+
+		out, err := fn(step)
+		if err != nil {
+			return nil, err
+		}
+		mapped = append(mapped, out...)
+	}
+
+	return mapped, nil
+}
+
+// stepType returns what kind of step a step map describes, which is one of
+// command, wait, block, input, trigger or group
+func stepType(step yaml.MapSlice) string {
+	for _, t := range []string{"wait", "block", "input", "trigger", "group"} {
+		if _, ok := mapSliceItem(t, step); ok {
+			return t
+		}
+	}
+
+	if item, ok := mapSliceItem("type", step); ok {
+		switch item.Value {
+		case "wait", "waiter":
+			return "wait"
+		case "block", "manual":
+			return "block"
+		case "input", "trigger":
+			return item.Value.(string)
+		}
+	}
+
+	return "command"
+}
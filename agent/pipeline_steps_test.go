@@ -0,0 +1,308 @@
+package agent
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parsePipelineForTest(t *testing.T, pipeline string) *PipelineParserResult {
+	t.Helper()
+
+	result, _, err := PipelineParser{
+		Filename:        "pipeline.yml",
+		Pipeline:        []byte(pipeline),
+		NoInterpolation: true,
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestApplyStepDefaults(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - command: make
+  - command: make slow
+    timeout_in_minutes: 60
+    retry: {manual: false}
+  - wait
+  - block: deploy?
+  - group: tests
+    steps:
+      - command: make test
+`)
+
+	changed := result.ApplyStepDefaults(StepDefaults{TimeoutInMinutes: 10, RetryLimit: 2})
+	assert.Equal(t, 2, changed)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[`+
+		`{"command":"make","timeout_in_minutes":10,"retry":{"automatic":{"limit":2}}},`+
+		`{"command":"make slow","timeout_in_minutes":60,"retry":{"manual":false}},`+
+		`"wait",`+
+		`{"block":"deploy?"},`+
+		`{"group":"tests","steps":[{"command":"make test","timeout_in_minutes":10,"retry":{"automatic":{"limit":2}}}]}`+
+		`]}`, string(j))
+}
+
+func TestStepDefaultsValidate(t *testing.T) {
+	assert.NoError(t, StepDefaults{}.Validate())
+	assert.NoError(t, StepDefaults{TimeoutInMinutes: 30, RetryLimit: 3}.Validate())
+	assert.Error(t, StepDefaults{TimeoutInMinutes: -1}.Validate())
+	assert.Error(t, StepDefaults{RetryLimit: 11}.Validate())
+}
+
+// parseTOMLPipelineForTest is like parsePipelineForTest, for TOML pipelines
+func parseTOMLPipelineForTest(t *testing.T, pipeline string) *PipelineParserResult {
+	t.Helper()
+
+	result, _, err := PipelineParser{
+		Filename:        "pipeline.toml",
+		Pipeline:        []byte(pipeline),
+		NoInterpolation: true,
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result
+}
+
+func TestCapStepTimeouts(t *testing.T) {
+	pipeline := `steps:
+  - command: make
+  - command: make slow
+    key: slow
+    timeout_in_minutes: 120
+  - command: make quick
+    timeout_in_minutes: 5
+  - command: make interpolated
+    timeout_in_minutes: "90"
+  - wait
+  - group: tests
+    steps:
+      - label: Tests
+        command: make test
+        timeout_in_minutes: 61
+`
+
+	result := parsePipelineForTest(t, pipeline)
+	lowered := result.CapStepTimeouts(60, false)
+	assert.Equal(t, []string{
+		`The timeout of step "slow" was lowered from 120 to the maximum of 60 minutes`,
+		`The timeout of step with command "make interpolated" was lowered from 90 to the maximum of 60 minutes`,
+		`The timeout of step "Tests" was lowered from 61 to the maximum of 60 minutes`,
+	}, lowered)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[`+
+		`{"command":"make"},`+
+		`{"command":"make slow","key":"slow","timeout_in_minutes":60},`+
+		`{"command":"make quick","timeout_in_minutes":5},`+
+		`{"command":"make interpolated","timeout_in_minutes":60},`+
+		`"wait",`+
+		`{"group":"tests","steps":[{"label":"Tests","command":"make test","timeout_in_minutes":60}]}`+
+		`]}`, string(j))
+
+	result = parsePipelineForTest(t, pipeline)
+	result.CapStepTimeouts(60, true)
+
+	j, err = json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Contains(t, string(j), `{"command":"make","timeout_in_minutes":60}`)
+	assert.Contains(t, string(j), `{"command":"make quick","timeout_in_minutes":5}`)
+}
+
+func TestCapStepTimeoutsToml(t *testing.T) {
+	result := parseTOMLPipelineForTest(t, `[[steps]]
+command = "make slow"
+timeout_in_minutes = 100
+
+[[steps]]
+command = "make quick"
+timeout_in_minutes = 5
+`)
+
+	lowered := result.CapStepTimeouts(30, false)
+	assert.Equal(t, []string{
+		`The timeout of step with command "make slow" was lowered from 100 to the maximum of 30 minutes`,
+	}, lowered)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[{"command":"make slow","timeout_in_minutes":30},{"command":"make quick","timeout_in_minutes":5}]}`, string(j))
+}
+
+func TestPropagateEnv(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - command: make
+  - command: make deploy
+    env:
+      REGION: eu-west-1
+  - wait
+  - trigger: other
+  - group: tests
+    steps:
+      - command: make test
+        env:
+          RELEASE: "1"
+`)
+
+	changed := result.PropagateEnv([]string{"REGION", "UNSET", "RELEASE"}, map[string]string{
+		"REGION":  "us-east-1",
+		"RELEASE": "$2.0",
+	})
+	assert.Equal(t, 3, changed)
+
+	j, err := json.Marshal(result)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"steps":[`+
+		`{"command":"make","env":{"REGION":"us-east-1","RELEASE":"$2.0"}},`+
+		`{"command":"make deploy","env":{"REGION":"eu-west-1","RELEASE":"$2.0"}},`+
+		`"wait",`+
+		`{"trigger":"other"},`+
+		`{"group":"tests","steps":[{"command":"make test","env":{"RELEASE":"1","REGION":"us-east-1"}}]}`+
+		`]}`, string(j))
+}
+
+func TestSortSteps(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - command: c
+    order: 3
+  - command: unordered 1
+  - command: a
+    order: 1
+  - command: b
+    order: 2.5
+  - command: unordered 2
+  - command: named
+    order: first
+  - wait
+  - command: e
+    order: 2
+  - command: d
+    order: 1
+`)
+
+	result.SortSteps("order")
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"steps": [
+		{"command": "a", "order": 1},
+		{"command": "b", "order": 2.5},
+		{"command": "c", "order": 3},
+		{"command": "named", "order": "first"},
+		{"command": "unordered 1"},
+		{"command": "unordered 2"},
+		"wait",
+		{"command": "d", "order": 1},
+		{"command": "e", "order": 2}
+	]}`, string(j))
+}
+
+func TestSortStepsToml(t *testing.T) {
+	result := parseTOMLPipelineForTest(t, `[[steps]]
+command = "ten"
+order = 10
+
+[[steps]]
+command = "nine"
+order = 9
+
+[[steps]]
+command = "half"
+order = 9.5
+`)
+
+	result.SortSteps("order")
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"steps": [
+		{"command": "nine", "order": 9},
+		{"command": "half", "order": 9.5},
+		{"command": "ten", "order": 10}
+	]}`, string(j))
+}
+
+func TestRemoveSteps(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - command: a
+  - wait
+  - command: b
+  - command: c
+`)
+
+	result.RemoveSteps([]int{0, 2, 10})
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"steps": ["wait", {"command": "c"}]}`, string(j))
+}
+
+func TestSelfTriggerSteps(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - trigger: deploy
+  - trigger: my-pipeline
+    label: again
+  - group: nested
+    steps:
+      - trigger: my-pipeline
+        key: nested-again
+  - command: my-pipeline
+`)
+
+	assert.Equal(t, []string{`"again"`, `"nested-again"`}, result.SelfTriggerSteps("my-pipeline"))
+	assert.Empty(t, result.SelfTriggerSteps("other-pipeline"))
+}
+
+func TestCheckLabelLengths(t *testing.T) {
+	result := parsePipelineForTest(t, `steps:
+  - command: a
+    label: ":llama: llamas"
+  - command: b
+    label: short
+  - group: "grouped llamas"
+    steps:
+      - command: c
+        name: "named llamas"
+        key: c
+`)
+
+	assert.Equal(t, []string{
+		`The label of step ":llama: llamas" is 14 characters long, which is more than the maximum of 10`,
+		`The name of step "c" is 12 characters long, which is more than the maximum of 10`,
+		`The group of step "grouped llamas" is 14 characters long, which is more than the maximum of 10`,
+	}, result.CheckLabelLengths(10, false))
+
+	assert.Len(t, result.CheckLabelLengths(10, true), 3)
+	assert.Empty(t, result.CheckLabelLengths(10, false))
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"steps": [
+		{"command": "a", "label": ":llama: ll"},
+		{"command": "b", "label": "short"},
+		{"group": "grouped ll", "steps": [
+			{"command": "c", "name": "named llam", "key": "c"}
+		]}
+	]}`, string(j))
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/buildkite/yaml"
+)
+
+// isTOMLFile returns whether a pipeline file should be parsed as TOML, based
+// on its extension
+func isTOMLFile(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".toml")
+}
+
+// unmarshalTOML parses a TOML pipeline into the same MapSlice representation
+// that YAML and JSON pipelines use. TOML decodes to maps, so the order of keys
+// is rebuilt from the order they appear in the document.
+func unmarshalTOML(data []byte) (yaml.MapSlice, error) {
+	var decoded map[string]interface{}
+	md, err := toml.Decode(string(data), &decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	order := map[string]int{}
+	for i, key := range md.Keys() {
+		path := key.String()
+		if _, ok := order[path]; !ok {
+			order[path] = i
+		}
+	}
+
+	return tomlMapSlice(decoded, "", order), nil
+}
+
+// tomlMapSlice converts a decoded TOML table at path to a MapSlice, ordering
+// its keys by where they first appear in the document
+func tomlMapSlice(table map[string]interface{}, path string, order map[string]int) yaml.MapSlice {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+
+	position := func(k string) int {
+		if i, ok := order[tomlKeyPath(path, k)]; ok {
+			return i
+		}
+		return len(order)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		pi, pj := position(keys[i]), position(keys[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return keys[i] < keys[j]
+	})
+
+	s := make(yaml.MapSlice, 0, len(keys))
+	for _, k := range keys {
+		s = append(s, yaml.MapItem{
+			Key:   k,
+			Value: tomlValue(table[k], tomlKeyPath(path, k), order),
+		})
+	}
+	return s
+}
+
+// tomlValue converts a decoded TOML value at path, recursing into tables and
+// arrays. Tables in an array of tables share the array's path.
+func tomlValue(v interface{}, path string, order map[string]int) interface{} {
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		return tomlMapSlice(tv, path, order)
+	case []map[string]interface{}:
+		values := make([]interface{}, len(tv))
+		for i, table := range tv {
+			values[i] = tomlMapSlice(table, path, order)
+		}
+		return values
+	case []interface{}:
+		values := make([]interface{}, len(tv))
+		for i, item := range tv {
+			values[i] = tomlValue(item, path, order)
+		}
+		return values
+	case int64:
+		// YAML decodes integers as int, which is what the rest of the agent
+		// expects of numbers like timeout_in_minutes
+		if int64(int(tv)) == tv {
+			return int(tv)
+		}
+		return tv
+	default:
+		return v
+	}
+}
+
+// tomlKeyPath joins a key onto a dotted path the same way toml.Key.String
+// does, so it can be looked up in the document's key order
+func tomlKeyPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -101,7 +101,9 @@ func (t *tagFetcher) Fetch(l logger.Logger, conf FetchTagsConfig) []string {
 			}
 
 			return err
-		}, &retry.Config{Maximum: 5, Interval: conf.WaitForEC2MetaDataTimeout / 5, Jitter: true})
+			// Six attempts have five waits between them, which together take
+			// the whole timeout
+		}, &retry.Config{Maximum: 6, Interval: conf.WaitForEC2MetaDataTimeout / 5, Jitter: true})
 
 		// Don't blow up if we can't find them, just show a nasty error.
 		if err != nil {
@@ -148,7 +150,7 @@ func (t *tagFetcher) Fetch(l logger.Logger, conf FetchTagsConfig) []string {
 				s.Break()
 			}
 			return err
-		}, &retry.Config{Maximum: 5, Interval: conf.WaitForEC2TagsTimeout / 5, Jitter: true})
+		}, &retry.Config{Maximum: 6, Interval: conf.WaitForEC2TagsTimeout / 5, Jitter: true})
 
 		// Don't blow up if we can't find them, just show a nasty error.
 		if err != nil {
@@ -217,7 +219,7 @@ func (t *tagFetcher) Fetch(l logger.Logger, conf FetchTagsConfig) []string {
 				s.Break()
 			}
 			return err
-		}, &retry.Config{Maximum: 5, Interval: conf.WaitForGCPLabelsTimeout / 5, Jitter: true})
+		}, &retry.Config{Maximum: 6, Interval: conf.WaitForGCPLabelsTimeout / 5, Jitter: true})
 
 		// Don't blow up if we can't find them, just show a nasty error.
 		if err != nil {
@@ -2,6 +2,8 @@ package api
 
 import (
 	"fmt"
+	"io"
+	"net/http"
 	"time"
 )
 
@@ -147,3 +149,37 @@ func (c *Client) SearchArtifacts(buildId string, opt *ArtifactSearchOptions) ([]
 
 	return a, resp, err
 }
+
+// DownloadArtifact writes the contents of an artifact stored by Buildkite to w.
+// Artifacts are served from signed URLs on other hosts, so they're downloaded
+// without the agent's access token, which mustn't be sent anywhere else.
+func (c *Client) DownloadArtifact(artifact *Artifact, w io.Writer) (*Response, error) {
+	if artifact.UploadDestination != "" {
+		return nil, fmt.Errorf("Artifact %s was uploaded to %s rather than Buildkite, so it can't be downloaded from the Agent API", artifact.Path, artifact.UploadDestination)
+	}
+	if artifact.URL == "" {
+		return nil, fmt.Errorf("Artifact %s doesn't have a URL to download it from", artifact.Path)
+	}
+
+	req, err := http.NewRequest("GET", artifact.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-Agent", c.conf.UserAgent)
+
+	c.logger.Debug("%s %s", req.Method, req.URL)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	response := newResponse(resp)
+	if err := checkResponse(resp); err != nil {
+		return response, err
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return response, err
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// LoadCACert returns the system's CA certificates along with the ones in the
+// PEM file at path, or an error if the file can't be read or doesn't contain
+// any certificates
+func LoadCACert(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read the CA certificate file: %v", err)
+	}
+
+	// The system pool isn't available everywhere, such as on Windows
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("The CA certificate file %s doesn't contain any PEM certificates", path)
+	}
+
+	return pool, nil
+}
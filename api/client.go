@@ -4,7 +4,9 @@ package api
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,6 +17,7 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -25,6 +28,10 @@ import (
 const (
 	defaultEndpoint  = "https://agent.buildkite.com/"
 	defaultUserAgent = "buildkite-agent/api"
+
+	// DefaultTimeout is how long a request can take if Config.Timeout isn't
+	// set
+	DefaultTimeout = 60 * time.Second
 )
 
 // Config is configuration for the API Client
@@ -42,9 +49,34 @@ type Config struct {
 	// If true, only HTTP2 is disabled
 	DisableHTTP2 bool
 
+	// The path to a PEM file of CA certificates to trust as well as the
+	// system's, for endpoints with certificates signed by a private CA
+	CACert string
+
+	// The CA certificates to trust, usually loaded from CACert with
+	// LoadCACert. Leave nil to use the system's.
+	RootCAs *x509.CertPool
+
+	// The proxy to use for HTTPS requests, instead of the one in HTTPS_PROXY
+	HTTPSProxy string
+
+	// Hosts to connect to without a proxy, instead of the ones in NO_PROXY
+	NoProxy string
+
 	// If true, requests and responses will be dumped and set to the logger
 	DebugHTTP bool
 
+	// If true, request bodies of at least CompressionThreshold bytes are
+	// gzipped and sent with a `Content-Encoding: gzip` header
+	CompressRequestBodies bool
+
+	// The minimum size in bytes of a request body before it's compressed
+	CompressionThreshold int
+
+	// How long a request can take, including reading the response. Defaults
+	// to DefaultTimeout.
+	Timeout time.Duration
+
 	// The http client used, leave nil for the default
 	HTTPClient *http.Client
 }
@@ -71,30 +103,17 @@ func NewClient(l logger.Logger, conf Config) *Client {
 		conf.UserAgent = defaultUserAgent
 	}
 
+	if conf.Timeout == 0 {
+		conf.Timeout = DefaultTimeout
+	}
+
 	httpClient := conf.HTTPClient
 	if conf.HTTPClient == nil {
-		t := &http.Transport{
-			Proxy:              http.ProxyFromEnvironment,
-			DisableCompression: false,
-			DisableKeepAlives:  false,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			MaxIdleConns:        100,
-			IdleConnTimeout:     90 * time.Second,
-			TLSHandshakeTimeout: 30 * time.Second,
-		}
-
-		if conf.DisableHTTP2 {
-			t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
-		}
-
 		httpClient = &http.Client{
-			Timeout: 60 * time.Second,
+			Timeout: conf.Timeout,
 			Transport: &authenticatedTransport{
 				Token:    conf.Token,
-				Delegate: t,
+				Delegate: newTransport(conf),
 			},
 		}
 	}
@@ -106,6 +125,48 @@ func NewClient(l logger.Logger, conf Config) *Client {
 	}
 }
 
+// NewUnauthenticatedHTTPClient returns an HTTP client with the same proxy and
+// TLS settings as an API client made with conf, which doesn't send the API
+// token, for talking to services other than the Agent API
+func NewUnauthenticatedHTTPClient(conf Config, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: newTransport(conf),
+	}
+}
+
+func newTransport(conf Config) *http.Transport {
+	t := &http.Transport{
+		Proxy:              http.ProxyFromEnvironment,
+		DisableCompression: false,
+		DisableKeepAlives:  false,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 30 * time.Second,
+	}
+
+	if conf.HTTPSProxy != "" || conf.NoProxy != "" {
+		t.Proxy = proxyFunc(conf)
+	}
+
+	if conf.RootCAs != nil {
+		t.TLSClientConfig = &tls.Config{RootCAs: conf.RootCAs}
+
+		// A custom TLS config turns off HTTP2 unless it's asked for
+		t.ForceAttemptHTTP2 = true
+	}
+
+	if conf.DisableHTTP2 {
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return t
+}
+
 // Config returns the internal configuration for the Client
 func (c *Client) Config() Config {
 	return c.conf
@@ -155,6 +216,20 @@ func (c *Client) newRequest(method, urlStr string, body interface{}) (*http.Requ
 		}
 	}
 
+	var contentEncoding string
+	if c.conf.CompressRequestBodies && body != nil && buf.Len() >= c.conf.CompressionThreshold {
+		compressed, err := gzipBuffer(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		c.logger.Debug("Compressed request body from %d to %d bytes (%.1f%% of original)",
+			buf.Len(), compressed.Len(), float64(compressed.Len())/float64(buf.Len())*100)
+
+		buf = compressed
+		contentEncoding = "gzip"
+	}
+
 	req, err := http.NewRequest(method, u, buf)
 	if err != nil {
 		return nil, err
@@ -166,9 +241,28 @@ func (c *Client) newRequest(method, urlStr string, body interface{}) (*http.Requ
 		req.Header.Add("Content-Type", "application/json")
 	}
 
+	if contentEncoding != "" {
+		req.Header.Add("Content-Encoding", contentEncoding)
+	}
+
 	return req, nil
 }
 
+// gzipBuffer returns a new buffer with the gzip compressed contents of buf
+func gzipBuffer(buf *bytes.Buffer) (*bytes.Buffer, error) {
+	compressed := new(bytes.Buffer)
+
+	zw := gzip.NewWriter(compressed)
+	if _, err := zw.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return compressed, nil
+}
+
 // NewFormRequest creates an multi-part form request. A relative URL can be
 // provided in urlStr, in which case it is resolved relative to the UploadURL
 // of the Client. Relative URLs should always be specified without a preceding
@@ -192,11 +286,15 @@ func (c *Client) newFormRequest(method, urlStr string, body *bytes.Buffer) (*htt
 // http.Response.
 type Response struct {
 	*http.Response
+
+	// The ID Buildkite gave the request, from the X-Request-Id header, which
+	// helps support find it
+	RequestID string
 }
 
 // newResponse creates a new Response for the provided http.Response.
 func newResponse(r *http.Response) *Response {
-	response := &Response{Response: r}
+	response := &Response{Response: r, RequestID: r.Header.Get(requestIDHeader)}
 	return response
 }
 
@@ -278,10 +376,14 @@ func (c *Client) doRequest(req *http.Request, v interface{}) (*Response, error)
 	return response, err
 }
 
+// requestIDHeader is the response header with the ID of the request
+const requestIDHeader = "X-Request-Id"
+
 // ErrorResponse provides a message.
 type ErrorResponse struct {
-	Response *http.Response // HTTP response that caused this error
-	Message  string         `json:"message"` // error message
+	Response  *http.Response // HTTP response that caused this error
+	Message   string         `json:"message"` // error message
+	RequestID string         `json:"-"`       // ID of the request, if the response has one
 }
 
 func (r *ErrorResponse) Error() string {
@@ -296,12 +398,43 @@ func (r *ErrorResponse) Error() string {
 	return s
 }
 
+// RetryAfter returns how long the Retry-After header of the response asks
+// clients to wait before retrying, if it has one. The header can be a number
+// of seconds or an HTTP date.
+func (r *ErrorResponse) RetryAfter() (time.Duration, bool) {
+	if r.Response == nil {
+		return 0, false
+	}
+
+	header := strings.TrimSpace(r.Response.Header.Get("Retry-After"))
+	if header == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+
+	return 0, false
+}
+
 func checkResponse(r *http.Response) error {
 	if c := r.StatusCode; 200 <= c && c <= 299 {
 		return nil
 	}
 
-	errorResponse := &ErrorResponse{Response: r}
+	errorResponse := &ErrorResponse{Response: r, RequestID: r.Header.Get(requestIDHeader)}
 	data, err := ioutil.ReadAll(r.Body)
 	if err == nil && data != nil {
 		json.Unmarshal(data, errorResponse)
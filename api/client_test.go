@@ -1,10 +1,19 @@
 package api
 
 import (
+	"compress/gzip"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent/v3/logger"
 )
@@ -73,3 +82,199 @@ func checkAuthToken(t *testing.T, req *http.Request, token string) bool {
 	}
 	return true
 }
+
+func TestCompressingRequestBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body := req.Body
+		if req.Header.Get(`Content-Encoding`) == `gzip` {
+			zr, err := gzip.NewReader(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+		}
+
+		var pipeline Pipeline
+		if err := json.NewDecoder(body).Decode(&pipeline); err != nil {
+			t.Fatal(err)
+		}
+
+		rw.Header().Set(`X-Was-Compressed`, strconv.FormatBool(req.Header.Get(`Content-Encoding`) == `gzip`))
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		Compress   bool
+		Threshold  int
+		Compressed string
+	}{
+		{Compress: false, Threshold: 0, Compressed: "false"},
+		{Compress: true, Threshold: 0, Compressed: "true"},
+		{Compress: true, Threshold: 1 << 20, Compressed: "false"},
+	} {
+		c := NewClient(logger.Discard, Config{
+			Endpoint:              server.URL,
+			Token:                 "llamas",
+			CompressRequestBodies: tc.Compress,
+			CompressionThreshold:  tc.Threshold,
+		})
+
+		resp, err := c.UploadPipeline("my-job", &Pipeline{UUID: "abc", Pipeline: map[string]string{"steps": "llamas"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := resp.Header.Get(`X-Was-Compressed`); got != tc.Compressed {
+			t.Errorf("Expected compressed=%s with threshold %d, got %s", tc.Compressed, tc.Threshold, got)
+		}
+	}
+}
+
+func TestErrorResponseRetryAfter(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case `/jobs/seconds/pipelines`:
+			rw.Header().Set("Retry-After", "30")
+			http.Error(rw, "Slow down", http.StatusTooManyRequests)
+		case `/jobs/date/pipelines`:
+			rw.Header().Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+			http.Error(rw, "Down for maintenance", http.StatusServiceUnavailable)
+		default:
+			http.Error(rw, "Oops", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	retryAfter := func(job string) (time.Duration, bool) {
+		_, err := c.UploadPipeline(job, &Pipeline{UUID: "uuid"})
+		apierr, ok := err.(*ErrorResponse)
+		if !ok {
+			t.Fatalf("Expected an *ErrorResponse, got %T", err)
+		}
+		return apierr.RetryAfter()
+	}
+
+	if wait, ok := retryAfter("seconds"); !ok || wait != 30*time.Second {
+		t.Fatalf("Expected a Retry-After of 30s, got %v (%v)", wait, ok)
+	}
+
+	if wait, ok := retryAfter("date"); !ok || wait < 59*time.Minute || wait > time.Hour {
+		t.Fatalf("Expected a Retry-After of about an hour, got %v (%v)", wait, ok)
+	}
+
+	if wait, ok := retryAfter("other"); ok {
+		t.Fatalf("Expected no Retry-After, got %v", wait)
+	}
+}
+
+func TestResponseRequestID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("X-Request-Id", "request-"+strings.Split(req.URL.Path, "/")[2])
+		switch req.URL.Path {
+		case `/jobs/ok/pipelines`:
+			rw.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(rw, "Oops", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+	})
+
+	resp, err := c.UploadPipeline("ok", &Pipeline{UUID: "uuid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.RequestID != "request-ok" {
+		t.Fatalf("Expected request ID request-ok, got %q", resp.RequestID)
+	}
+
+	_, err = c.UploadPipeline("broken", &Pipeline{UUID: "uuid"})
+	apierr, ok := err.(*ErrorResponse)
+	if !ok {
+		t.Fatalf("Expected an *ErrorResponse, got %T", err)
+	}
+	if apierr.RequestID != "request-broken" {
+		t.Fatalf("Expected request ID request-broken, got %q", apierr.RequestID)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	c := NewClient(logger.Discard, Config{
+		Endpoint: server.URL,
+		Token:    "llamas",
+		Timeout:  50 * time.Millisecond,
+	})
+
+	_, err := c.UploadPipeline("job", &Pipeline{UUID: "uuid"})
+	if err == nil {
+		t.Fatal("Expected the request to time out")
+	}
+	if _, ok := err.(*ErrorResponse); ok {
+		t.Fatalf("Expected a timeout rather than an *ErrorResponse, got %v", err)
+	}
+}
+
+func TestClientCACert(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ca-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath := filepath.Join(dir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test server's certificate isn't trusted by default
+	c := NewClient(logger.Discard, Config{Endpoint: server.URL, Token: "llamas"})
+	if _, err := c.UploadPipeline("job", &Pipeline{UUID: "uuid"}); err == nil {
+		t.Fatal("Expected the server's certificate not to be trusted")
+	}
+
+	pool, err := LoadCACert(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewClient(logger.Discard, Config{Endpoint: server.URL, Token: "llamas", CACert: certPath, RootCAs: pool})
+	if _, err := c.UploadPipeline("job", &Pipeline{UUID: "uuid"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files without certificates are an error
+	badPath := filepath.Join(dir, "bad.pem")
+	if err := ioutil.WriteFile(badPath, []byte("llamas"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCACert(badPath); err == nil {
+		t.Fatal("Expected an error loading a file without certificates")
+	}
+	if _, err := LoadCACert(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatal("Expected an error loading a missing file")
+	}
+}
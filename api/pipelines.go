@@ -21,3 +21,82 @@ func (c *Client) UploadPipeline(jobId string, pipeline *Pipeline) (*Response, er
 
 	return c.doRequest(req, nil)
 }
+
+// GetPipeline returns the pipeline that has been uploaded to the job's build
+// so far
+func (c *Client) GetPipeline(jobId string) (*Pipeline, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/pipeline", jobId)
+
+	req, err := c.newRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p := new(Pipeline)
+	resp, err := c.doRequest(req, p)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return p, resp, err
+}
+
+// PipelineValidation is the Buildkite Agent API's verdict on a pipeline
+type PipelineValidation struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ValidatePipeline asks the Buildkite Agent API to validate a pipeline without
+// adding it to the build
+func (c *Client) ValidatePipeline(jobId string, pipeline *Pipeline) (*PipelineValidation, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/pipelines/validate", jobId)
+
+	req, err := c.newRequest("POST", u, pipeline)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	v := new(PipelineValidation)
+	resp, err := c.doRequest(req, v)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return v, resp, err
+}
+
+// The states of a pipeline upload that the Buildkite Agent API processes
+// asynchronously
+const (
+	PipelineUploadStatePending  = "pending"
+	PipelineUploadStateApplied  = "applied"
+	PipelineUploadStateRejected = "rejected"
+)
+
+// PipelineUploadStatus is the Buildkite Agent API's progress processing a
+// pipeline upload
+type PipelineUploadStatus struct {
+	State   string   `json:"state"`
+	Message string   `json:"message,omitempty"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// PipelineUploadStatus returns how far along the Buildkite Agent API is with
+// processing the pipeline uploaded with the given UUID
+func (c *Client) PipelineUploadStatus(jobId string, uuid string) (*PipelineUploadStatus, *Response, error) {
+	u := fmt.Sprintf("jobs/%s/pipelines/%s", jobId, uuid)
+
+	req, err := c.newRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := new(PipelineUploadStatus)
+	resp, err := c.doRequest(req, s)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return s, resp, err
+}
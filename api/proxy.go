@@ -0,0 +1,27 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// proxyFunc returns a proxy function for an http.Transport that uses the
+// proxy settings from the environment, the same as http.ProxyFromEnvironment,
+// except that conf.HTTPSProxy and conf.NoProxy take precedence over
+// HTTPS_PROXY and NO_PROXY when they're set
+func proxyFunc(conf Config) func(*http.Request) (*url.URL, error) {
+	proxyConf := httpproxy.FromEnvironment()
+	if conf.HTTPSProxy != "" {
+		proxyConf.HTTPSProxy = conf.HTTPSProxy
+	}
+	if conf.NoProxy != "" {
+		proxyConf.NoProxy = conf.NoProxy
+	}
+
+	proxy := proxyConf.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestProxyFunc(t *testing.T) {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy", "REQUEST_METHOD"} {
+		if value, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, value)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Unsetenv(name)
+	}
+	os.Setenv("HTTPS_PROXY", "http://env-proxy:3128")
+	os.Setenv("NO_PROXY", "agent.buildkite.com")
+
+	for _, tc := range []struct {
+		name     string
+		conf     Config
+		url      string
+		expected string
+	}{
+		{"env no proxy", Config{HTTPSProxy: "http://flag-proxy:8080"}, "https://agent.buildkite.com/v3", ""},
+		{"flag proxy", Config{HTTPSProxy: "http://flag-proxy:8080"}, "https://example.com/v3", "http://flag-proxy:8080"},
+		{"flag no proxy", Config{NoProxy: "example.com"}, "https://agent.buildkite.com/v3", "http://env-proxy:3128"},
+		{"flag no proxy match", Config{NoProxy: "example.com"}, "https://example.com/v3", ""},
+		{"both flags", Config{HTTPSProxy: "http://flag-proxy:8080", NoProxy: ".example.com"}, "https://agent.buildkite.com/v3", "http://flag-proxy:8080"},
+		{"both flags subdomain", Config{HTTPSProxy: "http://flag-proxy:8080", NoProxy: ".example.com"}, "https://api.example.com/v3", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			proxy, err := newTransport(tc.conf).Proxy(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual := ""
+			if proxy != nil {
+				actual = proxy.String()
+			}
+			if actual != tc.expected {
+				t.Fatalf("Expected proxy %q for %s, got %q", tc.expected, tc.url, actual)
+			}
+		})
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -21,6 +20,7 @@ import (
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/hook"
 	"github.com/buildkite/agent/v3/process"
+	"github.com/buildkite/agent/v3/redaction"
 	"github.com/buildkite/agent/v3/retry"
 	"github.com/buildkite/agent/v3/tracetools"
 	"github.com/buildkite/agent/v3/utils"
@@ -34,11 +34,9 @@ import (
 )
 
 // RedactLengthMin is the shortest string length that will be considered a
-// potential secret by the environment redactor. For example, if the redactor is
-// configured to filter out environment variables matching *_TOKEN, and
-// API_TOKEN is set to "none", this minimum length will prevent the word "none"
-// from being redacted from useful log output.
-const RedactLengthMin = 6
+// potential secret by the environment redactor. It's kept for compatibility,
+// use redaction.LengthMin instead.
+const RedactLengthMin = redaction.LengthMin
 
 // Bootstrap represents the phases of execution in a Buildkite Job. It's run
 // as a sub-process of the buildkite-agent and finishes at the conclusion of a job.
@@ -432,7 +430,7 @@ func (b *Bootstrap) executeHook(ctx context.Context, scope string, name string,
 	return nil
 }
 
-func (b *Bootstrap) applyEnvironmentChanges(changes hook.HookScriptChanges, redactors RedactorMux) {
+func (b *Bootstrap) applyEnvironmentChanges(changes hook.HookScriptChanges, redactors redaction.RedactorMux) {
 	if afterWd, err := changes.GetAfterWd(); err == nil {
 		if afterWd != b.shell.Getwd() {
 			_ = b.shell.Chdir(afterWd)
@@ -448,7 +446,7 @@ func (b *Bootstrap) applyEnvironmentChanges(changes hook.HookScriptChanges, reda
 
 	// reset output redactors based on new environment variable values
 	redactors.Flush()
-	redactors.Reset(getValuesToRedact(b.shell, b.Config.RedactedVars, mergedEnv.ToMap()))
+	redactors.Reset(redaction.GetValuesToRedact(b.shell.Warningf, b.Config.RedactedVars, mergedEnv.ToMap()))
 
 	// First, let see any of the environment variables are supposed
 	// to change the bootstrap configuration at run time.
@@ -624,7 +622,7 @@ func (b *Bootstrap) setUp(ctx context.Context) error {
 
 	if b.Debug {
 		b.shell.Headerf("Buildkite environment variables")
-		for _, e := range b.shell.Env.ToSlice() {
+		for _, e := range b.shell.Env.ToSortedSlice() {
 			if strings.HasPrefix(e, "BUILDKITE_AGENT_ACCESS_TOKEN=") {
 				b.shell.Printf("BUILDKITE_AGENT_ACCESS_TOKEN=******************")
 			} else if strings.HasPrefix(e, "BUILDKITE") || strings.HasPrefix(e, "CI") || strings.HasPrefix(e, "PATH") {
@@ -1847,8 +1845,8 @@ func (b *Bootstrap) ignoredEnv() []string {
 // is necessary based on RedactedVars configuration and the existence of
 // matching environment vars.
 // RedactorMux (possibly empty) is returned so the caller can `defer redactor.Flush()`
-func (b *Bootstrap) setupRedactors() RedactorMux {
-	valuesToRedact := getValuesToRedact(b.shell, b.Config.RedactedVars, b.shell.Env.ToMap())
+func (b *Bootstrap) setupRedactors() redaction.RedactorMux {
+	valuesToRedact := redaction.GetValuesToRedact(b.shell.Warningf, b.Config.RedactedVars, b.shell.Env.ToMap())
 	if len(valuesToRedact) == 0 {
 		return nil
 	}
@@ -1857,16 +1855,16 @@ func (b *Bootstrap) setupRedactors() RedactorMux {
 		b.shell.Commentf("Enabling output redaction for values from environment variables matching: %v", b.Config.RedactedVars)
 	}
 
-	var mux RedactorMux
+	var mux redaction.RedactorMux
 
 	// If the shell Writer is already a Redactor, reset the values to redact.
-	if redactor, ok := b.shell.Writer.(*Redactor); ok {
+	if redactor, ok := b.shell.Writer.(*redaction.Redactor); ok {
 		redactor.Reset(valuesToRedact)
 		mux = append(mux, redactor)
 	} else if len(valuesToRedact) == 0 {
 		// skip
 	} else {
-		redactor := NewRedactor(b.shell.Writer, "[REDACTED]", valuesToRedact)
+		redactor := redaction.NewRedactor(b.shell.Writer, valuesToRedact)
 		b.shell.Writer = redactor
 		mux = append(mux, redactor)
 	}
@@ -1875,10 +1873,10 @@ func (b *Bootstrap) setupRedactors() RedactorMux {
 	// (maybe there's a better way to do two levels of type assertion? ...
 	// shell.Logger may be a WriterLogger, and its Writer may be a Redactor)
 	var shellWriterLogger *shell.WriterLogger
-	var shellLoggerRedactor *Redactor
+	var shellLoggerRedactor *redaction.Redactor
 	if logger, ok := b.shell.Logger.(*shell.WriterLogger); ok {
 		shellWriterLogger = logger
-		if redactor, ok := logger.Writer.(*Redactor); ok {
+		if redactor, ok := logger.Writer.(*redaction.Redactor); ok {
 			shellLoggerRedactor = redactor
 		}
 	}
@@ -1888,7 +1886,7 @@ func (b *Bootstrap) setupRedactors() RedactorMux {
 	} else if len(valuesToRedact) == 0 {
 		// skip
 	} else if shellWriterLogger != nil {
-		redactor := NewRedactor(b.shell.Writer, "[REDACTED]", valuesToRedact)
+		redactor := redaction.NewRedactor(b.shell.Writer, valuesToRedact)
 		shellWriterLogger.Writer = redactor
 		mux = append(mux, redactor)
 	}
@@ -1896,34 +1894,6 @@ func (b *Bootstrap) setupRedactors() RedactorMux {
 	return mux
 }
 
-// Given a redaction config string and an environment map, return the list of values to be redacted.
-// Lifted out of Bootstrap.setupRedactors to facilitate testing
-func getValuesToRedact(logger shell.Logger, patterns []string, environment map[string]string) []string {
-	var valuesToRedact []string
-
-	for varName, varValue := range environment {
-		for _, pattern := range patterns {
-			matched, err := path.Match(pattern, varName)
-			if err != nil {
-				// path.ErrBadPattern is the only error returned by path.Match
-				logger.Warningf("Bad redacted vars pattern: %s", pattern)
-				continue
-			}
-
-			if matched {
-				if len(varValue) < RedactLengthMin {
-					logger.Warningf("Value of %s below minimum length and will not be redacted", varName)
-				} else {
-					valuesToRedact = append(valuesToRedact, varValue)
-				}
-				break // Break pattern loop, continue to next env var
-			}
-		}
-	}
-
-	return valuesToRedact
-}
-
 type pluginCheckout struct {
 	*plugin.Plugin
 	*plugin.Definition
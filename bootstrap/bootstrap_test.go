@@ -27,40 +27,6 @@ func TestDirForAgentName(t *testing.T) {
 	}
 }
 
-func TestGetValuesToRedact(t *testing.T) {
-	t.Parallel()
-
-	redactConfig := []string{
-		"*_PASSWORD",
-		"*_TOKEN",
-	}
-	environment := map[string]string{
-		"BUILDKITE_PIPELINE": "unit-test",
-		"DATABASE_USERNAME":  "AzureDiamond",
-		"DATABASE_PASSWORD":  "hunter2",
-	}
-
-	valuesToRedact := getValuesToRedact(shell.DiscardLogger, redactConfig, environment)
-
-	assert.Equal(t, []string{"hunter2"}, valuesToRedact)
-}
-
-func TestGetValuesToRedactEmpty(t *testing.T) {
-	t.Parallel()
-
-	redactConfig := []string{}
-	environment := map[string]string{
-		"FOO": "BAR",
-		"BUILDKITE_PIPELINE": "unit-test",
-	}
-
-	valuesToRedact := getValuesToRedact(shell.DiscardLogger, redactConfig, environment)
-
-	var expected []string
-	assert.Equal(t, expected, valuesToRedact)
-	assert.Equal(t, 0, len(valuesToRedact))
-}
-
 func TestStartTracing(t *testing.T) {
 	oriCtx := context.Background()
 	var err error
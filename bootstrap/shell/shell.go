@@ -285,6 +285,31 @@ func (s *Shell) RunAndCapture(command string, arg ...string) (string, error) {
 	return strings.TrimSpace(b.String()), nil
 }
 
+// RunAndCaptureWithStderr is like RunAndCapture, but also captures stderr separately so it
+// can be reported if the command fails. Unlike RunAndCapture, stdout isn't trimmed, as
+// leading whitespace can be significant. A PTY is never used for RunAndCaptureWithStderr.
+func (s *Shell) RunAndCaptureWithStderr(command string, arg ...string) (string, string, error) {
+	if s.Debug {
+		s.Promptf("%s", process.FormatCommand(command, arg))
+	}
+
+	cmd, err := s.buildCommand(s.ctx, command, arg...)
+	if err != nil {
+		return "", "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err = s.executeCommand(s.ctx, cmd, &stdout, executeFlags{
+		Stdout: true,
+		Stderr: false,
+		PTY:    false,
+	})
+
+	return stdout.String(), strings.TrimSpace(stderr.String()), err
+}
+
 // injectTraceCtx adds tracing information to the given env vars to support
 // distributed tracing across jobs/builds.
 func (s *Shell) injectTraceCtx(ctx context.Context, env *env.Environment) {
@@ -70,6 +70,32 @@ func TestRunAndCaptureWithExitCode(t *testing.T) {
 	}
 }
 
+func TestRunAndCaptureWithStderr(t *testing.T) {
+	generator, err := bintest.CompileProxy("generator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generator.Close()
+
+	sh := newShellForTest(t)
+
+	go func() {
+		call := <-generator.Ch
+		fmt.Fprint(call.Stdout, "  - command: a\n  - command: b\n")
+		fmt.Fprintln(call.Stderr, "Llama drama! 🚨")
+		call.Exit(3)
+	}()
+
+	stdout, stderr, err := sh.RunAndCaptureWithStderr(generator.Path, "--llamas")
+	if exitCode := shell.GetExitCode(err); exitCode != 3 {
+		t.Fatalf("Expected %d, got %d", 3, exitCode)
+	}
+
+	// The indentation of the first line is kept
+	assert.Equal(t, "  - command: a\n  - command: b\n", stdout)
+	assert.Equal(t, "Llama drama! 🚨", stderr)
+}
+
 func TestRun(t *testing.T) {
 	sshKeygen, err := bintest.CompileProxy("ssh-keygen")
 	if err != nil {
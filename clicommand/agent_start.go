@@ -100,18 +100,23 @@ type AgentStartConfig struct {
 	LogFormat                   string   `cli:"log-format"`
 	CancelSignal                string   `cli:"cancel-signal"`
 	RedactedVars                []string `cli:"redacted-vars" normalize:"list"`
+	RedactedVarsFile            string   `cli:"redacted-vars-file" normalize:"filepath"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
 	NoColor     bool     `cli:"no-color"`
 	Experiments []string `cli:"experiment" normalize:"list"`
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP bool   `cli:"debug-http"`
-	Token     string `cli:"token" validate:"required"`
-	Endpoint  string `cli:"endpoint" validate:"required"`
-	NoHTTP2   bool   `cli:"no-http2"`
+	DebugHTTP  bool   `cli:"debug-http"`
+	Token      string `cli:"token" validate:"required"`
+	Endpoint   string `cli:"endpoint" validate:"required"`
+	NoHTTP2    bool   `cli:"no-http2"`
+	CACert     string `cli:"ca-cert" normalize:"filepath"`
+	HTTPSProxy string `cli:"https-proxy"`
+	NoProxy    string `cli:"no-proxy"`
 
 	// Deprecated
 	NoSSHFingerprintVerification bool     `cli:"no-automatic-ssh-fingerprint-verification" deprecated-and-renamed-to:"NoSSHKeyscan"`
@@ -417,12 +422,6 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Use Datadog Distributions for Timing metrics",
 			EnvVar: "BUILDKITE_METRICS_DATADOG_DISTRIBUTIONS",
 		},
-		cli.StringFlag{
-			Name:   "log-format",
-			Usage:  "The format to use for the logger output",
-			EnvVar: "BUILDKITE_LOG_FORMAT",
-			Value:  "text",
-		},
 		cli.IntFlag{
 			Name:   "spawn",
 			Usage:  "The number of agents to spawn in parallel",
@@ -441,6 +440,11 @@ var AgentStartCommand = cli.Command{
 			EnvVar: "BUILDKITE_REDACTED_VARS",
 			Value:  &cli.StringSlice{"*_PASSWORD", "*_SECRET", "*_TOKEN", "*_ACCESS_KEY", "*_SECRET_KEY"},
 		},
+		cli.StringFlag{
+			Name:   "redacted-vars-file",
+			Usage:  "Path to a file of patterns of environment variable names containing sensitive values, one on each line, to use as well as --redacted-vars. Blank lines and lines starting with # are ignored",
+			EnvVar: "BUILDKITE_REDACTED_VARS_FILE",
+		},
 		cli.StringFlag{
 			Name:   "tracing-backend",
 			Usage:  "The name of the tracing backend to use.",
@@ -452,11 +456,16 @@ var AgentStartCommand = cli.Command{
 		AgentRegisterTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		CACertFlag,
+		HTTPSProxyFlag,
+		NoProxyFlag,
 		DebugHTTPFlag,
 
 		// Global flags
+		LogFormatFlag,
 		NoColorFlag,
 		DebugFlag,
+		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
 
@@ -588,6 +597,14 @@ var AgentStartCommand = cli.Command{
 			cfg.Shell = DefaultShell()
 		}
 
+		// Jobs are given the patterns from the file along with the others
+		if cfg.RedactedVarsFile != "" {
+			cfg.RedactedVars, err = mergeRedactedVarsFile(cfg.RedactedVars, cfg.RedactedVarsFile)
+			if err != nil {
+				l.Fatal("Failed to read --redacted-vars-file: %v", err)
+			}
+		}
+
 		// Handle deprecated DisconnectAfterJobTimeout
 		if cfg.DisconnectAfterJobTimeout > 0 {
 			cfg.DisconnectAfterIdleTimeout = cfg.DisconnectAfterJobTimeout
@@ -56,7 +56,9 @@ type AnnotateConfig struct {
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
 	NoColor     bool     `cli:"no-color"`
+	LogFormat   string   `cli:"log-format"`
 	Experiments []string `cli:"experiment" normalize:"list"`
 	Profile     string   `cli:"profile"`
 
@@ -65,6 +67,9 @@ type AnnotateConfig struct {
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	CACert           string `cli:"ca-cert" normalize:"filepath"`
+	HTTPSProxy       string `cli:"https-proxy"`
+	NoProxy          string `cli:"no-proxy"`
 }
 
 var AnnotateCommand = cli.Command{
@@ -98,11 +103,16 @@ var AnnotateCommand = cli.Command{
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		CACertFlag,
+		HTTPSProxyFlag,
+		NoProxyFlag,
 		DebugHTTPFlag,
 
 		// Global flags
+		LogFormatFlag,
 		NoColorFlag,
 		DebugFlag,
+		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
 	},
@@ -117,6 +127,9 @@ var AnnotateCommand = cli.Command{
 			l.Fatal("%s", err)
 		}
 
+		// The logger was created before the log format and colors were loaded
+		l = CreateLogger(&cfg)
+
 		// Setup any global configuration options
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
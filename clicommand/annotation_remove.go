@@ -31,7 +31,9 @@ type AnnotationRemoveConfig struct {
 
   // Global flags
   Debug   bool         `cli:"debug"`
+  LogLevel string       `cli:"log-level"`
   NoColor bool         `cli:"no-color"`
+  LogFormat string       `cli:"log-format"`
   Experiments []string `cli:"experiment" normalize:"list"`
   Profile string       `cli:"profile"`
 
@@ -40,6 +42,9 @@ type AnnotationRemoveConfig struct {
   AgentAccessToken string `cli:"agent-access-token" validate:"required"`
   Endpoint         string `cli:"endpoint" validate:"required"`
   NoHTTP2          bool   `cli:"no-http2"`
+  CACert           string `cli:"ca-cert" normalize:"filepath"`
+  HTTPSProxy       string `cli:"https-proxy"`
+  NoProxy          string `cli:"no-proxy"`
 }
 
 var AnnotationRemoveCommand = cli.Command{
@@ -64,11 +69,16 @@ var AnnotationRemoveCommand = cli.Command{
     AgentAccessTokenFlag,
     EndpointFlag,
     NoHTTP2Flag,
+    CACertFlag,
+    HTTPSProxyFlag,
+    NoProxyFlag,
     DebugHTTPFlag,
 
     // Global flags
+    LogFormatFlag,
     NoColorFlag,
     DebugFlag,
+    LogLevelFlag,
     ExperimentsFlag,
     ProfileFlag,
   },
@@ -83,6 +93,9 @@ var AnnotationRemoveCommand = cli.Command{
       l.Fatal("%s", err)
     }
 
+    // The logger was created before the log format and colors were loaded
+    l = CreateLogger(&cfg)
+
     // Setup any global configuration options
     done := HandleGlobalFlags(l, cfg)
     defer done()
@@ -53,7 +53,9 @@ type ArtifactDownloadConfig struct {
 
 	// Global flags
 	Debug   bool         `cli:"debug"`
+	LogLevel string       `cli:"log-level"`
 	NoColor bool         `cli:"no-color"`
+	LogFormat string       `cli:"log-format"`
 	Experiments []string `cli:"experiment" normalize:"list"`
 	Profile string       `cli:"profile"`
 
@@ -62,6 +64,9 @@ type ArtifactDownloadConfig struct {
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	CACert           string `cli:"ca-cert" normalize:"filepath"`
+	HTTPSProxy       string `cli:"https-proxy"`
+	NoProxy          string `cli:"no-proxy"`
 }
 
 var ArtifactDownloadCommand = cli.Command{
@@ -90,11 +95,16 @@ var ArtifactDownloadCommand = cli.Command{
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		CACertFlag,
+		HTTPSProxyFlag,
+		NoProxyFlag,
 		DebugHTTPFlag,
 
 		// Global flags
+		LogFormatFlag,
 		NoColorFlag,
 		DebugFlag,
+		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
 	},
@@ -109,6 +119,9 @@ var ArtifactDownloadCommand = cli.Command{
 			l.Fatal("%s", err)
 		}
 
+		// The logger was created before the log format and colors were loaded
+		l = CreateLogger(&cfg)
+
 		// Setup any global configuration options
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
@@ -53,7 +53,9 @@ type ArtifactSearchConfig struct {
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
 	NoColor     bool     `cli:"no-color"`
+	LogFormat   string   `cli:"log-format"`
 	Experiments []string `cli:"experiment" normalize:"list"`
 	Profile     string   `cli:"profile"`
 
@@ -62,6 +64,9 @@ type ArtifactSearchConfig struct {
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	CACert           string `cli:"ca-cert" normalize:"filepath"`
+	HTTPSProxy       string `cli:"https-proxy"`
+	NoProxy          string `cli:"no-proxy"`
 }
 
 var ArtifactSearchCommand = cli.Command{
@@ -118,11 +123,16 @@ Format specifiers:
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		CACertFlag,
+		HTTPSProxyFlag,
+		NoProxyFlag,
 		DebugHTTPFlag,
 
 		// Global flags
+		LogFormatFlag,
 		NoColorFlag,
 		DebugFlag,
+		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
 	},
@@ -137,6 +147,9 @@ Format specifiers:
 			l.Fatal("%s", err)
 		}
 
+		// The logger was created before the log format and colors were loaded
+		l = CreateLogger(&cfg)
+
 		// Setup any global configuration options
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
@@ -44,7 +44,9 @@ type ArtifactShasumConfig struct {
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
 	NoColor     bool     `cli:"no-color"`
+	LogFormat   string   `cli:"log-format"`
 	Experiments []string `cli:"experiment" normalize:"list"`
 	Profile     string   `cli:"profile"`
 
@@ -53,6 +55,9 @@ type ArtifactShasumConfig struct {
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	CACert           string `cli:"ca-cert" normalize:"filepath"`
+	HTTPSProxy       string `cli:"https-proxy"`
+	NoProxy          string `cli:"no-proxy"`
 }
 
 var ArtifactShasumCommand = cli.Command{
@@ -81,11 +86,16 @@ var ArtifactShasumCommand = cli.Command{
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		CACertFlag,
+		HTTPSProxyFlag,
+		NoProxyFlag,
 		DebugHTTPFlag,
 
 		// Global flags
+		LogFormatFlag,
 		NoColorFlag,
 		DebugFlag,
+		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
 	},
@@ -100,6 +110,9 @@ var ArtifactShasumCommand = cli.Command{
 			l.Fatal("%s", err)
 		}
 
+		// The logger was created before the log format and colors were loaded
+		l = CreateLogger(&cfg)
+
 		// Setup any global configuration options
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
@@ -67,7 +67,9 @@ type ArtifactUploadConfig struct {
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
 	NoColor     bool     `cli:"no-color"`
+	LogFormat   string   `cli:"log-format"`
 	Experiments []string `cli:"experiment" normalize:"list"`
 	Profile     string   `cli:"profile"`
 
@@ -76,6 +78,9 @@ type ArtifactUploadConfig struct {
 	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
 	Endpoint         string `cli:"endpoint" validate:"required"`
 	NoHTTP2          bool   `cli:"no-http2"`
+	CACert           string `cli:"ca-cert" normalize:"filepath"`
+	HTTPSProxy       string `cli:"https-proxy"`
+	NoProxy          string `cli:"no-proxy"`
 
 	// Uploader flags
 	FollowSymlinks bool `cli:"follow-symlinks"`
@@ -103,11 +108,16 @@ var ArtifactUploadCommand = cli.Command{
 		AgentAccessTokenFlag,
 		EndpointFlag,
 		NoHTTP2Flag,
+		CACertFlag,
+		HTTPSProxyFlag,
+		NoProxyFlag,
 		DebugHTTPFlag,
 
 		// Global flags
+		LogFormatFlag,
 		NoColorFlag,
 		DebugFlag,
+		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
 		FollowSymlinksFlag,
@@ -123,6 +133,9 @@ var ArtifactUploadCommand = cli.Command{
 			l.Fatal("%s", err)
 		}
 
+		// The logger was created before the log format and colors were loaded
+		l = CreateLogger(&cfg)
+
 		// Setup any global configuration options
 		done := HandleGlobalFlags(l, cfg)
 		defer done()
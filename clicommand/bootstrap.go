@@ -84,6 +84,7 @@ type BootstrapConfig struct {
 	Profile                      string   `cli:"profile"`
 	CancelSignal                 string   `cli:"cancel-signal"`
 	RedactedVars                 []string `cli:"redacted-vars" normalize:"list"`
+	RedactedVarsFile             string   `cli:"redacted-vars-file" normalize:"filepath"`
 	TracingBackend               string   `cli:"tracing-backend"`
 }
 
@@ -310,6 +311,11 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Pattern of environment variable names containing sensitive values",
 			EnvVar: "BUILDKITE_REDACTED_VARS",
 		},
+		cli.StringFlag{
+			Name:   "redacted-vars-file",
+			Usage:  "Path to a file of patterns of environment variable names containing sensitive values, one on each line, to use as well as --redacted-vars. Blank lines and lines starting with # are ignored",
+			EnvVar: "BUILDKITE_REDACTED_VARS_FILE",
+		},
 		cli.StringFlag{
 			Name:   "tracing-backend",
 			Usage:  "The name of the tracing backend to use.",
@@ -366,6 +372,13 @@ var BootstrapCommand = cli.Command{
 			l.Fatal("Failed to parse cancel-signal: %v", err)
 		}
 
+		if cfg.RedactedVarsFile != "" {
+			cfg.RedactedVars, err = mergeRedactedVarsFile(cfg.RedactedVars, cfg.RedactedVarsFile)
+			if err != nil {
+				l.Fatal("Failed to read --redacted-vars-file: %v", err)
+			}
+		}
+
 		// Configure the bootstraper
 		bootstrap := bootstrap.New(bootstrap.Config{
 			Command:                      cfg.Command,
@@ -0,0 +1,55 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/oleiade/reflections"
+)
+
+// configProvenanceSecrets are parts of option names whose values are masked
+// when printing where config came from
+var configProvenanceSecrets = []string{"token", "password", "secret"}
+
+// configProvenance is where a config value came from, and what it is
+type configProvenance struct {
+	cliconfig.Source
+	Value interface{} `json:"value"`
+}
+
+// printConfigProvenance writes a JSON object to w describing, for each
+// option in cfg, its value and where it was loaded from
+func printConfigProvenance(w io.Writer, cfg interface{}, provenance map[string]cliconfig.Source) error {
+	out := map[string]configProvenance{}
+
+	fields, _ := reflections.Fields(cfg)
+	for _, fieldName := range fields {
+		cliName, _ := reflections.GetFieldTag(cfg, fieldName, "cli")
+		source, ok := provenance[cliName]
+		if cliName == "" || !ok {
+			continue
+		}
+
+		value, err := reflections.GetField(cfg, fieldName)
+		if err != nil {
+			return err
+		}
+
+		if s, ok := value.(string); ok && s != "" {
+			for _, secret := range configProvenanceSecrets {
+				if strings.Contains(cliName, secret) {
+					value = "[REDACTED]"
+					break
+				}
+			}
+		}
+
+		out[cliName] = configProvenance{Source: source, Value: value}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -0,0 +1,87 @@
+package clicommand
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintConfigProvenance(t *testing.T) {
+	os.Setenv("BUILDKITE_AGENT_ACCESS_TOKEN", "llamas")
+	defer os.Unsetenv("BUILDKITE_AGENT_ACCESS_TOKEN")
+
+	path, cleanup := writeManifest(t, "step-default-timeout: 30\n")
+	defer cleanup()
+
+	cfg := PipelineUploadConfig{}
+	c := newPipelineUploadContext(t, "--job", "my-job", "pipeline.yml")
+
+	provenance, err := cliconfig.LoadWithProvenance(c, logger.Discard, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := applyPipelineManifest(c, &cfg, path, provenance); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := printConfigProvenance(&b, cfg, provenance); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Contains(t, b.String(), `"arg:0": {
+    "source": "arg",
+    "value": "pipeline.yml"
+  }`)
+	assert.Contains(t, b.String(), `"agent-access-token": {
+    "source": "env",
+    "name": "BUILDKITE_AGENT_ACCESS_TOKEN",
+    "value": "[REDACTED]"
+  }`)
+	assert.Contains(t, b.String(), `"job": {
+    "source": "flag",
+    "value": "my-job"
+  }`)
+	assert.Contains(t, b.String(), `"step-default-timeout": {
+    "source": "manifest",
+    "name": "`+path+`",
+    "value": 30
+  }`)
+	assert.Contains(t, b.String(), `"max-warnings": {
+    "source": "default",
+    "value": -1
+  }`)
+	assert.NotContains(t, b.String(), "llamas")
+}
+
+func TestLoaderOnlyWarnsAboutUnknownFileOptionsWhenAsked(t *testing.T) {
+	path, cleanup := writeManifest(t, "agent-access-token=\"llamas\"\njob=\"my-job\"\ntags=\"queue=default\"\n")
+	defer cleanup()
+
+	for _, warn := range []bool{false, true} {
+		cfg := PipelineUploadConfig{}
+		loader := cliconfig.Loader{
+			CLI:                    newPipelineUploadContext(t, "--config", path),
+			Config:                 &cfg,
+			WarnUnknownFileOptions: warn,
+		}
+
+		warnings, err := loader.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "my-job", cfg.Job)
+
+		if warn {
+			assert.Equal(t, []string{
+				"The config option `tags` in " + path + " isn't an option of this command, so it was ignored",
+			}, warnings)
+		} else {
+			assert.Empty(t, warnings)
+		}
+	}
+}
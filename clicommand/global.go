@@ -3,9 +3,12 @@ package clicommand
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"reflect"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
@@ -26,6 +29,20 @@ var AgentAccessTokenFlag = cli.StringFlag{
 	EnvVar: "BUILDKITE_AGENT_ACCESS_TOKEN",
 }
 
+var AgentAccessTokenEnvFlag = cli.StringFlag{
+	Name:   "agent-access-token-env",
+	Value:  "",
+	Usage:  "The name of an environment variable to read the agent access token from, instead of BUILDKITE_AGENT_ACCESS_TOKEN",
+	EnvVar: "BUILDKITE_AGENT_ACCESS_TOKEN_ENV",
+}
+
+var AgentAccessTokenFileFlag = cli.StringFlag{
+	Name:   "agent-access-token-file",
+	Value:  "",
+	Usage:  "Path to a file to read the agent access token from, so it isn't visible in process listings. It takes precedence over BUILDKITE_AGENT_ACCESS_TOKEN, but can't be used with --agent-access-token or --agent-access-token-env",
+	EnvVar: "BUILDKITE_AGENT_ACCESS_TOKEN_FILE",
+}
+
 var AgentRegisterTokenFlag = cli.StringFlag{
 	Name:   "token",
 	Value:  "",
@@ -46,12 +63,37 @@ var NoHTTP2Flag = cli.BoolFlag{
 	EnvVar: "BUILDKITE_NO_HTTP2",
 }
 
+var CACertFlag = cli.StringFlag{
+	Name:   "ca-cert",
+	Usage:  "Path to a PEM file of CA certificates to trust when communicating with the Agent API, as well as the system's",
+	EnvVar: "BUILDKITE_AGENT_CACERT",
+}
+
+var HTTPSProxyFlag = cli.StringFlag{
+	Name:   "https-proxy",
+	Usage:  "The proxy to use when communicating with the Agent API over HTTPS. Takes precedence over HTTPS_PROXY.",
+	EnvVar: "BUILDKITE_AGENT_HTTPS_PROXY",
+}
+
+var NoProxyFlag = cli.StringFlag{
+	Name:   "no-proxy",
+	Usage:  "A comma-separated list of hosts to connect to without a proxy, in the same format as NO_PROXY. Takes precedence over NO_PROXY.",
+	EnvVar: "BUILDKITE_AGENT_NO_PROXY",
+}
+
 var DebugFlag = cli.BoolFlag{
 	Name:   "debug",
 	Usage:  "Enable debug mode",
 	EnvVar: "BUILDKITE_AGENT_DEBUG",
 }
 
+var LogLevelFlag = cli.StringFlag{
+	Name:   "log-level",
+	Value:  "notice",
+	Usage:  "The minimum level of messages to log, either debug, notice, info, warn or error. --debug is the same as --log-level=debug",
+	EnvVar: "BUILDKITE_AGENT_LOG_LEVEL",
+}
+
 var ProfileFlag = cli.StringFlag{
 	Name:   "profile",
 	Usage:  "Enable a profiling mode, either cpu, memory, mutex or block",
@@ -64,6 +106,13 @@ var DebugHTTPFlag = cli.BoolFlag{
 	EnvVar: "BUILDKITE_AGENT_DEBUG_HTTP",
 }
 
+var LogFormatFlag = cli.StringFlag{
+	Name:   "log-format",
+	Usage:  "The format to use for the logger output, either text or json. JSON logs have one object per line, with ts, level and msg keys and any other fields",
+	EnvVar: "BUILDKITE_LOG_FORMAT",
+	Value:  "text",
+}
+
 var NoColorFlag = cli.BoolFlag{
 	Name:   "no-color",
 	Usage:  "Don't show colors in logging",
@@ -113,9 +162,16 @@ func CreateLogger(cfg interface{}) logger.Logger {
 
 		l = logger.NewConsoleLogger(printer, os.Exit)
 	case `json`:
-		l = logger.NewConsoleLogger(logger.NewJSONPrinter(os.Stdout), os.Exit)
+		// Logs go to stderr so they don't get mixed up with the output of
+		// commands like meta-data get, but the agent has always logged JSON
+		// to stdout
+		w := os.Stderr
+		if _, ok := cfg.(AgentStartConfig); ok {
+			w = os.Stdout
+		}
+		l = logger.NewConsoleLogger(logger.NewJSONPrinter(w), os.Exit)
 	default:
-		fmt.Printf("Unknown log-format of %q, try text or json\n", logFormat)
+		fmt.Fprintf(os.Stderr, "Unknown log-format of %q, try text or json\n", logFormat)
 		os.Exit(1)
 	}
 
@@ -132,13 +188,17 @@ func HandleProfileFlag(l logger.Logger, cfg interface{}) func() {
 }
 
 func HandleGlobalFlags(l logger.Logger, cfg interface{}) func() {
-	// Enable debugging if a Debug option is present
-	debug, _ := reflections.GetField(cfg, "Debug")
-	if debug == true {
-		l.SetLevel(logger.DEBUG)
-	} else {
-		l.SetLevel(logger.NOTICE)
+	// Set the minimum level to log, with a Debug option overriding it
+	level := logger.NOTICE
+	if logLevel, err := reflections.GetField(cfg, "LogLevel"); err == nil && logLevel != "" {
+		if level, err = logger.LevelFromString(logLevel.(string)); err != nil {
+			l.Fatal("Invalid --log-level: %v", err)
+		}
 	}
+	if debug, _ := reflections.GetField(cfg, "Debug"); debug == true {
+		level = logger.DEBUG
+	}
+	l.SetLevel(level)
 
 	// Enable experiments
 	experimentNames, err := reflections.GetField(cfg, "Experiments")
@@ -152,6 +212,15 @@ func HandleGlobalFlags(l logger.Logger, cfg interface{}) func() {
 		}
 	}
 
+	// Fail fast on a CA certificate file that can't be used, rather than when
+	// the first API request is made
+	caCert, err := reflections.GetField(cfg, "CACert")
+	if caCert != "" && err == nil {
+		if _, err := api.LoadCACert(caCert.(string)); err != nil {
+			l.Fatal("Invalid --ca-cert: %v", err)
+		}
+	}
+
 	// Handle profiling flag
 	return HandleProfileFlag(l, cfg)
 }
@@ -175,6 +244,55 @@ func UnsetConfigFromEnvironment(c *cli.Context) error {
 	return nil
 }
 
+// applyAgentAccessTokenEnv sets the agent-access-token flag from the
+// environment variable named by the agent-access-token-env flag, if there is
+// one. It must be called before the config is loaded.
+func applyAgentAccessTokenEnv(c *cli.Context) error {
+	name := c.String("agent-access-token-env")
+	if name == "" {
+		return nil
+	}
+
+	token, ok := os.LookupEnv(name)
+	if !ok || token == "" {
+		return fmt.Errorf("The agent access token environment variable %s isn't set", name)
+	}
+
+	return c.Set("agent-access-token", token)
+}
+
+// applyAgentAccessTokenFile sets the agent-access-token flag from the file
+// named by the agent-access-token-file flag, if there is one, with any
+// trailing whitespace removed. It must be called before the config is loaded.
+func applyAgentAccessTokenFile(c *cli.Context) error {
+	path := c.String("agent-access-token-file")
+	if path == "" {
+		return nil
+	}
+
+	if c.String("agent-access-token-env") != "" {
+		return errors.New("--agent-access-token-file and --agent-access-token-env can't be used together")
+	}
+
+	// A token in BUILDKITE_AGENT_ACCESS_TOKEN, like the one every job has,
+	// is replaced, but one given on the command line is a mistake
+	if c.IsSet("agent-access-token") && c.String("agent-access-token") != os.Getenv("BUILDKITE_AGENT_ACCESS_TOKEN") {
+		return errors.New("--agent-access-token-file and --agent-access-token can't be used together")
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Couldn't read the agent access token file: %v", err)
+	}
+
+	token := strings.TrimRightFunc(string(contents), unicode.IsSpace)
+	if token == "" {
+		return fmt.Errorf("The agent access token file %s is empty", path)
+	}
+
+	return c.Set("agent-access-token", token)
+}
+
 func loadAPIClientConfig(cfg interface{}, tokenField string) api.Config {
 	conf := api.Config{
 		UserAgent: agent.UserAgent(),
@@ -201,5 +319,43 @@ func loadAPIClientConfig(cfg interface{}, tokenField string) api.Config {
 		conf.DisableHTTP2 = noHTTP2.(bool)
 	}
 
+	// Commands check the CA certificate file is valid when they start, in
+	// HandleGlobalFlags
+	caCert, err := reflections.GetField(cfg, "CACert")
+	if caCert != "" && err == nil {
+		conf.CACert = caCert.(string)
+		if pool, err := api.LoadCACert(conf.CACert); err == nil {
+			conf.RootCAs = pool
+		}
+	}
+
+	httpsProxy, err := reflections.GetField(cfg, "HTTPSProxy")
+	if httpsProxy != "" && err == nil {
+		conf.HTTPSProxy = httpsProxy.(string)
+	}
+
+	noProxy, err := reflections.GetField(cfg, "NoProxy")
+	if noProxy != "" && err == nil {
+		conf.NoProxy = noProxy.(string)
+	}
+
+	compressUpload, err := reflections.GetField(cfg, "CompressUpload")
+	if compressUpload == true && err == nil {
+		conf.CompressRequestBodies = true
+	}
+
+	compressThreshold, err := reflections.GetField(cfg, "CompressUploadThreshold")
+	if err == nil {
+		conf.CompressionThreshold = compressThreshold.(int)
+	}
+
+	// Commands with a --request-timeout check it's valid when they start
+	requestTimeout, err := reflections.GetField(cfg, "RequestTimeout")
+	if requestTimeout != "" && err == nil {
+		if timeout, err := time.ParseDuration(requestTimeout.(string)); err == nil {
+			conf.Timeout = timeout
+		}
+	}
+
 	return conf
 }
@@ -0,0 +1,47 @@
+package clicommand
+
+import (
+	"strings"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+)
+
+// agentConfigRedactedVars returns the redacted-vars set in the agent's
+// configuration file, and the path of the file. The file is configPath if it
+// isn't empty, like agent start's --config, or otherwise the first of
+// defaultPaths that exists. The names are nil if there's no file or it
+// doesn't set redacted-vars.
+func agentConfigRedactedVars(configPath string, defaultPaths []string) ([]string, string, error) {
+	var file *cliconfig.File
+	if configPath != "" {
+		file = &cliconfig.File{Path: configPath}
+	} else {
+		for _, path := range defaultPaths {
+			if f := (cliconfig.File{Path: path}); f.Exists() {
+				file = &f
+				break
+			}
+		}
+	}
+
+	if file == nil {
+		return nil, "", nil
+	}
+
+	if err := file.Load(); err != nil {
+		return nil, file.Path, err
+	}
+
+	value, ok := file.Config["redacted-vars"]
+	if !ok {
+		return nil, file.Path, nil
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, file.Path, nil
+}
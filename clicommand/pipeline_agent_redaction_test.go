@@ -0,0 +1,50 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentConfigRedactedVars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-redaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	withVars := filepath.Join(dir, "with-vars.cfg")
+	if err := ioutil.WriteFile(withVars, []byte("name=\"agent\"\nredacted-vars=\"*_PASSWORD, MY_KEY,\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	withoutVars := filepath.Join(dir, "without-vars.cfg")
+	if err := ioutil.WriteFile(withoutVars, []byte("name=\"agent\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := filepath.Join(dir, "missing.cfg")
+
+	names, path, err := agentConfigRedactedVars(withVars, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, withVars, path)
+	assert.Equal(t, []string{"*_PASSWORD", "MY_KEY"}, names)
+
+	// The first default path that exists is used
+	names, path, err = agentConfigRedactedVars("", []string{missing, withoutVars, withVars})
+	assert.NoError(t, err)
+	assert.Equal(t, withoutVars, path)
+	assert.Nil(t, names)
+
+	names, path, err = agentConfigRedactedVars("", []string{missing})
+	assert.NoError(t, err)
+	assert.Equal(t, "", path)
+	assert.Nil(t, names)
+
+	// A config file that was asked for has to exist
+	_, _, err = agentConfigRedactedVars(missing, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,39 @@
+package clicommand
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// downloadPipelineArtifact downloads the one artifact in a build whose path
+// matches query, which can be a glob, and returns its contents and path
+func downloadPipelineArtifact(l logger.Logger, client agent.APIClient, buildID string, query string) ([]byte, string, error) {
+	artifacts, err := agent.NewArtifactSearcher(l, client, buildID).Search(query, "", false, false)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to search for artifacts: %v", err)
+	}
+
+	switch len(artifacts) {
+	case 0:
+		return nil, "", fmt.Errorf("No artifacts in the build match %q", query)
+	case 1:
+	default:
+		paths := make([]string, 0, len(artifacts))
+		for _, artifact := range artifacts {
+			paths = append(paths, artifact.Path)
+		}
+		return nil, "", fmt.Errorf("%d artifacts in the build match %q, but only one pipeline can be uploaded: %s",
+			len(artifacts), query, strings.Join(paths, ", "))
+	}
+
+	var buf bytes.Buffer
+	if _, err := client.DownloadArtifact(artifacts[0], &buf); err != nil {
+		return nil, "", fmt.Errorf("Failed to download artifact %s: %v", artifacts[0].Path, err)
+	}
+
+	return buf.Bytes(), artifacts[0].Path, nil
+}
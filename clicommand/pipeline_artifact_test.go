@@ -0,0 +1,54 @@
+package clicommand
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadPipelineArtifact(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case `/builds/my-build/artifacts/search`:
+			switch req.URL.Query().Get("query") {
+			case "pipeline.yml":
+				fmt.Fprintf(rw, `[{"path": "pipeline.yml", "url": "http://%s/download"}]`, req.Host)
+			case "*.yml":
+				fmt.Fprint(rw, `[{"path": "one.yml"}, {"path": "two.yml"}]`)
+			default:
+				fmt.Fprint(rw, `[]`)
+			}
+		case `/download`:
+			if auth := req.Header.Get("Authorization"); auth != "" {
+				t.Errorf("Artifact was downloaded with Authorization %q", auth)
+			}
+			fmt.Fprint(rw, "steps: []")
+		default:
+			http.Error(rw, "Not found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{
+		Endpoint: server.URL,
+		Token:    `llamasforever`,
+	})
+
+	input, path, err := downloadPipelineArtifact(logger.Discard, client, "my-build", "pipeline.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "steps: []", string(input))
+	assert.Equal(t, "pipeline.yml", path)
+
+	_, _, err = downloadPipelineArtifact(logger.Discard, client, "my-build", "*.yml")
+	assert.EqualError(t, err, `2 artifacts in the build match "*.yml", but only one pipeline can be uploaded: one.yml, two.yml`)
+
+	_, _, err = downloadPipelineArtifact(logger.Discard, client, "my-build", "missing.yml")
+	assert.EqualError(t, err, `No artifacts in the build match "missing.yml"`)
+}
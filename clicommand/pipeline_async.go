@@ -0,0 +1,59 @@
+package clicommand
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retry"
+)
+
+// asyncPollMaxInterval is the longest --async-wait waits between checks on
+// a pipeline upload, as the interval doubles after each one
+const asyncPollMaxInterval = 30 * time.Second
+
+// errPipelineUploadPending is returned while the Agent API is still
+// processing a pipeline upload, so that it's checked again
+var errPipelineUploadPending = errors.New("The pipeline upload is still being processed")
+
+// waitForPipelineUpload polls the Agent API until it has applied or rejected
+// the pipeline upload with the given UUID, returning its final status. It
+// stops with ctx.Err() if ctx is done first.
+func waitForPipelineUpload(ctx context.Context, l logger.Logger, client *api.Client, jobID, uuid string, interval time.Duration) (*api.PipelineUploadStatus, error) {
+	// Polling forever needs an interval, even if retries don't wait
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	var status *api.PipelineUploadStatus
+
+	err := retry.DoWithContext(ctx, func(s *retry.Stats) error {
+		var err error
+		var resp *api.Response
+		status, resp, err = client.PipelineUploadStatus(jobID, uuid)
+		if err != nil {
+			// Don't bother retrying if the response was one of these statuses
+			if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 403 || resp.StatusCode == 404) {
+				s.Break()
+				return err
+			}
+			l.Warn("%s (%s)", err, s)
+			return err
+		}
+
+		switch status.State {
+		case api.PipelineUploadStateApplied, api.PipelineUploadStateRejected:
+			return nil
+		default:
+			l.Debug("The pipeline upload is %s (%s)", status.State, s)
+			return errPipelineUploadPending
+		}
+	}, &retry.Config{Forever: true, Interval: interval, Exponential: true, MaxInterval: asyncPollMaxInterval, ProportionalJitter: true})
+	if err != nil {
+		return nil, err
+	}
+
+	return status, nil
+}
@@ -0,0 +1,64 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitForPipelineUpload(t *testing.T) {
+	polls := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		polls[req.URL.Path]++
+		switch {
+		case req.URL.Path == "/jobs/job-id/pipelines/missing":
+			http.Error(rw, "Not Found", http.StatusNotFound)
+		case polls[req.URL.Path] < 3:
+			fmt.Fprint(rw, `{"state":"pending"}`)
+		case req.URL.Path == "/jobs/job-id/pipelines/applied":
+			fmt.Fprint(rw, `{"state":"applied"}`)
+		case req.URL.Path == "/jobs/job-id/pipelines/rejected":
+			fmt.Fprint(rw, `{"state":"rejected","message":"The pipeline is invalid","errors":["steps[0] has no command"]}`)
+		default:
+			fmt.Fprint(rw, `{"state":"pending"}`)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+	ctx := context.Background()
+
+	status, err := waitForPipelineUpload(ctx, logger.Discard, client, "job-id", "applied", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, api.PipelineUploadStateApplied, status.State)
+	assert.Equal(t, 3, polls["/jobs/job-id/pipelines/applied"])
+
+	status, err = waitForPipelineUpload(ctx, logger.Discard, client, "job-id", "rejected", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &api.PipelineUploadStatus{
+		State:   api.PipelineUploadStateRejected,
+		Message: "The pipeline is invalid",
+		Errors:  []string{"steps[0] has no command"},
+	}, status)
+
+	_, err = waitForPipelineUpload(ctx, logger.Discard, client, "job-id", "missing", time.Millisecond)
+	if assert.Error(t, err) {
+		assert.Equal(t, 1, polls["/jobs/job-id/pipelines/missing"])
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = waitForPipelineUpload(ctx, logger.Discard, client, "job-id", "pending", time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
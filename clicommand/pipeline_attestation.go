@@ -0,0 +1,189 @@
+package clicommand
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/buildkite/agent/v3/env"
+)
+
+const (
+	inTotoStatementType  = "https://in-toto.io/Statement/v0.1"
+	inTotoPayloadType    = "application/vnd.in-toto+json"
+	slsaProvenanceType   = "https://slsa.dev/provenance/v0.2"
+	pipelineUploadType   = "https://buildkite.com/docs/agent/v3/cli-pipeline#uploading-pipelines"
+	defaultAttestationID = "buildkite-agent"
+)
+
+// attestationStatement is an in-toto statement that a pipeline was uploaded,
+// with SLSA provenance describing where it came from
+type attestationStatement struct {
+	Type          string                `json:"_type"`
+	Subject       []attestationArtifact `json:"subject"`
+	PredicateType string                `json:"predicateType"`
+	Predicate     attestationProvenance `json:"predicate"`
+}
+
+type attestationArtifact struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+type attestationProvenance struct {
+	Builder struct {
+		ID string `json:"id"`
+	} `json:"builder"`
+	BuildType  string                `json:"buildType"`
+	Invocation attestationInvocation `json:"invocation"`
+	Materials  []attestationArtifact `json:"materials"`
+}
+
+type attestationInvocation struct {
+	Environment map[string]string `json:"environment"`
+}
+
+// attestationEnvelope is a DSSE envelope holding a signed statement
+type attestationEnvelope struct {
+	PayloadType string                 `json:"payloadType"`
+	Payload     string                 `json:"payload"`
+	Signatures  []attestationSignature `json:"signatures"`
+}
+
+type attestationSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// attestationSource is a file or other input that a pipeline was read from
+type attestationSource struct {
+	Name string
+	Data []byte
+}
+
+// newUploadAttestation describes the upload of pipeline, which was generated
+// from sources. The uploader and the commit the pipeline was built from are
+// taken from the job's environment.
+func newUploadAttestation(sources []attestationSource, pipeline []byte, environ *env.Environment) attestationStatement {
+	statement := attestationStatement{
+		Type: inTotoStatementType,
+		Subject: []attestationArtifact{
+			{Name: "pipeline.json", Digest: sha256Digest(pipeline)},
+		},
+		PredicateType: slsaProvenanceType,
+	}
+
+	provenance := &statement.Predicate
+	provenance.Builder.ID = defaultAttestationID
+	if buildURL, ok := environ.Get("BUILDKITE_BUILD_URL"); ok && buildURL != "" {
+		provenance.Builder.ID = buildURL
+	}
+	provenance.BuildType = pipelineUploadType
+
+	provenance.Invocation.Environment = map[string]string{}
+	for _, name := range []string{"BUILDKITE_AGENT_NAME", "BUILDKITE_JOB_ID", "BUILDKITE_BUILD_ID", "BUILDKITE_PIPELINE_SLUG"} {
+		if value, ok := environ.Get(name); ok && value != "" {
+			provenance.Invocation.Environment[name] = value
+		}
+	}
+
+	provenance.Materials = []attestationArtifact{}
+	for _, source := range sources {
+		provenance.Materials = append(provenance.Materials, attestationArtifact{
+			URI:    source.Name,
+			Digest: sha256Digest(source.Data),
+		})
+	}
+	repo, _ := environ.Get("BUILDKITE_REPO")
+	if commit, ok := environ.Get("BUILDKITE_COMMIT"); ok && commit != "" {
+		provenance.Materials = append(provenance.Materials, attestationArtifact{
+			URI:    repo,
+			Digest: map[string]string{"sha1": commit},
+		})
+	}
+
+	return statement
+}
+
+func sha256Digest(b []byte) map[string]string {
+	sum := sha256.Sum256(b)
+	return map[string]string{"sha256": hex.EncodeToString(sum[:])}
+}
+
+// loadAttestationKey reads a PEM encoded PKCS #8 or EC private key to sign
+// attestations with
+func loadAttestationKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read attestation signing key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("Attestation signing key isn't PEM encoded")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("Unsupported attestation signing key type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse attestation signing key: %v", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Attestation signing key of type %T can't sign", key)
+	}
+	return signer, nil
+}
+
+// marshalAttestation returns the statement as JSON, or if key isn't nil, a
+// DSSE envelope of the statement signed with key
+func marshalAttestation(statement attestationStatement, key crypto.Signer) ([]byte, error) {
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return json.MarshalIndent(statement, "", "  ")
+	}
+
+	// DSSE signs a pre-authentication encoding of the payload and its type
+	pae := []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(inTotoPayloadType), inTotoPayloadType, len(payload), payload))
+
+	var sig []byte
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, err = key.Sign(rand.Reader, pae, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(pae)
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign attestation: %v", err)
+	}
+
+	return json.MarshalIndent(attestationEnvelope{
+		PayloadType: inTotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []attestationSignature{
+			{Sig: base64.StdEncoding.EncodeToString(sig)},
+		},
+	}, "", "  ")
+}
@@ -0,0 +1,105 @@
+package clicommand
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewUploadAttestation(t *testing.T) {
+	environ := env.FromSlice([]string{
+		"BUILDKITE_BUILD_URL=https://buildkite.com/acme/app/builds/1",
+		"BUILDKITE_AGENT_NAME=agent-1",
+		"BUILDKITE_JOB_ID=job-1",
+		"BUILDKITE_REPO=git@github.com:acme/app.git",
+		"BUILDKITE_COMMIT=0123456789abcdef0123456789abcdef01234567",
+	})
+
+	statement := newUploadAttestation([]attestationSource{{Name: ".buildkite/pipeline.yml", Data: []byte("steps: []")}}, []byte(`{"steps":[]}`), environ)
+
+	j, err := json.Marshal(statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{
+		"_type": "https://in-toto.io/Statement/v0.1",
+		"subject": [{"name": "pipeline.json", "digest": {"sha256": "4430e7786edc0f8419f02e909c15422ebf572287a58132d8f6f33250ce053121"}}],
+		"predicateType": "https://slsa.dev/provenance/v0.2",
+		"predicate": {
+			"builder": {"id": "https://buildkite.com/acme/app/builds/1"},
+			"buildType": "https://buildkite.com/docs/agent/v3/cli-pipeline#uploading-pipelines",
+			"invocation": {"environment": {"BUILDKITE_AGENT_NAME": "agent-1", "BUILDKITE_JOB_ID": "job-1"}},
+			"materials": [
+				{"uri": ".buildkite/pipeline.yml", "digest": {"sha256": "557a607701752acc545cdabbc5ff51f641ebb7d078ef33d2760bc1e408f7a888"}},
+				{"uri": "git@github.com:acme/app.git", "digest": {"sha1": "0123456789abcdef0123456789abcdef01234567"}}
+			]
+		}
+	}`, string(j))
+}
+
+func TestMarshalAttestationSigned(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "attestation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := loadAttestationKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statement := newUploadAttestation([]attestationSource{{Name: "(stdin)", Data: []byte("steps: []")}}, []byte(`{"steps":[]}`), env.New())
+
+	j, err := marshalAttestation(statement, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var envelope attestationEnvelope
+	if err := json.Unmarshal(j, &envelope); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(envelope.Signatures[0].Sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pae := fmt.Sprintf("DSSEv1 %d %s %d %s", len(envelope.PayloadType), envelope.PayloadType, len(payload), payload)
+
+	assert.Equal(t, "application/vnd.in-toto+json", envelope.PayloadType)
+	assert.True(t, ed25519.Verify(public, []byte(pae), sig))
+	assert.Contains(t, string(payload), `"builder":{"id":"buildkite-agent"}`)
+}
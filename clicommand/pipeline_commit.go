@@ -0,0 +1,43 @@
+package clicommand
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// resolveCommit replaces a BUILDKITE_COMMIT in environ like HEAD or a branch
+// name with the commit hash that git rev-parse resolves it to, running git in
+// dir, or the current directory if it's empty. It's left alone if it can't be
+// resolved.
+func resolveCommit(l logger.Logger, environ *env.Environment, dir string) {
+	commitRef, ok := environ.Get(`BUILDKITE_COMMIT`)
+	if !ok {
+		return
+	}
+
+	cmd := exec.Command(`git`, `rev-parse`, commitRef)
+	cmd.Dir = dir
+	cmdOut, err := cmd.Output()
+	if err != nil {
+		// Pipelines are often uploaded from outside a checkout, where there's
+		// nothing to resolve the commit in
+		if exitErr, ok := err.(*exec.ExitError); ok && bytes.Contains(exitErr.Stderr, []byte("not a git repository")) {
+			where := dir
+			if where == "" {
+				where = "the current directory"
+			}
+			l.Debug("Not resolving BUILDKITE_COMMIT %q as %s isn't in a git repository", commitRef, where)
+			return
+		}
+		l.Warn("Error running git rev-parse %q: %v", commitRef, err)
+		return
+	}
+
+	trimmedCmdOut := strings.TrimSpace(string(cmdOut))
+	l.Info("Updating BUILDKITE_COMMIT to %q", trimmedCmdOut)
+	environ.Set(`BUILDKITE_COMMIT`, trimmedCmdOut)
+}
@@ -0,0 +1,106 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+func TestResolveCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	dir, err := ioutil.TempDir("", "resolve-commit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Outside a repository it's only worth a debug message
+	environ := env.FromSlice([]string{"BUILDKITE_COMMIT=HEAD"})
+	l := logger.NewBuffer()
+	resolveCommit(l, environ, dir)
+	commit, _ := environ.Get("BUILDKITE_COMMIT")
+	assert.Equal(t, "HEAD", commit)
+	assert.Equal(t, []string{`[debug] Not resolving BUILDKITE_COMMIT "HEAD" as ` + dir + ` isn't in a git repository`}, l.Messages)
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"-c", "user.name=Llama", "-c", "user.email=llama@example.com", "commit", "-q", "--allow-empty", "-m", "Initial commit"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v %s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	head, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolveCommit(logger.Discard, environ, dir)
+	commit, _ = environ.Get("BUILDKITE_COMMIT")
+	assert.Equal(t, strings.TrimSpace(string(head)), commit)
+}
+
+func TestPipelineUploadCommandNoGitCommitResolution(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pipelinePath := filepath.Join(dir, "pipeline.yml")
+	if err := ioutil.WriteFile(pipelinePath, []byte("steps:\n  - command: deploy $BUILDKITE_COMMIT\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{
+		"BUILDKITE_AGENT_ACCESS_TOKEN": "llamas",
+		"BUILDKITE_COMMIT":             "HEAD",
+	} {
+		if old, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Setenv(name, value)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{PipelineUploadCommand}
+	err = app.Run([]string{"buildkite-agent", "upload", "--no-color", "--dry-run", "--no-git-commit-resolution", pipelinePath})
+
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(output), "deploy HEAD")
+}
@@ -0,0 +1,341 @@
+package clicommand
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retry"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// diffContextLines is how many unchanged lines --diff shows around changes
+const diffContextLines = 3
+
+// stepDiff is what --diff-format=json outputs: the steps that uploading the
+// pipeline would add, remove and change, compared to the current pipeline
+type stepDiff struct {
+	Added   []stepDiffStep   `json:"added"`
+	Removed []stepDiffStep   `json:"removed"`
+	Changed []stepDiffChange `json:"changed"`
+}
+
+// stepDiffStep is a step that was added or removed. Steps without a key have
+// an empty key.
+type stepDiffStep struct {
+	Key  string      `json:"key,omitempty"`
+	Step interface{} `json:"step"`
+}
+
+// stepDiffChange is a step with a key that's in both pipelines, but differs
+type stepDiffChange struct {
+	Key    string      `json:"key"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// diffLine is a line of a diff, prefixed with ' ', '-' or '+'
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// fetchCurrentPipeline gets the pipeline already uploaded to the job's build
+// from the Agent API, retrying server errors
+func fetchCurrentPipeline(l logger.Logger, client *api.Client, jobID string) (*api.Pipeline, error) {
+	var pipeline *api.Pipeline
+	err := retry.Do(func(s *retry.Stats) error {
+		var err error
+		var resp *api.Response
+		pipeline, resp, err = client.GetPipeline(jobID)
+		// Don't bother retrying if the response was one of these statuses
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+			return err
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+
+	return pipeline, err
+}
+
+// parseCurrentPipeline turns the pipeline fetched from the Agent API into a
+// parser result, without interpolating it, so that it can be redacted and
+// compared like the pipeline being uploaded
+func parseCurrentPipeline(current *api.Pipeline) (*agent.PipelineParserResult, error) {
+	j, err := json.Marshal(current.Pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	result, _, err := agent.PipelineParser{
+		Filename:        "current pipeline",
+		Pipeline:        j,
+		NoInterpolation: true,
+	}.Parse()
+	return result, err
+}
+
+// formatPipelineForDiff writes a pipeline in the --dry-run-format for
+// diffing. It's round tripped through JSON first, so that keys are sorted the
+// same way whether the pipeline came from the API or was just parsed.
+func formatPipelineForDiff(format string, pipeline interface{}) (string, error) {
+	j, err := json.Marshal(pipeline)
+	if err != nil {
+		return "", err
+	}
+
+	var normalized interface{}
+	if err := json.Unmarshal(j, &normalized); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := writeDryRunOutput(&buf, format, normalized); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// stepMatch is how a top-level step of a new pipeline compares to the steps
+// of the current pipeline
+type stepMatch struct {
+	key  string
+	step interface{}
+
+	// The step in the current pipeline it was matched with, if found
+	current interface{}
+	found   bool
+}
+
+// changed returns whether the step was matched by key with a step that
+// differs from it
+func (m stepMatch) changed() bool {
+	return m.found && !reflect.DeepEqual(m.current, m.step)
+}
+
+// matchSteps matches each step in after with one in before. Steps are matched
+// by their key (or identifier or id). Steps without a key can't be matched up
+// like that, so they're only matched with an identical step. It returns the
+// steps in before that weren't matched too.
+func matchSteps(before, after []interface{}) ([]stepMatch, []interface{}) {
+	beforeByKey := map[string]interface{}{}
+	for _, step := range before {
+		if key := diffStepKey(step); key != "" {
+			beforeByKey[key] = step
+		}
+	}
+
+	afterKeys := map[string]bool{}
+	matched := make([]bool, len(before))
+	matches := make([]stepMatch, len(after))
+	for i, step := range after {
+		m := stepMatch{key: diffStepKey(step), step: step}
+
+		if m.key != "" {
+			afterKeys[m.key] = true
+			m.current, m.found = beforeByKey[m.key]
+		} else {
+			// Match each step without a key with an identical one, at most once
+			for j, existing := range before {
+				if !matched[j] && diffStepKey(existing) == "" && reflect.DeepEqual(existing, step) {
+					matched[j] = true
+					m.current, m.found = existing, true
+					break
+				}
+			}
+		}
+
+		matches[i] = m
+	}
+
+	var unmatched []interface{}
+	for i, step := range before {
+		key := diffStepKey(step)
+		if (key != "" && !afterKeys[key]) || (key == "" && !matched[i]) {
+			unmatched = append(unmatched, step)
+		}
+	}
+
+	return matches, unmatched
+}
+
+// diffSteps compares the top-level steps of two pipelines, matching them up
+// like matchSteps does. Steps without a key that aren't in both pipelines are
+// removed and added, rather than changed.
+func diffSteps(before, after interface{}) (stepDiff, error) {
+	diff := stepDiff{
+		Added:   []stepDiffStep{},
+		Removed: []stepDiffStep{},
+		Changed: []stepDiffChange{},
+	}
+
+	beforeSteps, err := pipelineStepsForDiff(before)
+	if err != nil {
+		return diff, err
+	}
+	afterSteps, err := pipelineStepsForDiff(after)
+	if err != nil {
+		return diff, err
+	}
+
+	matches, unmatched := matchSteps(beforeSteps, afterSteps)
+	for _, m := range matches {
+		switch {
+		case !m.found:
+			diff.Added = append(diff.Added, stepDiffStep{Key: m.key, Step: m.step})
+		case m.changed():
+			diff.Changed = append(diff.Changed, stepDiffChange{Key: m.key, Before: m.current, After: m.step})
+		}
+	}
+	for _, step := range unmatched {
+		diff.Removed = append(diff.Removed, stepDiffStep{Key: diffStepKey(step), Step: step})
+	}
+
+	return diff, nil
+}
+
+// pipelineStepsForDiff returns the top-level steps of a pipeline, round
+// tripped through JSON so that steps from the API and from parsing compare
+// the same way
+func pipelineStepsForDiff(pipeline interface{}) ([]interface{}, error) {
+	j, err := json.Marshal(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized struct {
+		Steps []interface{} `json:"steps"`
+	}
+	if err := json.Unmarshal(j, &normalized); err != nil {
+		return nil, err
+	}
+	return normalized.Steps, nil
+}
+
+// diffStepKey returns the key of a step, which can also be given as its
+// identifier or id, or an empty string if it doesn't have one
+func diffStepKey(step interface{}) string {
+	m, ok := step.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for _, k := range []string{"key", "identifier", "id"} {
+		if key, ok := m[k].(string); ok && key != "" {
+			return key
+		}
+	}
+	return ""
+}
+
+// unifiedDiff returns a unified diff from before to after, with their names
+// in the header. It's empty if they're the same.
+func unifiedDiff(beforeName, afterName, before, after string) string {
+	dmp := diffmatchpatch.New()
+	beforeRunes, afterRunes, lines := dmp.DiffLinesToRunes(before, after)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMainRunes(beforeRunes, afterRunes, false), lines)
+
+	var diffLines []diffLine
+	changed := false
+	for _, d := range diffs {
+		op := byte(' ')
+		switch d.Type {
+		case diffmatchpatch.DiffDelete:
+			op = '-'
+			changed = true
+		case diffmatchpatch.DiffInsert:
+			op = '+'
+			changed = true
+		}
+		for _, text := range strings.SplitAfter(d.Text, "\n") {
+			if text != "" {
+				diffLines = append(diffLines, diffLine{op: op, text: text})
+			}
+		}
+	}
+
+	if !changed {
+		return ""
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", beforeName, afterName)
+
+	// The line numbers in before and after that each diff line starts at
+	beforeLine := make([]int, len(diffLines)+1)
+	afterLine := make([]int, len(diffLines)+1)
+	for i, line := range diffLines {
+		beforeLine[i+1], afterLine[i+1] = beforeLine[i], afterLine[i]
+		if line.op != '+' {
+			beforeLine[i+1]++
+		}
+		if line.op != '-' {
+			afterLine[i+1]++
+		}
+	}
+
+	for i := 0; i < len(diffLines); {
+		// Skip to the next change
+		for i < len(diffLines) && diffLines[i].op == ' ' {
+			i++
+		}
+		if i == len(diffLines) {
+			break
+		}
+
+		// Changes close enough that their context would overlap are shown
+		// in the same hunk
+		last := i
+		for j := i; j < len(diffLines) && j-last <= 2*diffContextLines; j++ {
+			if diffLines[j].op != ' ' {
+				last = j
+			}
+		}
+
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		end := last + diffContextLines + 1
+		if end > len(diffLines) {
+			end = len(diffLines)
+		}
+
+		fmt.Fprintf(&b, "@@ -%s +%s @@\n",
+			hunkRange(beforeLine[start], beforeLine[end]-beforeLine[start]),
+			hunkRange(afterLine[start], afterLine[end]-afterLine[start]))
+		for _, line := range diffLines[start:end] {
+			b.WriteByte(line.op)
+			b.WriteString(line.text)
+			if !strings.HasSuffix(line.text, "\n") {
+				b.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		i = end
+	}
+
+	return b.String()
+}
+
+// hunkRange formats the lines a hunk covers for its header. An empty range
+// is given by the line before it.
+func hunkRange(before, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", before)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", before+1)
+	}
+	return fmt.Sprintf("%d,%d", before+1, count)
+}
@@ -0,0 +1,106 @@
+package clicommand
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	before := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"
+	after := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nm\nn\n"
+
+	assert.Equal(t, strings.Join([]string{
+		"--- current",
+		"+++ pipeline.yml",
+		"@@ -1,5 +1,5 @@",
+		" a",
+		"-b",
+		"+B",
+		" c",
+		" d",
+		" e",
+		"@@ -9,5 +9,5 @@",
+		" i",
+		" j",
+		" k",
+		"-l",
+		" m",
+		"+n",
+		"",
+	}, "\n"), unifiedDiff("current", "pipeline.yml", before, after))
+
+	assert.Equal(t, "", unifiedDiff("current", "pipeline.yml", before, before))
+
+	assert.Equal(t, "--- current\n+++ pipeline.yml\n@@ -0,0 +1,2 @@\n+a\n+b\n", unifiedDiff("current", "pipeline.yml", "", "a\nb\n"))
+}
+
+func TestFormatPipelineForDiffSortsKeys(t *testing.T) {
+	formatted, err := formatPipelineForDiff("yaml", map[string]interface{}{
+		"steps": []interface{}{map[string]interface{}{"label": "test", "command": "make test"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "steps:\n- command: make test\n  label: test\n", formatted)
+}
+
+func TestDiffSteps(t *testing.T) {
+	step := func(attrs ...string) map[string]interface{} {
+		m := map[string]interface{}{}
+		for i := 0; i < len(attrs); i += 2 {
+			m[attrs[i]] = attrs[i+1]
+		}
+		return m
+	}
+
+	before := map[string]interface{}{
+		"steps": []interface{}{
+			step("key", "test", "command", "make test"),
+			step("key", "lint", "command", "make lint"),
+			step("command", "echo unkeyed"),
+			"wait",
+			step("identifier", "deploy", "command", "make deploy"),
+		},
+	}
+	after := map[string]interface{}{
+		"steps": []interface{}{
+			step("key", "test", "command", "make test"),
+			step("command", "echo unkeyed"),
+			"wait",
+			step("identifier", "deploy", "command", "make deploy production"),
+			step("key", "notify", "command", "make notify"),
+			step("command", "echo another"),
+		},
+	}
+
+	diff, err := diffSteps(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, stepDiff{
+		Added: []stepDiffStep{
+			{Key: "notify", Step: map[string]interface{}{"key": "notify", "command": "make notify"}},
+			{Step: map[string]interface{}{"command": "echo another"}},
+		},
+		Removed: []stepDiffStep{
+			{Key: "lint", Step: map[string]interface{}{"key": "lint", "command": "make lint"}},
+		},
+		Changed: []stepDiffChange{
+			{
+				Key:    "deploy",
+				Before: map[string]interface{}{"identifier": "deploy", "command": "make deploy"},
+				After:  map[string]interface{}{"identifier": "deploy", "command": "make deploy production"},
+			},
+		},
+	}, diff)
+
+	// No changes are still output as empty lists
+	diff, err = diffSteps(before, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, stepDiff{Added: []stepDiffStep{}, Removed: []stepDiffStep{}, Changed: []stepDiffChange{}}, diff)
+}
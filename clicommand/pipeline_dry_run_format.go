@@ -0,0 +1,30 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/buildkite/yaml"
+)
+
+// writeDryRunOutput writes output to w in the given format, either json or yaml
+func writeDryRunOutput(w io.Writer, format string, output interface{}) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(output)
+
+	case "yaml":
+		data, err := yaml.Marshal(output)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+
+	default:
+		return fmt.Errorf("Unknown dry-run format %q", format)
+	}
+}
@@ -0,0 +1,29 @@
+package clicommand
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteDryRunOutput(t *testing.T) {
+	result, _, err := agent.PipelineParser{
+		Pipeline:        []byte("steps:\n  - label: test\n    command: make test\n  - wait\n"),
+		NoInterpolation: true,
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, writeDryRunOutput(&out, "json", result))
+	assert.Equal(t, "{\n  \"steps\": [\n    {\n      \"label\": \"test\",\n      \"command\": \"make test\"\n    },\n    \"wait\"\n  ]\n}\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, writeDryRunOutput(&out, "yaml", result))
+	assert.Equal(t, "steps:\n- label: test\n  command: make test\n- wait\n", out.String())
+
+	assert.Error(t, writeDryRunOutput(&out, "toml", result))
+}
@@ -0,0 +1,149 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retry"
+)
+
+// ensurePipelineStep checks whether the pipeline's only step already exists in
+// the build, and returns true if it still needs to be uploaded. If update is
+// true, attributes of an existing step that differ from the pipeline's step
+// are updated in place.
+func ensurePipelineStep(l logger.Logger, client *api.Client, result *agent.PipelineParserResult, update bool) bool {
+	step, err := pipelineEnsureStep(result)
+	if err != nil {
+		l.Fatal("%s", err)
+	}
+
+	key := step["key"].(string)
+
+	// Fetch the existing step, if there is one
+	var export *api.StepExportResponse
+	var resp *api.Response
+	err = retry.Do(func(s *retry.Stats) error {
+		export, resp, err = client.StepExport(key, &api.StepExportRequest{Format: "json"})
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+			return err
+		}
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+
+	if resp != nil && resp.StatusCode == 404 {
+		l.Debug("Step %q doesn't exist in the build yet", key)
+		return true
+	}
+	if err != nil {
+		l.Fatal("Failed to check whether step %q exists: %s", key, err)
+	}
+
+	if !update {
+		l.Info("Step %q already exists in the build, so it won't be uploaded", key)
+		return false
+	}
+
+	var existing map[string]interface{}
+	if err := json.Unmarshal([]byte(export.Output), &existing); err != nil {
+		l.Fatal("Failed to parse existing step %q: %s", key, err)
+	}
+
+	if updated := updateStepAttributes(l, client, key, step, existing); updated == 0 {
+		l.Info("Step %q already exists in the build and hasn't changed", key)
+	} else {
+		l.Info("Updated %d attributes of existing step %q", updated, key)
+	}
+
+	return false
+}
+
+// updateStepAttributes updates the attributes of the existing step with the
+// given key that differ in step, and returns how many it updated. Only text
+// attributes can be updated, so it warns about others that have changed.
+func updateStepAttributes(l logger.Logger, client *api.Client, key string, step, existing map[string]interface{}) int {
+	// Update the attributes that have changed in a consistent order
+	attributes := make([]string, 0, len(step))
+	for attribute := range step {
+		attributes = append(attributes, attribute)
+	}
+	sort.Strings(attributes)
+
+	updated := 0
+	for _, attribute := range attributes {
+		value := step[attribute]
+		if attribute == "key" || reflect.DeepEqual(value, existing[attribute]) {
+			continue
+		}
+
+		str, ok := value.(string)
+		if !ok {
+			l.Warn("Step %q attribute %q has changed, but only text attributes can be updated", key, attribute)
+			continue
+		}
+
+		err := retry.Do(func(s *retry.Stats) error {
+			resp, err := client.StepUpdate(key, &api.StepUpdate{
+				IdempotencyUUID: api.NewUUID(),
+				Attribute:       attribute,
+				Value:           str,
+			})
+			if resp != nil && (resp.StatusCode == 400 || resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 422) {
+				s.Break()
+			}
+			if err != nil {
+				l.Warn("%s (%s)", err, s)
+			}
+
+			return err
+		}, &retry.Config{Maximum: 10, Interval: 5 * time.Second})
+		if err != nil {
+			l.Fatal("Failed to update attribute %q of step %q: %s", attribute, key, err)
+		}
+
+		updated++
+	}
+
+	return updated
+}
+
+// pipelineEnsureStep returns the single step of a pipeline, which must have a
+// key so that it can be found in the build
+func pipelineEnsureStep(result *agent.PipelineParserResult) (map[string]interface{}, error) {
+	j, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	var pipeline struct {
+		Steps []interface{} `json:"steps"`
+	}
+	if err := json.Unmarshal(j, &pipeline); err != nil {
+		return nil, err
+	}
+
+	if len(pipeline.Steps) != 1 {
+		return nil, fmt.Errorf("Ensuring a step requires a pipeline with exactly 1 step, found %d", len(pipeline.Steps))
+	}
+
+	step, ok := pipeline.Steps[0].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Ensuring a step requires a step with a key, found %v", pipeline.Steps[0])
+	}
+
+	if key, ok := step["key"].(string); !ok || key == "" {
+		return nil, fmt.Errorf("Ensuring a step requires the step to have a key")
+	}
+
+	return step, nil
+}
@@ -0,0 +1,31 @@
+package clicommand
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipelineEnsureStep(t *testing.T) {
+	for _, tc := range []struct {
+		pipeline string
+		err      bool
+	}{
+		{"steps:\n  - command: make\n    key: build\n", false},
+		{"steps:\n  - command: make\n", true},
+		{"steps:\n  - wait\n", true},
+		{"steps:\n  - command: make\n    key: a\n  - command: make\n    key: b\n", true},
+	} {
+		result, _, err := agent.PipelineParser{Pipeline: []byte(tc.pipeline)}.Parse()
+		assert.NoError(t, err)
+
+		step, err := pipelineEnsureStep(result)
+		if tc.err {
+			assert.Error(t, err, tc.pipeline)
+		} else {
+			assert.NoError(t, err, tc.pipeline)
+			assert.Equal(t, "build", step["key"])
+		}
+	}
+}
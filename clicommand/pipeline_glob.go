@@ -0,0 +1,43 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// expandPipelinePaths replaces each of the pipeline file paths that's a glob,
+// like .buildkite/steps/*.yml, with the files it matches in lexical order.
+// Paths that exist as they are, SSH paths and URLs are left alone. It's an
+// error for a glob to match nothing, so a mistyped glob isn't read as a file
+// name.
+func expandPipelinePaths(paths []string) ([]string, error) {
+	var expanded []string
+
+	for _, p := range paths {
+		if _, _, ok := parseSSHPath(p); ok || !strings.ContainsAny(p, "*?[") {
+			expanded = append(expanded, p)
+			continue
+		}
+		if _, ok := parsePipelineURL(p); ok {
+			expanded = append(expanded, p)
+			continue
+		}
+		if _, err := os.Stat(p); err == nil {
+			expanded = append(expanded, p)
+			continue
+		}
+
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, fmt.Errorf("Bad pipeline file pattern \"%s\": %v", p, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("No pipeline files match \"%s\"", p)
+		}
+		expanded = append(expanded, matches...)
+	}
+
+	return expanded, nil
+}
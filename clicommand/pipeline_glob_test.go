@@ -0,0 +1,43 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandPipelinePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline-glob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"b.yml", "a.yml", "c.json", "[literal].yml"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("steps: []\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	paths, err := expandPipelinePaths([]string{
+		filepath.Join(dir, "pipeline.yml"),
+		filepath.Join(dir, "*.yml"),
+		filepath.Join(dir, "[literal].yml"),
+		"me@example.com:steps/*.yml",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "pipeline.yml"),
+		filepath.Join(dir, "[literal].yml"),
+		filepath.Join(dir, "a.yml"),
+		filepath.Join(dir, "b.yml"),
+		filepath.Join(dir, "[literal].yml"),
+		"me@example.com:steps/*.yml",
+	}, paths)
+
+	_, err = expandPipelinePaths([]string{filepath.Join(dir, "*.yaml")})
+	assert.EqualError(t, err, "No pipeline files match \""+filepath.Join(dir, "*.yaml")+"\"")
+}
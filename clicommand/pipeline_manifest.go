@@ -0,0 +1,141 @@
+package clicommand
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/yaml"
+	"github.com/oleiade/reflections"
+	"github.com/urfave/cli"
+)
+
+// pipelineManifestFileKey is the manifest key for the pipeline file, which is
+// otherwise given as the first argument to the command
+const pipelineManifestFileKey = "pipeline"
+
+// pipelineManifestIgnoredOptions can't be set from a manifest, as manifests
+// are usually committed alongside the pipeline
+var pipelineManifestIgnoredOptions = map[string]bool{
+	"agent-access-token":     true,
+	"agent-access-token-env": true,
+	"config":                 true,
+	"manifest":               true,
+}
+
+// applyPipelineManifest loads a YAML manifest of pipeline upload options from
+// path, and sets each one on cfg unless it was already given on the command
+// line or via an environment variable. Keys in the manifest are the names of
+// the command's flags, plus `pipeline` for the pipeline file. If provenance
+// isn't nil, the options set from the manifest are recorded in it.
+func applyPipelineManifest(c *cli.Context, cfg interface{}, path string, provenance map[string]cliconfig.Source) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read manifest %q: %v", path, err)
+	}
+
+	var manifest map[string]interface{}
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("Failed to parse manifest %q: %v", path, formatManifestYAMLError(err))
+	}
+
+	// Map each flag name to the field it's loaded into
+	fieldsByName := map[string]string{}
+	fields, _ := reflections.Fields(cfg)
+	for _, fieldName := range fields {
+		cliName, _ := reflections.GetFieldTag(cfg, fieldName, "cli")
+		switch {
+		case cliName == "arg:0":
+			fieldsByName[pipelineManifestFileKey] = fieldName
+		case cliName != "" && !strings.HasPrefix(cliName, "arg:"):
+			fieldsByName[cliName] = fieldName
+		}
+	}
+
+	// Sort the keys so errors are reported consistently
+	keys := make([]string, 0, len(manifest))
+	for key := range manifest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fieldName, ok := fieldsByName[key]
+		if !ok || pipelineManifestIgnoredOptions[key] {
+			return fmt.Errorf("Unknown option %q in manifest %q", key, path)
+		}
+
+		// Command line flags and environment variables win over the manifest
+		if key == pipelineManifestFileKey {
+			if c.NArg() > 0 {
+				continue
+			}
+		} else if cliconfig.IsSet(c, key) {
+			continue
+		}
+
+		value, err := manifestValue(cfg, fieldName, manifest[key])
+		if err != nil {
+			return fmt.Errorf("Invalid value for %q in manifest %q: %v", key, path, err)
+		}
+
+		if err := reflections.SetField(cfg, fieldName, value); err != nil {
+			return err
+		}
+
+		if provenance != nil {
+			cliName, _ := reflections.GetFieldTag(cfg, fieldName, "cli")
+			provenance[cliName] = cliconfig.Source{Kind: "manifest", Name: path}
+		}
+	}
+
+	return nil
+}
+
+// manifestValue converts a value from a YAML manifest into the type of the
+// config field it's destined for
+func manifestValue(cfg interface{}, fieldName string, value interface{}) (interface{}, error) {
+	kind, err := reflections.GetFieldKind(cfg, fieldName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case reflect.String:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case reflect.Bool:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case reflect.Int:
+		if i, ok := value.(int); ok {
+			return i, nil
+		}
+	case reflect.Slice:
+		switch v := value.(type) {
+		case string:
+			return strings.Split(v, ","), nil
+		case []interface{}:
+			s := make([]string, 0, len(v))
+			for _, item := range v {
+				str, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("expected a list of strings, got %T in the list", item)
+				}
+				s = append(s, str)
+			}
+			return s, nil
+		}
+	}
+
+	return nil, fmt.Errorf("expected a %s, got %T", kind, value)
+}
+
+func formatManifestYAMLError(err error) string {
+	return strings.TrimPrefix(err.Error(), "yaml: ")
+}
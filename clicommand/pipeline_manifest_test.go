@@ -0,0 +1,82 @@
+package clicommand
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+func writeManifest(t *testing.T, contents string) (string, func()) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		assert.FailNow(t, "failed to create temp dir: %v", err)
+	}
+	path := filepath.Join(dir, "pipeline.manifest.yml")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		assert.FailNow(t, "failed to write manifest: %v", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func newPipelineUploadContext(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("upload", flag.ContinueOnError)
+	for _, f := range PipelineUploadCommand.Flags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		assert.FailNow(t, "failed to parse args: %v", err)
+	}
+	c := cli.NewContext(cli.NewApp(), set, nil)
+	c.Command = PipelineUploadCommand
+	return c
+}
+
+func TestApplyPipelineManifest(t *testing.T) {
+	path, cleanup := writeManifest(t, `
+pipeline: .buildkite/pipeline.yml
+no-interpolation: true
+step-default-timeout: 30
+step-default-retry: 2
+`)
+	defer cleanup()
+
+	cfg := PipelineUploadConfig{StepDefaultRetry: 5}
+	c := newPipelineUploadContext(t, "--step-default-retry", "5")
+
+	assert.NoError(t, applyPipelineManifest(c, &cfg, path, nil))
+	assert.Equal(t, ".buildkite/pipeline.yml", cfg.FilePath)
+	assert.True(t, cfg.NoInterpolation)
+	assert.Equal(t, 30, cfg.StepDefaultTimeout)
+
+	// Flags given on the command line win over the manifest
+	assert.Equal(t, 5, cfg.StepDefaultRetry)
+}
+
+func TestApplyPipelineManifestArgumentWinsOverPipeline(t *testing.T) {
+	path, cleanup := writeManifest(t, `pipeline: .buildkite/pipeline.yml`)
+	defer cleanup()
+
+	cfg := PipelineUploadConfig{FilePath: "other.yml"}
+	c := newPipelineUploadContext(t, "other.yml")
+
+	assert.NoError(t, applyPipelineManifest(c, &cfg, path, nil))
+	assert.Equal(t, "other.yml", cfg.FilePath)
+}
+
+func TestApplyPipelineManifestErrors(t *testing.T) {
+	for _, manifest := range []string{
+		`llamas: true`,
+		`agent-access-token: secret`,
+		`step-default-timeout: thirty`,
+	} {
+		path, cleanup := writeManifest(t, manifest)
+		cfg := PipelineUploadConfig{}
+		assert.Error(t, applyPipelineManifest(newPipelineUploadContext(t), &cfg, path, nil), manifest)
+		cleanup()
+	}
+}
@@ -0,0 +1,101 @@
+package clicommand
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/retry"
+)
+
+// The values accepted by --on-parse-error
+const (
+	onParseErrorLog      = "log"
+	onParseErrorAnnotate = "annotate"
+)
+
+// parseErrorAnnotationContext is the annotation context used for parse
+// errors, so that a later failed upload replaces the annotation
+const parseErrorAnnotationContext = "pipeline-upload-parse-error"
+
+// parseErrorLine matches the line number in YAML parse errors
+var parseErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// parseErrorExcerpt returns the lines of input around the line that err
+// refers to, with a caret under the start of that line. It returns an empty
+// string if the error doesn't refer to a line of the input.
+func parseErrorExcerpt(input []byte, err error) string {
+	match := parseErrorLine.FindStringSubmatch(err.Error())
+	if match == nil {
+		return ""
+	}
+
+	lineNumber, _ := strconv.Atoi(match[1])
+	lines := strings.Split(string(input), "\n")
+	if lineNumber < 1 || lineNumber > len(lines) {
+		return ""
+	}
+
+	first, last := lineNumber-2, lineNumber+2
+	if first < 1 {
+		first = 1
+	}
+	if last > len(lines) {
+		last = len(lines)
+	}
+
+	width := len(strconv.Itoa(last))
+
+	var b bytes.Buffer
+	for n := first; n <= last; n++ {
+		line := lines[n-1]
+		fmt.Fprintf(&b, "%*d | %s\n", width, n, line)
+
+		if n == lineNumber {
+			indent := len(line) - len(strings.TrimLeft(line, " \t"))
+			fmt.Fprintf(&b, "%*s | %s^\n", width, "", line[:indent])
+		}
+	}
+
+	return b.String()
+}
+
+// annotateParseError shows a pipeline parse error, along with an excerpt of
+// the pipeline where possible, as an error annotation on the build
+func annotateParseError(l logger.Logger, client *api.Client, job string, src string, input []byte, parseErr error) error {
+	body := fmt.Sprintf("Pipeline parsing of `%s` failed:\n\n```\n%s\n```\n", src, parseErr)
+	if excerpt := parseErrorExcerpt(input, parseErr); excerpt != "" {
+		body += fmt.Sprintf("\n```\n%s```\n", excerpt)
+	}
+
+	return annotateUpload(l, client, job, &api.Annotation{
+		Body:    body,
+		Style:   "error",
+		Context: parseErrorAnnotationContext,
+	})
+}
+
+// annotateUpload adds an annotation to the build about a problem with the
+// pipeline upload, retrying server errors
+func annotateUpload(l logger.Logger, client *api.Client, job string, annotation *api.Annotation) error {
+	return retry.Do(func(s *retry.Stats) error {
+		resp, err := client.Annotate(job, annotation)
+
+		// Don't bother retrying if the response was one of these statuses
+		if resp != nil && (resp.StatusCode == 401 || resp.StatusCode == 404 || resp.StatusCode == 400) {
+			s.Break()
+			return err
+		}
+
+		if err != nil {
+			l.Warn("%s (%s)", err, s)
+		}
+
+		return err
+	}, &retry.Config{Maximum: 5, Interval: 1 * time.Second, Jitter: true})
+}
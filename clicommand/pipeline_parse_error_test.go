@@ -0,0 +1,28 @@
+package clicommand
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseErrorExcerpt(t *testing.T) {
+	input := []byte("steps:\n  - command: make\n  - command: \"make test\n    label: tests\n")
+	err := errors.New("Failed to parse pipeline.yml: line 3: found unexpected end of stream")
+
+	assert.Equal(t, ""+
+		"1 | steps:\n"+
+		"2 |   - command: make\n"+
+		"3 |   - command: \"make test\n"+
+		"  |   ^\n"+
+		"4 |     label: tests\n"+
+		"5 | \n", parseErrorExcerpt(input, err))
+}
+
+func TestParseErrorExcerptWithoutLine(t *testing.T) {
+	input := []byte("steps: {}\n")
+
+	assert.Equal(t, "", parseErrorExcerpt(input, errors.New("Failed to parse pipeline.yml: not a list")))
+	assert.Equal(t, "", parseErrorExcerpt(input, errors.New("Failed to parse pipeline.yml: line 30: oops")))
+}
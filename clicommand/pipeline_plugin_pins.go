@@ -0,0 +1,37 @@
+package clicommand
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/buildkite/yaml"
+)
+
+// readPluginPins reads a YAML file that maps plugin names to the versions
+// they're pinned to, like:
+//
+//	docker: v5.3.0
+//	my-org/cache: v2.0.0
+func readPluginPins(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pins := map[string]string{}
+	if err := yaml.Unmarshal(data, &pins); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", path, err)
+	}
+
+	for name, version := range pins {
+		if version == "" || strings.Contains(version, "#") {
+			return nil, fmt.Errorf("Invalid version %q for plugin %q in %s", version, name, path)
+		}
+		if strings.Contains(name, "#") {
+			return nil, fmt.Errorf("Invalid plugin name %q in %s, names mustn't include a version", name, path)
+		}
+	}
+
+	return pins, nil
+}
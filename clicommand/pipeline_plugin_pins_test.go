@@ -0,0 +1,43 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPluginPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugin-pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range []struct {
+		contents string
+		pins     map[string]string
+		ok       bool
+	}{
+		{"docker: v5.3.0\nmy-org/cache: v2.0.0\n", map[string]string{"docker": "v5.3.0", "my-org/cache": "v2.0.0"}, true},
+		{"docker: \"\"\n", nil, false},
+		{"docker: v5.3.0#v5\n", nil, false},
+		{"docker#v5: v5.3.0\n", nil, false},
+		{"- docker\n", nil, false},
+	} {
+		path := filepath.Join(dir, "pins.yml")
+		if err := ioutil.WriteFile(path, []byte(tc.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		pins, err := readPluginPins(path)
+		if !tc.ok {
+			assert.Error(t, err, tc.contents)
+			continue
+		}
+		assert.NoError(t, err, tc.contents)
+		assert.Equal(t, tc.pins, pins, tc.contents)
+	}
+}
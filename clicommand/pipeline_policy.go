@@ -0,0 +1,61 @@
+package clicommand
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+)
+
+// policyTimeout is how long a policy service has to make a decision
+const policyTimeout = 10 * time.Second
+
+// policyDecision is the response of a policy service
+type policyDecision struct {
+	Allow   bool     `json:"allow"`
+	Reasons []string `json:"reasons"`
+}
+
+// checkPipelinePolicy POSTs the pipeline as JSON to the policy service at
+// policyURL, and returns whether it allows the pipeline to be uploaded. Any
+// response other than a 2xx with a decision is an error.
+func checkPipelinePolicy(client *http.Client, policyURL string, result *agent.PipelineParserResult) (policyDecision, error) {
+	var decision policyDecision
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return decision, err
+	}
+
+	req, err := http.NewRequest("POST", policyURL, bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", agent.UserAgent())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return decision, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return decision, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decision, fmt.Errorf("%s responded with %s", policyURL, resp.Status)
+	}
+
+	if err := json.Unmarshal(respBody, &decision); err != nil {
+		return decision, fmt.Errorf("Failed to parse the response from %s: %v", policyURL, err)
+	}
+
+	return decision, nil
+}
@@ -0,0 +1,52 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPipelinePolicy(t *testing.T) {
+	result, _, err := agent.PipelineParser{Pipeline: []byte("steps:\n  - command: make\n")}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received = string(body)
+
+		switch req.URL.Path {
+		case "/allow":
+			rw.Write([]byte(`{"allow": true}`))
+		case "/deny":
+			rw.Write([]byte(`{"allow": false, "reasons": ["docker is not an allowed plugin"]}`))
+		case "/garbage":
+			rw.Write([]byte(`<html>`))
+		default:
+			http.Error(rw, "Not Found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	decision, err := checkPipelinePolicy(server.Client(), server.URL+"/allow", result)
+	assert.NoError(t, err)
+	assert.True(t, decision.Allow)
+	assert.Equal(t, `{"steps":[{"command":"make"}]}`, received)
+
+	decision, err = checkPipelinePolicy(server.Client(), server.URL+"/deny", result)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allow)
+	assert.Equal(t, []string{"docker is not an allowed plugin"}, decision.Reasons)
+
+	_, err = checkPipelinePolicy(server.Client(), server.URL+"/garbage", result)
+	assert.Error(t, err)
+
+	_, err = checkPipelinePolicy(server.Client(), server.URL+"/missing", result)
+	assert.Error(t, err)
+}
@@ -0,0 +1,98 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// redactionAnnotationContext is the annotation context used by
+// --annotate-on-redaction, so that a later upload replaces the annotation
+const redactionAnnotationContext = "pipeline-upload-redaction"
+
+// redactionReport is written to the path given by --redaction-report. It
+// never includes the values of the variables.
+type redactionReport struct {
+	Matches []redactionMatch `json:"matches"`
+}
+
+// redactionMatch is a redacted variable whose value was found in the pipeline
+type redactionMatch struct {
+	Variable string   `json:"variable"`
+	Paths    []string `json:"paths"`
+}
+
+// findRedactedVars returns the variables in varsToRedact whose values appear
+// in the pipeline, and where they appear, sorted by variable name
+func findRedactedVars(result *agent.PipelineParserResult, varsToRedact map[string]string) []redactionMatch {
+	names := make([]string, 0, len(varsToRedact))
+	for name := range varsToRedact {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	matches := []redactionMatch{}
+	for _, name := range names {
+		if paths := result.FindString(varsToRedact[name]); len(paths) > 0 {
+			matches = append(matches, redactionMatch{Variable: name, Paths: paths})
+		}
+	}
+
+	return matches
+}
+
+// describeRedactionMatches lists the variables whose values were found in the
+// pipeline, and where, for error messages. It never includes the values.
+func describeRedactionMatches(matches []redactionMatch) string {
+	descriptions := make([]string, 0, len(matches))
+	for _, match := range matches {
+		descriptions = append(descriptions, fmt.Sprintf("%s (at %s)", match.Variable, strings.Join(match.Paths, ", ")))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// redactionAnnotation describes the redacted variables found in the pipeline
+// for an annotation on the build. It never includes the values.
+func redactionAnnotation(matches []redactionMatch, uploaded bool) *api.Annotation {
+	var b strings.Builder
+	if uploaded {
+		b.WriteString("The uploaded pipeline contains the values of these redacted variables:\n\n")
+	} else {
+		b.WriteString("The pipeline wasn't uploaded, as it contains the values of these redacted variables:\n\n")
+	}
+	for _, match := range matches {
+		paths := make([]string, len(match.Paths))
+		for i, path := range match.Paths {
+			paths[i] = "`" + path + "`"
+		}
+		fmt.Fprintf(&b, "- `$%s` at %s\n", match.Variable, strings.Join(paths, ", "))
+	}
+	b.WriteString("\nEnsure your pipeline doesn't include secrets or interpolated secrets.\n")
+
+	return &api.Annotation{
+		Body:    b.String(),
+		Style:   "error",
+		Context: redactionAnnotationContext,
+	}
+}
+
+// annotateRedaction adds an annotation to the build listing the redacted
+// variables found in the pipeline
+func annotateRedaction(l logger.Logger, client *api.Client, job string, matches []redactionMatch, uploaded bool) error {
+	return annotateUpload(l, client, job, redactionAnnotation(matches, uploaded))
+}
+
+func writeRedactionReport(path string, matches []redactionMatch) error {
+	j, err := json.MarshalIndent(redactionReport{Matches: matches}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(j, '\n'), 0600)
+}
@@ -0,0 +1,116 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactionReport(t *testing.T) {
+	result, _, err := agent.PipelineParser{
+		Filename:        "pipeline.yml",
+		Pipeline:        []byte("steps:\n  - command: deploy --token hunter2\n    env:\n      PASS: correcthorse\n"),
+		NoInterpolation: true,
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matches := findRedactedVars(result, map[string]string{
+		"MY_TOKEN":    "hunter2",
+		"MY_PASSWORD": "correcthorse",
+		"MY_SECRET":   "notinthepipeline",
+	})
+
+	dir, err := ioutil.TempDir("", "redaction-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "report.json")
+	if err := writeRedactionReport(path, matches); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.JSONEq(t, `{"matches": [
+		{"variable": "MY_PASSWORD", "paths": ["steps[0].env.PASS"]},
+		{"variable": "MY_TOKEN", "paths": ["steps[0].command"]}
+	]}`, string(report))
+	assert.NotContains(t, string(report), "hunter2")
+
+	description := describeRedactionMatches(matches)
+	assert.Equal(t, "MY_PASSWORD (at steps[0].env.PASS), MY_TOKEN (at steps[0].command)", description)
+	assert.NotContains(t, description, "hunter2")
+}
+
+func TestFindRedactedVarsRefusesInterpolatedSecrets(t *testing.T) {
+	environ := env.FromSlice([]string{"MY_TOKEN=hunter2", "REGION=us-east-1"})
+	varsToRedact := map[string]string{"MY_TOKEN": "hunter2"}
+
+	for _, tc := range []struct {
+		pipeline string
+		refused  bool
+	}{
+		{"steps:\n  - command: deploy --token $MY_TOKEN\n", true},
+		{"steps:\n  - command: deploy --region $REGION\n", false},
+	} {
+		result, _, err := agent.PipelineParser{
+			Env:      environ,
+			Pipeline: []byte(tc.pipeline),
+		}.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matches := findRedactedVars(result, varsToRedact)
+		assert.Equal(t, tc.refused, len(matches) > 0, tc.pipeline)
+	}
+}
+
+func TestAnnotateRedaction(t *testing.T) {
+	var annotations []api.Annotation
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/jobs/job-id/annotations" {
+			http.Error(rw, "Not Found", http.StatusNotFound)
+			return
+		}
+		var annotation api.Annotation
+		if err := json.NewDecoder(req.Body).Decode(&annotation); err != nil {
+			t.Error(err)
+		}
+		annotations = append(annotations, annotation)
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+	matches := []redactionMatch{{Variable: "DEPLOY_TOKEN", Paths: []string{"steps[0].command", "steps[1].env.TOKEN"}}}
+
+	assert.NoError(t, annotateRedaction(logger.Discard, client, "job-id", matches, true))
+	assert.NoError(t, annotateRedaction(logger.Discard, client, "job-id", matches, false))
+
+	if assert.Len(t, annotations, 2) {
+		assert.Equal(t, "error", annotations[0].Style)
+		assert.Equal(t, redactionAnnotationContext, annotations[0].Context)
+		assert.Equal(t, "The uploaded pipeline contains the values of these redacted variables:\n\n"+
+			"- `$DEPLOY_TOKEN` at `steps[0].command`, `steps[1].env.TOKEN`\n\n"+
+			"Ensure your pipeline doesn't include secrets or interpolated secrets.\n", annotations[0].Body)
+		assert.Contains(t, annotations[1].Body, "The pipeline wasn't uploaded")
+	}
+}
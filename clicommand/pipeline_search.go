@@ -0,0 +1,85 @@
+package clicommand
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// defaultPipelinePaths are where a pipeline file is looked for when none is
+// given, in order of precedence
+var defaultPipelinePaths = []string{
+	"buildkite.yml",
+	"buildkite.yaml",
+	"buildkite.json",
+	"buildkite.toml",
+	filepath.FromSlash(".buildkite/pipeline.yml"),
+	filepath.FromSlash(".buildkite/pipeline.yaml"),
+	filepath.FromSlash(".buildkite/pipeline.json"),
+	filepath.FromSlash(".buildkite/pipeline.toml"),
+	filepath.FromSlash("buildkite/pipeline.yml"),
+	filepath.FromSlash("buildkite/pipeline.yaml"),
+	filepath.FromSlash("buildkite/pipeline.json"),
+	filepath.FromSlash("buildkite/pipeline.toml"),
+}
+
+// findPipelineFile returns the pipeline file to use when none is given. The
+// searchDirs are searched for a pipeline.yml, pipeline.yaml or pipeline.json
+// first, and defaultPipelinePaths only if none of them has one. If a search
+// finds more than one file, conflict is one of the --pipeline-conflict values
+// and says which to use, and the others are warned about with l.
+func findPipelineFile(l logger.Logger, searchDirs []string, conflict string) (string, error) {
+	searches := [][]string{defaultPipelinePaths}
+	if len(searchDirs) > 0 {
+		var searchPaths []string
+		for _, dir := range searchDirs {
+			for _, name := range []string{"pipeline.yml", "pipeline.yaml", "pipeline.json", "pipeline.toml"} {
+				searchPaths = append(searchPaths, filepath.Join(dir, name))
+			}
+		}
+		searches = [][]string{searchPaths, defaultPipelinePaths}
+	}
+
+	// Collect all the files that exist
+	exists := []string{}
+	for _, paths := range searches {
+		for _, path := range paths {
+			if _, err := os.Stat(path); err == nil {
+				exists = append(exists, path)
+			}
+		}
+		if len(exists) > 0 {
+			break
+		}
+	}
+
+	if len(exists) == 0 {
+		return "", errors.New("Could not find a default pipeline configuration file. See `buildkite-agent pipeline upload --help` for more information.")
+	}
+
+	// If more than 1 of the config files exist, it's an error unless
+	// conflict says which to use. The files are in the order they were
+	// searched for.
+	found := exists[0]
+	if len(exists) > 1 {
+		switch conflict {
+		case pipelineConflictFirst:
+		case pipelineConflictLast:
+			found = exists[len(exists)-1]
+		default:
+			return "", fmt.Errorf("Found multiple configuration files: %s. Please only have 1 configuration file present.", strings.Join(exists, ", "))
+		}
+
+		for _, other := range exists {
+			if other != found {
+				l.Warn("Ignoring configuration file \"%s\" as \"%s\" was also found, and --pipeline-conflict is %s", other, found, conflict)
+			}
+		}
+	}
+
+	return found, nil
+}
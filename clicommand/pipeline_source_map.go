@@ -0,0 +1,27 @@
+package clicommand
+
+import (
+	"strings"
+
+	"github.com/buildkite/agent/v3/agent"
+)
+
+// sourceMapOutput is what --dry-run outputs with --source-map
+type sourceMapOutput struct {
+	Pipeline  *agent.PipelineParserResult `json:"pipeline" yaml:"pipeline"`
+	SourceMap []agent.InterpolationSource `json:"source_map" yaml:"source_map"`
+}
+
+// redactSources returns a copy of sources with the values of varsToRedact in
+// their text replaced, as pipelines can contain secrets before interpolation
+// too
+func redactSources(sources []agent.InterpolationSource, varsToRedact map[string]string) []agent.InterpolationSource {
+	redacted := make([]agent.InterpolationSource, 0, len(sources))
+	for _, source := range sources {
+		for _, value := range varsToRedact {
+			source.Source = strings.Replace(source.Source, value, "[REDACTED]", -1)
+		}
+		redacted = append(redacted, source)
+	}
+	return redacted
+}
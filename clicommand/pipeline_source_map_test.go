@@ -0,0 +1,23 @@
+package clicommand
+
+import (
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactSources(t *testing.T) {
+	sources := []agent.InterpolationSource{
+		{Path: "steps[0].command", Source: "deploy --token hunter2 --env $ENV"},
+		{Path: "steps[1].command", Source: "echo $GREETING"},
+	}
+
+	assert.Equal(t, []agent.InterpolationSource{
+		{Path: "steps[0].command", Source: "deploy --token [REDACTED] --env $ENV"},
+		{Path: "steps[1].command", Source: "echo $GREETING"},
+	}, redactSources(sources, map[string]string{"DEPLOY_TOKEN": "hunter2"}))
+
+	// The original sources aren't changed
+	assert.Equal(t, "deploy --token hunter2 --env $ENV", sources[0].Source)
+}
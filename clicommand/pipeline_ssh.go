@@ -0,0 +1,48 @@
+package clicommand
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/buildkite/shellwords"
+)
+
+// sshPathPattern matches scp style paths like user@host:path/to/pipeline.yml.
+// The user can't start with -, so that ssh can't take it for an option.
+var sshPathPattern = regexp.MustCompile(`^([^-@/\s][^@/\s]*@[^:/\s]+):(.+)$`)
+
+// parseSSHPath splits an scp style path into the user@host to connect to and
+// the path of the file on that host
+func parseSSHPath(p string) (destination string, remotePath string, ok bool) {
+	matches := sshPathPattern.FindStringSubmatch(p)
+	if matches == nil {
+		return "", "", false
+	}
+	return matches[1], matches[2], true
+}
+
+// readSSHFile reads a file from another host with the system's ssh client,
+// which authenticates with the usual SSH agent and keys. It never prompts for
+// a password.
+func readSSHFile(destination string, remotePath string) ([]byte, error) {
+	sh, err := shell.New()
+	if err != nil {
+		return nil, err
+	}
+
+	// The remote command is run by the remote user's shell
+	stdout, stderr, err := sh.RunAndCaptureWithStderr("ssh",
+		"-o", "BatchMode=yes",
+		"--",
+		destination,
+		"cat -- "+shellwords.QuotePosix(remotePath))
+	if err != nil {
+		if stderr != "" {
+			return nil, fmt.Errorf("Failed to read %s from %s over SSH: %v\n%s", remotePath, destination, err, stderr)
+		}
+		return nil, fmt.Errorf("Failed to read %s from %s over SSH: %v", remotePath, destination, err)
+	}
+
+	return []byte(stdout), nil
+}
@@ -0,0 +1,33 @@
+package clicommand
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSSHPath(t *testing.T) {
+	for _, tc := range []struct {
+		path        string
+		destination string
+		remotePath  string
+		ok          bool
+	}{
+		{"git@pipelines.internal:/srv/pipeline.yml", "git@pipelines.internal", "/srv/pipeline.yml", true},
+		{"deploy@10.0.0.1:pipelines/deploy.yml", "deploy@10.0.0.1", "pipelines/deploy.yml", true},
+		{"pipeline.yml", "", "", false},
+		{".buildkite/pipeline.yml", "", "", false},
+		{"host:pipeline.yml", "", "", false},
+		{"./me@host:pipeline.yml", "", "", false},
+		{"me@host:", "", "", false},
+		{`C:\pipeline.yml`, "", "", false},
+		{"-oProxyCommand=x@host:pipeline.yml", "", "", false},
+		{"-@host:pipeline.yml", "", "", false},
+		{"us-er@host:pipeline.yml", "us-er@host", "pipeline.yml", true},
+	} {
+		destination, remotePath, ok := parseSSHPath(tc.path)
+		assert.Equal(t, tc.ok, ok, tc.path)
+		assert.Equal(t, tc.destination, destination, tc.path)
+		assert.Equal(t, tc.remotePath, remotePath, tc.path)
+	}
+}
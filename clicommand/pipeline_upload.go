@@ -1,71 +1,255 @@
 package clicommand
 
 import (
+	"bytes"
+	"context"
+	"crypto"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/bootstrap/shell"
 	"github.com/buildkite/agent/v3/cliconfig"
 	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/redaction"
 	"github.com/buildkite/agent/v3/retry"
 	"github.com/buildkite/agent/v3/stdin"
+	"github.com/buildkite/shellwords"
 	"github.com/urfave/cli"
 )
 
 var PipelineUploadHelpDescription = `Usage:
 
-   buildkite-agent pipeline upload [file] [options...]
+   buildkite-agent pipeline upload [file...] [options...]
 
 Description:
 
-   Allows you to change the pipeline of a running build by uploading either a
-   YAML (recommended) or JSON configuration file. If no configuration file is
+   Allows you to change the pipeline of a running build by uploading a YAML
+   (recommended), JSON or TOML configuration file. If no configuration file is
    provided, the command looks for the file in the following locations:
 
    - buildkite.yml
    - buildkite.yaml
    - buildkite.json
+   - buildkite.toml
    - .buildkite/pipeline.yml
    - .buildkite/pipeline.yaml
    - .buildkite/pipeline.json
+   - .buildkite/pipeline.toml
    - buildkite/pipeline.yml
    - buildkite/pipeline.yaml
    - buildkite/pipeline.json
+   - buildkite/pipeline.toml
+
+   Directories given with --pipeline-search-path are searched for a
+   pipeline.yml, pipeline.yaml, pipeline.json or pipeline.toml first, and
+   the locations above only if none of them has one. It's an error to find
+   more than one file in the same search, unless --pipeline-conflict is
+   "first" or "last" to use the first or last of them in the order they're
+   listed here.
 
    You can also pipe build pipelines to the command allowing you to create
    scripts that generate dynamic pipelines.
 
+   Environment variables are interpolated into YAML pipelines, but not into
+   JSON pipelines unless --force-interpolation is given, as JSON pipelines
+   are usually generated by a tool that's already done its own substitution.
+
+   If more than one file is given, the steps of the others are added to the
+   steps of the first, in order, and they're uploaded as one pipeline. If any
+   of them fails to parse, nothing is uploaded. Files can be given as globs,
+   like '.buildkite/steps/*.yml', which are expanded in lexical order.
+
+   A pipeline file given as an argument takes precedence over STDIN, which is
+   ignored. With --merge-stdin, a pipeline piped to STDIN is added after the
+   files instead, so generated steps can be appended to a committed pipeline:
+
+     $ ./generator | buildkite-agent pipeline upload base.yml --merge-stdin
+
+   When pipelines are added together their steps are concatenated in order.
+   Variables in their top-level env blocks are combined, and other top-level
+   keys are taken from whichever pipeline sets them. It's an error for two of
+   them to set the same variable or key to different values.
+
+   A file given as user@host:path is read from that host with ssh, which must
+   be able to connect without a password using an SSH agent or keys. A file
+   given as an http or https URL is downloaded, using the same proxy and
+   HTTP/2 settings as requests to the Agent API, but without the agent's
+   access token.
+
+   Options can also be read from a YAML manifest given with --manifest. Its
+   keys are the names of this command's options, plus "pipeline" for the
+   pipeline file:
+
+     pipeline: .buildkite/pipeline.yml
+     step-default-timeout: 30
+
+   Defaults for options that are shared between pipelines can be read from a
+   configuration file given with --config, in the same format as the agent's
+   configuration file:
+
+     endpoint="https://agent.buildkite.com/v3"
+     redacted-vars="*_PASSWORD,*_SECRET,*_TOKEN"
+
+   An option given on the command line or with an environment variable takes
+   precedence over the manifest, which takes precedence over the
+   configuration file, which takes precedence over the defaults. The agent
+   access token can't be set from a manifest.
+
+   With --interp-from-args, the arguments after the pipeline file can be
+   interpolated into the pipeline as $1 or ${1}, $2 or ${2}, and so on. The
+   first argument is always the pipeline file, so one must be given to pass
+   any other arguments:
+
+     $ buildkite-agent pipeline upload --interp-from-args deploy.yml app prod
+
+   By default every environment variable can be interpolated into the
+   pipeline. With --restrict-env, only BUILDKITE_* variables and those allowed
+   by --env-passthrough are, and others are interpolated as if they weren't
+   set. To migrate, run with --restrict-env and --max-warnings=0 (or check the
+   warnings about unset variables), and add each variable your pipeline needs
+   to --env-passthrough.
+
+   Variables can also be loaded from a dotenv style file with --env-file,
+   without setting them in the environment of the process. They take
+   precedence over variables of the same name in the environment, and are
+   interpolated even with --restrict-env.
+
 Example:
 
    $ buildkite-agent pipeline upload
    $ buildkite-agent pipeline upload my-custom-pipeline.yml
-   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload`
+   $ buildkite-agent pipeline upload frag-a.yml frag-b.yml
+   $ buildkite-agent pipeline upload deploy@pipelines.internal:/srv/pipeline.yml
+   $ ./script/dynamic_step_generator | buildkite-agent pipeline upload
+   $ buildkite-agent pipeline upload --pipeline-from-cmd "./script/dynamic_step_generator --all"
+   $ buildkite-agent pipeline upload --pipeline-from-artifact "generated/pipeline.yml"
+   $ buildkite-agent pipeline upload --pipeline-transform "jq '.steps |= map(.priority = 1)'"
+   $ buildkite-agent pipeline upload --manifest .buildkite/pipeline.manifest.yml`
 
 type PipelineUploadConfig struct {
 	FilePath        string `cli:"arg:0" label:"upload paths"`
+	PipelineFromCmd string `cli:"pipeline-from-cmd"`
+	FromArtifact    string `cli:"pipeline-from-artifact"`
+	Build           string `cli:"build"`
 	Replace         bool   `cli:"replace"`
 	Job             string `cli:"job"`
 	DryRun          bool   `cli:"dry-run"`
+	DryRunServer    bool   `cli:"dry-run-server"`
+	DryRunStrict    bool   `cli:"dry-run-strict"`
+	DryRunFormat    string `cli:"dry-run-format"`
+	Diff            bool   `cli:"diff"`
+	DiffFormat      string `cli:"diff-format"`
+	ExpandMatrix    bool   `cli:"expand-matrix"`
+	SourceMap       bool   `cli:"source-map"`
+	WriteBack       bool   `cli:"write-back"`
+	Yes             bool   `cli:"yes"`
 	NoInterpolation bool   `cli:"no-interpolation"`
+	ForceInterp     bool   `cli:"force-interpolation"`
+	InterpFromArgs  bool   `cli:"interp-from-args"`
+
+	PipelineSearchPaths []string `cli:"pipeline-search-path" normalize:"list"`
+	PipelineConflict    string   `cli:"pipeline-conflict"`
+
+	NormalizeLineEndings  bool     `cli:"normalize-line-endings"`
+	RestrictEnv           bool     `cli:"restrict-env"`
+	RequireGit            bool     `cli:"require-git"`
+	NoGitCommitResolution bool     `cli:"no-git-commit-resolution"`
+	RepoDir               string   `cli:"repo-dir" normalize:"filepath"`
+	EnvPassthrough        []string `cli:"env-passthrough" normalize:"list"`
+	EnvFile               string   `cli:"env-file" normalize:"filepath"`
+	PropagateEnv          []string `cli:"propagate-env" normalize:"list"`
+
+	CompressUpload          bool   `cli:"compress-upload"`
+	CompressUploadThreshold int    `cli:"compress-upload-threshold"`
+	RetryLimit              int    `cli:"retry-limit"`
+	RetryInterval           string `cli:"retry-interval"`
+	RequestTimeout          string `cli:"request-timeout"`
+	StdinTimeout            string `cli:"stdin-timeout"`
+	AsyncWait               bool   `cli:"async-wait"`
+	AsyncTimeout            string `cli:"async-timeout"`
+	StepDefaultTimeout      int    `cli:"step-default-timeout"`
+	StepDefaultRetry        int    `cli:"step-default-retry"`
+	StepTimeoutCap          int    `cli:"step-timeout-cap"`
+	StepTimeoutCapUnset     bool   `cli:"step-timeout-cap-unset"`
+	MaxWarnings             int    `cli:"max-warnings"`
+	FailOnWarnings          bool   `cli:"fail-on-warnings"`
+	ValidateSchema          bool   `cli:"validate-schema"`
+	MergeStdin              bool   `cli:"merge-stdin"`
+	Manifest                string `cli:"manifest"`
+	Config                  string `cli:"config"`
+	ResolveAWSSecrets       bool   `cli:"resolve-aws-secrets"`
+	EnsureStep              bool   `cli:"ensure-step"`
+	EnsureUpdate            bool   `cli:"ensure-update"`
+	UploadOnlyChanged       bool   `cli:"upload-only-changed"`
+	SkipUnchanged           bool   `cli:"skip-unchanged"`
+	Force                   bool   `cli:"force"`
+	UploadCacheDir          string `cli:"upload-cache-dir" normalize:"filepath"`
+	InterpStats             bool   `cli:"interp-stats"`
+	ValidateDependencies    bool   `cli:"validate-dependencies"`
+	PolicyURL               string `cli:"policy-url"`
+	OnParseError            string `cli:"on-parse-error"`
+	PipelineTransform       string `cli:"pipeline-transform"`
+	PluginPinFile           string `cli:"plugin-pin-file" normalize:"filepath"`
+	SortStepsBy             string `cli:"sort-steps-by"`
+	GroupUntaggedSteps      string `cli:"group-untagged-steps"`
+	StepKeyPrefix           string `cli:"step-key-prefix"`
+	StepLabelTemplate       string `cli:"step-label-template"`
+	DetectSelfTrigger       string `cli:"detect-self-trigger"`
+	ConfigProvenance        bool   `cli:"config-provenance"`
+	MaxLabelLength          int    `cli:"max-label-length"`
+	TruncateLabels          bool   `cli:"truncate-labels"`
+	MaxVarLength            int    `cli:"max-var-length"`
+	TruncateLongVars        bool   `cli:"truncate-long-vars"`
+	ValidateEnvReferences   bool   `cli:"validate-env-references"`
+	InterpolationStrict     bool   `cli:"interpolation-strict"`
+
+	RedactedVars        []string `cli:"redacted-vars" normalize:"list"`
+	RedactedVarsFile    string   `cli:"redacted-vars-file" normalize:"filepath"`
+	RedactedVarsMinLen  int      `cli:"redacted-vars-min-length"`
+	InheritRedaction    bool     `cli:"inherit-agent-redaction"`
+	RedactFromFile      string   `cli:"redact-from-file" normalize:"filepath"`
+	RedactedPatterns    []string `cli:"redacted-patterns"`
+	RedactPointers      []string `cli:"redact-pointer" normalize:"list"`
+	RedactPointerRemove bool     `cli:"redact-pointer-remove"`
+	ExitZeroOnRedaction bool     `cli:"exit-zero-on-redaction"`
+	AnnotateOnRedaction bool     `cli:"annotate-on-redaction"`
+	RedactionReport     string   `cli:"redaction-report"`
+	WarnSecretInterp    bool     `cli:"warn-secret-interp"`
+
+	Attestation    string `cli:"attestation" normalize:"filepath"`
+	AttestationKey string `cli:"attestation-key" normalize:"filepath"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
 	NoColor     bool     `cli:"no-color"`
+	LogFormat   string   `cli:"log-format"`
 	Experiments []string `cli:"experiment" normalize:"list"`
 	Profile     string   `cli:"profile"`
 
 	// API config
-	DebugHTTP        bool   `cli:"debug-http"`
-	AgentAccessToken string `cli:"agent-access-token" validate:"required"`
-	Endpoint         string `cli:"endpoint" validate:"required"`
-	NoHTTP2          bool   `cli:"no-http2"`
+	DebugHTTP            bool   `cli:"debug-http"`
+	AgentAccessToken     string `cli:"agent-access-token" validate:"required"`
+	AgentAccessTokenEnv  string `cli:"agent-access-token-env"`
+	AgentAccessTokenFile string `cli:"agent-access-token-file" normalize:"filepath"`
+	Endpoint             string `cli:"endpoint" validate:"required"`
+	ConfirmEndpoint      string `cli:"confirm-endpoint"`
+	NoHTTP2              bool   `cli:"no-http2"`
+	CACert               string `cli:"ca-cert" normalize:"filepath"`
+	HTTPSProxy           string `cli:"https-proxy"`
+	NoProxy              string `cli:"no-proxy"`
 }
 
 var PipelineUploadCommand = cli.Command{
@@ -84,26 +268,459 @@ var PipelineUploadCommand = cli.Command{
 			Usage:  "The job that is making the changes to its build",
 			EnvVar: "BUILDKITE_JOB_ID",
 		},
+		cli.StringFlag{
+			Name:   "pipeline-from-cmd",
+			Usage:  "Run this command and upload what it writes to stdout as the pipeline. The upload fails if the command does",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_FROM_CMD",
+		},
+		cli.StringFlag{
+			Name:   "pipeline-from-artifact",
+			Usage:  "Read the pipeline from the artifact in the build with this path, which can be a glob that matches exactly one artifact",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_FROM_ARTIFACT",
+		},
+		cli.StringFlag{
+			Name:   "build",
+			Usage:  "The build to find the --pipeline-from-artifact in",
+			EnvVar: "BUILDKITE_BUILD_ID",
+		},
+		cli.StringSliceFlag{
+			Name:   "pipeline-search-path",
+			Usage:  "A directory to look for pipeline.yml, pipeline.yaml, pipeline.json or pipeline.toml in when no pipeline file is given, before the default locations. Can be given more than once",
+			EnvVar: "BUILDKITE_PIPELINE_SEARCH_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "pipeline-conflict",
+			Value:  pipelineConflictFail,
+			Usage:  "What to do when more than one pipeline file is found when searching for one. Either \"fail\", or use the \"first\" or \"last\" in the order they're searched and warn about the others",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_PIPELINE_CONFLICT",
+		},
+		cli.StringFlag{
+			Name:   "pipeline-transform",
+			Usage:  "A command to pass the parsed pipeline through before it's uploaded. It's given the pipeline as JSON on stdin, and must write the new pipeline as JSON to stdout",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_TRANSFORM",
+		},
+		cli.StringFlag{
+			Name:   "plugin-pin-file",
+			Usage:  "Path to a YAML file of plugin names and the versions to pin them to. Every reference to those plugins is changed to use the pinned version",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_PLUGIN_PIN_FILE",
+		},
 		cli.BoolFlag{
 			Name:   "dry-run",
 			Usage:  "Rather than uploading the pipeline, it will be echoed to stdout",
 			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DRY_RUN",
 		},
+		cli.BoolFlag{
+			Name:   "dry-run-server",
+			Usage:  "Rather than uploading the pipeline, ask the Agent API to validate it and report the result. Falls back to local schema validation if the API doesn't support validation",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DRY_RUN_SERVER",
+		},
+		cli.BoolFlag{
+			Name:   "dry-run-strict",
+			Usage:  "With --dry-run, check the pipeline for the values of redacted variables like an upload does, and fail without outputting it if the upload would be refused",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DRY_RUN_STRICT",
+		},
+		cli.StringFlag{
+			Name:   "dry-run-format",
+			Value:  "json",
+			Usage:  "The format --dry-run and --diff output the pipeline in, either json or yaml",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DRY_RUN_FORMAT",
+		},
+		cli.BoolFlag{
+			Name:   "diff",
+			Usage:  "Rather than uploading the pipeline, print a unified diff of it against the pipeline already uploaded to the current build",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DIFF",
+		},
+		cli.StringFlag{
+			Name:   "diff-format",
+			Value:  "unified",
+			Usage:  "The format of --diff's output, either a unified diff, or json listing the steps that would be added, removed and changed, matched by their keys",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DIFF_FORMAT",
+		},
+		cli.BoolFlag{
+			Name:   "expand-matrix",
+			Usage:  "With --dry-run, replace each step that has a matrix with a step for each of its combinations, to check them before uploading",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_EXPAND_MATRIX",
+		},
+		cli.BoolFlag{
+			Name:   "source-map",
+			Usage:  "With --dry-run, output the pipeline under \"pipeline\" alongside a \"source_map\" of the text before interpolation of each value that interpolation changed",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_SOURCE_MAP",
+		},
+		cli.BoolFlag{
+			Name:   "write-back",
+			Usage:  "With --dry-run and a pipeline file, replace the file with the interpolated pipeline, keeping the original in a .bak file next to it. Needs --yes",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_WRITE_BACK",
+		},
+		cli.BoolFlag{
+			Name:  "yes",
+			Usage: "Confirm that --write-back can overwrite the pipeline file",
+		},
+		cli.BoolFlag{
+			Name:   "ensure-step",
+			Usage:  "Only upload the pipeline's single keyed step if a step with the same key isn't already in the build",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_ENSURE_STEP",
+		},
+		cli.BoolFlag{
+			Name:   "ensure-update",
+			Usage:  "With --ensure-step, update the attributes of an existing step that differ from the uploaded step",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_ENSURE_UPDATE",
+		},
+		cli.BoolFlag{
+			Name:   "upload-only-changed",
+			Usage:  "Only upload the steps that aren't already in the build's current pipeline, matched by key, or by content for steps without one. Existing steps that have changed have their text attributes updated in place",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_ONLY_CHANGED",
+		},
 		cli.BoolFlag{
 			Name:   "no-interpolation",
 			Usage:  "Skip variable interpolation the pipeline when uploaded",
 			EnvVar: "BUILDKITE_PIPELINE_NO_INTERPOLATION",
 		},
+		cli.BoolFlag{
+			Name:   "force-interpolation",
+			Usage:  "Interpolate pipelines that are JSON, which by default aren't as they're usually generated by a tool that's already done its own substitution",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_FORCE_INTERPOLATION",
+		},
+		cli.BoolFlag{
+			Name:   "interp-from-args",
+			Usage:  "Interpolate $1 or ${1}, $2 or ${2} and so on as the arguments after the pipeline file, like in a shell",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_INTERP_FROM_ARGS",
+		},
+		cli.BoolTFlag{
+			Name:   "normalize-line-endings",
+			Usage:  "Convert Windows (CRLF) line endings in the pipeline to Unix (LF) ones before parsing it. Use --normalize-line-endings=false to parse it as is",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_NORMALIZE_LINE_ENDINGS",
+		},
+		cli.BoolFlag{
+			Name:   "require-git",
+			Usage:  "Fail if git isn't installed, rather than not resolving BUILDKITE_COMMIT to a commit hash",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_REQUIRE_GIT",
+		},
+		cli.BoolFlag{
+			Name:   "no-git-commit-resolution",
+			Usage:  "Don't run git rev-parse to resolve BUILDKITE_COMMIT to a commit hash, such as when uploading from outside a checkout",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_NO_GIT_COMMIT_RESOLUTION",
+		},
+		cli.StringFlag{
+			Name:   "repo-dir",
+			Usage:  "The directory of the git checkout to resolve BUILDKITE_COMMIT in, if it isn't the current directory",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_REPO_DIR",
+		},
+		cli.BoolFlag{
+			Name:   "restrict-env",
+			Usage:  "Only interpolate BUILDKITE_* environment variables and those allowed by --env-passthrough, rather than the whole environment",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_RESTRICT_ENV",
+		},
+		cli.StringSliceFlag{
+			Name:   "env-passthrough",
+			Value:  &cli.StringSlice{},
+			Usage:  "With --restrict-env, a name or pattern (like MY_APP_*) of other environment variables to interpolate",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_ENV_PASSTHROUGH",
+		},
+		cli.StringFlag{
+			Name:   "env-file",
+			Usage:  "Path to a dotenv style file of KEY=VALUE lines to add to the environment used for interpolation. Its values take precedence over the process's environment",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_ENV_FILE",
+		},
+		cli.StringSliceFlag{
+			Name:   "propagate-env",
+			Value:  &cli.StringSlice{},
+			Usage:  "The name of an environment variable to add to the env of every command step, with its value when the pipeline is uploaded. Unset variables are skipped",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_PROPAGATE_ENV",
+		},
+		cli.StringFlag{
+			Name:   "manifest",
+			Usage:  "Path to a YAML file of options for this command. Options given as flags or environment variables take precedence",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_MANIFEST",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "Path to a configuration file of defaults for this command's options, in the same format as the agent's configuration file. Options in it that this command doesn't have are warned about",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_CONFIG",
+		},
+		cli.BoolFlag{
+			Name:   "config-provenance",
+			Usage:  "Print each option's value as JSON to stderr, along with whether it came from a flag, an environment variable, a config file or the manifest. Secrets are masked",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_CONFIG_PROVENANCE",
+		},
+		cli.BoolFlag{
+			Name:   "skip-unchanged",
+			Usage:  "Don't upload the pipeline if it's the same as the last one this job uploaded for the pipeline, which is recorded in --upload-cache-dir",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_SKIP_UNCHANGED",
+		},
+		cli.BoolFlag{
+			Name:   "force",
+			Usage:  "Upload the pipeline even if --skip-unchanged would skip it",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_FORCE",
+		},
+		cli.StringFlag{
+			Name:   "upload-cache-dir",
+			Usage:  "Where --skip-unchanged records the pipelines that were uploaded. Defaults to a directory in the agent's build path, or the system's temporary directory if that isn't set",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_CACHE_DIR",
+		},
+		cli.BoolFlag{
+			Name:   "interp-stats",
+			Usage:  "Log how many distinct variables were referenced during interpolation and how many resolved to a value, without logging their names or values",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_INTERP_STATS",
+		},
+		cli.StringFlag{
+			Name:   "sort-steps-by",
+			Usage:  "Sort the top-level steps by the value of this step attribute, such as key. Wait and block steps stay in place and the steps between them are sorted, and steps without the attribute keep their order after those with it",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_SORT_STEPS_BY",
+		},
+		cli.StringFlag{
+			Name:   "group-untagged-steps",
+			Usage:  "Move the top-level steps that aren't in a group into a group with this label, where the first of them was",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_GROUP_UNTAGGED_STEPS",
+		},
+		cli.StringFlag{
+			Name:   "step-key-prefix",
+			Usage:  "Add this prefix to the key of every step, and to the depends_on references to them, so the same pipeline can be uploaded to a build more than once",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_STEP_KEY_PREFIX",
+		},
+		cli.StringFlag{
+			Name:   "step-label-template",
+			Usage:  "A Go template, like '{{ .Command | firstLine }}', to generate labels for command steps that don't have one. It can use the step's .Command, .Key, .Env and .Agents",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_STEP_LABEL_TEMPLATE",
+		},
+		cli.StringFlag{
+			Name:   "detect-self-trigger",
+			Value:  "warn",
+			Usage:  "What to do about trigger steps that trigger the pipeline being built (from $BUILDKITE_PIPELINE_SLUG), which can cause an endless loop of builds. One of \"warn\", \"fail\" or \"off\"",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DETECT_SELF_TRIGGER",
+		},
+		cli.IntFlag{
+			Name:   "max-label-length",
+			Value:  agent.DefaultMaxLabelLength,
+			Usage:  "Fail if any step's label is longer than this many characters. A value of 0 allows labels of any length",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_MAX_LABEL_LENGTH",
+		},
+		cli.BoolFlag{
+			Name:   "truncate-labels",
+			Usage:  "Shorten labels longer than --max-label-length rather than failing",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_TRUNCATE_LABELS",
+		},
+		cli.IntFlag{
+			Name:   "max-var-length",
+			Usage:  "Fail if a variable interpolated into the pipeline has a value longer than this many bytes. A value of 0 allows values of any length",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_MAX_VAR_LENGTH",
+		},
+		cli.BoolFlag{
+			Name:   "truncate-long-vars",
+			Usage:  "Shorten the values of variables longer than --max-var-length when they're interpolated, with a warning, rather than failing",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_TRUNCATE_LONG_VARS",
+		},
+		cli.BoolFlag{
+			Name:   "validate-env-references",
+			Usage:  "Before interpolating, fail if the pipeline references environment variables without a default that aren't set. With --restrict-env, only the allowed variables count as set",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_VALIDATE_ENV_REFERENCES",
+		},
+		cli.BoolFlag{
+			Name:   "interpolation-strict",
+			Usage:  "Fail parsing, rather than warning, when interpolation references environment variables without a default that aren't set, listing all of them",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_INTERPOLATION_STRICT",
+		},
+		cli.BoolFlag{
+			Name:   "validate-dependencies",
+			Usage:  "Check that every depends_on refers to the key of a step in the pipeline, and that no steps depend on each other in a cycle",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_VALIDATE_DEPENDENCIES",
+		},
+		cli.StringFlag{
+			Name:   "policy-url",
+			Usage:  "The URL of a policy service to POST the parsed pipeline to as JSON. It must respond with {\"allow\": true} to allow the upload, or {\"allow\": false, \"reasons\": [...]} to deny it. The values of redacted-vars are redacted first, and it isn't used by --dry-run or --diff",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_POLICY_URL",
+		},
+		cli.StringFlag{
+			Name:   "on-parse-error",
+			Value:  onParseErrorLog,
+			Usage:  "What to do when the pipeline can't be parsed, as well as failing. Either \"log\" the error, or also \"annotate\" the build with it",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_ON_PARSE_ERROR",
+		},
+		cli.BoolFlag{
+			Name:   "compress-upload",
+			Usage:  "Gzip the pipeline before sending it to the Agent API. Requires an API endpoint that accepts gzip encoded request bodies",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_COMPRESS",
+		},
+		cli.IntFlag{
+			Name:   "compress-upload-threshold",
+			Value:  4096,
+			Usage:  "The minimum size in bytes of a pipeline before --compress-upload will compress it",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_COMPRESS_THRESHOLD",
+		},
+		cli.IntFlag{
+			Name:   "retry-limit",
+			Value:  60,
+			Usage:  "The number of times to try uploading the pipeline before giving up",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_RETRY_LIMIT",
+		},
+		cli.DurationFlag{
+			Name:   "retry-interval",
+			Value:  5 * time.Second,
+			Usage:  "The amount of time to wait between attempts to upload the pipeline, which is randomly varied by up to half to spread out retries",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_RETRY_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "request-timeout",
+			Value:  api.DefaultTimeout,
+			Usage:  "How long each request to the Agent API can take. An attempt to upload the pipeline that times out is retried",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_REQUEST_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "stdin-timeout",
+			Usage:  "How long to wait for the pipeline to be read from STDIN, like 30s, before failing. By default there's no limit",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_STDIN_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "async-wait",
+			Usage:  "After uploading, wait for the Agent API to finish processing the pipeline, and fail if it's rejected. Large pipelines are processed asynchronously",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_ASYNC_WAIT",
+		},
+		cli.DurationFlag{
+			Name:   "async-timeout",
+			Value:  5 * time.Minute,
+			Usage:  "How long --async-wait waits for the pipeline to be processed before failing",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_ASYNC_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "step-default-timeout",
+			Usage:  "A timeout_in_minutes to add to command steps that don't specify their own",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_STEP_DEFAULT_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "step-default-retry",
+			Usage:  "A number of automatic retries to add to command steps that don't specify their own retry config",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_STEP_DEFAULT_RETRY",
+		},
+		cli.IntFlag{
+			Name:   "step-timeout-cap",
+			Usage:  "The maximum timeout in minutes of command steps. Longer timeouts are lowered to it, with a warning. A value of 0 doesn't cap timeouts",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_STEP_TIMEOUT_CAP",
+		},
+		cli.BoolFlag{
+			Name:   "step-timeout-cap-unset",
+			Usage:  "Give command steps without a timeout the timeout of --step-timeout-cap",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_STEP_TIMEOUT_CAP_UNSET",
+		},
+		cli.IntFlag{
+			Name:   "max-warnings",
+			Value:  -1,
+			Usage:  "Fail if parsing the pipeline produces more than this many warnings. A negative value allows any number of warnings",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_MAX_WARNINGS",
+		},
+		cli.BoolFlag{
+			Name:   "fail-on-warnings",
+			Usage:  "Fail if parsing the pipeline produces any warnings, the same as --max-warnings=0",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_FAIL_ON_WARNINGS",
+		},
+		cli.BoolFlag{
+			Name:   "validate-schema",
+			Usage:  "Check the parsed pipeline against the schema printed by \"pipeline validate-schema\" before uploading it, and fail listing every place it doesn't conform",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_VALIDATE_SCHEMA",
+		},
+		cli.BoolFlag{
+			Name:   "merge-stdin",
+			Usage:  "When a pipeline file is given and a pipeline is also piped to STDIN, add the steps from STDIN after the file's, rather than ignoring STDIN",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_MERGE_STDIN",
+		},
+		cli.BoolFlag{
+			Name:   "resolve-aws-secrets",
+			Usage:  "Before interpolation, replace environment variables with values like \"awssm:<arn-or-name>#<json-key>\" with the secret from AWS Secrets Manager",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_RESOLVE_AWS_SECRETS",
+		},
+		cli.StringSliceFlag{
+			Name:   "redacted-vars",
+			Usage:  "Pattern of environment variable names containing sensitive values. The pipeline won't be uploaded if it contains any of their values",
+			EnvVar: "BUILDKITE_REDACTED_VARS",
+			Value:  &cli.StringSlice{"*_PASSWORD", "*_SECRET", "*_TOKEN", "*_ACCESS_KEY", "*_SECRET_KEY"},
+		},
+		cli.StringFlag{
+			Name:   "redacted-vars-file",
+			Usage:  "Path to a file of patterns of environment variable names containing sensitive values, one on each line, to use as well as --redacted-vars. Blank lines and lines starting with # are ignored",
+			EnvVar: "BUILDKITE_REDACTED_VARS_FILE",
+		},
+		cli.IntFlag{
+			Name:   "redacted-vars-min-length",
+			Value:  redaction.LengthMin,
+			Usage:  "The length values of redacted-vars must be to be treated as sensitive. Shorter values are skipped, as they're likely to appear in the pipeline by chance",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_REDACTED_VARS_MIN_LENGTH",
+		},
+		cli.BoolFlag{
+			Name:   "inherit-agent-redaction",
+			Usage:  "Also treat the redacted-vars in the agent's configuration file as sensitive. The file is the one the agent running the job was started with (BUILDKITE_CONFIG_PATH), or given by BUILDKITE_AGENT_CONFIG, or the first that exists of those the agent looks for",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_INHERIT_AGENT_REDACTION",
+		},
+		cli.StringFlag{
+			Name:   "redact-from-file",
+			Usage:  "Path to a file of secrets, one on each line, that the pipeline won't be uploaded if it contains. Lines starting with # are ignored",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_REDACT_FROM_FILE",
+		},
+		cli.StringSliceFlag{
+			Name:   "redacted-patterns",
+			Usage:  "A regular expression, like password=\\S+, for secrets that aren't the values of environment variables. The pipeline won't be uploaded if anything in it matches, and matches are redacted from --dry-run output. Can be given more than once, as patterns can contain commas",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_REDACTED_PATTERNS",
+		},
+		cli.StringSliceFlag{
+			Name:   "redact-pointer",
+			Usage:  "A JSON pointer, like /steps/*/env/AWS_SECRET_ACCESS_KEY, to values in the pipeline that are replaced with [REDACTED] before it's uploaded. A * matches every key or list item",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_REDACT_POINTER",
+		},
+		cli.BoolFlag{
+			Name:   "redact-pointer-remove",
+			Usage:  "Remove the values matched by --redact-pointer, rather than replacing them with [REDACTED]",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_REDACT_POINTER_REMOVE",
+		},
+		cli.StringFlag{
+			Name:   "redaction-report",
+			Usage:  "Write a JSON report of the redacted variables whose values are in the pipeline, and where they are, to this path. The values themselves are never written",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_REDACTION_REPORT",
+		},
+		cli.BoolFlag{
+			Name:   "warn-secret-interp",
+			Usage:  "Log a warning for each place in the pipeline that the value of a redacted variable is interpolated into, without logging the value",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_WARN_SECRET_INTERP",
+		},
+		cli.BoolFlag{
+			Name:   "exit-zero-on-redaction",
+			Usage:  "Log an error rather than failing when the pipeline contains the value of a redacted variable, and upload it anyway",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_EXIT_ZERO_ON_REDACTION",
+		},
+		cli.BoolFlag{
+			Name:   "annotate-on-redaction",
+			Usage:  "When the pipeline contains the value of a redacted variable, also annotate the build with the names of the variables and where they were found, but not their values",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_ANNOTATE_ON_REDACTION",
+		},
+
+		cli.StringFlag{
+			Name:   "attestation",
+			Usage:  "After uploading, write an in-toto attestation of the upload to this path, recording the digests of the pipeline's source and of the uploaded pipeline, the commit, and the job that uploaded it",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_ATTESTATION",
+		},
+		cli.StringFlag{
+			Name:   "attestation-key",
+			Usage:  "Path to a PEM encoded private key (Ed25519, ECDSA or RSA) to sign the --attestation with, which is then written as a DSSE envelope",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_ATTESTATION_KEY",
+		},
 
 		// API Flags
 		AgentAccessTokenFlag,
+		AgentAccessTokenEnvFlag,
+		AgentAccessTokenFileFlag,
 		EndpointFlag,
+		cli.StringFlag{
+			Name:   "confirm-endpoint",
+			Usage:  "Fail unless the Agent API endpoint contains this text, to guard against uploading to the wrong Buildkite organization",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_CONFIRM_ENDPOINT",
+		},
 		NoHTTP2Flag,
+		CACertFlag,
+		HTTPSProxyFlag,
+		NoProxyFlag,
 		DebugHTTPFlag,
 
 		// Global flags
+		LogFormatFlag,
 		NoColorFlag,
 		DebugFlag,
+		LogLevelFlag,
 		ExperimentsFlag,
 		ProfileFlag,
 	},
@@ -113,168 +730,1283 @@ var PipelineUploadCommand = cli.Command{
 
 		l := CreateLogger(&cfg)
 
-		// Load the configuration
-		if err := cliconfig.Load(c, l, &cfg); err != nil {
+		// Read the token from a custom environment variable if there is one
+		if err := applyAgentAccessTokenEnv(c); err != nil {
 			l.Fatal("%s", err)
 		}
 
-		// Setup any global configuration options
-		done := HandleGlobalFlags(l, cfg)
-		defer done()
-
-		// Find the pipeline file either from STDIN or the first
-		// argument
-		var input []byte
-		var err error
-		var filename string
+		// Or from a file, so it isn't in the process's arguments or environment
+		if err := applyAgentAccessTokenFile(c); err != nil {
+			l.Fatal("%s", err)
+		}
 
-		if cfg.FilePath != "" {
-			l.Info("Reading pipeline config from \"%s\"", cfg.FilePath)
+		// Load the configuration. The --config file is meant for this command,
+		// so options in it that the command doesn't have are warned about.
+		loader := cliconfig.Loader{
+			CLI:                    c,
+			Config:                 &cfg,
+			Provenance:             map[string]cliconfig.Source{},
+			WarnUnknownFileOptions: true,
+		}
+		configWarnings, err := loader.Load()
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+		for _, warning := range configWarnings {
+			l.Warn("%s", warning)
+		}
+		provenance := loader.Provenance
 
-			filename = filepath.Base(cfg.FilePath)
-			input, err = ioutil.ReadFile(cfg.FilePath)
-			if err != nil {
-				l.Fatal("Failed to read file: %s", err)
+		// Fill in anything not given on the command line from the manifest
+		if cfg.Manifest != "" {
+			if err := applyPipelineManifest(c, &cfg, cfg.Manifest, provenance); err != nil {
+				l.Fatal("%s", err)
 			}
-		} else if stdin.IsReadable() {
-			l.Info("Reading pipeline config from STDIN")
+		}
 
-			// Actually read the file from STDIN
-			input, err = ioutil.ReadAll(os.Stdin)
-			if err != nil {
-				l.Fatal("Failed to read from STDIN: %s", err)
+		if cfg.ConfigProvenance {
+			if cfg.AgentAccessTokenEnv != "" {
+				provenance["agent-access-token"] = cliconfig.Source{Kind: "env", Name: cfg.AgentAccessTokenEnv}
 			}
-		} else {
-			l.Info("Searching for pipeline config...")
-
-			paths := []string{
-				"buildkite.yml",
-				"buildkite.yaml",
-				"buildkite.json",
-				filepath.FromSlash(".buildkite/pipeline.yml"),
-				filepath.FromSlash(".buildkite/pipeline.yaml"),
-				filepath.FromSlash(".buildkite/pipeline.json"),
-				filepath.FromSlash("buildkite/pipeline.yml"),
-				filepath.FromSlash("buildkite/pipeline.yaml"),
-				filepath.FromSlash("buildkite/pipeline.json"),
-			}
-
-			// Collect all the files that exist
-			exists := []string{}
-			for _, path := range paths {
-				if _, err := os.Stat(path); err == nil {
-					exists = append(exists, path)
-				}
+			if cfg.AgentAccessTokenFile != "" {
+				provenance["agent-access-token"] = cliconfig.Source{Kind: "file", Name: cfg.AgentAccessTokenFile}
 			}
-
-			// If more than 1 of the config files exist, throw an
-			// error. There can only be one!!
-			if len(exists) > 1 {
-				l.Fatal("Found multiple configuration files: %s. Please only have 1 configuration file present.", strings.Join(exists, ", "))
-			} else if len(exists) == 0 {
-				l.Fatal("Could not find a default pipeline configuration file. See `buildkite-agent pipeline upload --help` for more information.")
+			if err := printConfigProvenance(os.Stderr, cfg, provenance); err != nil {
+				l.Fatal("Failed to print config provenance: %s", err)
 			}
+		}
 
-			found := exists[0]
+		// The logger was created before the log format and colors were loaded
+		l = CreateLogger(&cfg)
 
-			l.Info("Found config file \"%s\"", found)
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
 
-			// Read the default file
-			filename = path.Base(found)
-			input, err = ioutil.ReadFile(found)
-			if err != nil {
-				l.Fatal("Failed to read file \"%s\" (%s)", found, err)
-			}
+		if cfg.ConfirmEndpoint != "" && !strings.Contains(cfg.Endpoint, cfg.ConfirmEndpoint) {
+			l.Fatal("The endpoint %q doesn't contain %q from --confirm-endpoint", cfg.Endpoint, cfg.ConfirmEndpoint)
 		}
 
-		// Make sure the file actually has something in it
-		if len(input) == 0 {
-			l.Fatal("Config file is empty")
+		switch cfg.PipelineConflict {
+		case pipelineConflictFail, pipelineConflictFirst, pipelineConflictLast:
+		default:
+			l.Fatal("Invalid --pipeline-conflict %q, expected %q, %q or %q", cfg.PipelineConflict, pipelineConflictFail, pipelineConflictFirst, pipelineConflictLast)
 		}
 
-		// Load environment to pass into parser
-		environ := env.FromSlice(os.Environ())
+		if cfg.OnParseError != onParseErrorLog && cfg.OnParseError != onParseErrorAnnotate {
+			l.Fatal("Invalid --on-parse-error %q, expected %q or %q", cfg.OnParseError, onParseErrorLog, onParseErrorAnnotate)
+		}
 
-		// resolve BUILDKITE_COMMIT based on the local git repo
-		if commitRef, ok := environ.Get(`BUILDKITE_COMMIT`); ok {
-			cmdOut, err := exec.Command(`git`, `rev-parse`, commitRef).Output()
-			if err != nil {
-				l.Warn("Error running git rev-parse %q: %v", commitRef, err)
-			} else {
-				trimmedCmdOut := strings.TrimSpace(string(cmdOut))
-				l.Info("Updating BUILDKITE_COMMIT to %q", trimmedCmdOut)
-				environ.Set(`BUILDKITE_COMMIT`, trimmedCmdOut)
-			}
+		switch cfg.DetectSelfTrigger {
+		case "warn", "fail", "off":
+		default:
+			l.Fatal("Invalid --detect-self-trigger %q, expected \"warn\", \"fail\" or \"off\"", cfg.DetectSelfTrigger)
 		}
 
-		// Parse the pipeline
-		result, err := agent.PipelineParser{
-			Env:             environ,
-			Filename:        filename,
-			Pipeline:        input,
-			NoInterpolation: cfg.NoInterpolation,
-		}.Parse()
-		if err != nil {
-			src := filename
-			if src == "" {
-				src = "(stdin)"
-			}
-			l.Fatal("Pipeline parsing of \"%s\" failed (%s)", src, err)
+		if cfg.ExpandMatrix && !cfg.DryRun {
+			l.Fatal("--expand-matrix can only be used with --dry-run, as Buildkite expands matrices itself")
 		}
 
-		// In dry-run mode we just output the generated pipeline to stdout
-		if cfg.DryRun {
-			enc := json.NewEncoder(os.Stdout)
-			enc.SetIndent("", "  ")
+		if cfg.SourceMap && !cfg.DryRun {
+			l.Fatal("--source-map can only be used with --dry-run")
+		}
 
-			// Dump json indented to stdout. All logging happens to stderr
-			// this can be used with other tools to get interpolated json
-			if err := enc.Encode(result); err != nil {
-				l.Fatal("%#v", err)
-			}
+		if cfg.ForceInterp && cfg.NoInterpolation {
+			l.Fatal("Only one of --force-interpolation and --no-interpolation can be given")
+		}
 
-			return
+		switch cfg.DryRunFormat {
+		case "json", "yaml":
+		default:
+			l.Fatal("--dry-run-format must be json or yaml, got %q", cfg.DryRunFormat)
 		}
 
-		// Check we have a job id set if not in dry run
-		if cfg.Job == "" {
-			l.Fatal("Missing job parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_JOB_ID.")
+		// An empty value would be found everywhere
+		if cfg.RedactedVarsMinLen < 1 {
+			l.Fatal("--redacted-vars-min-length must be at least 1, got %d", cfg.RedactedVarsMinLen)
 		}
 
-		// Check we have an agent access token if not in dry run
-		if cfg.AgentAccessToken == "" {
-			l.Fatal("Missing agent-access-token parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_AGENT_ACCESS_TOKEN.")
+		if cfg.Diff && cfg.DryRun {
+			l.Fatal("Only one of --diff and --dry-run can be given")
 		}
 
-		// Create the API client
-		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+		// Replacing the pipeline with only its new steps would remove the rest
+		if cfg.UploadOnlyChanged && cfg.Replace {
+			l.Fatal("Only one of --upload-only-changed and --replace can be given")
+		}
 
-		// Generate a UUID that will identify this pipeline change. We
-		// do this outside of the retry loop because we want this UUID
-		// to be the same for each attempt at updating the pipeline.
-		uuid := api.NewUUID()
+		if cfg.UploadOnlyChanged && cfg.EnsureStep {
+			l.Fatal("Only one of --upload-only-changed and --ensure-step can be given")
+		}
 
-		// Retry the pipeline upload a few times before giving up
-		err = retry.Do(func(s *retry.Stats) error {
-			_, err = client.UploadPipeline(cfg.Job, &api.Pipeline{UUID: uuid, Pipeline: result, Replace: cfg.Replace})
-			if err != nil {
-				l.Warn("%s (%s)", err, s)
+		switch cfg.DiffFormat {
+		case "unified", "json":
+		default:
+			l.Fatal("--diff-format must be unified or json, got %q", cfg.DiffFormat)
+		}
 
-				// 422 responses will always fail no need to retry
-				if apierr, ok := err.(*api.ErrorResponse); ok && apierr.Response.StatusCode == 422 {
-					l.Error("Unrecoverable error, skipping retries")
-					s.Break()
-				}
-			}
+		if cfg.DiffFormat != "unified" && !cfg.Diff {
+			l.Fatal("--diff-format can only be used with --diff")
+		}
 
-			return err
+		if cfg.DryRunStrict && !cfg.DryRun {
+			l.Fatal("--dry-run-strict can only be used with --dry-run")
+		}
+
+		if cfg.WriteBack && !cfg.DryRun {
+			l.Fatal("--write-back can only be used with --dry-run")
+		}
+
+		if cfg.WriteBack && !cfg.Yes {
+			l.Fatal("--write-back overwrites the pipeline file, so --yes must be given to confirm it")
+		}
+
+		stepDefaults := agent.StepDefaults{
+			TimeoutInMinutes: cfg.StepDefaultTimeout,
+			RetryLimit:       cfg.StepDefaultRetry,
+		}
+		if err := stepDefaults.Validate(); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		if cfg.RetryLimit < 1 {
+			l.Fatal("Retry limit must be at least 1, got %d", cfg.RetryLimit)
+		}
+
+		retryInterval, err := time.ParseDuration(cfg.RetryInterval)
+		if err != nil {
+			l.Fatal("Failed to parse retry interval: %v", err)
+		}
+		if retryInterval < 0 {
+			l.Fatal("Retry interval can't be negative, got %s", retryInterval)
+		}
+
+		requestTimeout, err := time.ParseDuration(cfg.RequestTimeout)
+		if err != nil {
+			l.Fatal("Failed to parse request timeout: %v", err)
+		}
+		if requestTimeout <= 0 {
+			l.Fatal("Request timeout must be positive, got %s", requestTimeout)
+		}
+
+		stdinTimeout, err := time.ParseDuration(cfg.StdinTimeout)
+		if err != nil {
+			l.Fatal("Failed to parse STDIN timeout: %v", err)
+		}
+		if stdinTimeout < 0 {
+			l.Fatal("STDIN timeout can't be negative, got %s", stdinTimeout)
+		}
+
+		asyncTimeout, err := time.ParseDuration(cfg.AsyncTimeout)
+		if err != nil {
+			l.Fatal("Failed to parse async timeout: %v", err)
+		}
+		if asyncTimeout <= 0 {
+			l.Fatal("Async timeout must be positive, got %s", asyncTimeout)
+		}
+
+		if cfg.RepoDir != "" {
+			if fi, err := os.Stat(cfg.RepoDir); err != nil {
+				l.Fatal("Invalid --repo-dir: %v", err)
+			} else if !fi.IsDir() {
+				l.Fatal("Invalid --repo-dir: %s isn't a directory", cfg.RepoDir)
+			}
+		}
+
+		if cfg.StepTimeoutCap < 0 {
+			l.Fatal("Step timeout cap must be a positive number of minutes, got %d", cfg.StepTimeoutCap)
+		}
+
+		if cfg.StepTimeoutCapUnset && cfg.StepTimeoutCap == 0 {
+			l.Fatal("--step-timeout-cap-unset can only be used with --step-timeout-cap")
+		}
+
+		if cfg.AttestationKey != "" && cfg.Attestation == "" {
+			l.Fatal("--attestation-key can only be used with --attestation")
+		}
+
+		// Load the signing key before uploading, so that a bad key doesn't
+		// fail the command after the pipeline has been uploaded
+		var attestationKey crypto.Signer
+		if cfg.AttestationKey != "" {
+			var err error
+			if attestationKey, err = loadAttestationKey(cfg.AttestationKey); err != nil {
+				l.Fatal("%s", err)
+			}
+		}
+
+		var pluginPins map[string]string
+		if cfg.PluginPinFile != "" {
+			var err error
+			if pluginPins, err = readPluginPins(cfg.PluginPinFile); err != nil {
+				l.Fatal("Failed to read plugin pins: %s", err)
+			}
+		}
+
+		var labelTemplate *agent.LabelTemplate
+		if cfg.StepLabelTemplate != "" {
+			var err error
+			if labelTemplate, err = agent.NewLabelTemplate(cfg.StepLabelTemplate); err != nil {
+				l.Fatal("%s", err)
+			}
+		}
+
+		// Find the pipeline file either from STDIN or the first
+		// argument
+		var input []byte
+		var filename string
+
+		// Where the pipeline was read from, for the attestation
+		var source string
+
+		// The local file the pipeline was read from, if it was
+		var localPath string
+
+		// Pipeline files can be globs, which are expanded into all the files
+		// they match
+		var filePaths []string
+		if cfg.FilePath != "" {
+			filePaths = []string{cfg.FilePath}
+			if !cfg.InterpFromArgs && c.NArg() > 1 {
+				filePaths = append(filePaths, c.Args()[1:]...)
+			}
+
+			filePaths, err = expandPipelinePaths(filePaths)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+			cfg.FilePath = filePaths[0]
+		}
+
+		if cfg.PipelineFromCmd != "" && cfg.FromArtifact != "" {
+			l.Fatal("Only one of --pipeline-from-cmd and --pipeline-from-artifact can be given")
+		}
+
+		if cfg.FromArtifact != "" {
+			if cfg.FilePath != "" {
+				l.Fatal("A pipeline file can't be given along with --pipeline-from-artifact")
+			}
+			if cfg.Build == "" {
+				l.Fatal("Missing build parameter, which --pipeline-from-artifact needs. Usually this is set in the environment for a Buildkite job via BUILDKITE_BUILD_ID.")
+			}
+			if cfg.AgentAccessToken == "" {
+				l.Fatal("Missing agent-access-token parameter, which --pipeline-from-artifact needs. Usually this is set in the environment for a Buildkite job via BUILDKITE_AGENT_ACCESS_TOKEN.")
+			}
+
+			l.Info("Reading pipeline config from the artifact matching \"%s\"", cfg.FromArtifact)
+
+			client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+			var artifactPath string
+			input, artifactPath, err = downloadPipelineArtifact(l, client, cfg.Build, cfg.FromArtifact)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+			filename = path.Base(artifactPath)
+			source = artifactPath
+		} else if cfg.PipelineFromCmd != "" {
+			if cfg.FilePath != "" {
+				l.Fatal("A pipeline file can't be given along with --pipeline-from-cmd")
+			}
+
+			l.Info("Reading pipeline config from the output of \"%s\"", cfg.PipelineFromCmd)
+
+			source = cfg.PipelineFromCmd
+			input, err = runPipelineCommand(cfg.PipelineFromCmd, nil)
+			if err != nil {
+				l.Fatal("Failed to generate pipeline: %s", err)
+			}
+		} else if u, ok := parsePipelineURL(cfg.FilePath); ok {
+			l.Info("Reading pipeline config from \"%s\"", displayPipelineURL(u))
+
+			client := api.NewUnauthenticatedHTTPClient(loadAPIClientConfig(cfg, `AgentAccessToken`), pipelineURLTimeout)
+			filename = pipelineURLFilename(u)
+			source = displayPipelineURL(u)
+			input, err = readURLPipeline(client, u)
+			if err != nil {
+				l.Fatal("Failed to fetch pipeline: %s", err)
+			}
+		} else if destination, remotePath, ok := parseSSHPath(cfg.FilePath); ok {
+			l.Info("Reading pipeline config from \"%s\" on %s over SSH", remotePath, destination)
+
+			filename = path.Base(remotePath)
+			source = cfg.FilePath
+			input, err = readSSHFile(destination, remotePath)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+		} else if cfg.FilePath != "" {
+			l.Info("Reading pipeline config from \"%s\"", cfg.FilePath)
+
+			filename = filepath.Base(cfg.FilePath)
+			source = cfg.FilePath
+			localPath = cfg.FilePath
+			input, err = ioutil.ReadFile(cfg.FilePath)
+			if err != nil {
+				l.Fatal("Failed to read file: %s", err)
+			}
+		} else if stdin.IsReadable() {
+			l.Info("Reading pipeline config from STDIN")
+
+			// Actually read the file from STDIN
+			source = "(stdin)"
+			input, err = readStdinPipeline(stdinTimeout)
+			if err == context.DeadlineExceeded {
+				l.Fatal("Timed out reading pipeline from STDIN after %s", stdinTimeout)
+			}
+			if err != nil {
+				l.Fatal("Failed to read from STDIN: %s", err)
+			}
+		} else {
+			l.Info("Searching for pipeline config...")
+
+			found, err := findPipelineFile(l, cfg.PipelineSearchPaths, cfg.PipelineConflict)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+
+			l.Info("Found config file \"%s\"", found)
+
+			// Read the default file
+			filename = path.Base(found)
+			source = found
+			localPath = found
+			input, err = ioutil.ReadFile(found)
+			if err != nil {
+				l.Fatal("Failed to read file \"%s\" (%s)", found, err)
+			}
+		}
+
+		// Make sure the file actually has something in it
+		if len(input) == 0 {
+			l.Fatal("Config file is empty")
+		}
+
+		// STDIN is otherwise ignored when there's a pipeline file
+		mergeStdin := cfg.MergeStdin && cfg.FilePath != "" && stdin.IsReadable()
+		if cfg.MergeStdin && !mergeStdin {
+			l.Debug("Not merging a pipeline from STDIN, as there isn't both a pipeline file and a readable STDIN")
+		}
+
+		// Other pipeline files given after the first are fragments, whose steps
+		// are added to the first's, followed by the pipeline from STDIN
+		var fragments []pipelineFragment
+		if len(filePaths) > 1 || mergeStdin {
+			if localPath == "" {
+				l.Fatal("Only local pipeline files can be uploaded together")
+			}
+			if cfg.WriteBack {
+				l.Fatal("--write-back can only be used with a single pipeline file")
+			}
+			if cfg.SourceMap {
+				l.Fatal("--source-map can only be used with a single pipeline file")
+			}
+
+			for _, fragmentPath := range filePaths[1:] {
+				l.Info("Reading pipeline config from \"%s\"", fragmentPath)
+
+				fragmentInput, err := ioutil.ReadFile(fragmentPath)
+				if err != nil {
+					l.Fatal("Failed to read file: %s", err)
+				}
+				if len(fragmentInput) == 0 {
+					l.Fatal("Config file \"%s\" is empty", fragmentPath)
+				}
+				if cfg.NormalizeLineEndings {
+					fragmentInput = bytes.Replace(fragmentInput, []byte("\r\n"), []byte("\n"), -1)
+				}
+
+				fragments = append(fragments, pipelineFragment{
+					path:            fragmentPath,
+					input:           fragmentInput,
+					noInterpolation: cfg.NoInterpolation || (!cfg.ForceInterp && isJSONPipeline(fragmentInput)),
+				})
+			}
+
+			if mergeStdin {
+				l.Info("Reading pipeline config to merge from STDIN")
+
+				stdinInput, err := readStdinPipeline(stdinTimeout)
+				if err == context.DeadlineExceeded {
+					l.Fatal("Timed out reading pipeline from STDIN after %s", stdinTimeout)
+				}
+				if err != nil {
+					l.Fatal("Failed to read from STDIN: %s", err)
+				}
+				if cfg.NormalizeLineEndings {
+					stdinInput = bytes.Replace(stdinInput, []byte("\r\n"), []byte("\n"), -1)
+				}
+
+				// A generator with nothing to add can output nothing
+				if len(bytes.TrimSpace(stdinInput)) == 0 {
+					l.Info("Not merging the pipeline from STDIN, as it's empty")
+				} else {
+					fragments = append(fragments, pipelineFragment{
+						path:            "(stdin)",
+						input:           stdinInput,
+						noInterpolation: cfg.NoInterpolation || (!cfg.ForceInterp && isJSONPipeline(stdinInput)),
+					})
+				}
+			}
+		}
+
+		// Interpolating a generated JSON pipeline can mangle values that
+		// happen to contain a $
+		if !cfg.NoInterpolation && isJSONPipeline(input) {
+			if cfg.ForceInterp {
+				l.Debug("Interpolating the pipeline even though it's JSON, as --force-interpolation is set")
+			} else {
+				l.Debug("Not interpolating the pipeline as it's JSON, pass --force-interpolation to interpolate it")
+				cfg.NoInterpolation = true
+			}
+		}
+
+		if cfg.WriteBack && localPath == "" {
+			l.Fatal("--write-back can only be used with a local pipeline file, not %s", source)
+		}
+
+		if cfg.WriteBack {
+			if err := checkWriteBack(localPath); err != nil {
+				l.Fatal("%s", err)
+			}
+		}
+
+		if cfg.NormalizeLineEndings && bytes.Contains(input, []byte("\r\n")) {
+			input = bytes.Replace(input, []byte("\r\n"), []byte("\n"), -1)
+			l.Debug("Converted CRLF line endings in the pipeline to LF")
+		}
+
+		// Load environment to pass into parser
+		environ := env.FromSlice(os.Environ())
+		if cfg.RestrictEnv {
+			environ = restrictEnvironment(environ, cfg.EnvPassthrough)
+		}
+
+		// Variables from an env file are named explicitly, so they're added
+		// even with --restrict-env
+		if cfg.EnvFile != "" {
+			fileEnv, err := env.FromFile(cfg.EnvFile)
+			if err != nil {
+				l.Fatal("Failed to read the env file: %v", err)
+			}
+			environ = environ.Merge(fileEnv)
+			l.Debug("Loaded %d environment variables from %s", fileEnv.Length(), cfg.EnvFile)
+		}
+
+		// Minimal containers often don't have git, which is only needed to
+		// resolve BUILDKITE_COMMIT
+		if cfg.NoGitCommitResolution {
+			if cfg.RequireGit {
+				l.Fatal("--require-git can't be used with --no-git-commit-resolution")
+			}
+			l.Debug("Not resolving BUILDKITE_COMMIT as --no-git-commit-resolution is set")
+		} else if _, gitErr := exec.LookPath(`git`); gitErr != nil {
+			if cfg.RequireGit {
+				l.Fatal("git is required by --require-git, but couldn't be found: %v", gitErr)
+			}
+			l.Debug("Not resolving BUILDKITE_COMMIT as git isn't installed")
+		} else {
+			resolveCommit(l, environ, cfg.RepoDir)
+		}
+
+		// Replace references to AWS Secrets Manager secrets with the secrets
+		var resolvedSecretVars []string
+		if cfg.ResolveAWSSecrets {
+			resolvedSecretVars, err = agent.ResolveAWSSecrets(environ)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+			l.Debug("Resolved %d environment variables from AWS Secrets Manager", len(resolvedSecretVars))
+		}
+
+		// Collect the values that mustn't appear in the uploaded pipeline
+		// before parsing, as the pipeline's own env can add to environ.
+		// Secrets resolved from AWS are always treated as sensitive.
+		redactedVars := cfg.RedactedVars
+		if cfg.RedactedVarsFile != "" {
+			redactedVars, err = mergeRedactedVarsFile(redactedVars, cfg.RedactedVarsFile)
+			if err != nil {
+				l.Fatal("Failed to read --redacted-vars-file: %v", err)
+			}
+		}
+		redactedVars = append(redactedVars, resolvedSecretVars...)
+
+		// Use the same redaction policy as the agent running the job
+		if cfg.InheritRedaction {
+			agentConfig := os.Getenv("BUILDKITE_CONFIG_PATH")
+			if agentConfig == "" {
+				agentConfig = os.Getenv("BUILDKITE_AGENT_CONFIG")
+			}
+
+			inherited, configPath, err := agentConfigRedactedVars(agentConfig, DefaultConfigFilePaths())
+			switch {
+			case err != nil:
+				l.Fatal("Failed to read redacted-vars from the agent configuration file %s: %s", configPath, err)
+			case configPath == "":
+				l.Debug("Not inheriting the agent's redacted-vars, as its configuration file couldn't be found")
+			case inherited == nil:
+				l.Debug("The agent configuration file %s doesn't set redacted-vars", configPath)
+			default:
+				l.Debug("Inherited redacted-vars %s from the agent configuration file %s", strings.Join(inherited, ","), configPath)
+				redactedVars = append(redactedVars, inherited...)
+			}
+		}
+		// Secrets that --restrict-env stopped being interpolated still mustn't be
+		// uploaded, so they're looked for in the whole environment
+		redactionEnv := env.FromSlice(os.Environ()).Merge(environ)
+		varsToRedact, tooShort := redaction.GetVarsToRedactMinLength(l.Warn, redactedVars, redactionEnv.ToMap(), cfg.RedactedVarsMinLen)
+		for _, name := range tooShort {
+			l.Debug("Not treating the value of %s as sensitive, as it's shorter than %d characters", name, cfg.RedactedVarsMinLen)
+		}
+
+		// Secrets that aren't in the environment at all can be given in a file
+		if cfg.RedactFromFile != "" {
+			values, err := redaction.ReadValuesFile(l.Warn, cfg.RedactFromFile)
+			if err != nil {
+				l.Fatal("Failed to read secrets to redact: %s", err)
+			}
+			for name, value := range values {
+				varsToRedact[name] = value
+			}
+		}
+
+		// Secrets that are only recognisable by their shape are matched after
+		// the pipeline is parsed, but bad patterns are better found early
+		patternsToRedact, err := redaction.GetPatternsToRedact(l.Warn, cfg.RedactedPatterns)
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// Capture the values to propagate before parsing, as the pipeline's
+		// own env can add to environ. They're taken from the whole
+		// environment, as they're named explicitly.
+		propagatedEnv := map[string]string{}
+		for _, name := range cfg.PropagateEnv {
+			if value, ok := redactionEnv.Get(name); ok {
+				propagatedEnv[name] = value
+			} else {
+				l.Debug("Not propagating $%s as it isn't set", name)
+			}
+		}
+
+		// Arguments after the pipeline file are positional arguments
+		var args []string
+		if cfg.InterpFromArgs {
+			args = []string{}
+			if c.NArg() > 1 {
+				args = c.Args()[1:]
+			}
+		}
+
+		var secretVars []string
+		if cfg.WarnSecretInterp {
+			for name := range varsToRedact {
+				secretVars = append(secretVars, name)
+			}
+		}
+
+		parser := agent.PipelineParser{
+			Env:              environ,
+			Filename:         filename,
+			Pipeline:         input,
+			NoInterpolation:  cfg.NoInterpolation,
+			Args:             args,
+			SecretVars:       secretVars,
+			RecordSources:    cfg.SourceMap,
+			MaxVarLength:     cfg.MaxVarLength,
+			TruncateLongVars: cfg.TruncateLongVars,
+			Strict:           cfg.InterpolationStrict,
+		}
+
+		// Catch missing inputs before they're interpolated as empty strings
+		if cfg.ValidateEnvReferences && !cfg.NoInterpolation {
+			missing, err := parser.MissingReferences()
+			if err == nil && len(missing) > 0 {
+				for i, name := range missing {
+					missing[i] = "$" + name
+				}
+				l.Fatal("The pipeline references environment variables that aren't set: %s", strings.Join(missing, ", "))
+			}
+			// Errors are reported when the pipeline is parsed below
+		}
+
+		parseFailed := func(src string, input []byte, err error) {
+			// Show the error in the build as well, if we're able to
+			if cfg.OnParseError == onParseErrorAnnotate && cfg.Job != "" && cfg.AgentAccessToken != "" {
+				client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+				if annotateErr := annotateParseError(l, client, cfg.Job, src, input, err); annotateErr != nil {
+					l.Warn("Failed to annotate build with the parse error: %s", annotateErr)
+				}
+			}
+
+			l.Fatal("Pipeline parsing of \"%s\" failed (%s)", src, err)
+		}
+
+		// Parse the pipeline
+		result, warnings, err := parser.Parse()
+		if err != nil {
+			src := filename
+			if src == "" {
+				src = "(stdin)"
+			}
+			parseFailed(src, input, err)
+		}
+
+		for _, si := range result.SecretInterpolations() {
+			l.Warn("The value of redacted variable $%s was interpolated into %s", si.Name, si.Path)
+		}
+
+		// Parse every fragment before uploading anything, so that a broken
+		// fragment fails the whole upload
+		for _, fragment := range fragments {
+			fragmentParser := parser
+			fragmentParser.Filename = filepath.Base(fragment.path)
+			fragmentParser.Pipeline = fragment.input
+			fragmentParser.NoInterpolation = fragment.noInterpolation
+
+			if cfg.ValidateEnvReferences && !fragment.noInterpolation {
+				missing, err := fragmentParser.MissingReferences()
+				if err == nil && len(missing) > 0 {
+					for i, name := range missing {
+						missing[i] = "$" + name
+					}
+					l.Fatal("The pipeline in \"%s\" references environment variables that aren't set: %s", fragment.path, strings.Join(missing, ", "))
+				}
+			}
+
+			fragmentResult, fragmentWarnings, err := fragmentParser.Parse()
+			if err != nil {
+				parseFailed(fragment.path, fragment.input, err)
+			}
+
+			for _, si := range fragmentResult.SecretInterpolations() {
+				l.Warn("The value of redacted variable $%s was interpolated into %s in \"%s\"", si.Name, si.Path, fragment.path)
+			}
+			warnings = append(warnings, fragmentWarnings...)
+
+			if err := result.Merge(fragmentResult); err != nil {
+				l.Fatal("Failed to add the steps of \"%s\" to the pipeline: %s", fragment.path, err)
+			}
+		}
+
+		// The stats are of every file, now that they've been merged
+		if cfg.InterpStats && !cfg.NoInterpolation {
+			stats := result.InterpolationStats()
+			l.Info("Interpolation referenced %d distinct variables: %d resolved to a value, %d were empty or unset",
+				stats.Referenced, stats.Resolved, stats.Empty)
+		}
+
+		// Show every warning before deciding whether there were too many
+		for _, warning := range warnings {
+			l.Warn("%s", warning)
+		}
+		if cfg.FailOnWarnings && len(warnings) > 0 {
+			l.Fatal("Pipeline parsing produced %d warnings, and --fail-on-warnings is set", len(warnings))
+		}
+		if cfg.MaxWarnings >= 0 && len(warnings) > cfg.MaxWarnings {
+			l.Fatal("Pipeline parsing produced %d warnings, which is more than the maximum of %d", len(warnings), cfg.MaxWarnings)
+		}
+
+		if stepDefaults != (agent.StepDefaults{}) {
+			n := result.ApplyStepDefaults(stepDefaults)
+			l.Debug("Applied step defaults to %d command steps", n)
+		}
+
+		if cfg.StepTimeoutCap > 0 {
+			for _, problem := range result.CapStepTimeouts(cfg.StepTimeoutCap, cfg.StepTimeoutCapUnset) {
+				l.Warn("%s", problem)
+			}
+		}
+
+		if len(propagatedEnv) > 0 {
+			n := result.PropagateEnv(cfg.PropagateEnv, propagatedEnv)
+			l.Debug("Propagated %d environment variables to %d command steps", len(propagatedEnv), n)
+		}
+
+		if labelTemplate != nil {
+			n, err := result.GenerateLabels(labelTemplate)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+			l.Debug("Generated labels for %d command steps", n)
+		}
+
+		if cfg.StepKeyPrefix != "" {
+			if err := result.PrefixStepKeys(cfg.StepKeyPrefix); err != nil {
+				l.Fatal("%s", err)
+			}
+		}
+
+		if cfg.SortStepsBy != "" {
+			result.SortSteps(cfg.SortStepsBy)
+		}
+
+		if cfg.GroupUntaggedSteps != "" {
+			n, err := result.GroupUntaggedSteps(cfg.GroupUntaggedSteps)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+			l.Debug("Moved %d steps into the group %q", n, cfg.GroupUntaggedSteps)
+		}
+
+		if cfg.PipelineTransform != "" {
+			l.Info("Transforming pipeline with \"%s\"", cfg.PipelineTransform)
+
+			result, err = transformPipeline(cfg.PipelineTransform, result)
+			if err != nil {
+				l.Fatal("Failed to transform pipeline: %s", err)
+			}
+		}
+
+		if pluginPins != nil {
+			changed, unpinned := result.PinPlugins(pluginPins)
+			for _, pin := range changed {
+				l.Info("Pinned plugin %s to %s", pin.From, pin.To)
+			}
+			for _, name := range unpinned {
+				l.Warn("Plugin %s isn't pinned in %s", name, cfg.PluginPinFile)
+			}
+		}
+
+		// Look for trigger steps that would start another build of this
+		// pipeline, and so on forever
+		if slug, _ := environ.Get("BUILDKITE_PIPELINE_SLUG"); slug != "" && cfg.DetectSelfTrigger != "off" {
+			steps := result.SelfTriggerSteps(slug)
+			for _, step := range steps {
+				l.Warn("Trigger step %s triggers this pipeline (%s), which can cause an endless loop of builds", step, slug)
+			}
+			if len(steps) > 0 && cfg.DetectSelfTrigger == "fail" {
+				l.Fatal("Pipeline has %d trigger steps that trigger this pipeline", len(steps))
+			}
+		}
+
+		if cfg.MaxLabelLength > 0 {
+			problems := result.CheckLabelLengths(cfg.MaxLabelLength, cfg.TruncateLabels)
+			for _, problem := range problems {
+				if cfg.TruncateLabels {
+					l.Warn("%s, so it was truncated", problem)
+				} else {
+					l.Error("%s", problem)
+				}
+			}
+			if len(problems) > 0 && !cfg.TruncateLabels {
+				l.Fatal("Pipeline has %d labels that are too long", len(problems))
+			}
+		}
+
+		if cfg.ValidateDependencies {
+			problems := result.ValidateDependencies()
+			for _, problem := range problems {
+				l.Error("%s", problem)
+			}
+			if len(problems) > 0 {
+				l.Fatal("Pipeline has %d problems with step dependencies", len(problems))
+			}
+		}
+
+		// Some values mustn't be uploaded because of where they are,
+		// whatever they are
+		for _, pointer := range cfg.RedactPointers {
+			matched, err := result.RedactPointer(pointer, cfg.RedactPointerRemove)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+			if len(matched) == 0 {
+				l.Debug("Redact pointer %s didn't match anything", pointer)
+			} else {
+				l.Debug("Redact pointer %s matched %s", pointer, strings.Join(matched, ", "))
+			}
+		}
+
+		for name, value := range patternsToRedact.VarsToRedact(result.Strings()) {
+			varsToRedact[name] = value
+		}
+
+		// Check the pipeline doesn't contain any secrets, which would be
+		// visible to anyone who can view the build. A strict dry run checks too,
+		// so that it fails when the upload would.
+		if (!cfg.DryRun || cfg.DryRunStrict) && (len(varsToRedact) > 0 || cfg.RedactionReport != "") {
+			matches := findRedactedVars(result, varsToRedact)
+
+			if cfg.RedactionReport != "" {
+				if err := writeRedactionReport(cfg.RedactionReport, matches); err != nil {
+					l.Fatal("Failed to write redaction report: %s", err)
+				}
+			}
+
+			if len(matches) > 0 {
+				// A strict dry run isn't an upload, so the build isn't told
+				if cfg.AnnotateOnRedaction && !cfg.DryRun && cfg.Job != "" && cfg.AgentAccessToken != "" {
+					client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+					if err := annotateRedaction(l, client, cfg.Job, matches, cfg.ExitZeroOnRedaction); err != nil {
+						l.Warn("Failed to annotate build with the redacted variables: %s", err)
+					}
+				}
+
+				if !cfg.ExitZeroOnRedaction {
+					l.Fatal("Refusing to upload a pipeline containing the value of a redacted variable: %s. Ensure your pipeline doesn't include secrets or interpolated secrets, or pass --exit-zero-on-redaction to upload it regardless", describeRedactionMatches(matches))
+				}
+
+				l.Error("Pipeline contains the value of a redacted variable: %s. Uploading it anyway as --exit-zero-on-redaction is set", describeRedactionMatches(matches))
+			}
+		}
+
+		valuesToRedact := make([]string, 0, len(varsToRedact))
+		for _, value := range varsToRedact {
+			valuesToRedact = append(valuesToRedact, value)
+		}
+
+		// Structural mistakes like misspelled keys otherwise only fail once
+		// the pipeline has been sent to the API. The violations can quote
+		// the pipeline, so a copy with secrets redacted is checked.
+		if cfg.ValidateSchema {
+			violations, err := result.Redacted(valuesToRedact).ValidateSchema()
+			if err != nil {
+				l.Fatal("Failed to validate the pipeline against its schema: %s", err)
+			}
+			for _, violation := range violations {
+				l.Error("%s", violation)
+			}
+			if len(violations) > 0 {
+				l.Fatal("The pipeline doesn't match schema version %d, with %d problems", agent.PipelineSchemaVersion, len(violations))
+			}
+			l.Debug("The pipeline matches schema version %d", agent.PipelineSchemaVersion)
+		}
+
+		// Let the organisation's own policy decide whether the pipeline can be
+		// uploaded. The service is trusted like the Agent API, so it's reached
+		// with the same proxy and TLS settings. Nothing is uploaded by a dry
+		// run or --diff, so there's nothing to decide, and the pipeline is
+		// only sent after it's been checked for secrets, with them redacted.
+		if cfg.PolicyURL != "" && !cfg.DryRun && !cfg.Diff {
+			l.Info("Checking the pipeline with the policy service at %s", cfg.PolicyURL)
+
+			client := api.NewUnauthenticatedHTTPClient(loadAPIClientConfig(cfg, `AgentAccessToken`), policyTimeout)
+			decision, err := checkPipelinePolicy(client, cfg.PolicyURL, result.Redacted(valuesToRedact))
+			if err != nil {
+				l.Fatal("Failed to check the pipeline with the policy service: %s", err)
+			}
+			if !decision.Allow {
+				for _, reason := range decision.Reasons {
+					l.Error("%s", reason)
+				}
+				l.Fatal("The policy service denied the upload of the pipeline")
+			}
+		}
+
+		// In dry-run mode we just output the generated pipeline to stdout
+		if cfg.DryRun {
+			if cfg.ExpandMatrix {
+				if err := result.ExpandMatrix(); err != nil {
+					l.Fatal("%s", err)
+				}
+			}
+
+			// The output often ends up in logs, so it mustn't show secrets
+			redacted := result.Redacted(valuesToRedact)
+
+			// Dump the pipeline to stdout. All logging happens to stderr
+			// this can be used with other tools to get interpolated json
+			var output interface{} = redacted
+			if cfg.SourceMap {
+				output = sourceMapOutput{
+					Pipeline:  redacted,
+					SourceMap: redactSources(result.Sources(), varsToRedact),
+				}
+			}
+			if err := writeDryRunOutput(os.Stdout, cfg.DryRunFormat, output); err != nil {
+				l.Fatal("%#v", err)
+			}
+
+			if cfg.WriteBack {
+				// The file is usually committed, so it mustn't gain any secrets
+				if matches := findRedactedVars(result, varsToRedact); len(matches) > 0 {
+					l.Fatal("Refusing to write back a pipeline containing the value of a redacted variable to \"%s\": %s", localPath, describeRedactionMatches(matches))
+				}
+
+				backup, err := writePipelineBack(localPath, result)
+				if err != nil {
+					l.Fatal("Failed to write the pipeline back to \"%s\": %s", localPath, err)
+				}
+				l.Info("Wrote the pipeline back to \"%s\", the original is in \"%s\"", localPath, backup)
+			}
+
+			return
+		}
+
+		// Check we have a job id set if not in dry run
+		if cfg.Job == "" {
+			l.Fatal("Missing job parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_JOB_ID.")
+		}
+
+		// Check we have an agent access token if not in dry run
+		if cfg.AgentAccessToken == "" {
+			l.Fatal("Missing agent-access-token parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_AGENT_ACCESS_TOKEN.")
+		}
+
+		// Create the API client
+		client := api.NewClient(l, loadAPIClientConfig(cfg, `AgentAccessToken`))
+
+		// Ask the server to validate the pipeline rather than uploading it
+		if cfg.DryRunServer {
+			validation, err := validatePipelineOnServer(l, client, cfg.Job, result, cfg.Replace)
+			if err != nil {
+				l.Fatal("Failed to validate pipeline: %s", err)
+			}
+
+			if !validation.Valid {
+				for _, e := range validation.Errors {
+					l.Error("%s", e)
+				}
+				l.Fatal("Pipeline failed validation")
+			}
+
+			l.Info("Pipeline passed validation")
+			return
+		}
+
+		// Show what uploading would change, rather than uploading
+		if cfg.Diff {
+			current, err := fetchCurrentPipeline(l, client, cfg.Job)
+			if err != nil {
+				l.Fatal("Couldn't get the build's current pipeline to diff against, so nothing was uploaded: %s", err)
+			}
+
+			currentResult, err := parseCurrentPipeline(current)
+			if err != nil {
+				l.Fatal("Failed to parse the build's current pipeline: %s", err)
+			}
+
+			// The diff often ends up in logs, so it mustn't show secrets. The
+			// current pipeline can have them too, if it was uploaded with
+			// --exit-zero-on-redaction.
+			if cfg.DiffFormat == "json" {
+				diff, err := diffSteps(currentResult.Redacted(valuesToRedact), result.Redacted(valuesToRedact))
+				if err != nil {
+					l.Fatal("Failed to compare the pipeline's steps: %s", err)
+				}
+				if err := writeDryRunOutput(os.Stdout, "json", diff); err != nil {
+					l.Fatal("%s", err)
+				}
+				return
+			}
+
+			before, err := formatPipelineForDiff(cfg.DryRunFormat, currentResult.Redacted(valuesToRedact))
+			if err != nil {
+				l.Fatal("Failed to format the build's current pipeline: %s", err)
+			}
+
+			after, err := formatPipelineForDiff(cfg.DryRunFormat, result.Redacted(valuesToRedact))
+			if err != nil {
+				l.Fatal("Failed to format the pipeline: %s", err)
+			}
+
+			if diff := unifiedDiff("current", source, before, after); diff != "" {
+				fmt.Print(diff)
+			} else {
+				l.Info("The pipeline is the same as the build's current pipeline")
+			}
+			return
+		}
+
+		// Skip uploading a step that's already in the build
+		if cfg.EnsureStep && !ensurePipelineStep(l, client, result, cfg.EnsureUpdate) {
+			return
+		}
+
+		// Skip uploading the steps that are already in the build
+		if cfg.UploadOnlyChanged && !uploadOnlyChangedSteps(l, client, cfg.Job, result) {
+			return
+		}
+
+		// Skip uploading the same pipeline again from the same job
+		var cache uploadCache
+		var digest string
+		slug, _ := environ.Get("BUILDKITE_PIPELINE_SLUG")
+		if cfg.SkipUnchanged {
+			pipeline, err := json.Marshal(result)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+
+			cache = uploadCache{dir: cfg.UploadCacheDir}
+			if cache.dir == "" {
+				cache.dir = defaultUploadCacheDir(environ)
+			}
+			digest = uploadDigest(pipeline, cfg.Replace)
+
+			if cache.unchanged(digest, slug, cfg.Job) {
+				if !cfg.Force {
+					l.Info("Skipping upload, as this pipeline is the same as the last one uploaded by this job")
+					return
+				}
+				l.Info("Uploading the same pipeline again, as --force is set")
+			}
+		}
+
+		// Generate a UUID that will identify this pipeline change. We
+		// do this outside of the retry loop because we want this UUID
+		// to be the same for each attempt at updating the pipeline.
+		uuid := api.NewUUID()
+
+		// Stop retrying if we're asked to stop, rather than until we give up
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+
+		go func() {
+			select {
+			case sig := <-signals:
+				l.Warn("Received %s, cancelling the pipeline upload", sig)
+				cancel()
+
+				// Remove our signal handler so subsequent signals kill
+				signal.Stop(signals)
+			case <-ctx.Done():
+			}
+		}()
+
+		// Retry the pipeline upload a few times before giving up
+		var uploadStats *retry.Stats
+		err = retry.DoWithContext(ctx, func(s *retry.Stats) error {
+			uploadStats = s
+			if s.Attempt > 1 {
+				l.Debug("Retrying the pipeline upload after waiting %s", s.Slept)
+			}
+			resp, err := client.UploadPipeline(cfg.Job, &api.Pipeline{UUID: uuid, Pipeline: result, Replace: cfg.Replace})
+			if err == nil && resp.RequestID != "" {
+				l.Debug("Uploaded the pipeline in request %s", resp.RequestID)
+			}
+			if err != nil {
+				// Wait as long as the API asks when it's overloaded or down
+				apierr, isAPIErr := err.(*api.ErrorResponse)
+				if isAPIErr {
+					switch apierr.Response.StatusCode {
+					case 429, 503:
+						if wait, ok := apierr.RetryAfter(); ok {
+							s.SetNextInterval(wait)
+						}
+					}
+				}
+
+				// 422 responses will always fail no need to retry
+				if isAPIErr && apierr.Response.StatusCode == 422 {
+					if apierr.RequestID != "" {
+						l.Error("Unrecoverable error in request %s, skipping retries", apierr.RequestID)
+					} else {
+						l.Error("Unrecoverable error, skipping retries")
+					}
+					s.Break()
+				}
+			}
+
+			return err
 			// On a server error, it means there is downtime or other problems, we
-			// need to retry. Let's retry every 5 seconds, for a total of 5 minutes.
-		}, &retry.Config{Maximum: 60, Interval: 5 * time.Second})
+			// need to retry. By default we retry about every 5 seconds, for a total of 5
+			// minutes.
+		}, &retry.Config{
+			Maximum:            cfg.RetryLimit,
+			Interval:           retryInterval,
+			ProportionalJitter: true,
+			OnRetry: func(s *retry.Stats, err error) {
+				// Support can find the request by its ID
+				requestID := ""
+				if apierr, ok := err.(*api.ErrorResponse); ok && apierr.RequestID != "" {
+					requestID = fmt.Sprintf(", request ID %s", apierr.RequestID)
+				}
+
+				l.Warn("%s (%s%s)", err, s, requestID)
+			},
+		})
+		if err == context.Canceled {
+			l.Fatal("The pipeline upload was cancelled")
+		}
 		if err != nil {
 			l.Fatal("Failed to upload and process pipeline: %s", err)
 		}
 
-		l.Info("Successfully uploaded and parsed pipeline config")
+		// Large pipelines are processed after the upload is acknowledged, so
+		// wait to find out whether they were accepted
+		if cfg.AsyncWait {
+			l.Info("Waiting for the pipeline upload to be processed")
+
+			waitCtx, cancelWait := context.WithTimeout(ctx, asyncTimeout)
+			defer cancelWait()
+
+			status, err := waitForPipelineUpload(waitCtx, l, client, cfg.Job, uuid, retryInterval)
+			switch {
+			case err == context.Canceled:
+				l.Fatal("The pipeline upload was cancelled")
+			case err == context.DeadlineExceeded:
+				l.Fatal("Timed out after %s waiting for the pipeline upload to be processed", asyncTimeout)
+			case err != nil:
+				l.Fatal("Failed to check the pipeline upload: %s", err)
+			case status.State == api.PipelineUploadStateRejected:
+				for _, e := range status.Errors {
+					l.Error("%s", e)
+				}
+				if status.Message != "" {
+					l.Fatal("The pipeline upload was rejected: %s", status.Message)
+				}
+				l.Fatal("The pipeline upload was rejected")
+			}
+		}
+
+		if cfg.SkipUnchanged {
+			if err := cache.record(digest, slug, cfg.Job); err != nil {
+				l.Warn("Failed to record the upload for --skip-unchanged: %s", err)
+			}
+		}
+
+		// Mention retries, as they're a sign of problems with the Agent API
+		if uploadStats.Attempt > 1 {
+			l.Info("Successfully uploaded and parsed pipeline config after %d attempts over %s",
+				uploadStats.Attempt, uploadStats.Elapsed().Round(time.Second))
+		} else {
+			l.Info("Successfully uploaded and parsed pipeline config")
+		}
+
+		// Record what was uploaded, and where it came from
+		if cfg.Attestation != "" {
+			pipeline, err := json.Marshal(result)
+			if err != nil {
+				l.Fatal("Failed to write attestation: %s", err)
+			}
+
+			sources := []attestationSource{{Name: source, Data: input}}
+			for _, fragment := range fragments {
+				sources = append(sources, attestationSource{Name: fragment.path, Data: fragment.input})
+			}
+
+			attestation, err := marshalAttestation(newUploadAttestation(sources, pipeline, environ), attestationKey)
+			if err != nil {
+				l.Fatal("Failed to write attestation: %s", err)
+			}
+
+			if err := ioutil.WriteFile(cfg.Attestation, attestation, 0644); err != nil {
+				l.Fatal("Failed to write attestation: %s", err)
+			}
+		}
 	},
 }
+
+// The values accepted by --pipeline-conflict
+const (
+	pipelineConflictFail  = "fail"
+	pipelineConflictFirst = "first"
+	pipelineConflictLast  = "last"
+)
+
+// pipelineFragment is a pipeline file whose steps are added to those of the
+// first pipeline file
+type pipelineFragment struct {
+	path            string
+	input           []byte
+	noInterpolation bool
+}
+
+// readStdinPipeline reads a pipeline from STDIN, which can block forever if
+// whatever is writing to it hangs, so it gives up after timeout if it's
+// positive
+func readStdinPipeline(timeout time.Duration) ([]byte, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return stdin.ReadAll(ctx, os.Stdin)
+}
+
+// isJSONPipeline returns whether a pipeline is a JSON object or array, rather
+// than YAML
+func isJSONPipeline(input []byte) bool {
+	trimmed := bytes.TrimLeft(input, " \t\r\n\ufeff")
+	return len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[')
+}
+
+// restrictEnvironment returns the variables in environ whose names start with
+// BUILDKITE_, or match one of the passthrough patterns
+func restrictEnvironment(environ *env.Environment, passthrough []string) *env.Environment {
+	restricted := env.New()
+
+	for name, value := range environ.ToMap() {
+		allowed := strings.HasPrefix(name, "BUILDKITE_")
+		for _, pattern := range passthrough {
+			if matched, _ := path.Match(pattern, name); matched {
+				allowed = true
+				break
+			}
+		}
+
+		if allowed {
+			restricted.Set(name, value)
+		}
+	}
+
+	return restricted
+}
+
+// runPipelineCommand runs a command line with the shell, giving it stdin if
+// it's not nil, and returns what it writes to stdout. If the command fails,
+// the error includes its stderr.
+func runPipelineCommand(cmdline string, stdin io.Reader) ([]byte, error) {
+	args, err := shellwords.Split(cmdline)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse command %q: %v", cmdline, err)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("No command given")
+	}
+
+	sh, err := shell.New()
+	if err != nil {
+		return nil, err
+	}
+	if stdin != nil {
+		sh = sh.WithStdin(stdin)
+	}
+
+	stdout, stderr, err := sh.RunAndCaptureWithStderr(args[0], args[1:]...)
+	if err != nil {
+		if stderr != "" {
+			return nil, fmt.Errorf("%v\n%s", err, stderr)
+		}
+		return nil, err
+	}
+
+	return []byte(stdout), nil
+}
+
+// transformPipeline passes the pipeline as JSON through a command line, and
+// parses the JSON it outputs as the new pipeline
+func transformPipeline(cmdline string, result *agent.PipelineParserResult) (*agent.PipelineParserResult, error) {
+	j, err := result.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := runPipelineCommand(cmdline, bytes.NewReader(j))
+	if err != nil {
+		return nil, err
+	}
+
+	if !json.Valid(out) {
+		return nil, fmt.Errorf("Output of %q isn't valid JSON", cmdline)
+	}
+
+	// The pipeline was interpolated before it was transformed
+	transformed, _, err := agent.PipelineParser{
+		Filename:        "pipeline.json",
+		Pipeline:        out,
+		NoInterpolation: true,
+	}.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("Output of %q isn't a valid pipeline: %v", cmdline, err)
+	}
+
+	return transformed, nil
+}
@@ -0,0 +1,60 @@
+package clicommand
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/env"
+)
+
+// uploadCache records a digest of the last pipeline successfully uploaded in
+// each scope, so that uploading the same pipeline again can be skipped
+type uploadCache struct {
+	dir string
+}
+
+// defaultUploadCacheDir is where the upload cache is kept if no other
+// directory is given. That's in the agent's build path, so that it isn't
+// shared by everything on the host, or the system's temporary directory if
+// it isn't run by a job.
+func defaultUploadCacheDir(environ *env.Environment) string {
+	if buildPath, ok := environ.Get("BUILDKITE_BUILD_PATH"); ok && buildPath != "" {
+		return filepath.Join(buildPath, ".buildkite-pipeline-upload-cache")
+	}
+	return filepath.Join(os.TempDir(), "buildkite-pipeline-upload-cache")
+}
+
+// uploadDigest identifies the content of an upload
+func uploadDigest(pipeline []byte, replace bool) string {
+	h := sha256.New()
+	h.Write(pipeline)
+	if replace {
+		h.Write([]byte("\x00replace"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// path returns the file the digest for a scope, like a pipeline and job, is
+// kept in
+func (c uploadCache) path(scope ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(scope, "\x00")))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// unchanged returns whether digest is what was last uploaded in scope
+func (c uploadCache) unchanged(digest string, scope ...string) bool {
+	last, err := ioutil.ReadFile(c.path(scope...))
+	return err == nil && string(last) == digest
+}
+
+// record saves digest as what was last uploaded in scope
+func (c uploadCache) record(digest string, scope ...string) error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.path(scope...), []byte(digest), 0600)
+}
@@ -0,0 +1,42 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upload-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := uploadCache{dir: filepath.Join(dir, "cache")}
+	digest := uploadDigest([]byte(`{"steps":[]}`), false)
+
+	assert.False(t, cache.unchanged(digest, "my-pipeline", "job-1"))
+
+	if err := cache.record(digest, "my-pipeline", "job-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, cache.unchanged(digest, "my-pipeline", "job-1"))
+	assert.False(t, cache.unchanged(digest, "my-pipeline", "job-2"))
+	assert.False(t, cache.unchanged(uploadDigest([]byte(`{"steps":[]}`), true), "my-pipeline", "job-1"))
+	assert.False(t, cache.unchanged(uploadDigest([]byte(`{"steps":["wait"]}`), false), "my-pipeline", "job-1"))
+}
+
+func TestDefaultUploadCacheDir(t *testing.T) {
+	buildPath := filepath.Join("var", "lib", "buildkite-agent", "builds")
+	assert.Equal(t, filepath.Join(buildPath, ".buildkite-pipeline-upload-cache"),
+		defaultUploadCacheDir(env.FromSlice([]string{"BUILDKITE_BUILD_PATH=" + buildPath})))
+
+	assert.Equal(t, filepath.Join(os.TempDir(), "buildkite-pipeline-upload-cache"),
+		defaultUploadCacheDir(env.FromSlice([]string{})))
+}
@@ -0,0 +1,57 @@
+package clicommand
+
+import (
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// uploadOnlyChangedSteps removes the steps that are already in the build's
+// current pipeline from the pipeline, so that only new steps are uploaded.
+// Steps with a key that's already in the build, but that have changed, have
+// their changed attributes updated in place like --ensure-update does. It
+// returns false if there are no new steps left to upload.
+func uploadOnlyChangedSteps(l logger.Logger, client *api.Client, jobID string, result *agent.PipelineParserResult) bool {
+	current, err := fetchCurrentPipeline(l, client, jobID)
+	if err != nil {
+		l.Fatal("Couldn't get the build's current pipeline to compare with, so nothing was uploaded: %s", err)
+	}
+
+	currentSteps, err := pipelineStepsForDiff(current.Pipeline)
+	if err != nil {
+		l.Fatal("Failed to parse the build's current pipeline: %s", err)
+	}
+
+	steps, err := pipelineStepsForDiff(result)
+	if err != nil {
+		l.Fatal("Failed to parse the pipeline: %s", err)
+	}
+
+	matches, _ := matchSteps(currentSteps, steps)
+
+	var existing []int
+	for i, m := range matches {
+		if !m.found {
+			continue
+		}
+		existing = append(existing, i)
+
+		// Only steps with keys can be changed, and they're always maps
+		if m.changed() {
+			step, _ := m.step.(map[string]interface{})
+			currentStep, _ := m.current.(map[string]interface{})
+			updated := updateStepAttributes(l, client, m.key, step, currentStep)
+			l.Info("Updated %d attributes of existing step %q", updated, m.key)
+		}
+	}
+
+	result.RemoveSteps(existing)
+
+	if len(existing) == len(matches) {
+		l.Info("All of the pipeline's steps are already in the build, so nothing was uploaded")
+		return false
+	}
+
+	l.Info("Uploading %d new steps, and skipping %d that are already in the build", len(matches)-len(existing), len(existing))
+	return true
+}
@@ -0,0 +1,81 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadOnlyChangedSteps(t *testing.T) {
+	var updates []api.StepUpdate
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/jobs/job-id/pipeline":
+			rw.Write([]byte(`{"pipeline": {"steps": [
+				{"key": "test", "command": "make test"},
+				{"command": "echo unkeyed"},
+				"wait"
+			]}}`))
+		case req.Method == "PUT" && req.URL.Path == "/steps/test":
+			var update api.StepUpdate
+			body, _ := ioutil.ReadAll(req.Body)
+			if err := json.Unmarshal(body, &update); err != nil {
+				t.Error(err)
+			}
+			updates = append(updates, update)
+		default:
+			http.Error(rw, "Not Found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	parse := func(pipeline string) *agent.PipelineParserResult {
+		result, _, err := agent.PipelineParser{
+			Filename:        "pipeline.yml",
+			Pipeline:        []byte(pipeline),
+			NoInterpolation: true,
+		}.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	result := parse(`steps:
+  - key: test
+    command: make lint test
+  - command: echo unkeyed
+  - wait
+  - key: deploy
+    command: make deploy
+`)
+	assert.True(t, uploadOnlyChangedSteps(logger.Discard, client, "job-id", result))
+
+	j, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.JSONEq(t, `{"steps": [{"key": "deploy", "command": "make deploy"}]}`, string(j))
+
+	if assert.Len(t, updates, 1) {
+		assert.Equal(t, "command", updates[0].Attribute)
+		assert.Equal(t, "make lint test", updates[0].Value)
+	}
+
+	// Nothing is left to upload if every step is already in the build
+	result = parse(`steps:
+  - key: test
+    command: make test
+  - wait
+`)
+	assert.False(t, uploadOnlyChangedSteps(logger.Discard, client, "job-id", result))
+}
@@ -0,0 +1,532 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli"
+)
+
+func TestTransformPipeline(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Transform commands use sed")
+	}
+
+	result, _, err := agent.PipelineParser{
+		Filename:        "pipeline.yml",
+		Pipeline:        []byte("steps:\n  - command: make test\n"),
+		NoInterpolation: true,
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transformed, err := transformPipeline("sed s/test/lint/", result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal(transformed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"steps":[{"command":"make lint"}]}`, string(j))
+
+	_, err = transformPipeline("echo not json", result)
+	assert.EqualError(t, err, `Output of "echo not json" isn't valid JSON`)
+
+	_, err = transformPipeline("false", result)
+	assert.Error(t, err)
+}
+
+func TestApplyAgentAccessTokenEnv(t *testing.T) {
+	os.Setenv("MY_CUSTOM_TOKEN_VAR", "llamas")
+	defer os.Unsetenv("MY_CUSTOM_TOKEN_VAR")
+
+	c := newPipelineUploadContext(t, "--agent-access-token-env", "MY_CUSTOM_TOKEN_VAR")
+	assert.NoError(t, applyAgentAccessTokenEnv(c))
+	assert.Equal(t, "llamas", c.String("agent-access-token"))
+
+	c = newPipelineUploadContext(t, "--agent-access-token-env", "MY_MISSING_TOKEN_VAR")
+	assert.EqualError(t, applyAgentAccessTokenEnv(c), "The agent access token environment variable MY_MISSING_TOKEN_VAR isn't set")
+}
+
+func TestApplyAgentAccessTokenFile(t *testing.T) {
+	if token, ok := os.LookupEnv("BUILDKITE_AGENT_ACCESS_TOKEN"); ok {
+		defer os.Setenv("BUILDKITE_AGENT_ACCESS_TOKEN", token)
+	} else {
+		defer os.Unsetenv("BUILDKITE_AGENT_ACCESS_TOKEN")
+	}
+	os.Unsetenv("BUILDKITE_AGENT_ACCESS_TOKEN")
+
+	dir, err := ioutil.TempDir("", "token-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(path, []byte("llamas\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newPipelineUploadContext(t, "--agent-access-token-file", path)
+	assert.NoError(t, applyAgentAccessTokenFile(c))
+	assert.Equal(t, "llamas", c.String("agent-access-token"))
+
+	c = newPipelineUploadContext(t, "--agent-access-token-file", path, "--agent-access-token", "alpacas")
+	assert.EqualError(t, applyAgentAccessTokenFile(c), "--agent-access-token-file and --agent-access-token can't be used together")
+
+	c = newPipelineUploadContext(t, "--agent-access-token-file", path, "--agent-access-token-env", "MY_TOKEN")
+	assert.EqualError(t, applyAgentAccessTokenFile(c), "--agent-access-token-file and --agent-access-token-env can't be used together")
+
+	// The file takes precedence over the token every job has in its env
+	os.Setenv("BUILDKITE_AGENT_ACCESS_TOKEN", "alpacas")
+	c = newPipelineUploadContext(t, "--agent-access-token-file", path)
+	assert.NoError(t, applyAgentAccessTokenFile(c))
+	assert.Equal(t, "llamas", c.String("agent-access-token"))
+	os.Unsetenv("BUILDKITE_AGENT_ACCESS_TOKEN")
+
+	empty := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(empty, []byte(" \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c = newPipelineUploadContext(t, "--agent-access-token-file", empty)
+	assert.EqualError(t, applyAgentAccessTokenFile(c), "The agent access token file "+empty+" is empty")
+
+	c = newPipelineUploadContext(t, "--agent-access-token-file", filepath.Join(dir, "missing"))
+	assert.Error(t, applyAgentAccessTokenFile(c))
+}
+
+func TestRestrictEnvironment(t *testing.T) {
+	environ := env.FromSlice([]string{
+		"BUILDKITE_COMMIT=abc123",
+		"MY_APP_VERSION=1.2",
+		"MY_APP_NAME=llamas",
+		"DEPLOY_TARGET=production",
+		"AWS_SECRET_ACCESS_KEY=hunter2",
+	})
+
+	assert.Equal(t, []string{
+		"BUILDKITE_COMMIT=abc123",
+	}, restrictEnvironment(environ, nil).ToSlice())
+
+	assert.Equal(t, []string{
+		"BUILDKITE_COMMIT=abc123",
+		"DEPLOY_TARGET=production",
+		"MY_APP_NAME=llamas",
+		"MY_APP_VERSION=1.2",
+	}, restrictEnvironment(environ, []string{"MY_APP_*", "DEPLOY_TARGET"}).ToSlice())
+}
+
+func TestIsJSONPipeline(t *testing.T) {
+	for input, expected := range map[string]bool{
+		`{"steps": [{"command": "echo $$HOME"}]}`: true,
+		"\n  [\"wait\"]\n":                        true,
+		"\ufeff{\"steps\": []}":                   true,
+		"steps:\n  - command: make\n":             false,
+		"# {not json}\nsteps: []\n":               false,
+		"":                                        false,
+	} {
+		assert.Equal(t, expected, isJSONPipeline([]byte(input)), input)
+	}
+}
+
+func TestPipelineUploadCommandUploadsToAPI(t *testing.T) {
+	var uploads []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || req.URL.Path != "/jobs/job-id/pipelines" {
+			http.Error(rw, "Not Found", http.StatusNotFound)
+			return
+		}
+		if req.Header.Get("Authorization") != "Token llamas" {
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var upload map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&upload); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		uploads = append(uploads, upload)
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pipeline-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pipelinePath := filepath.Join(dir, "pipeline.yml")
+	if err := ioutil.WriteFile(pipelinePath, []byte("steps:\n  - command: echo $UPLOAD_TEST_GREETING\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fragmentPath := filepath.Join(dir, "fragment.json")
+	if err := ioutil.WriteFile(fragmentPath, []byte(`{"steps": ["wait", {"command": "echo $NOT_INTERPOLATED"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{
+		"BUILDKITE_AGENT_ACCESS_TOKEN": "llamas",
+		"BUILDKITE_AGENT_ENDPOINT":     server.URL,
+		"BUILDKITE_JOB_ID":             "job-id",
+		"UPLOAD_TEST_GREETING":         "hello",
+	} {
+		if old, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Setenv(name, value)
+	}
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{PipelineUploadCommand}
+	if err := app.Run([]string{"buildkite-agent", "upload", "--no-color", pipelinePath, fragmentPath}); err != nil {
+		t.Fatal(err)
+	}
+
+	if assert.Len(t, uploads, 1) {
+		assert.NotEmpty(t, uploads[0]["uuid"])
+		assert.Equal(t, map[string]interface{}{
+			"steps": []interface{}{
+				map[string]interface{}{"command": "echo hello"},
+				"wait",
+				map[string]interface{}{"command": "echo $NOT_INTERPOLATED"},
+			},
+		}, uploads[0]["pipeline"])
+	}
+}
+
+func TestPipelineUploadCommandRedactsDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pipelinePath := filepath.Join(dir, "pipeline.yml")
+	if err := ioutil.WriteFile(pipelinePath, []byte("steps:\n  - command: deploy --token $DRY_RUN_TEST_TOKEN\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{
+		"BUILDKITE_AGENT_ACCESS_TOKEN": "llamas",
+		"DRY_RUN_TEST_TOKEN":           "hunter2hunter2",
+	} {
+		if old, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Setenv(name, value)
+	}
+
+	for _, format := range []string{"json", "yaml"} {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stdout := os.Stdout
+		os.Stdout = w
+
+		app := cli.NewApp()
+		app.Commands = []cli.Command{PipelineUploadCommand}
+		err = app.Run([]string{"buildkite-agent", "upload", "--no-color", "--dry-run", "--dry-run-format", format, pipelinePath})
+
+		os.Stdout = stdout
+		w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Contains(t, string(output), "deploy --token [REDACTED]", format)
+		assert.NotContains(t, string(output), "hunter2hunter2", format)
+	}
+}
+
+func TestPipelineUploadCommandMergeStdin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pipelinePath := filepath.Join(dir, "pipeline.yml")
+	if err := ioutil.WriteFile(pipelinePath, []byte("steps:\n  - command: make base\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if old, ok := os.LookupEnv("BUILDKITE_AGENT_ACCESS_TOKEN"); ok {
+		defer os.Setenv("BUILDKITE_AGENT_ACCESS_TOKEN", old)
+	} else {
+		defer os.Unsetenv("BUILDKITE_AGENT_ACCESS_TOKEN")
+	}
+	os.Setenv("BUILDKITE_AGENT_ACCESS_TOKEN", "llamas")
+
+	upload := func(args ...string) string {
+		stdinR, stdinW, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stdinW.Write([]byte("steps:\n  - command: make generated\n")); err != nil {
+			t.Fatal(err)
+		}
+		stdinW.Close()
+
+		stdoutR, stdoutW, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stdin, stdout := os.Stdin, os.Stdout
+		os.Stdin, os.Stdout = stdinR, stdoutW
+
+		app := cli.NewApp()
+		app.Commands = []cli.Command{PipelineUploadCommand}
+		err = app.Run(append([]string{"buildkite-agent", "upload", "--no-color", "--dry-run"}, args...))
+
+		os.Stdin, os.Stdout = stdin, stdout
+		stdinR.Close()
+		stdoutW.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := ioutil.ReadAll(stdoutR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(output)
+	}
+
+	// STDIN is ignored when there's a file, unless it's merged
+	output := upload(pipelinePath)
+	assert.Contains(t, output, "make base")
+	assert.NotContains(t, output, "make generated")
+
+	output = upload("--merge-stdin", pipelinePath)
+	assert.Contains(t, output, "make base")
+	assert.Contains(t, output, "make generated")
+	assert.True(t, strings.Index(output, "make base") < strings.Index(output, "make generated"), output)
+}
+
+func TestPipelineUploadCommandDiff(t *testing.T) {
+	uploaded := false
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/jobs/job-id/pipeline":
+			rw.Write([]byte(`{"pipeline": {"steps": [{"label": "test", "command": "make test"}]}}`))
+		case req.Method == "POST":
+			uploaded = true
+			rw.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(rw, "Not Found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pipeline-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pipelinePath := filepath.Join(dir, "pipeline.yml")
+	if err := ioutil.WriteFile(pipelinePath, []byte("steps:\n  - label: test\n    command: make lint test\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{
+		"BUILDKITE_AGENT_ACCESS_TOKEN": "llamas",
+		"BUILDKITE_AGENT_ENDPOINT":     server.URL,
+		"BUILDKITE_JOB_ID":             "job-id",
+	} {
+		if old, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Setenv(name, value)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{PipelineUploadCommand}
+	err = app.Run([]string{"buildkite-agent", "upload", "--no-color", "--diff", "--dry-run-format", "yaml", pipelinePath})
+
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, strings.Join([]string{
+		"--- current",
+		"+++ " + pipelinePath,
+		"@@ -1,3 +1,3 @@",
+		" steps:",
+		"-- command: make test",
+		"+- command: make lint test",
+		"   label: test",
+		"",
+	}, "\n"), string(output))
+	assert.False(t, uploaded, "The pipeline shouldn't be uploaded with --diff")
+}
+
+func TestPipelineUploadCommandPolicyRedactsSecrets(t *testing.T) {
+	var policyRequests []string
+	policy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		policyRequests = append(policyRequests, string(body))
+		rw.Write([]byte(`{"allow": true}`))
+	}))
+	defer policy.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pipeline-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pipelinePath := filepath.Join(dir, "pipeline.yml")
+	if err := ioutil.WriteFile(pipelinePath, []byte("steps:\n  - command: deploy --token $POLICY_TEST_TOKEN\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{
+		"BUILDKITE_AGENT_ACCESS_TOKEN": "llamas",
+		"BUILDKITE_AGENT_ENDPOINT":     server.URL,
+		"BUILDKITE_JOB_ID":             "job-id",
+		"POLICY_TEST_TOKEN":            "hunter2hunter2",
+	} {
+		if old, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Setenv(name, value)
+	}
+
+	run := func(args ...string) {
+		t.Helper()
+		stdout := os.Stdout
+		os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		defer func() { os.Stdout = stdout }()
+
+		app := cli.NewApp()
+		app.Commands = []cli.Command{PipelineUploadCommand}
+		if err := app.Run(append([]string{"buildkite-agent", "upload", "--no-color", "--policy-url", policy.URL}, args...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A dry run doesn't upload anything, so the policy service isn't asked
+	run("--dry-run", pipelinePath)
+	assert.Empty(t, policyRequests)
+
+	run("--exit-zero-on-redaction", pipelinePath)
+	if assert.Len(t, policyRequests, 1) {
+		assert.Contains(t, policyRequests[0], "deploy --token [REDACTED]")
+		assert.NotContains(t, policyRequests[0], "hunter2hunter2")
+	}
+}
+
+func TestPipelineUploadCommandDiffRedactsCurrentPipeline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" && req.URL.Path == "/jobs/job-id/pipeline" {
+			// Uploaded earlier with --exit-zero-on-redaction
+			rw.Write([]byte(`{"pipeline": {"steps": [{"command": "deploy --token hunter2hunter2"}]}}`))
+			return
+		}
+		http.Error(rw, "Not Found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "pipeline-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pipelinePath := filepath.Join(dir, "pipeline.yml")
+	if err := ioutil.WriteFile(pipelinePath, []byte("steps:\n  - command: deploy\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{
+		"BUILDKITE_AGENT_ACCESS_TOKEN": "llamas",
+		"BUILDKITE_AGENT_ENDPOINT":     server.URL,
+		"BUILDKITE_JOB_ID":             "job-id",
+		"DIFF_TEST_TOKEN":              "hunter2hunter2",
+	} {
+		if old, ok := os.LookupEnv(name); ok {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+		os.Setenv(name, value)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	app := cli.NewApp()
+	app.Commands = []cli.Command{PipelineUploadCommand}
+	err = app.Run([]string{"buildkite-agent", "upload", "--no-color", "--diff", "--dry-run-format", "yaml", pipelinePath})
+
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Contains(t, string(output), "-- command: deploy --token [REDACTED]")
+	assert.NotContains(t, string(output), "hunter2hunter2")
+}
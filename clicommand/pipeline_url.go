@@ -0,0 +1,81 @@
+package clicommand
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/agent"
+)
+
+// pipelineURLTimeout is how long fetching a pipeline from a URL can take
+const pipelineURLTimeout = 60 * time.Second
+
+// parsePipelineURL returns the URL of a pipeline file given as an http or
+// https URL, like https://example.com/pipeline.yml
+func parsePipelineURL(p string) (*url.URL, bool) {
+	u, err := url.Parse(p)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, false
+	}
+	return u, true
+}
+
+// pipelineURLFilename returns the base name of the URL's path, like
+// pipeline.yml, or an empty string if it has no path
+func pipelineURLFilename(u *url.URL) string {
+	if name := path.Base(u.Path); name != "/" && name != "." {
+		return name
+	}
+	return ""
+}
+
+// displayPipelineURL returns the URL without any username or password, and
+// with the values of its query masked, for logs and errors. Pre-signed URLs
+// and the like carry credentials in their query.
+func displayPipelineURL(u *url.URL) string {
+	display := *u
+	display.User = nil
+
+	if display.RawQuery != "" {
+		params := strings.Split(display.RawQuery, "&")
+		for i, param := range params {
+			if j := strings.IndexByte(param, '='); j >= 0 {
+				params[i] = param[:j] + "=" + agent.RedactedValue
+			}
+		}
+		display.RawQuery = strings.Join(params, "&")
+	}
+
+	return display.String()
+}
+
+// readURLPipeline fetches a pipeline from a URL. Any response other than a 2xx
+// is an error.
+func readURLPipeline(client *http.Client, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", agent.UserAgent())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// The error includes the URL, which mustn't show its credentials
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = displayPipelineURL(u)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s responded with %s", displayPipelineURL(u), resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,208 @@
+package clicommand
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/stdin"
+	"github.com/urfave/cli"
+)
+
+var PipelineValidateHelpDescription = `Usage:
+
+   buildkite-agent pipeline validate [file...] [options...]
+
+Description:
+
+   Parses pipeline files the same way pipeline upload does, without uploading
+   them, and fails with the reason if any of them can't be parsed. It never
+   talks to the Agent API, so it doesn't need an agent access token, and can
+   be used to check pipelines before they're committed.
+
+   Files are found the same way as pipeline upload finds them: each file
+   given, which can be a glob, or the pipeline piped to the command, or the
+   first of the default locations that exists. Unlike pipeline upload, each
+   file is checked on its own.
+
+   It stops at the first file that fails, unless --keep-going is given, in
+   which case every file is checked and the ones that failed are listed at the
+   end. Either way, it exits with an error if any file failed.
+
+Example:
+
+   $ buildkite-agent pipeline validate
+   $ buildkite-agent pipeline validate .buildkite/steps/*.yml
+   $ buildkite-agent pipeline validate --keep-going .buildkite/steps/*.yml
+   $ ./script/dynamic_step_generator | buildkite-agent pipeline validate`
+
+type PipelineValidateConfig struct {
+	NoInterpolation     bool     `cli:"no-interpolation"`
+	PipelineSearchPaths []string `cli:"pipeline-search-path" normalize:"list"`
+	PipelineConflict    string   `cli:"pipeline-conflict"`
+	KeepGoing           bool     `cli:"keep-going"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	LogFormat   string   `cli:"log-format"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var PipelineValidateCommand = cli.Command{
+	Name:        "validate",
+	Usage:       "Checks that pipeline files can be parsed, without uploading them",
+	Description: PipelineValidateHelpDescription,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:   "no-interpolation",
+			Usage:  "Skip variable interpolation of the pipeline",
+			EnvVar: "BUILDKITE_PIPELINE_NO_INTERPOLATION",
+		},
+		cli.StringSliceFlag{
+			Name:   "pipeline-search-path",
+			Usage:  "A directory to look for pipeline.yml, pipeline.yaml, pipeline.json or pipeline.toml in when no pipeline file is given, before the default locations. Can be given more than once",
+			EnvVar: "BUILDKITE_PIPELINE_SEARCH_PATHS",
+		},
+		cli.StringFlag{
+			Name:   "pipeline-conflict",
+			Value:  pipelineConflictFail,
+			Usage:  "What to do when more than one pipeline file is found when searching for one. Either \"fail\", or use the \"first\" or \"last\" in the order they're searched and warn about the others",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_PIPELINE_CONFLICT",
+		},
+		cli.BoolFlag{
+			Name:   "keep-going",
+			Usage:  "Check every file, even after one fails, and list the ones that failed at the end",
+			EnvVar: "BUILDKITE_PIPELINE_VALIDATE_KEEP_GOING",
+		},
+
+		// Global flags
+		LogFormatFlag,
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := PipelineValidateConfig{}
+
+		l := CreateLogger(&cfg)
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// The logger was created before the log format and colors were loaded
+		l = CreateLogger(&cfg)
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		switch cfg.PipelineConflict {
+		case pipelineConflictFail, pipelineConflictFirst, pipelineConflictLast:
+		default:
+			l.Fatal("Invalid --pipeline-conflict %q, expected %q, %q or %q", cfg.PipelineConflict, pipelineConflictFail, pipelineConflictFirst, pipelineConflictLast)
+		}
+
+		paths, err := expandPipelinePaths(c.Args())
+		if err != nil {
+			l.Fatal("%s", err)
+		}
+
+		environ := env.FromSlice(os.Environ())
+
+		if len(paths) == 0 && stdin.IsReadable() {
+			input, err := ioutil.ReadAll(os.Stdin)
+			if err != nil {
+				l.Fatal("Failed to read from STDIN: %s", err)
+			}
+
+			warnings, err := validatePipeline(environ, "", input, cfg.NoInterpolation)
+			if err != nil {
+				l.Fatal("Pipeline parsing of \"(stdin)\" failed (%s)", err)
+			}
+			for _, warning := range warnings {
+				l.Warn("%s", warning)
+			}
+
+			l.Info("The pipeline from STDIN is valid")
+			return
+		}
+
+		if len(paths) == 0 {
+			found, err := findPipelineFile(l, cfg.PipelineSearchPaths, cfg.PipelineConflict)
+			if err != nil {
+				l.Fatal("%s", err)
+			}
+			paths = []string{found}
+		}
+
+		var failed []string
+		for _, path := range paths {
+			if err := validatePipelineFile(l, environ, path, cfg.NoInterpolation); err != nil {
+				if !cfg.KeepGoing {
+					l.Fatal("%s", err)
+				}
+				l.Error("%s", err)
+				failed = append(failed, path)
+			}
+		}
+
+		if len(failed) > 0 {
+			l.Fatal("%d of %d pipeline files failed validation: %s", len(failed), len(paths), strings.Join(failed, ", "))
+		}
+		if cfg.KeepGoing && len(paths) > 1 {
+			l.Info("All %d pipeline files are valid", len(paths))
+		}
+	},
+}
+
+// validatePipelineFile reads and validates the pipeline file at path, logging
+// any warnings, and whether it's valid if it is
+func validatePipelineFile(l logger.Logger, environ *env.Environment, path string, noInterpolation bool) error {
+	input, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read file: %s", err)
+	}
+
+	warnings, err := validatePipeline(environ, filepath.Base(path), input, noInterpolation)
+	if err != nil {
+		return fmt.Errorf("Pipeline parsing of \"%s\" failed (%s)", path, err)
+	}
+	for _, warning := range warnings {
+		l.Warn("%s: %s", path, warning)
+	}
+
+	l.Info("\"%s\" is a valid pipeline", path)
+	return nil
+}
+
+// validatePipeline parses a pipeline like pipeline upload does, including not
+// interpolating JSON pipelines, and returns any warnings
+func validatePipeline(environ *env.Environment, filename string, input []byte, noInterpolation bool) ([]agent.Warning, error) {
+	if len(input) == 0 {
+		return nil, errors.New("Config file is empty")
+	}
+
+	_, warnings, err := agent.PipelineParser{
+		Env:             environ,
+		Filename:        filename,
+		Pipeline:        input,
+		NoInterpolation: noInterpolation || isJSONPipeline(input),
+	}.Parse()
+
+	return warnings, err
+}
@@ -0,0 +1,75 @@
+package clicommand
+
+import (
+	"fmt"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/cliconfig"
+	"github.com/urfave/cli"
+)
+
+var PipelineValidateSchemaHelpDescription = `Usage:
+
+   buildkite-agent pipeline validate-schema [options...]
+
+Description:
+
+   Prints the JSON Schema that the agent uses to validate pipelines locally.
+   The schema can be wired into editors that support JSON Schema (such as the
+   YAML extension for VS Code) to provide autocompletion and validation while
+   writing pipeline files.
+
+   The schema is versioned, and the version is included in its description so
+   that changes in validation rules between agent releases are discoverable.
+
+Example:
+
+   $ buildkite-agent pipeline validate-schema > .buildkite/pipeline.schema.json`
+
+type PipelineValidateSchemaConfig struct {
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	LogFormat   string   `cli:"log-format"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var PipelineValidateSchemaCommand = cli.Command{
+	Name:        "validate-schema",
+	Usage:       "Prints the JSON Schema used to validate pipelines",
+	Description: PipelineValidateSchemaHelpDescription,
+	Flags: []cli.Flag{
+		// Global flags
+		LogFormatFlag,
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) {
+		// The configuration will be loaded into this struct
+		cfg := PipelineValidateSchemaConfig{}
+
+		l := CreateLogger(&cfg)
+
+		// Load the configuration
+		if err := cliconfig.Load(c, l, &cfg); err != nil {
+			l.Fatal("%s", err)
+		}
+
+		// The logger was created before the log format and colors were loaded
+		l = CreateLogger(&cfg)
+
+		// Setup any global configuration options
+		done := HandleGlobalFlags(l, cfg)
+		defer done()
+
+		l.Debug("Printing pipeline schema version %d", agent.PipelineSchemaVersion)
+
+		// The schema goes to stdout, all logging happens to stderr
+		fmt.Print(agent.PipelineSchema)
+	},
+}
@@ -0,0 +1,46 @@
+package clicommand
+
+import (
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// validatePipelineOnServer asks the Agent API to validate the pipeline for
+// --dry-run-server. If the Agent API doesn't have the validation endpoint,
+// the pipeline is validated against the local schema instead.
+func validatePipelineOnServer(l logger.Logger, client *api.Client, jobID string, result *agent.PipelineParserResult, replace bool) (*api.PipelineValidation, error) {
+	validation, resp, err := client.ValidatePipeline(jobID, &api.Pipeline{UUID: api.NewUUID(), Pipeline: result, Replace: replace})
+	switch {
+	case validationRouteMissing(resp, err):
+		l.Warn("The Agent API doesn't support pipeline validation, falling back to local schema validation")
+
+		violations, err := result.ValidateSchema()
+		if err != nil {
+			return nil, err
+		}
+		return &api.PipelineValidation{Valid: len(violations) == 0, Errors: violations}, nil
+	case resp != nil && resp.StatusCode == 422:
+		validation = &api.PipelineValidation{Valid: false}
+		if apierr, ok := err.(*api.ErrorResponse); ok && apierr.Message != "" {
+			validation.Errors = []string{apierr.Message}
+		}
+		return validation, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return validation, nil
+}
+
+// validationRouteMissing returns whether the Agent API responded to a
+// validation request as though it doesn't have the endpoint. The Agent API
+// explains the 404s it returns for unknown or finished jobs, so only a 404
+// without a message means the route itself is missing.
+func validationRouteMissing(resp *api.Response, err error) bool {
+	if resp == nil || resp.StatusCode != 404 {
+		return false
+	}
+	apierr, ok := err.(*api.ErrorResponse)
+	return !ok || apierr.Message == ""
+}
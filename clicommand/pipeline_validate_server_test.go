@@ -0,0 +1,61 @@
+package clicommand
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePipelineOnServer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/jobs/valid/pipelines/validate":
+			fmt.Fprint(rw, `{"valid":true}`)
+		case "/jobs/invalid/pipelines/validate":
+			rw.WriteHeader(http.StatusUnprocessableEntity)
+			fmt.Fprint(rw, `{"message":"steps[0] has no command"}`)
+		case "/jobs/finished/pipelines/validate":
+			rw.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(rw, `{"message":"No job found"}`)
+		default:
+			http.Error(rw, "Not Found", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := api.NewClient(logger.Discard, api.Config{Endpoint: server.URL, Token: "llamas"})
+
+	result, _, err := agent.PipelineParser{Pipeline: []byte("steps:\n  - command: echo hello\n")}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validation, err := validatePipelineOnServer(logger.Discard, client, "valid", result, false)
+	if assert.NoError(t, err) {
+		assert.True(t, validation.Valid)
+	}
+
+	validation, err = validatePipelineOnServer(logger.Discard, client, "invalid", result, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &api.PipelineValidation{Valid: false, Errors: []string{"steps[0] has no command"}}, validation)
+	}
+
+	// A 404 for a job the Agent API knows nothing about is an error, not a
+	// reason to fall back to the local schema
+	_, err = validatePipelineOnServer(logger.Discard, client, "finished", result, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "No job found")
+	}
+
+	// Without the validation route, the local schema is used instead
+	validation, err = validatePipelineOnServer(logger.Discard, client, "old-api", result, false)
+	if assert.NoError(t, err) {
+		assert.True(t, validation.Valid)
+	}
+}
@@ -0,0 +1,72 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePipeline(t *testing.T) {
+	environ := env.FromSlice([]string{"GREETING=hello"})
+
+	warnings, err := validatePipeline(environ, "pipeline.yml", []byte("steps:\n  - command: echo $GREETING\n"), false)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+
+	warnings, err = validatePipeline(environ, "pipeline.yml", []byte("steps:\n  - command: echo $MISSING\n"), false)
+	assert.NoError(t, err)
+	if assert.Len(t, warnings, 1) {
+		assert.Equal(t, "$MISSING is not set, so it was interpolated as an empty string", warnings[0].String())
+	}
+
+	// Interpolation errors only happen when interpolating, which JSON
+	// pipelines aren't by default
+	_, err = validatePipeline(environ, "pipeline.yml", []byte("steps:\n  - command: echo ${MISSING?}\n"), false)
+	assert.Error(t, err)
+	_, err = validatePipeline(environ, "pipeline.yml", []byte("steps:\n  - command: echo ${MISSING?}\n"), true)
+	assert.NoError(t, err)
+	_, err = validatePipeline(environ, "pipeline.json", []byte(`{"steps": [{"command": "echo ${MISSING?}"}]}`), false)
+	assert.NoError(t, err)
+
+	_, err = validatePipeline(environ, "pipeline.yml", []byte("steps:\n  - command: [\n"), false)
+	assert.Error(t, err)
+
+	_, err = validatePipeline(environ, "pipeline.yml", nil, false)
+	assert.EqualError(t, err, "Config file is empty")
+}
+
+func TestValidatePipelineFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pipeline-validate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	valid := filepath.Join(dir, "valid.yml")
+	if err := ioutil.WriteFile(valid, []byte("steps:\n  - command: echo hello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	invalid := filepath.Join(dir, "invalid.yml")
+	if err := ioutil.WriteFile(invalid, []byte("steps:\n  - command: [\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	environ := env.FromSlice([]string{})
+
+	assert.NoError(t, validatePipelineFile(logger.Discard, environ, valid, false))
+
+	err = validatePipelineFile(logger.Discard, environ, invalid, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `Pipeline parsing of "`+invalid+`" failed`)
+	}
+
+	err = validatePipelineFile(logger.Discard, environ, filepath.Join(dir, "missing.yml"), false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Failed to read file")
+	}
+}
@@ -0,0 +1,64 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/yaml"
+)
+
+// writeBackSuffix is added to the name of the pipeline file to make the name
+// of its backup
+const writeBackSuffix = ".bak"
+
+// checkWriteBack returns an error if the pipeline file at path can't be
+// written back. TOML files can't, as the pipeline would be written as YAML
+// that the next upload would fail to parse as TOML.
+func checkWriteBack(path string) error {
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		return fmt.Errorf("--write-back can't write TOML pipeline files like %s", path)
+	}
+	return nil
+}
+
+// writePipelineBack replaces the pipeline file at path with result, as JSON if
+// the file name ends in .json and YAML otherwise, after copying the original
+// to a backup file next to it. It returns the path of the backup.
+func writePipelineBack(path string, result *agent.PipelineParserResult) (string, error) {
+	if err := checkWriteBack(path); err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	var data []byte
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		data, err = json.MarshalIndent(result, "", "  ")
+		data = append(data, '\n')
+	} else {
+		data, err = yaml.Marshal(result)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	backup := path + writeBackSuffix
+	if err := ioutil.WriteFile(backup, original, info.Mode().Perm()); err != nil {
+		return "", err
+	}
+
+	return backup, ioutil.WriteFile(path, data, info.Mode().Perm())
+}
@@ -0,0 +1,96 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWritePipelineBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write-back")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	original := "steps:\n  - command: echo $NAME\n    label:   hello\n"
+
+	for _, tc := range []struct {
+		name     string
+		expected string
+	}{
+		{"pipeline.yml", "steps:\n- command: echo world\n  label: hello\n"},
+		{"pipeline.json", "{\n  \"steps\": [\n    {\n      \"command\": \"echo world\",\n      \"label\": \"hello\"\n    }\n  ]\n}\n"},
+	} {
+		path := filepath.Join(dir, tc.name)
+		if err := ioutil.WriteFile(path, []byte(original), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		result, _, err := agent.PipelineParser{
+			Env:      env.FromSlice([]string{"NAME=world"}),
+			Pipeline: []byte(original),
+		}.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		backup, err := writePipelineBack(path, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, path+".bak", backup)
+
+		written, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.expected, string(written), tc.name)
+
+		kept, err := ioutil.ReadFile(backup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, original, string(kept), tc.name)
+	}
+}
+
+func TestWritePipelineBackRejectsTOML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "write-back")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	original := "[[steps]]\ncommand = \"echo hello\"\n"
+	path := filepath.Join(dir, "pipeline.toml")
+	if err := ioutil.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	result, _, err := agent.PipelineParser{
+		Filename: "pipeline.toml",
+		Pipeline: []byte(original),
+	}.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Error(t, checkWriteBack(path))
+	_, err = writePipelineBack(path, result)
+	assert.Error(t, err)
+
+	// The file and its backup are left alone
+	kept, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, original, string(kept))
+	_, err = os.Stat(path + writeBackSuffix)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,26 @@
+package clicommand
+
+import (
+	"github.com/buildkite/agent/v3/redaction"
+)
+
+// mergeRedactedVarsFile returns redactedVars, like those given with
+// --redacted-vars, with the patterns in the --redacted-vars-file at path
+// added. Patterns that are already in redactedVars aren't added again.
+func mergeRedactedVarsFile(redactedVars []string, path string) ([]string, error) {
+	patterns, err := redaction.ReadPatternsFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	merged := []string{}
+	for _, pattern := range append(append([]string{}, redactedVars...), patterns...) {
+		if !seen[pattern] {
+			seen[pattern] = true
+			merged = append(merged, pattern)
+		}
+	}
+
+	return merged, nil
+}
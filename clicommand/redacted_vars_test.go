@@ -0,0 +1,32 @@
+package clicommand
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeRedactedVarsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redacted-vars-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "redacted-vars")
+	if err := ioutil.WriteFile(path, []byte("# Secrets\n*_TOKEN\nDATABASE_URL\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := mergeRedactedVarsFile([]string{"*_PASSWORD", "*_TOKEN"}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"*_PASSWORD", "*_TOKEN", "DATABASE_URL"}, merged)
+
+	_, err = mergeRedactedVarsFile(nil, filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
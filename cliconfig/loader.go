@@ -5,6 +5,7 @@ import (
 	"os"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -29,21 +30,45 @@ type Loader struct {
 
 	// The file that was used when loading this configuration
 	File *File
+
+	// If not nil, records where the value of each field with a cli tag was
+	// loaded from, keyed by its cli name
+	Provenance map[string]Source
+
+	// If true, Load warns about each option in the config file that isn't
+	// an option of the command, as it's probably a typo
+	WarnUnknownFileOptions bool
+}
+
+// Source describes where a config value was loaded from
+type Source struct {
+	// One of "flag", "env", "config", "arg" or "default"
+	Kind string `json:"source"`
+
+	// The environment variable or config file the value was loaded from
+	Name string `json:"name,omitempty"`
 }
 
 var argCliNameRegexp = regexp.MustCompile(`arg:(\d+)`)
 
 // A shortcut for loading a config from the CLI
 func Load(c *cli.Context, l logger.Logger, cfg interface{}) error {
-	loader := Loader{CLI: c, Config: cfg}
+	_, err := LoadWithProvenance(c, l, cfg)
+	return err
+}
+
+// LoadWithProvenance is like Load, but also returns where each config value
+// was loaded from, keyed by the cli name of its field
+func LoadWithProvenance(c *cli.Context, l logger.Logger, cfg interface{}) (map[string]Source, error) {
+	loader := Loader{CLI: c, Config: cfg, Provenance: map[string]Source{}}
 	warnings, err := loader.Load()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, warning := range warnings {
 		l.Warn("%s", warning)
 	}
-	return nil
+	return loader.Provenance, nil
 }
 
 // Loads the config from the CLI and config files that are present and returns
@@ -178,9 +203,40 @@ func (l *Loader) Load() (warnings []string, err error) {
 		}
 	}
 
+	// Options in the config file that the command doesn't have are probably
+	// typos, or meant for another command
+	if l.WarnUnknownFileOptions && l.File != nil {
+		warnings = append(warnings, l.unknownFileOptions(fields)...)
+	}
+
 	return warnings, nil
 }
 
+// unknownFileOptions returns a warning for each option in the config file
+// that isn't the cli name of one of fields
+func (l Loader) unknownFileOptions(fields []string) []string {
+	known := map[string]bool{}
+	for _, fieldName := range fields {
+		if cliName, _ := reflections.GetFieldTag(l.Config, fieldName, "cli"); cliName != "" {
+			known[cliName] = true
+		}
+	}
+
+	var unknown []string
+	for key := range l.File.Config {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+
+	var warnings []string
+	for _, key := range unknown {
+		warnings = append(warnings, fmt.Sprintf("The config option `%s` in %s isn't an option of this command, so it was ignored", key, l.File.Path))
+	}
+	return warnings
+}
+
 func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 	// Get the kind of field we need to set
 	fieldKind, err := reflections.GetFieldKind(l.Config, fieldName)
@@ -189,6 +245,7 @@ func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 	}
 
 	var value interface{}
+	source := Source{Kind: "default"}
 
 	// See the if the cli option is using the arg format (arg:1)
 	argMatch := argCliNameRegexp.FindStringSubmatch(cliName)
@@ -205,6 +262,7 @@ func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 		// the position to exist.
 		if len(l.CLI.Args()) > argIndex {
 			value = l.CLI.Args()[argIndex]
+			source = Source{Kind: "arg"}
 		}
 
 		// Otherwise see if we can pull it from an environment variable
@@ -214,6 +272,7 @@ func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 			if err == nil {
 				if envValue, envSet := os.LookupEnv(envName); envSet {
 					value = envValue
+					source = Source{Kind: "env", Name: envName}
 				}
 			}
 		}
@@ -237,6 +296,7 @@ func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 				} else {
 					return fmt.Errorf("Unable to convert string to type %s", fieldKind)
 				}
+				source = Source{Kind: "config", Name: l.File.Path}
 			}
 		}
 
@@ -254,9 +314,25 @@ func (l Loader) setFieldValueFromCLI(fieldName string, cliName string) error {
 			} else {
 				return fmt.Errorf("Unable to handle type: %s", fieldKind)
 			}
+
+			// cli.Context#IsSet is also true for flags set by their
+			// environment variable, so a flag given on the command
+			// line is told apart by its value
+			envName := flagEnvVar(l.CLI, cliName)
+			if envName != "" && envValueMatches(os.Getenv(envName), value) {
+				source = Source{Kind: "env", Name: envName}
+			} else if l.CLI.IsSet(cliName) {
+				source = Source{Kind: "flag"}
+			} else {
+				source = Source{Kind: "default"}
+			}
 		}
 	}
 
+	if l.Provenance != nil {
+		l.Provenance[cliName] = source
+	}
+
 	// Set the value to the cfg
 	if value != nil {
 		err = reflections.SetField(l.Config, fieldName, value)
@@ -275,26 +351,58 @@ func (l Loader) Errorf(format string, v ...interface{}) error {
 }
 
 func (l Loader) cliValueIsSet(cliName string) bool {
-	if l.CLI.IsSet(cliName) {
-		return true
-	} else {
-		// cli.Context#IsSet only checks to see if the command was set via the cli, not
-		// via the environment. So here we do some hacks to find out the name of the
-		// EnvVar, and return true if it was set.
-		for _, flag := range l.CLI.Command.Flags {
-			name, _ := reflections.GetField(flag, "Name")
-			envVar, _ := reflections.GetField(flag, "EnvVar")
-			if name == cliName && envVar != "" {
-				// Make sure envVar is a string
-				if envVarStr, ok := envVar.(string); ok {
-					envVarStr = strings.TrimSpace(string(envVarStr))
-
-					return os.Getenv(envVarStr) != ""
+	return IsSet(l.CLI, cliName)
+}
+
+// IsSet returns whether a flag was given either on the command line or via
+// its environment variable
+func IsSet(c *cli.Context, cliName string) bool {
+	return c.IsSet(cliName) || flagEnvVar(c, cliName) != ""
+}
+
+// flagEnvVar returns the name of the environment variable that a flag was set
+// with, or an empty string if it wasn't set by one
+func flagEnvVar(c *cli.Context, cliName string) string {
+	// cli.Context#IsSet only checks to see if the command was set via the cli, not
+	// via the environment. So here we do some hacks to find out the name of the
+	// EnvVar, and return it if it was set.
+	for _, flag := range c.Command.Flags {
+		name, _ := reflections.GetField(flag, "Name")
+		envVar, _ := reflections.GetField(flag, "EnvVar")
+		if name == cliName && envVar != "" {
+			// Make sure envVar is a string
+			if envVarStr, ok := envVar.(string); ok {
+				envVarStr = strings.TrimSpace(string(envVarStr))
+
+				if os.Getenv(envVarStr) != "" {
+					return envVarStr
 				}
 			}
 		}
 	}
 
+	return ""
+}
+
+// envValueMatches returns whether a flag's value is what it would be if it
+// were set by an environment variable with the given value
+func envValueMatches(envValue string, value interface{}) bool {
+	switch v := value.(type) {
+	case string:
+		return v == envValue
+	case []string:
+		parts := strings.Split(envValue, ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		return reflect.DeepEqual(v, parts)
+	case bool:
+		b, _ := strconv.ParseBool(envValue)
+		return v == b
+	case int:
+		i, _ := strconv.Atoi(envValue)
+		return v == i
+	}
 	return false
 }
 
@@ -0,0 +1,101 @@
+package env
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/buildkite/interpolate"
+)
+
+// ExpandAlternates replaces shell style ${VAR:+alternate} expansions in s,
+// which the interpolate package doesn't support, with the alternate if VAR is
+// set and not empty and with nothing otherwise. The alternate is left for the
+// interpolator to expand along with the rest of s. Escaped dollar signs ($$
+// and \$) are left alone. If reference isn't nil, it's called with the name
+// of each variable an expansion checks.
+func ExpandAlternates(s string, variables interpolate.Env, reference func(name string)) (string, error) {
+	if !strings.Contains(s, ":+") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		// Leave escaped dollar signs and backslashes for the interpolator
+		if rest := s[i:]; strings.HasPrefix(rest, "$$") || strings.HasPrefix(rest, `\$`) || strings.HasPrefix(rest, `\\`) {
+			b.WriteString(s[i : i+2])
+			i++
+			continue
+		}
+
+		name, contentStart, ok := alternateValueStart(s, i)
+		if !ok {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		end, err := matchingBrace(s, contentStart)
+		if err != nil {
+			return "", err
+		}
+
+		if reference != nil {
+			reference(name)
+		}
+		if v, _ := variables.Get(name); v != "" {
+			// Alternates can contain alternates of their own
+			alternate, err := ExpandAlternates(s[contentStart:end], variables, reference)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(alternate)
+		}
+		i = end
+	}
+
+	return b.String(), nil
+}
+
+// alternateValueStart returns the variable name of the ${VAR:+ at i in s, and
+// where the alternate after it starts
+func alternateValueStart(s string, i int) (string, int, bool) {
+	if !strings.HasPrefix(s[i:], "${") {
+		return "", 0, false
+	}
+
+	start := i + 2
+	end := start
+	for end < len(s) && (s[end] == '_' || isASCIILetter(s[end]) || (end > start && s[end] >= '0' && s[end] <= '9')) {
+		end++
+	}
+	if end == start || !strings.HasPrefix(s[end:], ":+") {
+		return "", 0, false
+	}
+
+	return s[start:end], end + 2, true
+}
+
+// matchingBrace returns the index of the } that closes the brace expansion
+// whose content starts at start in s, skipping nested expansions and escapes
+func matchingBrace(s string, start int) (int, error) {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "$$") || strings.HasPrefix(s[i:], `\$`) || strings.HasPrefix(s[i:], `\\`):
+			i++
+		case strings.HasPrefix(s[i:], "${"):
+			depth++
+			i++
+		case s[i] == '}':
+			if depth == 0 {
+				return i, nil
+			}
+			depth--
+		}
+	}
+
+	return 0, fmt.Errorf("Expected brace expansion to end with }, got end of string")
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,31 @@
+package env
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpandAlternates(t *testing.T) {
+	variables := FromSlice([]string{"SET=yes", "EMPTY="})
+
+	for s, expected := range map[string]string{
+		"${SET:+alt}":                "alt",
+		"${EMPTY:+alt}":              "",
+		"${UNSET:+alt}":              "",
+		"${SET:+${SET:+nested}}":     "nested",
+		"${SET:+${UNSET:-${SET}}}":   "${UNSET:-${SET}}",
+		"${SET:+a}${SET:+b}":         "ab",
+		"$${SET:+alt} \\${SET:+alt}": "$${SET:+alt} \\${SET:+alt}",
+		"${SET:+$$}}":                "$$}",
+		"${SET:-alt} ${SET} $SET:+":  "${SET:-alt} ${SET} $SET:+",
+		"${1SET:+alt}":               "${1SET:+alt}",
+	} {
+		actual, err := ExpandAlternates(s, variables, nil)
+		assert.NoError(t, err, s)
+		assert.Equal(t, expected, actual, s)
+	}
+
+	_, err := ExpandAlternates("${SET:+${SET}", variables, nil)
+	assert.Error(t, err)
+}
@@ -4,21 +4,33 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+
+	"github.com/buildkite/interpolate"
 )
 
 // Environment is a map of environment variables, with the keys normalized
 // for case-insensitive operating systems
 type Environment struct {
 	env map[string]string
+
+	// Whether keys are normalized to upper case, see normalizeKeyName
+	caseInsensitive bool
 }
 
+// New returns an empty environment, which is case-insensitive on Windows
 func New() *Environment {
-	return &Environment{env: map[string]string{}}
+	return &Environment{env: map[string]string{}, caseInsensitive: runtime.GOOS == "windows"}
+}
+
+// NewCaseInsensitive returns an empty environment that's case-insensitive on
+// every operating system, like environments on Windows are
+func NewCaseInsensitive() *Environment {
+	return &Environment{env: map[string]string{}, caseInsensitive: true}
 }
 
 // FromSlice creates a new environment from a string slice of KEY=VALUE
 func FromSlice(s []string) *Environment {
-	env := &Environment{env: make(map[string]string, len(s))}
+	env := New()
 
 	for _, l := range s {
 		parts := strings.SplitN(l, "=", 2)
@@ -32,7 +44,7 @@ func FromSlice(s []string) *Environment {
 
 // Get returns a key from the environment
 func (e *Environment) Get(key string) (string, bool) {
-	v, ok := e.env[normalizeKeyName(key)]
+	v, ok := e.env[e.normalizeKeyName(key)]
 	return v, ok
 }
 
@@ -52,13 +64,13 @@ func (e *Environment) GetBool(key string, defaultValue bool) bool {
 
 // Exists returns true/false depending on whether or not the key exists in the env
 func (e *Environment) Exists(key string) bool {
-	_, ok := e.env[normalizeKeyName(key)]
+	_, ok := e.env[e.normalizeKeyName(key)]
 	return ok
 }
 
 // Set sets a key in the environment
 func (e *Environment) Set(key string, value string) string {
-	e.env[normalizeKeyName(key)] = value
+	e.env[e.normalizeKeyName(key)] = value
 
 	return value
 }
@@ -67,7 +79,7 @@ func (e *Environment) Set(key string, value string) string {
 func (e *Environment) Remove(key string) string {
 	value, ok := e.Get(key)
 	if ok {
-		delete(e.env, normalizeKeyName(key))
+		delete(e.env, e.normalizeKeyName(key))
 	}
 	return value
 }
@@ -77,8 +89,10 @@ func (e *Environment) Length() int {
 	return len(e.env)
 }
 
-// Diff returns a new environment with the keys and values from this
-// environment which are different in the other one.
+// Diff returns how this environment differs from the other one, as if other
+// was changed to become this one. Keys only in this environment are Added,
+// keys only in other are Removed, and keys in both with different values are
+// Changed, with other's value as Old and this environment's as New.
 func (e *Environment) Diff(other *Environment) Diff {
 	diff := Diff {
 		Added: make(map[string]string),
@@ -150,7 +164,24 @@ func (e *Environment) Copy() *Environment {
 		c[k] = v
 	}
 
-	return &Environment{env: c}
+	return &Environment{env: c, caseInsensitive: e.caseInsensitive}
+}
+
+// Expand replaces $VAR and ${VAR} in s with values from the environment,
+// the same way pipelines are interpolated. That includes ${VAR:-default},
+// ${VAR-default} and ${VAR:+alternate}, which can be nested, and $$ expands
+// to $. If s can't be parsed, it's returned as it is.
+func (e *Environment) Expand(s string) string {
+	expanded, err := ExpandAlternates(s, e, nil)
+	if err != nil {
+		return s
+	}
+
+	expanded, err = interpolate.Interpolate(e, expanded)
+	if err != nil {
+		return s
+	}
+	return expanded
 }
 
 // ToSlice returns a sorted slice representation of the environment
@@ -166,7 +197,26 @@ func (e *Environment) ToSlice() []string {
 	return s
 }
 
-// ToMap returns a map representation of the environment
+// ToSortedSlice returns the environment as KEY=VALUE entries sorted by key,
+// so that anything logged or written from it is the same between runs. It
+// differs from ToSlice when a key is a prefix of another, like FOO and FOO-BAR.
+func (e *Environment) ToSortedSlice() []string {
+	keys := make([]string, 0, len(e.env))
+	for k := range e.env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := make([]string, 0, len(keys))
+	for _, k := range keys {
+		s = append(s, k+"="+e.env[k])
+	}
+
+	return s
+}
+
+// ToMap returns a map representation of the environment. Iterating over it
+// happens in a random order, so use ToSortedSlice for output.
 func (e *Environment) ToMap() map[string]string {
 	return e.env
 }
@@ -195,32 +245,37 @@ func (e *Environment) ToMap() map[string]string {
 // machines, we'll normalise all the keys that go in/out of this API.
 //
 // Unix systems _are_ case sensitive when it comes to ENV, so we'll just leave
-// that alone.
-func normalizeKeyName(key string) string {
-	if runtime.GOOS == "windows" {
+// that alone, unless the environment was made with NewCaseInsensitive.
+func (e *Environment) normalizeKeyName(key string) string {
+	if e.caseInsensitive {
 		return strings.ToUpper(key)
 	} else {
 		return key
 	}
 }
 
+// Diff is the difference between two environments, as returned by
+// Environment.Diff
 type Diff struct {
 	Added map[string]string
 	Changed map[string]DiffPair
 	Removed map[string]struct{}
 }
 
+// DiffPair is the old and new values of a changed variable
 type DiffPair struct {
 	Old string
 	New string
 }
 
+// Remove removes key from the diff, whether it was added, changed or removed
 func (diff *Diff) Remove(key string) {
 	delete(diff.Added, key)
 	delete(diff.Changed, key)
 	delete(diff.Removed, key)
 }
 
+// Empty returns whether the environments were the same
 func (diff *Diff) Empty() bool {
 	return len(diff.Added) == 0 && len(diff.Changed) == 0 && len(diff.Removed) == 0
 }
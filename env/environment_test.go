@@ -94,34 +94,77 @@ func TestEnvironmentToSlice(t *testing.T) {
 	assert.Equal(t, []string{"THIS_IS_GREAT=totes", "ZOMG=greatness"}, env.ToSlice())
 }
 
+func TestEnvironmentToSortedSlice(t *testing.T) {
+	t.Parallel()
+
+	env := FromSlice([]string{"ZOMG=greatness", "FOO-BAR=baz", "THIS_IS_GREAT=totes", "FOO=bar", "A=1"})
+	expected := []string{"A=1", "FOO=bar", "FOO-BAR=baz", "THIS_IS_GREAT=totes", "ZOMG=greatness"}
+
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, expected, env.ToSortedSlice())
+	}
+}
+
+func TestEnvironmentExpand(t *testing.T) {
+	t.Parallel()
+
+	env := FromSlice([]string{"FOO=bar", "EMPTY=", "B=nested"})
+
+	for s, expected := range map[string]string{
+		"$FOO":                  "bar",
+		"${FOO}-baz":            "bar-baz",
+		"$MISSING":              "",
+		"$$FOO":                 "$FOO",
+		"${MISSING:-default}":   "default",
+		"${EMPTY:-default}":     "default",
+		"${FOO:-default}":       "bar",
+		"${EMPTY-default}":      "",
+		"${MISSING-default}":    "default",
+		"no variables, just $":  "no variables, just $",
+		"${FOO} and ${FOO:-no}": "bar and bar",
+		"${MISSING:-${B}}":      "nested",
+		"${MISSING:-a${B}c}":    "anestedc",
+		"${MISSING:-{braces}}":  "{braces}",
+		"${FOO:+alt}":           "alt",
+		"${EMPTY:+alt}":         "",
+		"${MISSING:+alt}":       "",
+		"${FOO:+$FOO-alt}":      "bar-alt",
+		"$$":                    "$",
+		"$${FOO}":               "${FOO}",
+		"${FOO":                 "${FOO",
+	} {
+		assert.Equal(t, expected, env.Expand(s), s)
+	}
+}
+
 func TestEnvironmentDiff(t *testing.T) {
 	t.Parallel()
 	a := FromSlice([]string{"A=hello", "B=world"})
 	b := FromSlice([]string{"A=hello", "B=there", "C=new", "D="})
 
 	ab := a.Diff(b)
-	assert.Equal(t, Diff {
+	assert.Equal(t, Diff{
 		Added: map[string]string{},
 		Changed: map[string]DiffPair{
-			"B": DiffPair {
+			"B": DiffPair{
 				Old: "there",
 				New: "world",
 			},
 		},
-		Removed: map[string]struct{} {
+		Removed: map[string]struct{}{
 			"C": struct{}{},
 			"D": struct{}{},
 		},
 	}, ab)
 
 	ba := b.Diff(a)
-	assert.Equal(t, Diff {
+	assert.Equal(t, Diff{
 		Added: map[string]string{
 			"C": "new",
 			"D": "",
 		},
-		Changed: map[string]DiffPair {
-			"B": DiffPair {
+		Changed: map[string]DiffPair{
+			"B": DiffPair{
 				Old: "world",
 				New: "there",
 			},
@@ -130,20 +173,33 @@ func TestEnvironmentDiff(t *testing.T) {
 	}, ba)
 }
 
+func TestEnvironmentDiffSame(t *testing.T) {
+	t.Parallel()
+
+	a := FromSlice([]string{"A=hello", "B="})
+	diff := a.Diff(a.Copy())
+	assert.True(t, diff.Empty())
+
+	// An empty value is still different to being unset
+	diff = a.Diff(FromSlice([]string{"A=hello"}))
+	assert.False(t, diff.Empty())
+	assert.Equal(t, map[string]string{"B": ""}, diff.Added)
+}
+
 func TestEnvironmentDiffRemove(t *testing.T) {
 	t.Parallel()
 
-	diff := Diff {
-		Added: map[string]string {
+	diff := Diff{
+		Added: map[string]string{
 			"A": "new",
 		},
-		Changed: map[string]DiffPair {
-			"B": DiffPair {
+		Changed: map[string]DiffPair{
+			"B": DiffPair{
 				Old: "old",
 				New: "new",
 			},
 		},
-		Removed: map[string]struct{} {
+		Removed: map[string]struct{}{
 			"C": struct{}{},
 		},
 	}
@@ -152,9 +208,9 @@ func TestEnvironmentDiffRemove(t *testing.T) {
 	diff.Remove("B")
 	diff.Remove("C")
 
-	assert.Equal(t, Diff {
-		Added: map[string]string {},
-		Changed: map[string]DiffPair {},
+	assert.Equal(t, Diff{
+		Added:   map[string]string{},
+		Changed: map[string]DiffPair{},
 		Removed: map[string]struct{}{},
 	}, diff)
 }
@@ -171,7 +227,7 @@ func TestEnvironmentApply(t *testing.T) {
 	t.Parallel()
 
 	env := &Environment{}
-	env = env.Apply(Diff {
+	env = env.Apply(Diff{
 		Added: map[string]string{
 			"LLAMAS_ENABLED": "1",
 		},
@@ -182,12 +238,12 @@ func TestEnvironmentApply(t *testing.T) {
 		"LLAMAS_ENABLED=1",
 	}), env)
 
-	env = env.Apply(Diff {
+	env = env.Apply(Diff{
 		Added: map[string]string{
 			"ALPACAS_ENABLED": "1",
 		},
 		Changed: map[string]DiffPair{
-			"LLAMAS_ENABLED": DiffPair {
+			"LLAMAS_ENABLED": DiffPair{
 				Old: "1",
 				New: "0",
 			},
@@ -199,13 +255,34 @@ func TestEnvironmentApply(t *testing.T) {
 		"LLAMAS_ENABLED=0",
 	}), env)
 
-	env = env.Apply(Diff {
-		Added: map[string]string{},
+	env = env.Apply(Diff{
+		Added:   map[string]string{},
 		Changed: map[string]DiffPair{},
-		Removed: map[string]struct{} {
-			"LLAMAS_ENABLED": struct{}{},
+		Removed: map[string]struct{}{
+			"LLAMAS_ENABLED":  struct{}{},
 			"ALPACAS_ENABLED": struct{}{},
 		},
 	})
 	assert.Equal(t, FromSlice([]string{}), env)
 }
+
+func TestEnvironmentCaseInsensitive(t *testing.T) {
+	t.Parallel()
+
+	env := NewCaseInsensitive()
+	env.Set("Path", `C:\Windows`)
+
+	v, ok := env.Get("PATH")
+	assert.True(t, ok)
+	assert.Equal(t, `C:\Windows`, v)
+	assert.True(t, env.Exists("path"))
+
+	// Copies and merges stay case-insensitive
+	merged := env.Copy().Merge(FromSlice([]string{"PATH=C:\\Tools"}))
+	v, _ = merged.Get("pAtH")
+	assert.Equal(t, `C:\Tools`, v)
+	assert.Equal(t, 1, merged.Length())
+
+	assert.Equal(t, `C:\Windows`, env.Remove("path"))
+	assert.False(t, env.Exists("Path"))
+}
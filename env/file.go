@@ -0,0 +1,138 @@
+package env
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envFileKeyRegex = regexp.MustCompile(`\A[a-zA-Z_][a-zA-Z0-9_]*\z`)
+
+// FromFile parses environment variables from a dotenv style file, with a
+// KEY=VALUE on each line:
+//
+//     # Comments and blank lines are skipped
+//     export LLAMAS=great
+//     ALPACAS="also great\nbut in \"quotes\""
+//     LITERAL='nothing in $single quotes is escaped'
+//     UNQUOTED=values end at a comment # like this one
+//
+// Double quoted values support \n, \t, \", \\ and \$ escapes. Nothing is
+// interpolated, so values like $HOME are kept as they are.
+func FromFile(path string) (*Environment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	env, err := parseEnvFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+	return env, nil
+}
+
+func parseEnvFile(r io.Reader) (*Environment, error) {
+	env := New()
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(text, "export "), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%d: expected KEY=VALUE", line)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		if !envFileKeyRegex.MatchString(key) {
+			return nil, fmt.Errorf("%d: %q isn't a valid variable name", line, key)
+		}
+
+		value, err := parseEnvFileValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%d: %v", line, err)
+		}
+
+		env.Set(key, value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+func parseEnvFileValue(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	var value strings.Builder
+	var rest string
+
+	switch s[0] {
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end == -1 {
+			return "", fmt.Errorf("unterminated single quoted value")
+		}
+		value.WriteString(s[1 : end+1])
+		rest = s[end+2:]
+
+	case '"':
+		closed := false
+		i := 1
+		for ; i < len(s) && !closed; i++ {
+			switch c := s[i]; {
+			case c == '"':
+				closed = true
+			case c == '\\' && i+1 < len(s):
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				case 't':
+					value.WriteByte('\t')
+				case '"', '\\', '$':
+					value.WriteByte(s[i])
+				default:
+					value.WriteByte('\\')
+					value.WriteByte(s[i])
+				}
+			default:
+				value.WriteByte(c)
+			}
+		}
+		if !closed {
+			return "", fmt.Errorf("unterminated double quoted value")
+		}
+		rest = s[i:]
+
+	default:
+		// A # only starts a comment after whitespace, so values like
+		// url#fragment are kept whole
+		for i := 0; i < len(s); i++ {
+			if s[i] == '#' && i > 0 && (s[i-1] == ' ' || s[i-1] == '\t') {
+				return strings.TrimSpace(s[:i]), nil
+			}
+		}
+		return s, nil
+	}
+
+	// Only a comment can follow a quoted value
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("unexpected %q after quoted value", rest)
+	}
+
+	return value.String(), nil
+}
@@ -0,0 +1,89 @@
+package env
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	t.Parallel()
+
+	env, err := parseEnvFile(strings.NewReader(`# A comment
+
+LLAMAS=great
+export ALPACAS = also great
+EMPTY=
+DOUBLE="hello\nfriends \"and\" \$HOME" # comment
+SINGLE='$HOME \n stays' # comment
+UNQUOTED=values end at a comment # like this
+URL=https://example.com/#fragment
+EQUALS=a=b
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"LLAMAS":   "great",
+		"ALPACAS":  "also great",
+		"EMPTY":    "",
+		"DOUBLE":   "hello\nfriends \"and\" $HOME",
+		"SINGLE":   `$HOME \n stays`,
+		"UNQUOTED": "values end at a comment",
+		"URL":      "https://example.com/#fragment",
+		"EQUALS":   "a=b",
+	}, env.ToMap())
+}
+
+func TestParseEnvFileErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		input, err string
+	}{
+		{"LLAMAS", "1: expected KEY=VALUE"},
+		{"\nMY-VAR=1", `2: "MY-VAR" isn't a valid variable name`},
+		{`A="unterminated`, "1: unterminated double quoted value"},
+		{`A='unterminated`, "1: unterminated single quoted value"},
+		{`A="quoted" trailing`, `1: unexpected "trailing" after quoted value`},
+	} {
+		_, err := parseEnvFile(strings.NewReader(tc.input))
+		assert.EqualError(t, err, tc.err, "input %q", tc.input)
+	}
+}
+
+func TestFromFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "env-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, ".env")
+	if err := ioutil.WriteFile(path, []byte("LLAMAS=great\nBAD\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = FromFile(path)
+	assert.EqualError(t, err, path+":2: expected KEY=VALUE")
+
+	if err := ioutil.WriteFile(path, []byte("LLAMAS=great\nFOO=baz\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fileEnv, err := FromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Values from the file win when it's merged in
+	merged := FromSlice([]string{"FOO=bar", "OTHER=1"}).Merge(fileEnv)
+	assert.Equal(t, []string{"FOO=baz", "LLAMAS=great", "OTHER=1"}, merged.ToSlice())
+}
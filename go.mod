@@ -4,6 +4,7 @@ go 1.14
 
 require (
 	cloud.google.com/go v0.0.0-20170217213217-65216237311a
+	github.com/BurntSushi/toml v0.3.1
 	github.com/DataDog/datadog-go v3.7.2+incompatible
 	github.com/aws/aws-sdk-go v1.32.10
 	github.com/buildkite/bintest/v3 v3.1.0
@@ -28,10 +29,11 @@ require (
 	github.com/qri-io/jsonpointer v0.0.0-20180309164927-168dd9e45cf2 // indirect
 	github.com/qri-io/jsonschema v0.0.0-20180607150648-d0d3b10ec792
 	github.com/rjeczalik/interfaces v0.1.1
-	github.com/sergi/go-diff v1.0.0 // indirect
+	github.com/sergi/go-diff v1.0.0
 	github.com/stretchr/testify v1.5.1
 	github.com/urfave/cli v1.22.4
 	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
+	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
 	golang.org/x/oauth2 v0.0.0-20181003184128-c57b0facaced
 	golang.org/x/sys v0.0.0-20200122134326-e047566fdf82
 	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e // indirect
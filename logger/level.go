@@ -1,13 +1,18 @@
 package logger
 
+import (
+	"fmt"
+	"strings"
+)
+
 type Level int
 
 const (
 	DEBUG Level = iota
 	NOTICE
 	INFO
-	ERROR
 	WARN
+	ERROR
 	FATAL
 )
 
@@ -15,8 +20,8 @@ var levelNames = []string{
 	"DEBUG",
 	"NOTICE",
 	"INFO",
-	"ERROR",
 	"WARN",
+	"ERROR",
 	"FATAL",
 }
 
@@ -24,3 +29,23 @@ var levelNames = []string{
 func (p Level) String() string {
 	return levelNames[p]
 }
+
+// LevelFromString returns the logging level with the given name, like debug
+// or warn, ignoring case. Fatal messages are always logged, so FATAL isn't a
+// level that can be chosen.
+func LevelFromString(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DEBUG, nil
+	case "notice":
+		return NOTICE, nil
+	case "info":
+		return INFO, nil
+	case "warn", "warning":
+		return WARN, nil
+	case "error":
+		return ERROR, nil
+	default:
+		return 0, fmt.Errorf("Unknown log level %q, expected debug, notice, info, warn or error", s)
+	}
+}
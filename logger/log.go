@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -81,7 +82,9 @@ func (l *ConsoleLogger) Debug(format string, v ...interface{}) {
 }
 
 func (l *ConsoleLogger) Error(format string, v ...interface{}) {
-	l.printer.Print(ERROR, fmt.Sprintf(format, v...), l.fields)
+	if l.level <= ERROR {
+		l.printer.Print(ERROR, fmt.Sprintf(format, v...), l.fields)
+	}
 }
 
 func (l *ConsoleLogger) Fatal(format string, v ...interface{}) {
@@ -243,12 +246,12 @@ func NewJSONPrinter(w io.Writer) *JSONPrinter {
 func (p *JSONPrinter) Print(level Level, msg string, fields Fields) {
 	var b strings.Builder
 
-	b.WriteString(fmt.Sprintf(`"ts":%q,`, time.Now().Format(time.RFC3339)))
-	b.WriteString(fmt.Sprintf(`"level":%q,`, level.String()))
-	b.WriteString(fmt.Sprintf(`"msg":%q,`, msg))
+	b.WriteString(fmt.Sprintf(`"ts":%s,`, jsonString(time.Now().Format(time.RFC3339))))
+	b.WriteString(fmt.Sprintf(`"level":%s,`, jsonString(level.String())))
+	b.WriteString(fmt.Sprintf(`"msg":%s,`, jsonString(msg)))
 
 	for _, field := range fields {
-		b.WriteString(fmt.Sprintf(`%q:%q,`, field.Key(), field.String()))
+		b.WriteString(fmt.Sprintf(`%s:%s,`, jsonString(field.Key()), jsonString(field.String())))
 	}
 
 	// Make sure we're only outputting a line one at a time
@@ -257,6 +260,13 @@ func (p *JSONPrinter) Print(level Level, msg string, fields Fields) {
 	mutex.Unlock()
 }
 
+// jsonString quotes s as a JSON string. %q uses Go's escapes, some of which,
+// like \x00, aren't valid JSON.
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
 var Discard = &ConsoleLogger{
 	printer: &TextPrinter{
 		Writer: ioutil.Discard,
@@ -54,6 +54,66 @@ func TestConsoleLogger(t *testing.T) {
 	}
 }
 
+func TestConsoleLoggerLevels(t *testing.T) {
+	for _, tc := range []struct {
+		level    logger.Level
+		expected []string
+	}{
+		{logger.DEBUG, []string{"Debug", "Notice", "Info", "Warn", "Error", "Fatal"}},
+		{logger.NOTICE, []string{"Notice", "Info", "Warn", "Error", "Fatal"}},
+		{logger.WARN, []string{"Warn", "Error", "Fatal"}},
+		{logger.ERROR, []string{"Error", "Fatal"}},
+	} {
+		b := &bytes.Buffer{}
+
+		printer := logger.NewTextPrinter(b)
+		printer.Colors = false
+
+		l := logger.NewConsoleLogger(printer, func(c int) {})
+		l.SetLevel(tc.level)
+
+		l.Debug("Debug")
+		l.Notice("Notice")
+		l.Info("Info")
+		l.Warn("Warn")
+		l.Error("Error")
+		l.Fatal("Fatal")
+
+		var messages []string
+		for _, line := range strings.Split(strings.TrimRight(b.String(), "\n"), "\n") {
+			fields := strings.Fields(line)
+			messages = append(messages, fields[len(fields)-1])
+		}
+
+		if strings.Join(messages, ",") != strings.Join(tc.expected, ",") {
+			t.Fatalf("level %s: expected %v, got %v", tc.level, tc.expected, messages)
+		}
+	}
+}
+
+func TestLevelFromString(t *testing.T) {
+	for name, expected := range map[string]logger.Level{
+		"debug":   logger.DEBUG,
+		"NOTICE":  logger.NOTICE,
+		"info":    logger.INFO,
+		"warn":    logger.WARN,
+		"Warning": logger.WARN,
+		"error":   logger.ERROR,
+	} {
+		level, err := logger.LevelFromString(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if level != expected {
+			t.Fatalf("%s: expected %s, got %s", name, expected, level)
+		}
+	}
+
+	if _, err := logger.LevelFromString("fatal"); err == nil {
+		t.Fatal("expected an error for fatal")
+	}
+}
+
 func TestTextPrinter(t *testing.T) {
 	b := &bytes.Buffer{}
 
@@ -95,3 +155,44 @@ func TestJSONPrinter(t *testing.T) {
 		t.Fatalf("bad level, got %v", val)
 	}
 }
+
+func TestJSONPrinterEscapes(t *testing.T) {
+	b := &bytes.Buffer{}
+
+	printer := logger.NewJSONPrinter(b)
+	printer.Print(logger.WARN, "bad \x00 byte and \"quotes\"\n", logger.Fields{logger.StringField("k\x01", "\x1b[31mred")})
+
+	var results map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &results); err != nil {
+		t.Fatalf("bad json %q: %v", b.String(), err)
+	}
+
+	if val := results[`msg`]; val != "bad \x00 byte and \"quotes\"\n" {
+		t.Fatalf("bad msg, got %q", val)
+	}
+
+	if val := results["k\x01"]; val != "\x1b[31mred" {
+		t.Fatalf("bad field, got %q", val)
+	}
+}
+
+func TestJSONLoggerFatal(t *testing.T) {
+	b := &bytes.Buffer{}
+	exitCode := -1
+
+	l := logger.NewConsoleLogger(logger.NewJSONPrinter(b), func(code int) { exitCode = code })
+	l.Fatal("llamas %s", "escaped")
+
+	if exitCode != 1 {
+		t.Fatalf("expected exit code 1, got %d", exitCode)
+	}
+
+	var results map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &results); err != nil {
+		t.Fatalf("bad json %q: %v", b.String(), err)
+	}
+
+	if results[`level`] != `FATAL` || results[`msg`] != `llamas escaped` {
+		t.Fatalf("bad record, got %v", results)
+	}
+}
@@ -95,6 +95,8 @@ func main() {
 			Usage: "Make changes to the pipeline of the currently running build",
 			Subcommands: []cli.Command{
 				clicommand.PipelineUploadCommand,
+				clicommand.PipelineValidateCommand,
+				clicommand.PipelineValidateSchemaCommand,
 			},
 		},
 		{
@@ -0,0 +1,57 @@
+package redaction
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// PatternMatcher finds the parts of strings that match regular expressions
+// for secrets, like password=\S+, that aren't the values of variables
+type PatternMatcher struct {
+	patterns []*regexp.Regexp
+}
+
+// GetPatternsToRedact compiles each of patterns as a regular expression. It's
+// an error for any of them not to compile. Patterns that can match an empty
+// string are reported with warnf, as only their non-empty matches are
+// redacted.
+func GetPatternsToRedact(warnf func(format string, v ...interface{}), patterns []string) (*PatternMatcher, error) {
+	m := &PatternMatcher{}
+
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Bad redacted pattern %q: %v", pattern, err)
+		}
+
+		if re.MatchString("") {
+			warnf("Redacted pattern %q can match an empty string, only its non-empty matches will be redacted", pattern)
+		}
+
+		m.patterns = append(m.patterns, re)
+	}
+
+	return m, nil
+}
+
+// VarsToRedact returns the matches of the patterns in values, so they can be
+// redacted along with the variables from GetVarsToRedact. They're keyed by the
+// pattern that matched and a count, like /password=\S+/:2.
+func (m *PatternMatcher) VarsToRedact(values []string) map[string]string {
+	varsToRedact := map[string]string{}
+
+	for _, re := range m.patterns {
+		seen := map[string]bool{}
+		for _, value := range values {
+			for _, match := range re.FindAllString(value, -1) {
+				if match == "" || seen[match] {
+					continue
+				}
+				seen[match] = true
+				varsToRedact[fmt.Sprintf("/%s/:%d", re, len(seen))] = match
+			}
+		}
+	}
+
+	return varsToRedact
+}
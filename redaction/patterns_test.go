@@ -0,0 +1,36 @@
+package redaction
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPatternsToRedact(t *testing.T) {
+	t.Parallel()
+
+	var warnings []string
+	warnf := func(format string, v ...interface{}) {
+		warnings = append(warnings, format)
+	}
+
+	matcher, err := GetPatternsToRedact(warnf, []string{`password=\S+`, `ghp_[0-9a-zA-Z]{36}`, `x*`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, warnings, 1)
+
+	assert.Equal(t, map[string]string{
+		`/password=\S+/:1`: "password=hunter2",
+		`/password=\S+/:2`: "password=correcthorse",
+		`/x*/:1`:           "xx",
+	}, matcher.VarsToRedact([]string{
+		"postgres://db?user=me&password=hunter2",
+		"mysql --password=hunter2 && mysql --password=correcthorse",
+		"xx",
+		"nothing to see here",
+	}))
+
+	_, err = GetPatternsToRedact(warnf, []string{`password=(\S+`})
+	assert.EqualError(t, err, "Bad redacted pattern \"password=(\\\\S+\": error parsing regexp: missing closing ): `password=(\\S+`")
+}
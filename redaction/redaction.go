@@ -0,0 +1,137 @@
+package redaction
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// LengthMin is the shortest string length that will be considered a
+// potential secret by the environment redactor. For example, if the redactor is
+// configured to filter out environment variables matching *_TOKEN, and
+// API_TOKEN is set to "none", this minimum length will prevent the word "none"
+// from being redacted from useful log output.
+const LengthMin = 6
+
+// GetValuesToRedact returns the values of the variables in environment whose
+// names match any of the patterns, which are the secrets to be redacted.
+// Problems with the patterns or values are reported with warnf.
+func GetValuesToRedact(warnf func(format string, v ...interface{}), patterns []string, environment map[string]string) []string {
+	var valuesToRedact []string
+
+	for _, varValue := range GetVarsToRedact(warnf, patterns, environment) {
+		valuesToRedact = append(valuesToRedact, varValue)
+	}
+
+	return valuesToRedact
+}
+
+// GetVarsToRedact is like GetValuesToRedact, but returns a map of the names
+// of the variables to their values
+func GetVarsToRedact(warnf func(format string, v ...interface{}), patterns []string, environment map[string]string) map[string]string {
+	varsToRedact, skipped := GetVarsToRedactMinLength(warnf, patterns, environment, LengthMin)
+
+	for _, varName := range skipped {
+		warnf("Value of %s below minimum length and will not be redacted", varName)
+	}
+
+	return varsToRedact
+}
+
+// GetVarsToRedactMinLength is like GetVarsToRedact, but with a minimum length
+// other than LengthMin. The names of the variables whose values are too short
+// are returned rather than reported, sorted by name.
+func GetVarsToRedactMinLength(warnf func(format string, v ...interface{}), patterns []string, environment map[string]string, minLength int) (map[string]string, []string) {
+	varsToRedact := map[string]string{}
+	var skipped []string
+
+	for varName, varValue := range environment {
+		for _, pattern := range patterns {
+			matched, err := path.Match(pattern, varName)
+			if err != nil {
+				// path.ErrBadPattern is the only error returned by path.Match
+				warnf("Bad redacted vars pattern: %s", pattern)
+				continue
+			}
+
+			if matched {
+				if len(varValue) < minLength {
+					skipped = append(skipped, varName)
+				} else {
+					varsToRedact[varName] = varValue
+				}
+				break // Break pattern loop, continue to next env var
+			}
+		}
+	}
+
+	sort.Strings(skipped)
+	return varsToRedact, skipped
+}
+
+// ReadValuesFile reads secrets to redact from a file with one on each line.
+// Surrounding whitespace is ignored, as are blank lines and lines starting
+// with #. Values shorter than LengthMin are reported by their line with warnf
+// and skipped. The values are returned keyed by where they are in the file,
+// like secrets.txt:3, and are never included in warnings or errors.
+func ReadValuesFile(warnf func(format string, v ...interface{}), filePath string) (map[string]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		value := strings.TrimSpace(scanner.Text())
+		if value == "" || strings.HasPrefix(value, "#") {
+			continue
+		}
+
+		name := fmt.Sprintf("%s:%d", filePath, line)
+		if len(value) < LengthMin {
+			warnf("Value on line %d of %s below minimum length and will not be redacted", line, filePath)
+			continue
+		}
+		values[name] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", filePath, err)
+	}
+
+	return values, nil
+}
+
+// ReadPatternsFile reads patterns of environment variable names, like those
+// given to GetValuesToRedact, from a file with one on each line. Surrounding
+// whitespace is ignored, as are blank lines and lines starting with #.
+func ReadPatternsFile(filePath string) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := []string{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read %s: %v", filePath, err)
+	}
+
+	return patterns, nil
+}
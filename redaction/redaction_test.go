@@ -0,0 +1,147 @@
+package redaction
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/agent/v3/bootstrap/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetValuesToRedact(t *testing.T) {
+	t.Parallel()
+
+	redactConfig := []string{
+		"*_PASSWORD",
+		"*_TOKEN",
+	}
+	environment := map[string]string{
+		"BUILDKITE_PIPELINE": "unit-test",
+		"DATABASE_USERNAME":  "AzureDiamond",
+		"DATABASE_PASSWORD":  "hunter2",
+	}
+
+	valuesToRedact := GetValuesToRedact(shell.DiscardLogger.Warningf, redactConfig, environment)
+
+	assert.Equal(t, []string{"hunter2"}, valuesToRedact)
+}
+
+func TestGetValuesToRedactEmpty(t *testing.T) {
+	t.Parallel()
+
+	redactConfig := []string{}
+	environment := map[string]string{
+		"FOO":                "BAR",
+		"BUILDKITE_PIPELINE": "unit-test",
+	}
+
+	valuesToRedact := GetValuesToRedact(shell.DiscardLogger.Warningf, redactConfig, environment)
+
+	var expected []string
+	assert.Equal(t, expected, valuesToRedact)
+	assert.Equal(t, 0, len(valuesToRedact))
+}
+
+func TestGetVarsToRedact(t *testing.T) {
+	t.Parallel()
+
+	redactConfig := []string{
+		"*_PASSWORD",
+		"*_TOKEN",
+	}
+	environment := map[string]string{
+		"BUILDKITE_PIPELINE": "unit-test",
+		"DATABASE_PASSWORD":  "hunter2",
+		"API_TOKEN":          "none",
+	}
+
+	varsToRedact := GetVarsToRedact(shell.DiscardLogger.Warningf, redactConfig, environment)
+
+	assert.Equal(t, map[string]string{"DATABASE_PASSWORD": "hunter2"}, varsToRedact)
+}
+
+func TestGetVarsToRedactMinLength(t *testing.T) {
+	t.Parallel()
+
+	redactConfig := []string{
+		"*_PASSWORD",
+		"*_TOKEN",
+	}
+	environment := map[string]string{
+		"DATABASE_PASSWORD": "hunter2",
+		"API_TOKEN":         "none",
+		"OTHER_TOKEN":       "ab",
+	}
+
+	varsToRedact, skipped := GetVarsToRedactMinLength(shell.DiscardLogger.Warningf, redactConfig, environment, 4)
+
+	assert.Equal(t, map[string]string{"DATABASE_PASSWORD": "hunter2", "API_TOKEN": "none"}, varsToRedact)
+	assert.Equal(t, []string{"OTHER_TOKEN"}, skipped)
+}
+
+func TestReadValuesFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "redaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "secrets.txt")
+	contents := "# Exported from the vault\n\nhunter2\n  correct horse battery staple  \r\nshort\n\t# indented comment\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []string
+	warnf := func(format string, v ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, v...))
+	}
+
+	values, err := ReadValuesFile(warnf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		path + ":3": "hunter2",
+		path + ":4": "correct horse battery staple",
+	}, values)
+	assert.Equal(t, []string{"Value on line 5 of " + path + " below minimum length and will not be redacted"}, warnings)
+}
+
+func TestReadValuesFileMissing(t *testing.T) {
+	t.Parallel()
+
+	_, err := ReadValuesFile(shell.DiscardLogger.Warningf, filepath.Join(os.TempDir(), "does-not-exist.txt"))
+	assert.Error(t, err)
+}
+
+func TestReadPatternsFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "redaction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "redacted-vars.txt")
+	contents := "# Managed centrally\n\nDATABASE_URL\n  *_API_KEY  \r\n\t# indented comment\nSTRIPE_*\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns, err := ReadPatternsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"DATABASE_URL", "*_API_KEY", "STRIPE_*"}, patterns)
+
+	_, err = ReadPatternsFile(filepath.Join(dir, "does-not-exist.txt"))
+	assert.Error(t, err)
+}
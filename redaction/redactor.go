@@ -1,10 +1,16 @@
-package bootstrap
+package redaction
 
 import (
 	"bytes"
 	"io"
 )
 
+// Replacement is what Redactor writes in place of each value it redacts
+const Replacement = "[REDACTED]"
+
+// Redactor is an io.Writer that replaces values to redact in what's written
+// to it before passing it on to another io.Writer, including values split
+// across calls to Write
 type Redactor struct {
 	replacement []byte
 
@@ -33,9 +39,9 @@ type Redactor struct {
 type RedactorMux []*Redactor
 
 // Construct a new Redactor, and pre-compile the Boyer-Moore skip table
-func NewRedactor(output io.Writer, replacement string, needles []string) *Redactor {
+func NewRedactor(output io.Writer, needles []string) *Redactor {
 	redactor := &Redactor{
-		replacement: []byte(replacement),
+		replacement: []byte(Replacement),
 		output:      output,
 	}
 	redactor.Reset(needles)
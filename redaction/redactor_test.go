@@ -1,4 +1,4 @@
-package bootstrap
+package redaction
 
 import (
 	"bytes"
@@ -13,7 +13,7 @@ func TestRedactorEmpty(t *testing.T) {
 
 	var buf bytes.Buffer
 
-	redactor := NewRedactor(&buf, "[REDACTED]", []string{})
+	redactor := NewRedactor(&buf, []string{})
 
 	fmt.Fprint(redactor, "Lorem ipsum dolor sit amet")
 	redactor.Flush()
@@ -26,7 +26,7 @@ func TestRedactorSingle(t *testing.T) {
 
 	var buf bytes.Buffer
 
-	redactor := NewRedactor(&buf, "[REDACTED]", []string{"ipsum"})
+	redactor := NewRedactor(&buf, []string{"ipsum"})
 
 	fmt.Fprint(redactor, "Lorem ipsum dolor sit amet")
 	redactor.Flush()
@@ -41,7 +41,7 @@ func TestRedactorMulti(t *testing.T) {
 
 	var buf bytes.Buffer
 
-	redactor := NewRedactor(&buf, "[REDACTED]", []string{"ipsum", "amet"})
+	redactor := NewRedactor(&buf, []string{"ipsum", "amet"})
 
 	fmt.Fprint(redactor, "Lorem ipsum dolor sit amet")
 	redactor.Flush()
@@ -56,7 +56,7 @@ func TestRedactorWriteBoundaries(t *testing.T) {
 
 	var buf bytes.Buffer
 
-	redactor := NewRedactor(&buf, "[REDACTED]", []string{"ipsum"})
+	redactor := NewRedactor(&buf, []string{"ipsum"})
 
 	redactor.Write([]byte("Lorem ip"))
 	redactor.Write([]byte("sum dolor sit amet"))
@@ -71,7 +71,7 @@ func TestRedactorResetMidStream(t *testing.T) {
 	t.Parallel()
 
 	var buf bytes.Buffer
-	redactor := NewRedactor(&buf, "[REDACTED]", []string{"secret1111"})
+	redactor := NewRedactor(&buf, []string{"secret1111"})
 
 	// start writing to the stream (no trailing newline, to be extra tricky)
 	redactor.Write([]byte("redact secret1111 but don't redact secret2222 until"))
@@ -93,7 +93,7 @@ func TestRedactorSlowLoris(t *testing.T) {
 	t.Parallel()
 
 	var buf bytes.Buffer
-	redactor := NewRedactor(&buf, "[REDACTED]", []string{"secret1111"})
+	redactor := NewRedactor(&buf, []string{"secret1111"})
 
 	redactor.Write([]byte("s"))
 	redactor.Write([]byte("e"))
@@ -130,7 +130,7 @@ func TestRedactorSubsetSecrets(t *testing.T) {
 	*/
 
 	var buf bytes.Buffer
-	redactor := NewRedactor(&buf, "[REDACTED]", []string{"secret1111", "secret"})
+	redactor := NewRedactor(&buf, []string{"secret1111", "secret"})
 
 	redactor.Write([]byte("secret1111"))
 	redactor.Flush()
@@ -144,8 +144,26 @@ func TestRedactorLatin1(t *testing.T) {
 	t.Parallel()
 
 	var buf bytes.Buffer
-	redactor := NewRedactor(&buf, "[REDACTED]", []string{"ÿ"})
+	redactor := NewRedactor(&buf, []string{"ÿ"})
 
 	redactor.Write([]byte("foo"))
 	redactor.Flush()
 }
+
+func TestRedactorNeedleSplitAcrossWrites(t *testing.T) {
+	t.Parallel()
+
+	input := "export TOKEN=hunter2hunter2 && deploy"
+
+	for i := 1; i < len(input); i++ {
+		var buf bytes.Buffer
+
+		redactor := NewRedactor(&buf, []string{"hunter2hunter2"})
+
+		redactor.Write([]byte(input[:i]))
+		redactor.Write([]byte(input[i:]))
+		redactor.Flush()
+
+		assert.Equal(t, "export TOKEN=[REDACTED] && deploy", buf.String(), "split at %d", i)
+	}
+}
@@ -1,8 +1,10 @@
 package retry
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"time"
 )
@@ -12,13 +14,45 @@ type Stats struct {
 	Interval  time.Duration
 	Config    *Config
 	breakNext bool
+	started   time.Time
+
+	// How long Do actually waited before this attempt, including jitter. It's
+	// 0 for the first attempt
+	Slept time.Duration
 }
 
 type Config struct {
 	Maximum  int
 	Interval time.Duration
 	Forever  bool
-	Jitter   bool
+
+	// If true, up to a second is randomly added to each interval
+	Jitter bool
+
+	// If true, each interval is randomly lengthened or shortened by up to
+	// half, so that many clients failing at once don't all retry in lockstep.
+	// It's used instead of Jitter if both are set.
+	ProportionalJitter bool
+
+	// The source of randomness for jitter. If it's nil, each call to Do uses a
+	// new source seeded from the current time
+	Rand *rand.Rand
+
+	// If true, the interval doubles after each attempt, up to MaxInterval if
+	// it's set
+	Exponential bool
+	MaxInterval time.Duration
+
+	// If set, Do gives up rather than wait for another attempt once this
+	// long has passed since the first attempt started, or if waiting would
+	// take longer than that. It applies along with Maximum and Forever, and
+	// whichever limit is reached first ends the loop.
+	MaxElapsedTime time.Duration
+
+	// If set, OnRetry is called after each failed attempt that will be
+	// retried, before waiting for the next one. It isn't called after an
+	// attempt that succeeds, or after the last one.
+	OnRetry func(*Stats, error)
 }
 
 // A human readable representation often useful for debugging.
@@ -38,14 +72,62 @@ func (s *Stats) String() string {
 	return str
 }
 
+// The time since the first attempt started
+func (s *Stats) Elapsed() time.Duration {
+	return time.Since(s.started)
+}
+
+// Wait for d before the next attempt, rather than the configured interval
+func (s *Stats) SetNextInterval(d time.Duration) {
+	s.Interval = d
+}
+
 // Allow a retry loop to break out of itself
 func (s *Stats) Break() {
 	s.breakNext = true
 }
 
+// The interval to wait after the given attempt, before jitter
+func (c *Config) interval(attempt int) time.Duration {
+	if !c.Exponential {
+		return c.Interval
+	}
+
+	interval := c.Interval
+	for i := 1; i < attempt; i++ {
+		// Stop doubling before the interval passes the maximum or overflows
+		if c.MaxInterval > 0 && interval >= c.MaxInterval/2 {
+			return c.MaxInterval
+		}
+		if interval > math.MaxInt64/2 {
+			return interval
+		}
+		interval *= 2
+	}
+
+	if c.MaxInterval > 0 && interval > c.MaxInterval {
+		return c.MaxInterval
+	}
+	return interval
+}
+
+// Randomly add up to a second to interval
+func jitter(interval time.Duration, random *rand.Rand) time.Duration {
+	return interval + time.Duration(1000*random.Float32())*time.Millisecond
+}
+
+// Randomly lengthen or shorten interval by up to half of it
+func proportionalJitter(interval time.Duration, random *rand.Rand) time.Duration {
+	return interval + time.Duration((random.Float64()-0.5)*float64(interval))
+}
+
 func Do(callback func(*Stats) error, config *Config) error {
-	var err error
+	return DoWithContext(context.Background(), callback, config)
+}
 
+// DoWithContext is like Do, but stops retrying and returns ctx.Err() as soon
+// as ctx is cancelled
+func DoWithContext(ctx context.Context, callback func(*Stats) error, config *Config) error {
 	// Setup a default config for the retry
 	if config == nil {
 		config = &Config{Forever: true, Interval: 1 * time.Second, Jitter: false}
@@ -63,21 +145,30 @@ func Do(callback func(*Stats) error, config *Config) error {
 	}
 
 	// The stats struct that is passed to every attempt of the callback
-	stats := &Stats{Attempt: 1, Config: config}
+	stats := &Stats{Attempt: 1, Config: config, started: time.Now()}
 
 	// Needed for jitter calcs
-	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	random := config.Rand
+	if random == nil {
+		random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
 
 	for {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
 		// Preconfigure the interval that will be used (so that we have
 		// access to it in the callback)
-		stats.Interval = config.Interval
-		if config.Jitter {
-			stats.Interval = stats.Interval + (time.Duration(1000*random.Float32()) * time.Millisecond)
+		stats.Interval = config.interval(stats.Attempt)
+		if config.ProportionalJitter {
+			stats.Interval = proportionalJitter(stats.Interval, random)
+		} else if config.Jitter {
+			stats.Interval = jitter(stats.Interval, random)
 		}
 
 		// Attempt the callback
-		err = callback(stats)
+		err := callback(stats)
 		if err == nil {
 			return nil
 		}
@@ -88,19 +179,34 @@ func Do(callback func(*Stats) error, config *Config) error {
 			return err
 		}
 
+		// Give up rather than wait past the time limit, as a long interval
+		// from SetNextInterval could otherwise overrun it by far
+		if config.MaxElapsedTime > 0 && stats.Elapsed()+stats.Interval > config.MaxElapsedTime {
+			return err
+		}
+
+		// Should we give up? This is checked before waiting, so the last
+		// attempt isn't followed by a pointless wait
+		if !config.Forever && stats.Attempt >= config.Maximum {
+			return err
+		}
+
+		if config.OnRetry != nil {
+			config.OnRetry(stats, err)
+		}
+
 		// Bump the attempt number
 		stats.Attempt = stats.Attempt + 1
 
 		// Try the callback again after the interval
-		time.Sleep(stats.Interval)
-
-		if !stats.Config.Forever {
-			// Should we give up?
-			if stats.Attempt > stats.Config.Maximum {
-				break
-			}
+		sleepStarted := time.Now()
+		timer := time.NewTimer(stats.Interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
 		}
+		stats.Slept = time.Since(sleepStarted)
 	}
-
-	return err
 }
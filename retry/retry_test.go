@@ -0,0 +1,225 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigInterval(t *testing.T) {
+	linear := &Config{Interval: 5 * time.Second}
+	exponential := &Config{Interval: time.Second, Exponential: true}
+	capped := &Config{Interval: time.Second, Exponential: true, MaxInterval: 5 * time.Second}
+
+	for attempt, expected := range []struct {
+		linear, exponential, capped time.Duration
+	}{
+		{5 * time.Second, time.Second, time.Second},
+		{5 * time.Second, 2 * time.Second, 2 * time.Second},
+		{5 * time.Second, 4 * time.Second, 4 * time.Second},
+		{5 * time.Second, 8 * time.Second, 5 * time.Second},
+		{5 * time.Second, 16 * time.Second, 5 * time.Second},
+	} {
+		assert.Equal(t, expected.linear, linear.interval(attempt+1), "attempt %d", attempt+1)
+		assert.Equal(t, expected.exponential, exponential.interval(attempt+1), "attempt %d", attempt+1)
+		assert.Equal(t, expected.capped, capped.interval(attempt+1), "attempt %d", attempt+1)
+	}
+
+	// Huge numbers of attempts don't overflow
+	assert.True(t, exponential.interval(100) > 0)
+}
+
+func TestDoExponential(t *testing.T) {
+	var intervals []time.Duration
+
+	err := Do(func(s *Stats) error {
+		intervals = append(intervals, s.Interval)
+		return errors.New("nope")
+	}, &Config{Maximum: 4, Interval: time.Millisecond, Exponential: true, MaxInterval: 3 * time.Millisecond})
+
+	assert.EqualError(t, err, "nope")
+	assert.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond, 3 * time.Millisecond}, intervals)
+}
+
+func TestDoSetNextInterval(t *testing.T) {
+	var intervals []time.Duration
+	var started []time.Time
+
+	err := Do(func(s *Stats) error {
+		intervals = append(intervals, s.Interval)
+		started = append(started, time.Now())
+		if s.Attempt == 1 {
+			s.SetNextInterval(50 * time.Millisecond)
+		}
+		return errors.New("nope")
+	}, &Config{Maximum: 3, Interval: time.Millisecond})
+
+	assert.EqualError(t, err, "nope")
+	assert.True(t, started[1].Sub(started[0]) >= 50*time.Millisecond, "waited %s", started[1].Sub(started[0]))
+
+	// Only the next interval is changed
+	assert.Equal(t, []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}, intervals)
+}
+
+func TestDoWithContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	attempts := 0
+	started := time.Now()
+
+	err := DoWithContext(ctx, func(s *Stats) error {
+		attempts++
+		cancel()
+		return errors.New("nope")
+	}, &Config{Maximum: 3, Interval: time.Minute})
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, attempts)
+	assert.True(t, time.Since(started) < time.Minute)
+
+	// A context that's already cancelled stops it before the first attempt
+	err = DoWithContext(ctx, func(s *Stats) error {
+		attempts++
+		return nil
+	}, &Config{Maximum: 3, Interval: time.Minute})
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestDoJitter(t *testing.T) {
+	var intervals []time.Duration
+
+	err := Do(func(s *Stats) error {
+		intervals = append(intervals, s.Interval)
+		return errors.New("nope")
+	}, &Config{Maximum: 2, Interval: time.Millisecond, Jitter: true, Rand: rand.New(rand.NewSource(1))})
+
+	assert.EqualError(t, err, "nope")
+	for _, interval := range intervals {
+		// Jitter only ever adds up to a second
+		assert.True(t, interval >= time.Millisecond && interval <= time.Second+time.Millisecond, "interval %s", interval)
+	}
+}
+
+func TestDoProportionalJitter(t *testing.T) {
+	var intervals []time.Duration
+	var slept []time.Duration
+
+	err := Do(func(s *Stats) error {
+		intervals = append(intervals, s.Interval)
+		slept = append(slept, s.Slept)
+		return errors.New("nope")
+	}, &Config{Maximum: 20, Interval: 10 * time.Millisecond, ProportionalJitter: true, Rand: rand.New(rand.NewSource(1))})
+
+	assert.EqualError(t, err, "nope")
+	assert.Equal(t, time.Duration(0), slept[0])
+
+	varied := false
+	for i, interval := range intervals {
+		assert.True(t, interval >= 5*time.Millisecond && interval <= 15*time.Millisecond, "interval %s", interval)
+		varied = varied || interval != 10*time.Millisecond
+		if i > 0 {
+			assert.True(t, slept[i] >= intervals[i-1], "slept %s, expected at least %s", slept[i], intervals[i-1])
+		}
+	}
+	assert.True(t, varied)
+
+	// The same source gives the same intervals
+	var again []time.Duration
+	_ = Do(func(s *Stats) error {
+		again = append(again, s.Interval)
+		return errors.New("nope")
+	}, &Config{Maximum: 20, Interval: 10 * time.Millisecond, ProportionalJitter: true, Rand: rand.New(rand.NewSource(1))})
+	assert.Equal(t, intervals, again)
+}
+
+func TestDoMaxElapsedTime(t *testing.T) {
+	attempts := 0
+	started := time.Now()
+
+	err := Do(func(s *Stats) error {
+		attempts++
+		return errors.New("nope")
+	}, &Config{Forever: true, Interval: 10 * time.Millisecond, MaxElapsedTime: 55 * time.Millisecond})
+
+	assert.EqualError(t, err, "nope")
+	assert.True(t, attempts >= 2 && attempts <= 6, "made %d attempts", attempts)
+	assert.True(t, time.Since(started) < time.Second, "took %s", time.Since(started))
+}
+
+func TestDoMaxElapsedTimeBeforeMaximum(t *testing.T) {
+	attempts := 0
+
+	err := Do(func(s *Stats) error {
+		attempts++
+		// Like a server asking for a long wait with Retry-After
+		s.SetNextInterval(time.Hour)
+		return errors.New("nope")
+	}, &Config{Maximum: 10, Interval: time.Millisecond, MaxElapsedTime: time.Minute})
+
+	assert.EqualError(t, err, "nope")
+	assert.Equal(t, 1, attempts)
+}
+
+func TestDoMaximumBeforeMaxElapsedTime(t *testing.T) {
+	attempts := 0
+
+	err := Do(func(s *Stats) error {
+		attempts++
+		return errors.New("nope")
+	}, &Config{Maximum: 3, Interval: time.Millisecond, MaxElapsedTime: time.Minute})
+
+	assert.EqualError(t, err, "nope")
+	assert.Equal(t, 3, attempts)
+}
+
+func TestStatsElapsed(t *testing.T) {
+	var elapsed []time.Duration
+
+	err := Do(func(s *Stats) error {
+		elapsed = append(elapsed, s.Elapsed())
+		return errors.New("nope")
+	}, &Config{Maximum: 2, Interval: 20 * time.Millisecond})
+
+	assert.EqualError(t, err, "nope")
+	if assert.Len(t, elapsed, 2) {
+		assert.True(t, elapsed[1]-elapsed[0] >= 20*time.Millisecond, "elapsed %s between attempts", elapsed[1]-elapsed[0])
+	}
+}
+
+func TestDoOnRetry(t *testing.T) {
+	var retried []int
+	var errs []error
+
+	err := Do(func(s *Stats) error {
+		if s.Attempt < 3 {
+			return fmt.Errorf("attempt %d failed", s.Attempt)
+		}
+		return nil
+	}, &Config{Maximum: 5, Interval: time.Millisecond, OnRetry: func(s *Stats, err error) {
+		retried = append(retried, s.Attempt)
+		errs = append(errs, err)
+	}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, retried)
+	assert.Equal(t, []error{errors.New("attempt 1 failed"), errors.New("attempt 2 failed")}, errs)
+
+	// The last attempt isn't retried
+	retried = nil
+	err = Do(func(s *Stats) error {
+		return errors.New("nope")
+	}, &Config{Maximum: 3, Interval: time.Millisecond, OnRetry: func(s *Stats, err error) {
+		retried = append(retried, s.Attempt)
+	}})
+
+	assert.EqualError(t, err, "nope")
+	assert.Equal(t, []int{1, 2}, retried)
+}
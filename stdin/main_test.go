@@ -1,6 +1,7 @@
 package stdin_test
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -8,6 +9,7 @@ import (
 	"os/exec"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/buildkite/agent/v3/stdin"
 )
@@ -97,3 +99,50 @@ func TestIsStdinIsReadableWithOutputRedirection(t *testing.T) {
 		t.Errorf("Stdin should be readable from a file, wanted %q, got %q", e, g)
 	}
 }
+
+func TestReadAll(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := w.Write([]byte("steps: []")); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	b, err := stdin.ReadAll(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(b), "steps: []"; g != e {
+		t.Errorf("wanted %q, got %q", e, g)
+	}
+}
+
+func TestReadAllTimeout(t *testing.T) {
+	// The writer is never closed, so reading never finishes
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	if _, err := w.Write([]byte("steps:")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	_, err = stdin.ReadAll(ctx, r)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("wanted %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("took %s to time out", elapsed)
+	}
+}
@@ -0,0 +1,30 @@
+package stdin
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+// ReadAll reads from r until EOF, like ioutil.ReadAll, but gives up when ctx
+// is done and returns ctx.Err(). The read carries on in the background until
+// r is closed, as reads can't be interrupted, so what it reads is lost.
+func ReadAll(ctx context.Context, r io.Reader) ([]byte, error) {
+	type result struct {
+		b   []byte
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		b, err := ioutil.ReadAll(r)
+		done <- result{b, err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.b, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}